@@ -1,13 +1,19 @@
 package bakery
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -49,7 +55,28 @@ func (c *Client) GetValue(cookieName string) (string, error) {
 	return value, nil
 }
 
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", xerrors.Errorf("failed to read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// challenge lets the browser hand a one-time code to a loopback listener, and exchanges the code for the cookie value
+// with a verifier that never leaves this process.
 func (c *Client) challenge(cookieName string) (map[string]string, error) {
+	verifier, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	state, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	codeChallenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
 	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", c.listenPort))
 	if err != nil {
 		return nil, err
@@ -58,15 +85,16 @@ func (c *Client) challenge(cookieName string) (map[string]string, error) {
 		_ = listener.Close()
 	}()
 
-	quit := make(chan map[string]string, 1)
+	quit := make(chan string, 1)
 	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(state)) != 1 {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(`<script>window.open("about:blank","_self").close()</script>`))
-		m := make(map[string]string)
-		m["value"] = r.URL.Query().Get("value")
-		m["expires"] = r.URL.Query().Get("expires")
 		select {
-		case quit <- m:
+		case quit <- r.URL.Query().Get("code"):
 		default:
 		}
 	}))
@@ -78,11 +106,47 @@ func (c *Client) challenge(cookieName string) (map[string]string, error) {
 	queries := u.Query()
 	queries.Set("redirect_url", fmt.Sprintf("http://127.0.0.1:%d", listener.Addr().(*net.TCPAddr).Port))
 	queries.Set("cookie_name", cookieName)
+	queries.Set("code_challenge", codeChallenge)
+	queries.Set("code_challenge_method", "S256")
+	queries.Set("state", state)
 	u.RawQuery = queries.Encode()
 	_ = open.Start(u.String())
 	_, _ = fmt.Fprintln(os.Stderr, "Please visit this URL to authorize: "+u.String())
 
-	return <-quit, nil
+	code := <-quit
+	return c.exchange(code, verifier)
+}
+
+// exchange redeems a code at /exchange next to the callback URL.
+func (c *Client) exchange(code string, verifier string) (map[string]string, error) {
+	u, err := url.ParseRequestURI(c.url)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse request uri: %w", err)
+	}
+	u = u.JoinPath("../exchange")
+	u.RawQuery = ""
+
+	response, err := http.PostForm(u.String(), url.Values{
+		"code":          {code},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to exchange code: %w", err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(response.Body)
+		return nil, xerrors.Errorf("failed to exchange code: %d %s", response.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	var cookie map[string]string
+	if err := json.NewDecoder(response.Body).Decode(&cookie); err != nil {
+		return nil, xerrors.Errorf("failed to decode response: %w", err)
+	}
+	return cookie, nil
 }
 
 func (c *Client) restore(cookieName string) map[string]string {
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -15,6 +20,8 @@ import (
 	"os/signal"
 	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -64,72 +71,238 @@ func envOrDefaultValue[T any](key string, defaultValue T) T {
 	return defaultValue
 }
 
+const (
+	OpenIDConfigurationPath = "/.well-known/openid-configuration"
+	JWKSPath                = "/openid/v1/jwks"
+)
+
+var DiscoveryPaths = []string{OpenIDConfigurationPath, JWKSPath}
+
+type Document struct {
+	Body      []byte
+	ETag      string
+	FetchedAt time.Time
+}
+
+// DiscoveryCache keeps the OIDC discovery documents of the API server in memory.
+type DiscoveryCache struct {
+	Client    *http.Client
+	APIServer string
+	// Issuer replaces issuer and jwks_uri of the OpenID configuration, so that relying parties outside the cluster
+	// fetch the keys from here. It must equal --service-account-issuer of the API server.
+	Issuer string
+
+	mu        sync.RWMutex
+	documents map[string]*Document
+}
+
+// Get returns the cached document of path, fetching it only when it has never been fetched.
+func (c *DiscoveryCache) Get(ctx context.Context, path string) (*Document, error) {
+	c.mu.RLock()
+	document, ok := c.documents[path]
+	c.mu.RUnlock()
+	if ok {
+		return document, nil
+	}
+
+	document, err := c.fetch(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	c.store(path, document)
+	return document, nil
+}
+
+// Refresh fetches every document. A document that fails to be fetched keeps being served as cached.
+func (c *DiscoveryCache) Refresh(ctx context.Context) error {
+	var errs []error
+	for _, path := range DiscoveryPaths {
+		document, err := c.fetch(ctx, path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.store(path, document)
+	}
+	return errors.Join(errs...)
+}
+
+func (c *DiscoveryCache) store(path string, document *Document) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.documents == nil {
+		c.documents = make(map[string]*Document)
+	}
+	if previous, ok := c.documents[path]; ok && previous.ETag == document.ETag {
+		// Keep Last-Modified stable while the content is unchanged
+		return
+	}
+	c.documents[path] = document
+}
+
+func (c *DiscoveryCache) fetch(ctx context.Context, path string) (*Document, error) {
+	// The projected token is rotated by kubelet, so read it every time
+	token, err := os.ReadFile(KubernetesServiceAccountToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token: %w", err)
+	}
+
+	u, err := url.JoinPath(c.APIServer, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build URL: %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	request.Header.Set("Accept", "application/json")
+
+	response, err := c.Client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request %s: %w", path, err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code of %s: %d: %s", path, response.StatusCode, body)
+	}
+
+	if path == OpenIDConfigurationPath && c.Issuer != "" {
+		body, err = rewriteIssuer(body, c.Issuer)
+		if err != nil {
+			return nil, err
+		}
+	} else if !json.Valid(body) {
+		return nil, fmt.Errorf("invalid JSON of %s", path)
+	}
+
+	sum := sha256.Sum256(body)
+	return &Document{
+		Body:      body,
+		ETag:      `"` + hex.EncodeToString(sum[:]) + `"`,
+		FetchedAt: time.Now().UTC().Truncate(time.Second),
+	}, nil
+}
+
+func rewriteIssuer(body []byte, issuer string) ([]byte, error) {
+	var configuration map[string]any
+	if err := json.Unmarshal(body, &configuration); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenID configuration: %w", err)
+	}
+
+	jwksURI, err := url.JoinPath(issuer, JWKSPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build jwks_uri: %w", err)
+	}
+	configuration["issuer"] = issuer
+	configuration["jwks_uri"] = jwksURI
+
+	b, err := json.Marshal(configuration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode OpenID configuration: %w", err)
+	}
+	return b, nil
+}
+
 func main() {
 	var address string
 	var terminationGracePeriod time.Duration
 	var lameduck time.Duration
 	var keepAlive bool
+	var apiServer string
+	var issuer string
+	var refreshInterval time.Duration
+	var upstreamTimeout time.Duration
+	var maxAge time.Duration
 	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
 
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
+	flag.StringVar(&apiServer, "api-server", envOrDefaultValue("API_SERVER", "https://kubernetes.default.svc.cluster.local"), "URL of the Kubernetes API server")
+	flag.StringVar(&issuer, "issuer", envOrDefaultValue("ISSUER", ""), "Public issuer URL that /.well-known/openid-configuration is rewritten to; kept as the API server returns it if empty")
+	flag.DurationVar(&refreshInterval, "refresh-interval", envOrDefaultValue("REFRESH_INTERVAL", 1*time.Minute), "Interval to refresh the documents from the API server")
+	flag.DurationVar(&upstreamTimeout, "upstream-timeout", envOrDefaultValue("UPSTREAM_TIMEOUT", 10*time.Second), "Timeout of a request to the API server")
+	flag.DurationVar(&maxAge, "max-age", envOrDefaultValue("MAX_AGE", 5*time.Minute), "max-age of Cache-Control")
 	flag.Parse()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /openid/v1/jwks", func(w http.ResponseWriter, r *http.Request) {
-		token, err := os.ReadFile(KubernetesServiceAccountToken)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-
-		caCert, err := os.ReadFile(KubernetesServiceAccountCaCert)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
+	caCert, err := os.ReadFile(KubernetesServiceAccountCaCert)
+	if err != nil {
+		log.Fatalf("failed to read CA certificate: %+v", err)
+	}
 
-		transport := &http.Transport{
-			MaxIdleConnsPerHost: http.DefaultTransport.(*http.Transport).MaxIdleConns,
-			TLSClientConfig: &tls.Config{
-				RootCAs: x509.NewCertPool(),
-			},
-		}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caCert) {
+		log.Fatalf("failed to parse CA certificate: %s", KubernetesServiceAccountCaCert)
+	}
 
-		transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(caCert)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs: rootCAs,
+	}
 
-		client := &http.Client{
+	cache := &DiscoveryCache{
+		Client: &http.Client{
 			Transport: transport,
-		}
+			Timeout:   upstreamTimeout,
+		},
+		APIServer: apiServer,
+		Issuer:    issuer,
+	}
 
-		u, err := url.JoinPath("https://kubernetes.default.svc.cluster.local", r.URL.Path)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
+	refreshCtx, refreshCancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	if err := cache.Refresh(refreshCtx); err != nil {
+		log.Printf("failed to refresh: %+v", err)
+	}
+	refreshCancel()
 
-		request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u, nil)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("panic: %+v\n%s", err, debug.Stack())
+			}
+		}()
+
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+			if err := cache.Refresh(ctx); err != nil {
+				log.Printf("failed to refresh: %+v", err)
+			}
+			cancel()
 		}
+	}()
 
-		request.Header.Set("Authorization", "Bearer "+string(token))
+	cacheControl := fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
 
-		response, err := client.Do(request)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-		defer func() {
-			_ = response.Body.Close()
-		}()
+	mux := http.NewServeMux()
+	for _, path := range DiscoveryPaths {
+		mux.HandleFunc("GET "+path, func(w http.ResponseWriter, r *http.Request) {
+			document, err := cache.Get(r.Context(), path)
+			if err != nil {
+				log.Printf("failed to get %s: %+v", path, err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(response.StatusCode)
-		_, _ = io.Copy(w, response.Body)
-	})
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", cacheControl)
+			w.Header().Set("ETag", document.ETag)
+			// ServeContent answers If-None-Match with 304 Not Modified
+			http.ServeContent(w, r, "", document.FetchedAt, bytes.NewReader(document.Body))
+		})
+	}
 
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -1,21 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
+const prefix = "/bakery"
+
 func envOrDefaultValue[T any](key string, defaultValue T) T {
 	value, exists := os.LookupEnv(key)
 	if !exists {
@@ -58,18 +72,255 @@ func envOrDefaultValue[T any](key string, defaultValue T) T {
 	return defaultValue
 }
 
-func main() {
-	var address string
-	var terminationGracePeriod time.Duration
-	var lameduck time.Duration
-	var keepAlive bool
-	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
+// isLoopback tells whether a redirect goes back to the machine of the browser, where a CLI listens.
+func isLoopback(u *url.URL) bool {
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
-	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
-	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
-	flag.Parse()
+func parseAllowedRedirectURLs(s string) ([]*url.URL, error) {
+	var allowed []*url.URL
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			return nil, fmt.Errorf("invalid redirect URL: %s", raw)
+		}
+		allowed = append(allowed, u)
+	}
+	return allowed, nil
+}
+
+// matchHost matches a host of an allowed URL, where a leading *. matches exactly one label,
+// e.g. *.chromiumapp.org for the redirect URL of a browser extension whatever its ID is.
+func matchHost(pattern string, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") {
+		label, ok := strings.CutSuffix(host, suffix)
+		return ok && label != "" && !strings.Contains(label, ".")
+	}
+	return pattern == host
+}
+
+// isAllowedRedirect allows loopback addresses on any port, and URLs under an allowed URL of the same scheme and host.
+func isAllowedRedirect(u *url.URL, allowed []*url.URL) bool {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return false
+	}
+	if isLoopback(u) {
+		return true
+	}
+
+	for _, a := range allowed {
+		if a.Scheme != u.Scheme || !matchHost(a.Host, u.Host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(a.Path, "/")
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// S256 is the only code_challenge_method, as in RFC 7636.
+func s256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type grant struct {
+	Value     string    `json:"value"`
+	Expires   string    `json:"expires"`
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// grantStore keeps cookie values in http-kvs until a client redeems the code it was given, once, so that any replica can redeem it.
+// A grant is stored under a hash of its code and sealed with a key derived from the code, so that http-kvs never holds a usable cookie value or code.
+type grantStore struct {
+	baseURL string
+}
+
+// grantKeys derives the key that seals the grant of code, and the http-kvs key it is stored under.
+func grantKeys(code string) ([]byte, string) {
+	secret := sha256.Sum256([]byte(code))
+	id := sha256.Sum256(secret[:])
+	return secret[:], path.Join(prefix, base64.RawURLEncoding.EncodeToString(id[:]))
+}
+
+func seal(secret []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
 
+func unseal(secret []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed grant is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+func (s *grantStore) Issue(ctx context.Context, g *grant) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate code: %w", err)
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+	secret, key := grantKeys(code)
+
+	plaintext, err := json.Marshal(g)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal grant: %w", err)
+	}
+	sealed, err := seal(secret, plaintext)
+	if err != nil {
+		return "", fmt.Errorf("failed to seal grant: %w", err)
+	}
+
+	// http-kvs expires keys by the second, and Redeem checks expiresAt itself.
+	seconds := max(int64((time.Until(g.ExpiresAt)+time.Second-1)/time.Second), 1)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, s.baseURL+key, bytes.NewReader(sealed))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("If-None-Match", "*")
+	request.Header.Set("X-Expires-After", strconv.FormatInt(seconds, 10))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to store grant: %w", err)
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode >= 400 {
+		return "", fmt.Errorf("unexpected status from http-kvs: %d", response.StatusCode)
+	}
+	return code, nil
+}
+
+// take reads the value of key and deletes it if nobody has changed or deleted it meanwhile, and returns nil if key is gone or someone else took it.
+func (s *grantStore) take(ctx context.Context, key string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get grant: %w", err)
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected status from http-kvs: %d", response.StatusCode)
+	}
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grant: %w", err)
+	}
+
+	request, err = http.NewRequestWithContext(ctx, http.MethodDelete, s.baseURL+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("If-Match", response.Header.Get("ETag"))
+	deleted, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete grant: %w", err)
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, deleted.Body)
+		_ = deleted.Body.Close()
+	}()
+
+	if deleted.StatusCode == http.StatusNotFound || deleted.StatusCode == http.StatusPreconditionFailed {
+		return nil, nil
+	}
+	if deleted.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected status from http-kvs: %d", deleted.StatusCode)
+	}
+	return b, nil
+}
+
+// Redeem returns the grant of a code if the verifier matches, or nil if it does not or the code is unknown.
+// The code is gone either way, so that it cannot be guessed at, and only the replica whose conditional delete wins gets the grant.
+func (s *grantStore) Redeem(ctx context.Context, code string, verifier string) (*grant, error) {
+	secret, key := grantKeys(code)
+
+	sealed, err := s.take(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if sealed == nil {
+		return nil, nil
+	}
+
+	plaintext, err := unseal(secret, sealed)
+	if err != nil {
+		return nil, nil
+	}
+	var g grant
+	if err := json.Unmarshal(plaintext, &g); err != nil {
+		return nil, nil
+	}
+
+	if time.Now().After(g.ExpiresAt) {
+		return nil, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(s256(verifier)), []byte(g.Challenge)) != 1 {
+		return nil, nil
+	}
+	return &g, nil
+}
+
+// isValidVerifier checks a code_verifier, or a code_challenge which has the same alphabet, as in RFC 7636.
+func isValidVerifier(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+	for _, c := range v {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("-._~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// newMux serves /callback, which hands a one-time code to an allowed redirect_url, and /exchange, which redeems it.
+func newMux(allowed []*url.URL, grants *grantStore, codeTTL time.Duration) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /callback", func(w http.ResponseWriter, r *http.Request) {
 		redirectURL := r.URL.Query().Get("redirect_url")
@@ -78,6 +329,20 @@ func main() {
 			http.Error(w, "invalid redirect_url parameter", http.StatusBadRequest)
 			return
 		}
+		if !isAllowedRedirect(u, allowed) {
+			http.Error(w, "redirect_url is not allowed", http.StatusBadRequest)
+			return
+		}
+
+		challenge := r.URL.Query().Get("code_challenge")
+		if !isValidVerifier(challenge) {
+			http.Error(w, "invalid code_challenge parameter", http.StatusBadRequest)
+			return
+		}
+		if method := r.URL.Query().Get("code_challenge_method"); method != "" && method != "S256" {
+			http.Error(w, "code_challenge_method must be S256", http.StatusBadRequest)
+			return
+		}
 
 		name := r.URL.Query().Get("cookie_name")
 		cookie, err := r.Cookie(name)
@@ -86,20 +351,90 @@ func main() {
 			return
 		}
 
+		code, err := grants.Issue(r.Context(), &grant{
+			Value:     cookie.Value,
+			Expires:   time.Now().Add(time.Hour).Format(time.RFC3339),
+			Challenge: challenge,
+			ExpiresAt: time.Now().Add(codeTTL),
+		})
+		if err != nil {
+			log.Printf("%+v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
 		queries := u.Query()
-		queries.Set("value", cookie.Value)
-		queries.Set("expires", time.Now().Add(time.Hour).Format(time.RFC3339))
+		queries.Set("code", code)
+		if state := r.URL.Query().Get("state"); state != "" {
+			queries.Set("state", state)
+		}
 		u.RawQuery = queries.Encode()
 
 		http.Redirect(w, r, u.String(), http.StatusFound)
 	})
 
+	mux.HandleFunc("POST /exchange", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PostFormValue("code")
+		verifier := r.PostFormValue("code_verifier")
+		if code == "" || !isValidVerifier(verifier) {
+			http.Error(w, "invalid code or code_verifier parameter", http.StatusBadRequest)
+			return
+		}
+
+		g, err := grants.Redeem(r.Context(), code, verifier)
+		if err != nil {
+			log.Printf("%+v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if g == nil {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"value":   g.Value,
+			"expires": g.Expires,
+		})
+	})
+
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
 	})
 
+	return mux
+}
+
+func main() {
+	var address string
+	var terminationGracePeriod time.Duration
+	var lameduck time.Duration
+	var keepAlive bool
+	var allowedRedirectURLs string
+	var codeTTL time.Duration
+	var httpKVSURL string
+	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
+
+	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
+	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
+	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
+	flag.StringVar(&allowedRedirectURLs, "allowed-redirect-urls", envOrDefaultValue("ALLOWED_REDIRECT_URLS", ""), "Comma-separated URLs that redirect_url may be at or under, besides loopback addresses")
+	flag.DurationVar(&codeTTL, "code-ttl", envOrDefaultValue("CODE_TTL", 1*time.Minute), "How long a code can be exchanged for the cookie value")
+	flag.StringVar(&httpKVSURL, "http-kvs-url", envOrDefaultValue("HTTP_KVS_URL", "https://http-kvs.minikube.127.0.0.1.nip.io"), "HTTP KVS URL")
+	flag.Parse()
+
+	allowed, err := parseAllowedRedirectURLs(allowedRedirectURLs)
+	if err != nil {
+		log.Fatalf("invalid --allowed-redirect-urls: %+v", err)
+	}
+
+	mux := newMux(allowed, &grantStore{baseURL: httpKVSURL}, codeTTL)
+
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("failed to listen: %+v", err)
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func TestIsAllowedRedirect(t *testing.T) {
+	allowed, err := parseAllowedRedirectURLs("https://app.example.com/callback, https://*.chromiumapp.org/extension")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		redirectURL string
+		want        bool
+	}{
+		{"loopback", "http://127.0.0.1:8765", true},
+		{"localhost", "http://localhost:8765/cb", true},
+		{"ipv6 loopback", "http://[::1]:8765", true},
+		{"allowed", "https://app.example.com/callback", true},
+		{"under allowed", "https://app.example.com/callback/cli", true},
+		{"sibling path", "https://app.example.com/callbacks", false},
+		{"other scheme", "http://app.example.com/callback", false},
+		{"other host", "https://evil.example.com/callback", false},
+		{"user info", "https://user@app.example.com/callback", false},
+		{"extension", "https://abcdefghijklmnop.chromiumapp.org/extension", true},
+		{"nested label", "https://a.b.chromiumapp.org/extension", false},
+		{"bare wildcard domain", "https://chromiumapp.org/extension", false},
+		{"javascript", "javascript:alert(1)", false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		redirectURL := tt.redirectURL
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := url.Parse(redirectURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isAllowedRedirect(u, allowed); got != want {
+				t.Errorf("isAllowedRedirect(%s) = %v, want %v", redirectURL, got, want)
+			}
+		})
+	}
+}
+
+func TestParseAllowedRedirectURLs(t *testing.T) {
+	for _, s := range []string{"ftp://example.com", "/callback", "https://a.*.example.com"} {
+		if _, err := parseAllowedRedirectURLs(s); err == nil {
+			t.Errorf("parsed %s", s)
+		}
+	}
+}
+
+// fakeKVS is the subset of http-kvs that grantStore uses: writes with If-None-Match, reads with ETag, and deletes with If-Match.
+type fakeKVS struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	version int
+}
+
+func newFakeKVS(t *testing.T) (*fakeKVS, string) {
+	t.Helper()
+
+	kvs := &fakeKVS{objects: make(map[string][]byte), etags: make(map[string]string)}
+	server := httptest.NewServer(kvs)
+	t.Cleanup(server.Close)
+	return kvs, server.URL
+}
+
+func (f *fakeKVS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := r.URL.Path
+	etag, exists := f.etags[key]
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(f.objects[key])
+	case http.MethodPut, http.MethodPost:
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("X-Expires-After") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		f.version++
+		f.objects[key] = b
+		f.etags[key] = fmt.Sprintf(`"%d"`, f.version)
+	case http.MethodDelete:
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		delete(f.objects, key)
+		delete(f.etags, key)
+	}
+}
+
+func (f *fakeKVS) values() [][]byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var values [][]byte
+	for key, b := range f.objects {
+		values = append(values, []byte(key), b)
+	}
+	return values
+}
+
+func callback(t *testing.T, mux *http.ServeMux, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/callback?"+query.Encode(), nil)
+	r.AddCookie(&http.Cookie{Name: "_oauth2_proxy", Value: "cookie-value"})
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func exchange(t *testing.T, mux *http.ServeMux, code string, verifier string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/exchange", strings.NewReader(url.Values{"code": {code}, "code_verifier": {verifier}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestCallback(t *testing.T) {
+	_, kvsURL := newFakeKVS(t)
+	mux := newMux(nil, &grantStore{baseURL: kvsURL}, time.Minute)
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  int
+	}{
+		{"allowed", url.Values{"redirect_url": {"http://127.0.0.1:8765"}, "cookie_name": {"_oauth2_proxy"}, "code_challenge": {s256(testVerifier)}, "code_challenge_method": {"S256"}}, http.StatusFound},
+		{"not allowed", url.Values{"redirect_url": {"https://evil.example.com"}, "cookie_name": {"_oauth2_proxy"}, "code_challenge": {s256(testVerifier)}}, http.StatusBadRequest},
+		{"without code_challenge", url.Values{"redirect_url": {"http://127.0.0.1:8765"}, "cookie_name": {"_oauth2_proxy"}}, http.StatusBadRequest},
+		{"plain method", url.Values{"redirect_url": {"http://127.0.0.1:8765"}, "cookie_name": {"_oauth2_proxy"}, "code_challenge": {s256(testVerifier)}, "code_challenge_method": {"plain"}}, http.StatusBadRequest},
+		{"without cookie", url.Values{"redirect_url": {"http://127.0.0.1:8765"}, "cookie_name": {"other"}, "code_challenge": {s256(testVerifier)}}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		query := tt.query
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			w := callback(t, mux, query)
+			if w.Code != want {
+				t.Fatalf("got %d, want %d: %s", w.Code, want, w.Body)
+			}
+			if want != http.StatusFound {
+				return
+			}
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.Host != "127.0.0.1:8765" || location.Query().Get("code") == "" || location.Query().Has("value") {
+				t.Errorf("got Location %s", location)
+			}
+		})
+	}
+}
+
+func TestExchange(t *testing.T) {
+	kvs, kvsURL := newFakeKVS(t)
+	mux := newMux(nil, &grantStore{baseURL: kvsURL}, time.Minute)
+
+	issue := func(t *testing.T) string {
+		w := callback(t, mux, url.Values{"redirect_url": {"http://127.0.0.1:8765"}, "cookie_name": {"_oauth2_proxy"}, "code_challenge": {s256(testVerifier)}, "state": {"xyz"}})
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.Query().Get("state") != "xyz" {
+			t.Errorf("got state %q, want xyz", location.Query().Get("state"))
+		}
+		return location.Query().Get("code")
+	}
+
+	code := issue(t)
+	for _, b := range kvs.values() {
+		if bytes.Contains(b, []byte("cookie-value")) || bytes.Contains(b, []byte(code)) {
+			t.Errorf("http-kvs holds the cookie value or the code: %s", b)
+		}
+	}
+	w := exchange(t, mux, code, testVerifier)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var cookie map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&cookie); err != nil {
+		t.Fatal(err)
+	}
+	if cookie["value"] != "cookie-value" || cookie["expires"] == "" {
+		t.Errorf("got %v", cookie)
+	}
+
+	if w := exchange(t, mux, code, testVerifier); w.Code != http.StatusBadRequest {
+		t.Errorf("redeemed a code twice: %d", w.Code)
+	}
+
+	code = issue(t)
+	if w := exchange(t, mux, code, strings.Repeat("a", 43)); w.Code != http.StatusBadRequest {
+		t.Errorf("redeemed a code with another verifier: %d", w.Code)
+	}
+	if w := exchange(t, mux, code, testVerifier); w.Code != http.StatusBadRequest {
+		t.Errorf("redeemed a code after a wrong verifier: %d", w.Code)
+	}
+
+	expired := newMux(nil, &grantStore{baseURL: kvsURL}, -time.Second)
+	w = callback(t, expired, url.Values{"redirect_url": {"http://127.0.0.1:8765"}, "cookie_name": {"_oauth2_proxy"}, "code_challenge": {s256(testVerifier)}})
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w := exchange(t, expired, location.Query().Get("code"), testVerifier); w.Code != http.StatusBadRequest {
+		t.Errorf("redeemed an expired code: %d", w.Code)
+	}
+}
+
+func TestExchange_Replicas(t *testing.T) {
+	_, kvsURL := newFakeKVS(t)
+	replicas := []*http.ServeMux{
+		newMux(nil, &grantStore{baseURL: kvsURL}, time.Minute),
+		newMux(nil, &grantStore{baseURL: kvsURL}, time.Minute),
+	}
+
+	w := callback(t, replicas[0], url.Values{"redirect_url": {"http://127.0.0.1:8765"}, "cookie_name": {"_oauth2_proxy"}, "code_challenge": {s256(testVerifier)}})
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := location.Query().Get("code")
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := range cap(codes) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- exchange(t, replicas[i%len(replicas)], code, testVerifier).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	redeemed := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			redeemed++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("got %d", code)
+		}
+	}
+	if redeemed != 1 {
+		t.Errorf("redeemed a code %d times across replicas, want once", redeemed)
+	}
+}
+
+func TestExchange_KVSUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	mux := newMux(nil, &grantStore{baseURL: server.URL}, time.Minute)
+
+	if w := callback(t, mux, url.Values{"redirect_url": {"http://127.0.0.1:8765"}, "cookie_name": {"_oauth2_proxy"}, "code_challenge": {s256(testVerifier)}}); w.Code != http.StatusInternalServerError {
+		t.Errorf("callback got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if w := exchange(t, mux, "code", testVerifier); w.Code != http.StatusInternalServerError {
+		t.Errorf("exchange got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,326 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validator validates instances decoded by encoding/json against a JSON Schema.
+// Only the keywords of the validation vocabulary are supported, not references.
+type Validator struct {
+	schema   any
+	patterns map[string]*regexp.Regexp
+}
+
+// Compile checks schema up front, so that a broken schema fails at startup rather than on an event.
+func Compile(b []byte) (*Validator, error) {
+	var schema any
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return nil, fmt.Errorf("failed to parse schema: %w", err)
+	}
+
+	v := &Validator{schema: schema, patterns: make(map[string]*regexp.Regexp)}
+	if err := v.compile(schema, "#"); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *Validator) compile(schema any, path string) error {
+	switch s := schema.(type) {
+	case bool:
+		return nil
+	case map[string]any:
+		if _, ok := s["$ref"]; ok {
+			return fmt.Errorf("%s: $ref is not supported", path)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern: %w", path, err)
+			}
+			v.patterns[pattern] = re
+		}
+		for _, key := range []string{"items", "additionalProperties", "not"} {
+			if sub, ok := s[key]; ok {
+				if err := v.compile(sub, path+"/"+key); err != nil {
+					return err
+				}
+			}
+		}
+		if properties, ok := s["properties"].(map[string]any); ok {
+			for name, sub := range properties {
+				if err := v.compile(sub, path+"/properties/"+name); err != nil {
+					return err
+				}
+			}
+		}
+		for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+			if subs, ok := s[key].([]any); ok {
+				for i, sub := range subs {
+					if err := v.compile(sub, fmt.Sprintf("%s/%s/%d", path, key, i)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s: schema must be an object or a boolean", path)
+	}
+}
+
+// Validate returns every violation of instance, each prefixed with a JSON Pointer to where it is.
+func (v *Validator) Validate(instance any) error {
+	return errors.Join(v.validate(v.schema, instance, "")...)
+}
+
+// Reference: https://json-schema.org/draft/2020-12/json-schema-validation
+func (v *Validator) validate(schema any, instance any, path string) []error {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		// 4.3.2 Boolean JSON Schemas
+		if schema == false {
+			return []error{fmt.Errorf("%s: not allowed", pointer(path))}
+		}
+		return nil
+	}
+
+	var errs []error
+	violation := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", pointer(path), fmt.Sprintf(format, args...)))
+	}
+
+	// 6.1 Validation Keywords for Any Instance Type
+	// https://json-schema.org/draft/2020-12/json-schema-validation#section-6.1
+	if t, ok := s["type"]; ok {
+		// 6.1.1 type
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []any:
+			for _, e := range t {
+				if e, ok := e.(string); ok {
+					types = append(types, e)
+				}
+			}
+		}
+		if !slices.ContainsFunc(types, func(t string) bool { return isType(instance, t) }) {
+			violation("must be %s", strings.Join(types, " or "))
+			// The other keywords would only repeat the mismatch
+			return errs
+		}
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		// 6.1.2 enum
+		if !slices.ContainsFunc(enum, func(e any) bool { return equal(e, instance) }) {
+			violation("must be one of %v", enum)
+		}
+	}
+	if c, ok := s["const"]; ok {
+		// 6.1.3 const
+		if !equal(c, instance) {
+			violation("must be %v", c)
+		}
+	}
+
+	switch instance := instance.(type) {
+	case float64:
+		// 6.2 Validation Keywords for Numeric Instances
+		// https://json-schema.org/draft/2020-12/json-schema-validation#section-6.2
+		if multipleOf, ok := s["multipleOf"].(float64); ok && multipleOf > 0 {
+			// 6.2.1 multipleOf
+			if q := instance / multipleOf; q != math.Trunc(q) {
+				violation("must be a multiple of %v", multipleOf)
+			}
+		}
+		if maximum, ok := s["maximum"].(float64); ok && instance > maximum {
+			// 6.2.2 maximum
+			violation("must be at most %v", maximum)
+		}
+		if exclusiveMaximum, ok := s["exclusiveMaximum"].(float64); ok && instance >= exclusiveMaximum {
+			// 6.2.3 exclusiveMaximum
+			violation("must be less than %v", exclusiveMaximum)
+		}
+		if minimum, ok := s["minimum"].(float64); ok && instance < minimum {
+			// 6.2.4 minimum
+			violation("must be at least %v", minimum)
+		}
+		if exclusiveMinimum, ok := s["exclusiveMinimum"].(float64); ok && instance <= exclusiveMinimum {
+			// 6.2.5 exclusiveMinimum
+			violation("must be greater than %v", exclusiveMinimum)
+		}
+	case string:
+		// 6.3 Validation Keywords for Strings
+		// https://json-schema.org/draft/2020-12/json-schema-validation#section-6.3
+		length := float64(utf8.RuneCountInString(instance))
+		if maxLength, ok := s["maxLength"].(float64); ok && length > maxLength {
+			// 6.3.1 maxLength
+			violation("must be at most %v characters", maxLength)
+		}
+		if minLength, ok := s["minLength"].(float64); ok && length < minLength {
+			// 6.3.2 minLength
+			violation("must be at least %v characters", minLength)
+		}
+		if pattern, ok := s["pattern"].(string); ok && !v.patterns[pattern].MatchString(instance) {
+			// 6.3.3 pattern
+			violation("must match %s", pattern)
+		}
+	case []any:
+		// 6.4 Validation Keywords for Arrays
+		// https://json-schema.org/draft/2020-12/json-schema-validation#section-6.4
+		length := float64(len(instance))
+		if maxItems, ok := s["maxItems"].(float64); ok && length > maxItems {
+			// 6.4.1 maxItems
+			violation("must have at most %v items", maxItems)
+		}
+		if minItems, ok := s["minItems"].(float64); ok && length < minItems {
+			// 6.4.2 minItems
+			violation("must have at least %v items", minItems)
+		}
+		if uniqueItems, ok := s["uniqueItems"].(bool); ok && uniqueItems {
+			// 6.4.3 uniqueItems
+			for i := range instance {
+				if slices.ContainsFunc(instance[i+1:], func(e any) bool { return equal(e, instance[i]) }) {
+					violation("must have unique items")
+					break
+				}
+			}
+		}
+		// https://json-schema.org/draft/2020-12/json-schema-core#section-10.3.1.2
+		if items, ok := s["items"]; ok {
+			for i, e := range instance {
+				errs = append(errs, v.validate(items, e, fmt.Sprintf("%s/%d", path, i))...)
+			}
+		}
+	case map[string]any:
+		// 6.5 Validation Keywords for Objects
+		// https://json-schema.org/draft/2020-12/json-schema-validation#section-6.5
+		length := float64(len(instance))
+		if maxProperties, ok := s["maxProperties"].(float64); ok && length > maxProperties {
+			// 6.5.1 maxProperties
+			violation("must have at most %v properties", maxProperties)
+		}
+		if minProperties, ok := s["minProperties"].(float64); ok && length < minProperties {
+			// 6.5.2 minProperties
+			violation("must have at least %v properties", minProperties)
+		}
+		if required, ok := s["required"].([]any); ok {
+			// 6.5.3 required
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, ok := instance[name]; !ok {
+						violation("missing property %s", name)
+					}
+				}
+			}
+		}
+		if dependentRequired, ok := s["dependentRequired"].(map[string]any); ok {
+			// 6.5.4 dependentRequired
+			for name, dependencies := range dependentRequired {
+				if _, ok := instance[name]; !ok {
+					continue
+				}
+				dependencies, _ := dependencies.([]any)
+				for _, dependency := range dependencies {
+					if dependency, ok := dependency.(string); ok {
+						if _, ok := instance[dependency]; !ok {
+							violation("missing property %s required by %s", dependency, name)
+						}
+					}
+				}
+			}
+		}
+		// https://json-schema.org/draft/2020-12/json-schema-core#section-10.3.2
+		properties, _ := s["properties"].(map[string]any)
+		additionalProperties, hasAdditionalProperties := s["additionalProperties"]
+		for name, value := range instance {
+			if property, ok := properties[name]; ok {
+				errs = append(errs, v.validate(property, value, path+"/"+escape(name))...)
+			} else if hasAdditionalProperties {
+				errs = append(errs, v.validate(additionalProperties, value, path+"/"+escape(name))...)
+			}
+		}
+	}
+
+	// https://json-schema.org/draft/2020-12/json-schema-core#section-10.2.1
+	if allOf, ok := s["allOf"].([]any); ok {
+		for _, sub := range allOf {
+			errs = append(errs, v.validate(sub, instance, path)...)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		if !slices.ContainsFunc(anyOf, func(sub any) bool { return len(v.validate(sub, instance, path)) == 0 }) {
+			violation("must match any of anyOf")
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if len(v.validate(sub, instance, path)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			violation("must match exactly one of oneOf, matched %d", matched)
+		}
+	}
+	if not, ok := s["not"]; ok {
+		if len(v.validate(not, instance, path)) == 0 {
+			violation("must not match not")
+		}
+	}
+
+	return errs
+}
+
+func isType(instance any, t string) bool {
+	switch t {
+	case "null":
+		return instance == nil
+	case "boolean":
+		_, ok := instance.(bool)
+		return ok
+	case "object":
+		_, ok := instance.(map[string]any)
+		return ok
+	case "array":
+		_, ok := instance.([]any)
+		return ok
+	case "number":
+		_, ok := instance.(float64)
+		return ok
+	case "integer":
+		n, ok := instance.(float64)
+		return ok && n == math.Trunc(n)
+	case "string":
+		_, ok := instance.(string)
+		return ok
+	default:
+		return false
+	}
+}
+
+func equal(a any, b any) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// escape escapes a property name as a reference token of a JSON Pointer.
+func escape(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,207 @@
+package jsonschema_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"cloudevents-ingress/internal/jsonschema"
+)
+
+func TestValidator_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		instance string
+		wantErr  bool
+	}{
+		{
+			name:     "valid object",
+			schema:   `{"type": "object", "properties": {"action": {"type": "string"}}, "required": ["action"]}`,
+			instance: `{"action": "opened"}`,
+			wantErr:  false,
+		},
+		{
+			name:     "missing required property",
+			schema:   `{"type": "object", "properties": {"action": {"type": "string"}}, "required": ["action"]}`,
+			instance: `{}`,
+			wantErr:  true,
+		},
+		{
+			name:     "wrong type",
+			schema:   `{"type": "object"}`,
+			instance: `[]`,
+			wantErr:  true,
+		},
+		{
+			name:     "integer",
+			schema:   `{"type": "integer"}`,
+			instance: `1.5`,
+			wantErr:  true,
+		},
+		{
+			name:     "type array",
+			schema:   `{"type": ["string", "null"]}`,
+			instance: `null`,
+			wantErr:  false,
+		},
+		{
+			name:     "enum",
+			schema:   `{"enum": ["opened", "closed"]}`,
+			instance: `"reopened"`,
+			wantErr:  true,
+		},
+		{
+			name:     "const",
+			schema:   `{"const": {"a": 1}}`,
+			instance: `{"a": 1}`,
+			wantErr:  false,
+		},
+		{
+			name:     "maximum",
+			schema:   `{"maximum": 10}`,
+			instance: `11`,
+			wantErr:  true,
+		},
+		{
+			name:     "exclusiveMinimum",
+			schema:   `{"exclusiveMinimum": 0}`,
+			instance: `0`,
+			wantErr:  true,
+		},
+		{
+			name:     "multipleOf",
+			schema:   `{"multipleOf": 2}`,
+			instance: `4`,
+			wantErr:  false,
+		},
+		{
+			name:     "minLength counts characters",
+			schema:   `{"minLength": 2}`,
+			instance: `"あ"`,
+			wantErr:  true,
+		},
+		{
+			name:     "pattern",
+			schema:   `{"pattern": "^refs/heads/"}`,
+			instance: `"refs/tags/v1"`,
+			wantErr:  true,
+		},
+		{
+			name:     "items",
+			schema:   `{"type": "array", "items": {"type": "string"}}`,
+			instance: `["a", 1]`,
+			wantErr:  true,
+		},
+		{
+			name:     "uniqueItems",
+			schema:   `{"uniqueItems": true}`,
+			instance: `[1, 2, 1]`,
+			wantErr:  true,
+		},
+		{
+			name:     "additionalProperties false",
+			schema:   `{"properties": {"a": {}}, "additionalProperties": false}`,
+			instance: `{"a": 1, "b": 2}`,
+			wantErr:  true,
+		},
+		{
+			name:     "additionalProperties schema",
+			schema:   `{"additionalProperties": {"type": "string"}}`,
+			instance: `{"a": "b"}`,
+			wantErr:  false,
+		},
+		{
+			name:     "dependentRequired",
+			schema:   `{"dependentRequired": {"after": ["before"]}}`,
+			instance: `{"after": "x"}`,
+			wantErr:  true,
+		},
+		{
+			name:     "nested property",
+			schema:   `{"properties": {"repository": {"properties": {"full_name": {"type": "string"}}}}}`,
+			instance: `{"repository": {"full_name": 1}}`,
+			wantErr:  true,
+		},
+		{
+			name:     "anyOf",
+			schema:   `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`,
+			instance: `true`,
+			wantErr:  true,
+		},
+		{
+			name:     "oneOf",
+			schema:   `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`,
+			instance: `1`,
+			wantErr:  true,
+		},
+		{
+			name:     "not",
+			schema:   `{"not": {"type": "null"}}`,
+			instance: `null`,
+			wantErr:  true,
+		},
+		{
+			name:     "false schema",
+			schema:   `false`,
+			instance: `{}`,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := jsonschema.Compile([]byte(tt.schema))
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+
+			var instance any
+			if err := json.Unmarshal([]byte(tt.instance), &instance); err != nil {
+				t.Fatalf("failed to parse instance: %v", err)
+			}
+
+			err = v.Validate(instance)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			schema:  `{"type": "object"}`,
+			wantErr: false,
+		},
+		{
+			name:    "invalid pattern",
+			schema:  `{"properties": {"a": {"pattern": "("}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "ref",
+			schema:  `{"items": {"$ref": "#/$defs/a"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a schema",
+			schema:  `1`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := jsonschema.Compile([]byte(tt.schema))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,21 +2,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"cloudevents-ingress/internal/jsonschema"
+
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
 	"github.com/google/uuid"
@@ -29,8 +35,91 @@ var (
 	port                   int
 	terminationGracePeriod time.Duration
 	lameduck               time.Duration
+	schemaDir              string
+	idempotencyWindow      time.Duration
+	deliveryIDHeaders      string
+	maxBodySize            int64
+)
+
+const (
+	contentTypeStructured = "application/cloudevents+json"
+	contentTypeBatch      = "application/cloudevents-batch+json"
 )
 
+type idempotencyEntry struct {
+	expiresAt time.Time
+	sent      bool
+}
+
+// idempotencyStore remembers the events sent within a window, keyed by source and ID as the spec makes them unique.
+type idempotencyStore struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+func idempotencyKey(event *cloudevents.Event) string {
+	return event.Source() + "\x00" + event.ID()
+}
+
+// Reserve claims key to send an event, returning whether it was sent already and whether it is being sent now.
+func (s *idempotencyStore) Reserve(key string, now time.Time) (sent bool, inFlight bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expiresAt) {
+		return e.sent, !e.sent
+	}
+	s.entries[key] = &idempotencyEntry{expiresAt: now.Add(s.window)}
+	return false, false
+}
+
+// Done marks key as sent, or forgets it so that a retry sends it again.
+func (s *idempotencyStore) Done(key string, sent bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !sent {
+		delete(s.entries, key)
+		return
+	}
+	s.entries[key] = &idempotencyEntry{expiresAt: now.Add(s.window), sent: true}
+}
+
+func (s *idempotencyStore) Sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.entries {
+		if !now.Before(e.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// loadSchemas reads <type>.json of dir as the JSON Schema of data of events of type.
+func loadSchemas(dir string) (map[string]*jsonschema.Validator, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schemas: %w", err)
+	}
+
+	schemas := make(map[string]*jsonschema.Validator, len(paths))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema %s: %w", path, err)
+		}
+		v, err := jsonschema.Compile(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile schema %s: %w", path, err)
+		}
+		schemas[strings.TrimSuffix(filepath.Base(path), ".json")] = v
+	}
+	return schemas, nil
+}
+
 type oidcTransport struct {
 	base      http.RoundTripper
 	tokenPath string
@@ -87,6 +176,70 @@ func envOrDefaultValue[T any](key string, defaultValue T) T {
 	return defaultValue
 }
 
+// handleEvents sends the events of a request to the sink, and answers 502 unless the sink acknowledges every one of them.
+func handleEvents(sender cloudevents.Client, schemas map[string]*jsonschema.Validator, idempotency *idempotencyStore, idHeaders []string, maxBodySize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		events, err := eventsFromRequest(r, body, idHeaders)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Validate the whole batch before sending any of it
+		for _, event := range events {
+			if err := validateData(schemas, &event); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		status := http.StatusAccepted
+		for _, event := range events {
+			var key string
+			if idempotency != nil {
+				key = idempotencyKey(&event)
+				sent, inFlight := idempotency.Reserve(key, time.Now())
+				if sent {
+					continue
+				}
+				if inFlight {
+					status = http.StatusConflict
+					continue
+				}
+			}
+
+			// A sink that answers with a non-2xx status did not take the event either, so it is not sent
+			result := sender.Send(r.Context(), event)
+			acked := cloudevents.IsACK(result)
+			if idempotency != nil {
+				idempotency.Done(key, acked, time.Now())
+			}
+			if !acked {
+				log.Printf("failed to send %s: %+v", event.ID(), result)
+				status = http.StatusBadGateway
+			}
+		}
+
+		if status != http.StatusAccepted {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
 func main() {
 	flag.StringVar(&sink, "sink", envOrDefaultValue("K_SINK", ""), "Sink URL to send CloudEvents to (K_SINK)")
 	flag.StringVar(&oidcTokenPath, "oidc-token-path", envOrDefaultValue("K_OIDC_TOKEN_PATH", ""), "Path to OIDC token file for broker authentication (K_OIDC_TOKEN_PATH)")
@@ -94,6 +247,10 @@ func main() {
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.IntVar(&port, "port", envOrDefaultValue("PORT", 8080), "Server port")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
+	flag.StringVar(&schemaDir, "schema-dir", envOrDefaultValue("SCHEMA_DIR", ""), "Directory of <type>.json JSON Schemas that data of events of type must satisfy")
+	flag.DurationVar(&idempotencyWindow, "idempotency-window", envOrDefaultValue("IDEMPOTENCY_WINDOW", 10*time.Minute), "Window in which an event with the same Ce-Id and Ce-Source is sent only once, 0 to disable")
+	flag.StringVar(&deliveryIDHeaders, "delivery-id-headers", envOrDefaultValue("DELIVERY_ID_HEADERS", "X-GitHub-Delivery"), "Comma-separated headers whose value is the ID of a binary-mode event without Ce-Id, in order of precedence")
+	flag.Int64Var(&maxBodySize, "max-body-size", envOrDefaultValue("MAX_BODY_SIZE", int64(1<<20)), "Max size of a request body in bytes")
 	flag.Parse()
 
 	if sink == "" {
@@ -115,35 +272,36 @@ func main() {
 		log.Fatalf("failed to create CloudEvents client: %+v", err)
 	}
 
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		body, err := io.ReadAll(r.Body)
+	schemas := map[string]*jsonschema.Validator{}
+	if schemaDir != "" {
+		schemas, err = loadSchemas(schemaDir)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+			log.Fatalf("failed to load schemas: %+v", err)
 		}
+	}
 
-		event := cloudevents.NewEvent()
-		event.SetID(headerOrDefault(r, "Ce-Id", uuid.New().String()))
-		event.SetType(headerOrDefault(r, "Ce-Type", r.Method))
-		event.SetSource(headerOrDefault(r, "Ce-Source", defaultSource))
-		event.SetSubject(headerOrDefault(r, "Ce-Subject", r.URL.Path))
-
-		contentType := headerOrDefault(r, "Content-Type", "application/json")
-		if err := event.SetData(contentType, body); err != nil {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+	var idHeaders []string
+	for _, header := range strings.Split(deliveryIDHeaders, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			idHeaders = append(idHeaders, header)
 		}
+	}
 
-		result := sender.Send(r.Context(), event)
-		if cloudevents.IsUndelivered(result) {
-			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
-			return
-		}
+	var idempotency *idempotencyStore
+	if idempotencyWindow > 0 {
+		idempotency = &idempotencyStore{window: idempotencyWindow, entries: make(map[string]*idempotencyEntry)}
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				idempotency.Sweep(now)
+			}
+		}()
+	}
 
-		w.WriteHeader(http.StatusAccepted)
-	})
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", handleEvents(sender, schemas, idempotency, idHeaders, maxBodySize))
 
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -182,6 +340,81 @@ func main() {
 	}
 }
 
+// eventsFromRequest decodes events of structured or batched content mode, or builds one of binary content mode from
+// Ce-* headers with the body as data. An event without Ce-Id takes its ID from the first of idHeaders the request has,
+// so that a webhook redelivered by its sender is deduplicated, and a random one otherwise.
+// https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/bindings/http-protocol-binding.md#3-http-message-mapping
+func eventsFromRequest(r *http.Request, body []byte, idHeaders []string) ([]cloudevents.Event, error) {
+	mediaType, _, err := mime.ParseMediaType(headerOrDefault(r, "Content-Type", "application/json"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Type: %w", err)
+	}
+
+	switch mediaType {
+	case contentTypeStructured:
+		var event cloudevents.Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			return nil, fmt.Errorf("invalid event: %w", err)
+		}
+		if err := event.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid event: %w", err)
+		}
+		return []cloudevents.Event{event}, nil
+	case contentTypeBatch:
+		var events []cloudevents.Event
+		if err := json.Unmarshal(body, &events); err != nil {
+			return nil, fmt.Errorf("invalid batch: %w", err)
+		}
+		for i, event := range events {
+			if err := event.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid event at %d: %w", i, err)
+			}
+		}
+		return events, nil
+	default:
+		event := cloudevents.NewEvent()
+		id := r.Header.Get("Ce-Id")
+		for _, header := range idHeaders {
+			if id != "" {
+				break
+			}
+			id = r.Header.Get(header)
+		}
+		if id == "" {
+			id = uuid.New().String()
+		}
+		event.SetID(id)
+		event.SetType(headerOrDefault(r, "Ce-Type", r.Method))
+		event.SetSource(headerOrDefault(r, "Ce-Source", defaultSource))
+		event.SetSubject(headerOrDefault(r, "Ce-Subject", r.URL.Path))
+
+		contentType := headerOrDefault(r, "Content-Type", "application/json")
+		if err := event.SetData(contentType, body); err != nil {
+			return nil, fmt.Errorf("invalid data: %w", err)
+		}
+		return []cloudevents.Event{event}, nil
+	}
+}
+
+// validateData checks data of event against the schema of its type, if there is one.
+func validateData(schemas map[string]*jsonschema.Validator, event *cloudevents.Event) error {
+	v, ok := schemas[event.Type()]
+	if !ok {
+		return nil
+	}
+
+	var data any
+	if b := event.Data(); len(b) > 0 {
+		if err := json.Unmarshal(b, &data); err != nil {
+			return fmt.Errorf("data of %s is not JSON: %w", event.ID(), err)
+		}
+	}
+	if err := v.Validate(data); err != nil {
+		return fmt.Errorf("invalid data of %s: %w", event.ID(), err)
+	}
+	return nil
+}
+
 func headerOrDefault(r *http.Request, key string, defaultValue string) string {
 	if v := r.Header.Get(key); v != "" {
 		return v
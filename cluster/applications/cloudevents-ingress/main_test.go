@@ -0,0 +1,352 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloudevents-ingress/internal/jsonschema"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEventsFromRequest(t *testing.T) {
+	type event struct {
+		ID      string
+		Type    string
+		Source  string
+		Subject string
+		Data    string
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		want    []event
+		wantErr bool
+	}{
+		{
+			"binary",
+			map[string]string{"Content-Type": "application/json", "Ce-Id": "1", "Ce-Type": "push", "Ce-Source": "github", "Ce-Subject": "repo"},
+			`{"ref":"main"}`,
+			[]event{{"1", "push", "github", "repo", `{"ref":"main"}`}},
+			false,
+		},
+		{
+			"binary with defaults",
+			map[string]string{"Ce-Id": "1"},
+			`{}`,
+			[]event{{"1", http.MethodPost, "", "/hooks", `{}`}},
+			false,
+		},
+		{
+			"binary with the ID of a delivery header",
+			map[string]string{"X-GitHub-Delivery": "delivery", "X-Other-Delivery": "other"},
+			`{}`,
+			[]event{{"delivery", http.MethodPost, "", "/hooks", `{}`}},
+			false,
+		},
+		{
+			"binary with Ce-Id over a delivery header",
+			map[string]string{"Ce-Id": "1", "X-GitHub-Delivery": "delivery"},
+			`{}`,
+			[]event{{"1", http.MethodPost, "", "/hooks", `{}`}},
+			false,
+		},
+		{
+			"structured",
+			map[string]string{"Content-Type": "application/cloudevents+json; charset=utf-8"},
+			`{"specversion":"1.0","id":"1","type":"push","source":"github","datacontenttype":"application/json","data":{"ref":"main"}}`,
+			[]event{{"1", "push", "github", "", `{"ref":"main"}`}},
+			false,
+		},
+		{
+			"structured without id",
+			map[string]string{"Content-Type": "application/cloudevents+json"},
+			`{"specversion":"1.0","type":"push","source":"github"}`,
+			nil,
+			true,
+		},
+		{
+			"batch",
+			map[string]string{"Content-Type": "application/cloudevents-batch+json"},
+			`[{"specversion":"1.0","id":"1","type":"push","source":"github"},{"specversion":"1.0","id":"2","type":"issues","source":"github"}]`,
+			[]event{{"1", "push", "github", "", ""}, {"2", "issues", "github", "", ""}},
+			false,
+		},
+		{
+			"batch with an invalid event",
+			map[string]string{"Content-Type": "application/cloudevents-batch+json"},
+			`[{"specversion":"1.0","id":"1","type":"push","source":"github"},{"specversion":"1.0","id":"2","source":"github"}]`,
+			nil,
+			true,
+		},
+		{
+			"invalid batch",
+			map[string]string{"Content-Type": "application/cloudevents-batch+json"},
+			`{}`,
+			nil,
+			true,
+		},
+		{
+			"invalid Content-Type",
+			map[string]string{"Content-Type": "application/json; ="},
+			`{}`,
+			nil,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		headers := tt.headers
+		body := tt.body
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodPost, "/hooks", strings.NewReader(body))
+			for k, v := range headers {
+				r.Header.Set(k, v)
+			}
+
+			events, err := eventsFromRequest(r, []byte(body), []string{"X-GitHub-Delivery", "X-Other-Delivery"})
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+
+			var got []event
+			for _, e := range events {
+				got = append(got, event{e.ID(), e.Type(), e.Source(), e.Subject(), string(e.Data())})
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEventsFromRequest_RandomID(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(http.MethodPost, "/hooks", strings.NewReader(`{}`))
+	first, err := eventsFromRequest(r, []byte(`{}`), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	second, err := eventsFromRequest(r, []byte(`{}`), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if first[0].ID() == "" || first[0].ID() == second[0].ID() {
+		t.Errorf("got IDs %q and %q, want distinct ones", first[0].ID(), second[0].ID())
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type step struct {
+		// reserve, sent or failed
+		op           string
+		at           time.Duration
+		wantSent     bool
+		wantInFlight bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			"new",
+			[]step{{op: "reserve"}},
+		},
+		{
+			"in flight",
+			[]step{{op: "reserve"}, {op: "reserve", wantInFlight: true}},
+		},
+		{
+			"sent",
+			[]step{{op: "reserve"}, {op: "sent"}, {op: "reserve", at: time.Minute, wantSent: true}},
+		},
+		{
+			"failed is forgotten",
+			[]step{{op: "reserve"}, {op: "failed"}, {op: "reserve"}},
+		},
+		{
+			"sent out of the window",
+			[]step{{op: "reserve"}, {op: "sent"}, {op: "reserve", at: 10 * time.Minute}},
+		},
+		{
+			"in flight out of the window",
+			[]step{{op: "reserve"}, {op: "reserve", at: 10 * time.Minute}},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		steps := tt.steps
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &idempotencyStore{window: 10 * time.Minute, entries: make(map[string]*idempotencyEntry)}
+			for i, step := range steps {
+				switch step.op {
+				case "reserve":
+					sent, inFlight := s.Reserve("key", now.Add(step.at))
+					if sent != step.wantSent || inFlight != step.wantInFlight {
+						t.Errorf("step %d: got sent %v, in flight %v, want %v, %v", i, sent, inFlight, step.wantSent, step.wantInFlight)
+					}
+				case "sent":
+					s.Done("key", true, now.Add(step.at))
+				case "failed":
+					s.Done("key", false, now.Add(step.at))
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotencyStore_Sweep(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &idempotencyStore{window: 10 * time.Minute, entries: make(map[string]*idempotencyEntry)}
+	s.Reserve("old", now)
+	s.Done("old", true, now)
+	s.Reserve("new", now.Add(5*time.Minute))
+
+	s.Sweep(now.Add(10 * time.Minute))
+
+	var got []string
+	for key := range s.entries {
+		got = append(got, key)
+	}
+	if diff := cmp.Diff([]string{"new"}, got); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateData(t *testing.T) {
+	v, err := jsonschema.Compile([]byte(`{"type": "object", "properties": {"action": {"type": "string"}}, "required": ["action"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas := map[string]*jsonschema.Validator{"issues": v}
+
+	tests := []struct {
+		name        string
+		eventType   string
+		contentType string
+		data        string
+		wantErr     bool
+	}{
+		{"valid", "issues", "application/json", `{"action":"opened"}`, false},
+		{"invalid", "issues", "application/json", `{"action":1}`, true},
+		{"without data", "issues", "application/json", ``, true},
+		{"not JSON", "issues", "text/plain", `opened`, true},
+		{"without schema", "push", "text/plain", `anything`, false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		eventType := tt.eventType
+		contentType := tt.contentType
+		data := tt.data
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			event := cloudevents.NewEvent()
+			event.SetID("1")
+			event.SetType(eventType)
+			event.SetSource("github")
+			if data != "" {
+				if err := event.SetData(contentType, []byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := validateData(schemas, &event); (err != nil) != wantErr {
+				t.Errorf("got error %v, want error %v", err, wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		// sinkStatuses are the statuses the sink answers in turn, the last one repeated
+		sinkStatuses     []int
+		want             []int
+		wantSinkRequests int32
+	}{
+		{
+			"accepted",
+			[]int{http.StatusAccepted},
+			[]int{http.StatusAccepted, http.StatusAccepted},
+			1,
+		},
+		{
+			"rejected by the sink",
+			[]int{http.StatusBadRequest},
+			[]int{http.StatusBadGateway, http.StatusBadGateway},
+			2,
+		},
+		{
+			"retried after a server error of the sink",
+			[]int{http.StatusInternalServerError, http.StatusAccepted},
+			[]int{http.StatusBadGateway, http.StatusAccepted, http.StatusAccepted},
+			2,
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		sinkStatuses := tt.sinkStatuses
+		want := tt.want
+		wantSinkRequests := tt.wantSinkRequests
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var sinkRequests atomic.Int32
+			sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(sinkRequests.Add(1))
+				w.WriteHeader(sinkStatuses[min(n, len(sinkStatuses))-1])
+			}))
+			defer sink.Close()
+
+			sender, err := cloudevents.NewClientHTTP(cehttp.WithTarget(sink.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			idempotency := &idempotencyStore{window: 10 * time.Minute, entries: make(map[string]*idempotencyEntry)}
+			handler := handleEvents(sender, map[string]*jsonschema.Validator{}, idempotency, nil, 1<<20)
+
+			var got []int
+			for range want {
+				r := httptest.NewRequest(http.MethodPost, "/hooks", strings.NewReader(`{}`))
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("Ce-Id", "1")
+				r.Header.Set("Ce-Source", "github")
+				w := httptest.NewRecorder()
+				handler(w, r)
+				got = append(got, w.Code)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+			if got := sinkRequests.Load(); got != wantSinkRequests {
+				t.Errorf("got %d requests to the sink, want %d", got, wantSinkRequests)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -16,10 +17,20 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"sort"
 	"strconv"
-	"sync"
+	"strings"
 	"syscall"
 	"time"
+	"unicode/utf8"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/rest"
 )
 
 func envOrDefaultValue[T any](key string, defaultValue T) T {
@@ -64,27 +75,325 @@ func envOrDefaultValue[T any](key string, defaultValue T) T {
 	return defaultValue
 }
 
-type statusRecorder struct {
+// responseRecorder keeps the status of a proxied response and, when limit is positive, its headers and up to limit bytes of its body.
+type responseRecorder struct {
+	header     http.Header
 	statusCode int
+	body       bytes.Buffer
+	limit      int
+	truncated  bool
 	err        error
 }
 
-func (r *statusRecorder) Header() http.Header         { return http.Header{} }
-func (r *statusRecorder) Write(b []byte) (int, error) { return len(b), nil }
-func (r *statusRecorder) WriteHeader(code int)        { r.statusCode = code }
+func (r *responseRecorder) Header() http.Header { return r.header }
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.limit <= 0 {
+		return len(b), nil
+	}
+	remaining := r.limit - r.body.Len()
+	if len(b) > remaining {
+		r.body.Write(b[:max(remaining, 0)])
+		r.truncated = true
+	} else {
+		r.body.Write(b)
+	}
+	return len(b), nil
+}
+func (r *responseRecorder) WriteHeader(code int) { r.statusCode = code }
 
 type PodResult struct {
-	Pod     string `json:"pod"`
-	Status  int    `json:"status"`
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Pod           string      `json:"pod"`
+	Name          string      `json:"name,omitempty"`
+	Status        int         `json:"status"`
+	Success       bool        `json:"success"`
+	Attempts      int         `json:"attempts"`
+	Error         string      `json:"error,omitempty"`
+	Headers       http.Header `json:"headers,omitempty"`
+	Body          string      `json:"body,omitempty"`
+	BodyEncoding  string      `json:"bodyEncoding,omitempty"`
+	BodyTruncated bool        `json:"bodyTruncated,omitempty"`
 }
 
 type BroadcastResponse struct {
-	Total   int         `json:"total"`
-	Success int         `json:"success"`
-	Failed  int         `json:"failed"`
-	Results []PodResult `json:"results"`
+	Total     int         `json:"total"`
+	Success   int         `json:"success"`
+	Failed    int         `json:"failed"`
+	Quorum    int         `json:"quorum,omitempty"`
+	QuorumMet *bool       `json:"quorumMet,omitempty"`
+	Results   []PodResult `json:"results,omitempty"`
+}
+
+type endpoint struct {
+	address string
+	port    int
+	name    string
+}
+
+type endpointResolver interface {
+	Resolve(ctx context.Context) ([]endpoint, error)
+}
+
+// dnsResolver looks up the A records of a headless service.
+type dnsResolver struct {
+	host string
+	port int
+}
+
+func (d *dnsResolver) Resolve(ctx context.Context) ([]endpoint, error) {
+	ips, err := net.DefaultResolver.LookupHost(ctx, d.host)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]endpoint, 0, len(ips))
+	for _, ip := range ips {
+		endpoints = append(endpoints, endpoint{address: ip, port: d.port})
+	}
+	return endpoints, nil
+}
+
+// endpointSliceResolver reads the EndpointSlices of a service from an informer cache, so it works for non-headless services too.
+type endpointSliceResolver struct {
+	lister             discoverylisters.EndpointSliceNamespaceLister
+	port               int
+	portName           string
+	includeTerminating bool
+}
+
+func newEndpointSliceResolver(clientset kubernetes.Interface, namespace string, service string, port int, portName string, includeTerminating bool, stopCh <-chan struct{}) (*endpointSliceResolver, error) {
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, 10*time.Minute,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: service}).String()
+		}),
+	)
+	informer := informerFactory.Discovery().V1().EndpointSlices()
+	lister := informer.Lister()
+	informerFactory.Start(stopCh)
+	for typ, ok := range informerFactory.WaitForCacheSync(stopCh) {
+		if !ok {
+			return nil, fmt.Errorf("failed to sync cache of %v", typ)
+		}
+	}
+	return &endpointSliceResolver{
+		lister:             lister.EndpointSlices(namespace),
+		port:               port,
+		portName:           portName,
+		includeTerminating: includeTerminating,
+	}, nil
+}
+
+func (e *endpointSliceResolver) Resolve(_ context.Context) ([]endpoint, error) {
+	slices, err := e.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	// IPv4 slices come first, so that a dual-stack pod is reached by the same address every time
+	sort.Slice(slices, func(i, j int) bool {
+		if slices[i].AddressType != slices[j].AddressType {
+			return slices[i].AddressType < slices[j].AddressType
+		}
+		return slices[i].Name < slices[j].Name
+	})
+
+	var endpoints []endpoint
+	seen := make(map[string]struct{})
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+
+		port := e.port
+		if e.portName != "" {
+			port = 0
+			for _, p := range slice.Ports {
+				if p.Name != nil && *p.Name == e.portName && p.Port != nil {
+					port = int(*p.Port)
+					break
+				}
+			}
+			if port == 0 {
+				continue
+			}
+		}
+
+		for _, ep := range slice.Endpoints {
+			if !e.eligible(ep.Conditions) || len(ep.Addresses) == 0 {
+				continue
+			}
+			// Dual-stack services publish one slice per family with different addresses of a pod, which should be reached once
+			address := ep.Addresses[0]
+			id := address
+			if ep.TargetRef != nil && ep.TargetRef.UID != "" {
+				id = string(ep.TargetRef.UID)
+			}
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+
+			var name string
+			if ep.TargetRef != nil {
+				name = ep.TargetRef.Name
+			}
+			endpoints = append(endpoints, endpoint{address: address, port: port, name: name})
+		}
+	}
+	return endpoints, nil
+}
+
+// eligible accepts ready endpoints, and terminating ones that still serve when includeTerminating is set.
+func (e *endpointSliceResolver) eligible(conditions discoveryv1.EndpointConditions) bool {
+	if conditions.Ready == nil || *conditions.Ready {
+		return true
+	}
+	if e.includeTerminating && conditions.Terminating != nil && *conditions.Terminating {
+		return conditions.Serving == nil || *conditions.Serving
+	}
+	return false
+}
+
+const (
+	discoveryDNS           = "dns"
+	discoveryEndpointSlice = "endpointslice"
+)
+
+const inClusterNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Query parameters consumed by the broadcaster and not forwarded to pods
+const (
+	quorumParameter  = "quorum"
+	captureParameter = "capture"
+)
+
+// parseQuorum resolves all, majority or a positive count against the number of pods.
+func parseQuorum(value string, total int) (int, error) {
+	switch value {
+	case "all":
+		return total, nil
+	case "majority":
+		return total/2 + 1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid quorum: %s", value)
+	}
+	return n, nil
+}
+
+type broadcaster struct {
+	targetService   string
+	podTimeout      time.Duration
+	retries         int
+	retryBackoff    time.Duration
+	maxCaptureBytes int
+}
+
+func retryable(recorder *responseRecorder) bool {
+	if recorder.err != nil {
+		return true
+	}
+	switch recorder.statusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// serve runs proxy outside of a server, where nothing would recover the http.ErrAbortHandler it panics with
+// when the pod fails mid-body, such as by stalling past the pod timeout, so the panic is recorded as the pod's error.
+func serve(proxy *httputil.ReverseProxy, recorder *responseRecorder, request *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err != http.ErrAbortHandler {
+				panic(err)
+			}
+			recorder.err = errors.New("response body aborted")
+			if cause := context.Cause(request.Context()); cause != nil {
+				recorder.err = fmt.Errorf("response body aborted: %w", cause)
+			}
+		}
+	}()
+	proxy.ServeHTTP(recorder, request)
+}
+
+// send proxies r to one pod, retrying connection errors and 502/503/504 up to b.retries times.
+func (b *broadcaster) send(r *http.Request, body []byte, e endpoint, capture bool) PodResult {
+	result := PodResult{Pod: e.address, Name: e.name}
+
+	target, err := url.Parse(fmt.Sprintf("http://%s", net.JoinHostPort(e.address, strconv.Itoa(e.port))))
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to parse target URL: %v", err)
+		return result
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	originalDirector := proxy.Director
+	proxy.Director = func(request *http.Request) {
+		originalDirector(request)
+		request.Host = b.targetService
+	}
+
+	var recorder *responseRecorder
+	for attempt := 0; attempt <= b.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(b.retryBackoff * time.Duration(1<<(attempt-1))):
+			}
+			if r.Context().Err() != nil {
+				break
+			}
+		}
+
+		recorder = &responseRecorder{header: http.Header{}}
+		if capture {
+			recorder.limit = b.maxCaptureBytes
+		}
+		proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) {
+			recorder.err = err
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), b.podTimeout)
+		request := r.Clone(ctx)
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		request.ContentLength = int64(len(body))
+		serve(proxy, recorder, request)
+		cancel()
+
+		result.Attempts = attempt + 1
+		if !retryable(recorder) {
+			break
+		}
+	}
+
+	if recorder.err != nil {
+		result.Error = recorder.err.Error()
+		return result
+	}
+
+	result.Status = recorder.statusCode
+	result.Success = recorder.statusCode > 0 && recorder.statusCode < 400
+	if capture {
+		result.Headers = recorder.header
+		if utf8.Valid(recorder.body.Bytes()) {
+			result.Body = recorder.body.String()
+		} else {
+			result.Body = base64.StdEncoding.EncodeToString(recorder.body.Bytes())
+			result.BodyEncoding = "base64"
+		}
+		result.BodyTruncated = recorder.truncated
+	}
+	return result
+}
+
+func writeEvent(w io.Writer, event string, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("failed to marshal %s event: %+v", event, err)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
 }
 
 func main() {
@@ -94,13 +403,29 @@ func main() {
 	var keepAlive bool
 	var targetService string
 	var targetPort int
+	var targetPortName string
+	var targetNamespace string
+	var discovery string
+	var includeTerminating bool
+	var podTimeout time.Duration
+	var retries int
+	var retryBackoff time.Duration
+	var maxCaptureBytes int
 
 	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
-	flag.StringVar(&targetService, "target-service", envOrDefaultValue("TARGET_SERVICE", ""), "Headless service FQDN to broadcast to")
+	flag.StringVar(&targetService, "target-service", envOrDefaultValue("TARGET_SERVICE", ""), "Headless service FQDN to broadcast to, or the service name with endpointslice discovery")
 	flag.IntVar(&targetPort, "target-port", envOrDefaultValue("TARGET_PORT", 80), "Target port on each pod")
+	flag.StringVar(&targetPortName, "target-port-name", envOrDefaultValue("TARGET_PORT_NAME", ""), "Name of the service port to target, overriding --target-port with endpointslice discovery")
+	flag.StringVar(&targetNamespace, "target-namespace", envOrDefaultValue("TARGET_NAMESPACE", ""), "Namespace of the service with endpointslice discovery, defaulting to the pod's own")
+	flag.StringVar(&discovery, "discovery", envOrDefaultValue("DISCOVERY", discoveryDNS), "How pods are discovered (dns or endpointslice)")
+	flag.BoolVar(&includeTerminating, "include-terminating", envOrDefaultValue("INCLUDE_TERMINATING", false), "Also broadcast to terminating pods that are still serving with endpointslice discovery")
+	flag.DurationVar(&podTimeout, "pod-timeout", envOrDefaultValue("POD_TIMEOUT", 10*time.Second), "Timeout for each attempt against a single pod")
+	flag.IntVar(&retries, "retries", envOrDefaultValue("RETRIES", 0), "Number of retries against a pod after a connection error or a 502, 503 or 504")
+	flag.DurationVar(&retryBackoff, "retry-backoff", envOrDefaultValue("RETRY_BACKOFF", 100*time.Millisecond), "Backoff before the first retry, doubled on each further retry")
+	flag.IntVar(&maxCaptureBytes, "max-capture-bytes", envOrDefaultValue("MAX_CAPTURE_BYTES", 64*1024), "Maximum bytes of each pod's response body kept when capture is requested")
 	flag.Parse()
 
 	if targetService == "" {
@@ -109,6 +434,44 @@ func main() {
 
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = http.DefaultTransport.(*http.Transport).MaxIdleConns
 
+	stopCh := make(chan struct{})
+
+	var resolver endpointResolver
+	switch discovery {
+	case discoveryDNS:
+		resolver = &dnsResolver{host: targetService, port: targetPort}
+	case discoveryEndpointSlice:
+		kubeConfig, err := rest.InClusterConfig()
+		if err != nil {
+			log.Fatalf("failed to create kubernetes config: %+v", err)
+		}
+		clientset, err := kubernetes.NewForConfig(kubeConfig)
+		if err != nil {
+			log.Fatalf("failed to create kubernetes client: %+v", err)
+		}
+		if targetNamespace == "" {
+			namespace, err := os.ReadFile(inClusterNamespacePath)
+			if err != nil {
+				log.Fatalf("failed to find target namespace: %+v", err)
+			}
+			targetNamespace = string(namespace)
+		}
+		resolver, err = newEndpointSliceResolver(clientset, targetNamespace, targetService, targetPort, targetPortName, includeTerminating, stopCh)
+		if err != nil {
+			log.Fatalf("failed to watch endpointslices: %+v", err)
+		}
+	default:
+		log.Fatalf("unknown discovery: %s", discovery)
+	}
+
+	b := &broadcaster{
+		targetService:   targetService,
+		podTimeout:      podTimeout,
+		retries:         retries,
+		retryBackoff:    retryBackoff,
+		maxCaptureBytes: maxCaptureBytes,
+	}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -118,9 +481,9 @@ func main() {
 	})
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		ips, err := net.DefaultResolver.LookupHost(r.Context(), targetService)
+		endpoints, err := resolver.Resolve(r.Context())
 		if err != nil {
-			log.Printf("DNS lookup failed for %s: %v", targetService, err)
+			log.Printf("service discovery failed for %s: %v", targetService, err)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadGateway)
 			_ = json.NewEncoder(w).Encode(map[string]string{
@@ -129,7 +492,7 @@ func main() {
 			return
 		}
 
-		if len(ips) == 0 {
+		if len(endpoints) == 0 {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusBadGateway)
 			_ = json.NewEncoder(w).Encode(map[string]string{
@@ -138,8 +501,35 @@ func main() {
 			return
 		}
 
-		results := make([]PodResult, len(ips))
-		wg := &sync.WaitGroup{}
+		query := r.URL.Query()
+		quorum := 0
+		if v := query.Get(quorumParameter); v != "" {
+			quorum, err = parseQuorum(v, len(endpoints))
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{
+					"error": err.Error(),
+				})
+				return
+			}
+		}
+		capture := false
+		if v := query.Get(captureParameter); v != "" {
+			capture, err = strconv.ParseBool(v)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{
+					"error": fmt.Sprintf("invalid capture: %s", v),
+				})
+				return
+			}
+		}
+		query.Del(quorumParameter)
+		query.Del(captureParameter)
+		forwarded := r.Clone(r.Context())
+		forwarded.URL.RawQuery = query.Encode()
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -151,53 +541,45 @@ func main() {
 			return
 		}
 
-		for i, ip := range ips {
-			wg.Go(func() {
-				target, err := url.Parse(fmt.Sprintf("http://%s:%d", ip, targetPort))
-				if err != nil {
-					results[i] = PodResult{
-						Pod:     ip,
-						Success: false,
-						Error:   fmt.Sprintf("failed to parse target URL: %v", err),
-					}
-					return
-				}
-
-				proxy := httputil.NewSingleHostReverseProxy(target)
-				originalDirector := proxy.Director
-				proxy.Director = func(request *http.Request) {
-					originalDirector(request)
-					request.Host = targetService
-				}
+		var flusher http.Flusher
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			f, ok := w.(http.Flusher)
+			if !ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				_ = json.NewEncoder(w).Encode(map[string]string{
+					"error": "streaming is not supported",
+				})
+				return
+			}
+			flusher = f
+			// The Accept header is meant for the broadcaster, not for the pods
+			forwarded.Header.Del("Accept")
+		}
 
-				recorder := &statusRecorder{}
-				proxy.ErrorHandler = func(_ http.ResponseWriter, _ *http.Request, err error) {
-					recorder.err = err
-				}
+		completed := make(chan PodResult, len(endpoints))
+		for _, e := range endpoints {
+			go func() {
+				completed <- b.send(forwarded, body, e, capture)
+			}()
+		}
 
-				request := r.Clone(r.Context())
-				request.Body = io.NopCloser(bytes.NewReader(body))
-				request.ContentLength = int64(len(body))
-
-				proxy.ServeHTTP(recorder, request)
-
-				if recorder.err != nil {
-					results[i] = PodResult{
-						Pod:     ip,
-						Success: false,
-						Error:   recorder.err.Error(),
-					}
-				} else {
-					results[i] = PodResult{
-						Pod:     ip,
-						Status:  recorder.statusCode,
-						Success: recorder.statusCode > 0 && recorder.statusCode < 400,
-					}
-				}
-			})
+		if flusher != nil {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
 		}
 
-		wg.Wait()
+		results := make([]PodResult, 0, len(endpoints))
+		for range endpoints {
+			result := <-completed
+			results = append(results, result)
+			if flusher != nil {
+				writeEvent(w, "result", result)
+				flusher.Flush()
+			}
+		}
 
 		successCount := 0
 		for _, result := range results {
@@ -210,11 +592,36 @@ func main() {
 			Total:   len(results),
 			Success: successCount,
 			Failed:  len(results) - successCount,
-			Results: results,
+			Quorum:  quorum,
+		}
+
+		status := http.StatusOK
+		if quorum > 0 {
+			met := successCount >= quorum
+			response.QuorumMet = &met
+			if !met {
+				status = http.StatusBadGateway
+			}
+		}
+
+		if flusher != nil {
+			writeEvent(w, "summary", response)
+			flusher.Flush()
+			return
+		}
+
+		// Keep the pods in discovery order regardless of who answered first
+		order := make(map[string]int, len(endpoints))
+		for i, e := range endpoints {
+			order[e.address] = i
 		}
+		sort.Slice(results, func(i, j int) bool {
+			return order[results[i].Pod] < order[results[j].Pod]
+		})
+		response.Results = results
 
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(status)
 		_ = json.NewEncoder(w).Encode(response)
 	})
 
@@ -243,6 +650,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGTERM)
 	<-quit
 	time.Sleep(lameduck)
+	close(stopCh)
 
 	ctx, cancel := context.WithTimeout(context.Background(), terminationGracePeriod)
 	defer cancel()
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+)
+
+func newEndpointSlice(name string, addressType discoveryv1.AddressType, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Name: name, Namespace: "default"},
+		AddressType: addressType,
+		Endpoints:   endpoints,
+		Ports:       []discoveryv1.EndpointPort{{Name: ptr.To("http"), Port: ptr.To[int32](8080)}},
+	}
+}
+
+func newEndpoint(address string, pod string, conditions discoveryv1.EndpointConditions) discoveryv1.Endpoint {
+	ep := discoveryv1.Endpoint{Addresses: []string{address}, Conditions: conditions}
+	if pod != "" {
+		ep.TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: pod, UID: types.UID("uid-" + pod)}
+	}
+	return ep
+}
+
+func TestEndpointSliceResolver_Resolve(t *testing.T) {
+	ready := discoveryv1.EndpointConditions{Ready: ptr.To(true)}
+	terminating := discoveryv1.EndpointConditions{Ready: ptr.To(false), Serving: ptr.To(true), Terminating: ptr.To(true)}
+
+	tests := []struct {
+		name               string
+		slices             []*discoveryv1.EndpointSlice
+		portName           string
+		includeTerminating bool
+		want               []endpoint
+	}{
+		{
+			"dual-stack pods are reached once by IPv4",
+			[]*discoveryv1.EndpointSlice{
+				newEndpointSlice("a-v6", discoveryv1.AddressTypeIPv6, newEndpoint("fd00::1", "a", ready), newEndpoint("fd00::2", "b", ready)),
+				newEndpointSlice("a-v4", discoveryv1.AddressTypeIPv4, newEndpoint("10.0.0.1", "a", ready), newEndpoint("10.0.0.2", "b", ready)),
+			},
+			"",
+			false,
+			[]endpoint{{"10.0.0.1", 80, "a"}, {"10.0.0.2", 80, "b"}},
+		},
+		{
+			"without a target, by address",
+			[]*discoveryv1.EndpointSlice{
+				newEndpointSlice("a", discoveryv1.AddressTypeIPv4, newEndpoint("10.0.0.1", "", ready)),
+				newEndpointSlice("b", discoveryv1.AddressTypeIPv4, newEndpoint("10.0.0.1", "", ready), newEndpoint("10.0.0.2", "", ready)),
+			},
+			"",
+			false,
+			[]endpoint{{"10.0.0.1", 80, ""}, {"10.0.0.2", 80, ""}},
+		},
+		{
+			"a pod moved between slices is reached once",
+			[]*discoveryv1.EndpointSlice{
+				newEndpointSlice("a", discoveryv1.AddressTypeIPv4, newEndpoint("10.0.0.1", "a", ready)),
+				newEndpointSlice("b", discoveryv1.AddressTypeIPv4, newEndpoint("10.0.0.1", "a", ready)),
+			},
+			"",
+			false,
+			[]endpoint{{"10.0.0.1", 80, "a"}},
+		},
+		{
+			"FQDN slices are skipped",
+			[]*discoveryv1.EndpointSlice{
+				newEndpointSlice("a", discoveryv1.AddressTypeFQDN, newEndpoint("example.com", "", ready)),
+			},
+			"",
+			false,
+			nil,
+		},
+		{
+			"named port",
+			[]*discoveryv1.EndpointSlice{
+				newEndpointSlice("a", discoveryv1.AddressTypeIPv4, newEndpoint("10.0.0.1", "a", ready)),
+			},
+			"http",
+			false,
+			[]endpoint{{"10.0.0.1", 8080, "a"}},
+		},
+		{
+			"terminating is excluded",
+			[]*discoveryv1.EndpointSlice{
+				newEndpointSlice("a", discoveryv1.AddressTypeIPv4, newEndpoint("10.0.0.1", "a", ready), newEndpoint("10.0.0.2", "b", terminating)),
+			},
+			"",
+			false,
+			[]endpoint{{"10.0.0.1", 80, "a"}},
+		},
+		{
+			"terminating is included",
+			[]*discoveryv1.EndpointSlice{
+				newEndpointSlice("a", discoveryv1.AddressTypeIPv4, newEndpoint("10.0.0.1", "a", ready), newEndpoint("10.0.0.2", "b", terminating)),
+			},
+			"",
+			true,
+			[]endpoint{{"10.0.0.1", 80, "a"}, {"10.0.0.2", 80, "b"}},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		slices := tt.slices
+		portName := tt.portName
+		includeTerminating := tt.includeTerminating
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			for _, slice := range slices {
+				if err := indexer.Add(slice); err != nil {
+					t.Fatal(err)
+				}
+			}
+			resolver := &endpointSliceResolver{
+				lister:             discoverylisters.NewEndpointSliceLister(indexer).EndpointSlices("default"),
+				port:               80,
+				portName:           portName,
+				includeTerminating: includeTerminating,
+			}
+
+			got, err := resolver.Resolve(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if diff := cmp.Diff(want, got, cmp.AllowUnexported(endpoint{})); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+package openmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// family is the metadata block currently being read, keyed by the name used in its TYPE line.
+type family struct {
+	name    string
+	typ     string
+	help    *string
+	unit    *string
+	metrics map[string]*dto.Metric
+	order   []string
+}
+
+type sample struct {
+	name      string
+	labels    []*dto.LabelPair
+	value     float64
+	timestamp *float64
+	exemplar  *dto.Exemplar
+}
+
+// Parse reads an OpenMetrics 1.0 text exposition.
+// https://github.com/prometheus/OpenMetrics/blob/main/specification/OpenMetrics.md
+// Families are keyed the way the Prometheus client names them, so counters keep their _total suffix and info metrics their _info suffix.
+func Parse(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	families := make(map[string]*dto.MetricFamily)
+	var current *family
+
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		mf, err := current.build()
+		if err != nil {
+			return err
+		}
+		current = nil
+		// A family with metadata but no samples has nothing to expose
+		if len(mf.Metric) == 0 {
+			return nil
+		}
+		if _, ok := families[mf.GetName()]; ok {
+			return fmt.Errorf("duplicate metric family: %s", mf.GetName())
+		}
+		families[mf.GetName()] = mf
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	eof := false
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if eof {
+			return nil, fmt.Errorf("line %d: content after # EOF", lineNumber)
+		}
+
+		if strings.HasPrefix(line, "#") {
+			if line == "# EOF" {
+				eof = true
+				continue
+			}
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: invalid metadata: %s", lineNumber, line)
+			}
+			keyword, name := fields[1], fields[2]
+			value := ""
+			if len(fields) == 4 {
+				value = fields[3]
+			}
+
+			if current == nil || current.name != name {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				current = &family{name: name, typ: "unknown", metrics: make(map[string]*dto.Metric)}
+			}
+			switch keyword {
+			case "TYPE":
+				current.typ = value
+			case "HELP":
+				help := unescape(value)
+				current.help = &help
+			case "UNIT":
+				current.unit = &value
+			default:
+				return nil, fmt.Errorf("line %d: unknown metadata: %s", lineNumber, keyword)
+			}
+			continue
+		}
+
+		if line == "" {
+			return nil, fmt.Errorf("line %d: empty line", lineNumber)
+		}
+
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		suffix, ok := matchSuffix(current, s.name)
+		if !ok {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			current = &family{name: s.name, typ: "unknown", metrics: make(map[string]*dto.Metric)}
+			suffix = ""
+		}
+		if err := current.add(suffix, s); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !eof {
+		return nil, fmt.Errorf("missing # EOF")
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+func suffixes(typ string) []string {
+	switch typ {
+	case "counter":
+		return []string{"_total", "_created"}
+	case "histogram":
+		return []string{"_bucket", "_count", "_sum", "_created"}
+	case "gaugehistogram":
+		return []string{"_bucket", "_gcount", "_gsum"}
+	case "summary":
+		return []string{"", "_count", "_sum", "_created"}
+	case "info":
+		return []string{"_info"}
+	default:
+		return []string{""}
+	}
+}
+
+func matchSuffix(f *family, name string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	for _, suffix := range suffixes(f.typ) {
+		if name == f.name+suffix {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+func (f *family) add(suffix string, s sample) error {
+	var labels []*dto.LabelPair
+	var le, quantile *float64
+	for _, label := range s.labels {
+		switch {
+		case label.GetName() == "le" && (f.typ == "histogram" || f.typ == "gaugehistogram") && suffix == "_bucket":
+			v, err := parseFloat(label.GetValue())
+			if err != nil {
+				return fmt.Errorf("invalid le: %w", err)
+			}
+			le = &v
+		case label.GetName() == "quantile" && f.typ == "summary" && suffix == "":
+			v, err := parseFloat(label.GetValue())
+			if err != nil {
+				return fmt.Errorf("invalid quantile: %w", err)
+			}
+			quantile = &v
+		default:
+			labels = append(labels, label)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+
+	var key strings.Builder
+	for _, label := range labels {
+		key.WriteString(label.GetName())
+		key.WriteByte(0)
+		key.WriteString(label.GetValue())
+		key.WriteByte(0)
+	}
+	m, ok := f.metrics[key.String()]
+	if !ok {
+		m = &dto.Metric{Label: labels}
+		if s.timestamp != nil {
+			m.TimestampMs = proto.Int64(int64(*s.timestamp * 1000))
+		}
+		f.metrics[key.String()] = m
+		f.order = append(f.order, key.String())
+	}
+
+	switch f.typ {
+	case "counter":
+		if m.Counter == nil {
+			m.Counter = &dto.Counter{}
+		}
+		switch suffix {
+		case "_total":
+			m.Counter.Value = proto.Float64(s.value)
+			m.Counter.Exemplar = s.exemplar
+		case "_created":
+			m.Counter.CreatedTimestamp = timestamp(s.value)
+		}
+	case "gauge", "stateset", "info":
+		m.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+	case "summary":
+		if m.Summary == nil {
+			m.Summary = &dto.Summary{}
+		}
+		switch suffix {
+		case "":
+			if quantile == nil {
+				return fmt.Errorf("missing quantile label: %s", s.name)
+			}
+			m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{Quantile: quantile, Value: proto.Float64(s.value)})
+		case "_count":
+			m.Summary.SampleCount = proto.Uint64(uint64(s.value))
+		case "_sum":
+			m.Summary.SampleSum = proto.Float64(s.value)
+		case "_created":
+			m.Summary.CreatedTimestamp = timestamp(s.value)
+		}
+	case "histogram", "gaugehistogram":
+		if m.Histogram == nil {
+			m.Histogram = &dto.Histogram{}
+		}
+		switch suffix {
+		case "_bucket":
+			if le == nil {
+				return fmt.Errorf("missing le label: %s", s.name)
+			}
+			m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      le,
+				CumulativeCount: proto.Uint64(uint64(s.value)),
+				Exemplar:        s.exemplar,
+			})
+		case "_count", "_gcount":
+			m.Histogram.SampleCount = proto.Uint64(uint64(s.value))
+		case "_sum", "_gsum":
+			m.Histogram.SampleSum = proto.Float64(s.value)
+		case "_created":
+			m.Histogram.CreatedTimestamp = timestamp(s.value)
+		}
+	default:
+		m.Untyped = &dto.Untyped{Value: proto.Float64(s.value)}
+	}
+	return nil
+}
+
+func (f *family) build() (*dto.MetricFamily, error) {
+	mf := &dto.MetricFamily{
+		Name: proto.String(f.name),
+		Help: f.help,
+		Unit: f.unit,
+	}
+	switch f.typ {
+	case "counter":
+		mf.Name = proto.String(f.name + "_total")
+		mf.Type = dto.MetricType_COUNTER.Enum()
+	case "gauge", "stateset":
+		mf.Type = dto.MetricType_GAUGE.Enum()
+	case "info":
+		mf.Name = proto.String(f.name + "_info")
+		mf.Type = dto.MetricType_GAUGE.Enum()
+	case "summary":
+		mf.Type = dto.MetricType_SUMMARY.Enum()
+	case "histogram":
+		mf.Type = dto.MetricType_HISTOGRAM.Enum()
+	case "gaugehistogram":
+		mf.Type = dto.MetricType_GAUGE_HISTOGRAM.Enum()
+	case "unknown":
+		mf.Type = dto.MetricType_UNTYPED.Enum()
+	default:
+		return nil, fmt.Errorf("unknown type %q of %s", f.typ, f.name)
+	}
+	for _, key := range f.order {
+		m := f.metrics[key]
+		if m.Counter != nil && m.Counter.Value == nil {
+			// A counter exposing only _created has no sample to carry
+			continue
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+	return mf, nil
+}
+
+func parseSample(line string) (sample, error) {
+	var s sample
+
+	exemplarPart := ""
+	if i := exemplarIndex(line); i >= 0 {
+		exemplarPart = line[i+3:]
+		line = line[:i]
+	}
+
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return s, fmt.Errorf("invalid sample: %s", line)
+	}
+	s.name = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return s, err
+		}
+		s.labels = labels
+		rest = rest[n:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return s, fmt.Errorf("invalid sample: %s", line)
+	}
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return s, fmt.Errorf("invalid value: %w", err)
+	}
+	s.value = value
+	if len(fields) == 2 {
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid timestamp: %w", err)
+		}
+		s.timestamp = &ts
+	}
+
+	if exemplarPart != "" {
+		exemplar, err := parseExemplar(exemplarPart)
+		if err != nil {
+			return s, err
+		}
+		s.exemplar = exemplar
+	}
+	return s, nil
+}
+
+func parseExemplar(text string) (*dto.Exemplar, error) {
+	if !strings.HasPrefix(text, "{") {
+		return nil, fmt.Errorf("invalid exemplar: %s", text)
+	}
+	labels, n, err := parseLabels(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exemplar: %w", err)
+	}
+	fields := strings.Fields(text[n:])
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid exemplar: %s", text)
+	}
+	value, err := parseFloat(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid exemplar value: %w", err)
+	}
+	exemplar := &dto.Exemplar{Label: labels, Value: proto.Float64(value)}
+	if len(fields) == 2 {
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exemplar timestamp: %w", err)
+		}
+		exemplar.Timestamp = timestamp(ts)
+	}
+	return exemplar, nil
+}
+
+// parseLabels parses a {name="value",...} block at the start of text and returns the number of bytes consumed.
+func parseLabels(text string) ([]*dto.LabelPair, int, error) {
+	var labels []*dto.LabelPair
+	i := 1
+	for {
+		if i >= len(text) {
+			return nil, 0, fmt.Errorf("unterminated labels: %s", text)
+		}
+		if text[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		eq := strings.IndexByte(text[i:], '=')
+		if eq <= 0 {
+			return nil, 0, fmt.Errorf("invalid label: %s", text[i:])
+		}
+		name := text[i : i+eq]
+		i += eq + 1
+		if i >= len(text) || text[i] != '"' {
+			return nil, 0, fmt.Errorf("unquoted label value of %s", name)
+		}
+		i++
+
+		var value strings.Builder
+		closed := false
+		for i < len(text) {
+			c := text[i]
+			if c == '\\' && i+1 < len(text) {
+				switch text[i+1] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(text[i+1])
+				}
+				i += 2
+				continue
+			}
+			i++
+			if c == '"' {
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, 0, fmt.Errorf("unterminated label value of %s", name)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value.String())})
+
+		if i < len(text) && text[i] == ',' {
+			i++
+		}
+	}
+}
+
+// exemplarIndex returns the position of the " # " that starts an exemplar, skipping any inside quoted label values, or -1.
+func exemplarIndex(line string) int {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ' ':
+			if !quoted && strings.HasPrefix(line[i:], " # ") {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parseFloat(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func timestamp(seconds float64) *timestamppb.Timestamp {
+	sec, frac := math.Modf(seconds)
+	return &timestamppb.Timestamp{Seconds: int64(sec), Nanos: int32(frac * 1e9)}
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`).Replace(s)
+}
@@ -0,0 +1,146 @@
+package openmetrics
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			"counter with exemplar and created",
+			`# HELP http_requests Total requests.
+# TYPE http_requests counter
+http_requests_total{code="200"} 1027 # {trace_id="KOO5S4vxi0o"} 0.67
+http_requests_created{code="200"} 1.6e+09
+http_requests_total{code="500"} 3
+# EOF
+`,
+			`# HELP http_requests Total requests.
+# TYPE http_requests counter
+http_requests_total{code="200"} 1027.0 # {trace_id="KOO5S4vxi0o"} 0.67
+http_requests_created{code="200"} 1.6e+09
+http_requests_total{code="500"} 3.0
+# EOF
+`,
+		},
+		{
+			"histogram with bucket exemplar",
+			`# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 8
+latency_seconds_bucket{le="1"} 10 # {trace_id="abc"} 0.5 1.6e+09
+latency_seconds_bucket{le="+Inf"} 11
+latency_seconds_count 11
+latency_seconds_sum 4.2
+# EOF
+`,
+			`# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 8
+latency_seconds_bucket{le="1.0"} 10 # {trace_id="abc"} 0.5 1.6e+09
+latency_seconds_bucket{le="+Inf"} 11
+latency_seconds_sum 4.2
+latency_seconds_count 11
+# EOF
+`,
+		},
+		{
+			"summary, gauge and metric without metadata",
+			`# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.05
+rpc_duration_seconds_sum 17
+rpc_duration_seconds_count 100
+# TYPE temperature gauge
+temperature{room="a b # c"} 21.5
+orphan 1
+# EOF
+`,
+			`# TYPE orphan unknown
+orphan 1.0
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.05
+rpc_duration_seconds_sum 17.0
+rpc_duration_seconds_count 100
+# TYPE temperature gauge
+temperature{room="a b # c"} 21.5
+# EOF
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			families, err := Parse(strings.NewReader(in))
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			names := make([]string, 0, len(families))
+			for name := range families {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			var buf bytes.Buffer
+			for _, name := range names {
+				if _, err := expfmt.MetricFamilyToOpenMetrics(&buf, families[name], expfmt.WithCreatedLines()); err != nil {
+					t.Fatalf("unexpected error: %+v", err)
+				}
+			}
+			_, _ = expfmt.FinalizeOpenMetrics(&buf)
+
+			if diff := cmp.Diff(want, buf.String()); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{
+			"missing EOF",
+			"# TYPE a gauge\na 1\n",
+		},
+		{
+			"content after EOF",
+			"# TYPE a gauge\na 1\n# EOF\nb 1\n",
+		},
+		{
+			"bucket without le",
+			"# TYPE a histogram\na_bucket 1\n# EOF\n",
+		},
+		{
+			"unterminated label value",
+			"a{b=\"c} 1\n# EOF\n",
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := Parse(strings.NewReader(in)); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type Action string
+
+const (
+	ActionReplace   Action = "replace"
+	ActionKeep      Action = "keep"
+	ActionDrop      Action = "drop"
+	ActionLabelMap  Action = "labelmap"
+	ActionLabelDrop Action = "labeldrop"
+	ActionLabelKeep Action = "labelkeep"
+)
+
+const MetricNameLabel = "__name__"
+
+// Config follows the fields of Prometheus' relabel_config.
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+type Config struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       Action   `yaml:"action"`
+}
+
+type Rule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       Action
+}
+
+func Compile(configs []Config) ([]*Rule, error) {
+	rules := make([]*Rule, 0, len(configs))
+	for i, config := range configs {
+		rule := &Rule{
+			sourceLabels: config.SourceLabels,
+			separator:    ";",
+			targetLabel:  config.TargetLabel,
+			replacement:  "$1",
+			action:       config.Action,
+		}
+		if config.Separator != nil {
+			rule.separator = *config.Separator
+		}
+		if config.Replacement != nil {
+			rule.replacement = *config.Replacement
+		}
+		if rule.action == "" {
+			rule.action = ActionReplace
+		}
+
+		regex := "(.*)"
+		if config.Regex != nil {
+			regex = *config.Regex
+		}
+		// Prometheus anchors every regex at both ends
+		compiled, err := regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: invalid regex %q: %w", i, regex, err)
+		}
+		rule.regex = compiled
+
+		switch rule.action {
+		case ActionReplace:
+			if rule.targetLabel == "" {
+				return nil, fmt.Errorf("relabel config %d: target_label is required for %s", i, rule.action)
+			}
+			if rule.targetLabel == MetricNameLabel {
+				return nil, fmt.Errorf("relabel config %d: %s cannot be rewritten", i, MetricNameLabel)
+			}
+		case ActionKeep, ActionDrop:
+			if len(rule.sourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel config %d: source_labels is required for %s", i, rule.action)
+			}
+		case ActionLabelMap, ActionLabelDrop, ActionLabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel config %d: unknown action %q", i, rule.action)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Process applies rules in order to a copy of labels and returns nil if a rule drops the series.
+// The metric name is readable as __name__ but always survives unchanged.
+func Process(labels map[string]string, rules []*Rule) map[string]string {
+	result := make(map[string]string, len(labels))
+	for name, value := range labels {
+		result[name] = value
+	}
+	name, hasName := labels[MetricNameLabel]
+
+	for _, rule := range rules {
+		values := make([]string, 0, len(rule.sourceLabels))
+		for _, sourceLabel := range rule.sourceLabels {
+			values = append(values, result[sourceLabel])
+		}
+		value := strings.Join(values, rule.separator)
+
+		switch rule.action {
+		case ActionKeep:
+			if !rule.regex.MatchString(value) {
+				return nil
+			}
+		case ActionDrop:
+			if rule.regex.MatchString(value) {
+				return nil
+			}
+		case ActionReplace:
+			indexes := rule.regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, indexes))
+			replacement := string(rule.regex.ExpandString(nil, rule.replacement, value, indexes))
+			if target == "" || target == MetricNameLabel {
+				continue
+			}
+			if replacement == "" {
+				delete(result, target)
+				continue
+			}
+			result[target] = replacement
+		case ActionLabelMap:
+			for _, n := range sortedNames(result) {
+				if rule.regex.MatchString(n) {
+					result[rule.regex.ReplaceAllString(n, rule.replacement)] = result[n]
+				}
+			}
+		case ActionLabelDrop:
+			for _, n := range sortedNames(result) {
+				if rule.regex.MatchString(n) {
+					delete(result, n)
+				}
+			}
+		case ActionLabelKeep:
+			for _, n := range sortedNames(result) {
+				if !rule.regex.MatchString(n) {
+					delete(result, n)
+				}
+			}
+		}
+	}
+
+	delete(result, MetricNameLabel)
+	if hasName {
+		result[MetricNameLabel] = name
+	}
+	return result
+}
+
+func sortedNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
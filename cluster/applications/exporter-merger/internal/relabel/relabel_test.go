@@ -0,0 +1,161 @@
+package relabel
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func p[T any](v T) *T {
+	return &v
+}
+
+func TestProcess(t *testing.T) {
+	type in struct {
+		labels  map[string]string
+		configs []Config
+	}
+
+	tests := []struct {
+		name string
+		in   in
+		want map[string]string
+	}{
+		{
+			"no rules keeps labels",
+			in{
+				labels:  map[string]string{"__name__": "up", "job": "node"},
+				configs: nil,
+			},
+			map[string]string{"__name__": "up", "job": "node"},
+		},
+		{
+			"drop matching metric name",
+			in{
+				labels:  map[string]string{"__name__": "go_goroutines"},
+				configs: []Config{{SourceLabels: []string{"__name__"}, Regex: p("go_.*"), Action: ActionDrop}},
+			},
+			nil,
+		},
+		{
+			"keep is anchored",
+			in{
+				labels:  map[string]string{"__name__": "node_cpu_seconds_total"},
+				configs: []Config{{SourceLabels: []string{"__name__"}, Regex: p("cpu"), Action: ActionKeep}},
+			},
+			nil,
+		},
+		{
+			"replace joins source labels",
+			in{
+				labels:  map[string]string{"__name__": "up", "namespace": "default", "pod": "web-0"},
+				configs: []Config{{SourceLabels: []string{"namespace", "pod"}, Separator: p("/"), TargetLabel: "instance"}},
+			},
+			map[string]string{"__name__": "up", "namespace": "default", "pod": "web-0", "instance": "default/web-0"},
+		},
+		{
+			"replace with capture group",
+			in{
+				labels:  map[string]string{"__name__": "up", "merger_url": "http://127.0.0.1:9100/metrics"},
+				configs: []Config{{SourceLabels: []string{"merger_url"}, Regex: p("https?://([^/]+)/.*"), TargetLabel: "instance", Replacement: p("$1")}},
+			},
+			map[string]string{"__name__": "up", "merger_url": "http://127.0.0.1:9100/metrics", "instance": "127.0.0.1:9100"},
+		},
+		{
+			"empty replacement deletes target",
+			in{
+				labels:  map[string]string{"__name__": "up", "instance": "a"},
+				configs: []Config{{TargetLabel: "instance", Replacement: p("")}},
+			},
+			map[string]string{"__name__": "up"},
+		},
+		{
+			"labeldrop never drops metric name",
+			in{
+				labels:  map[string]string{"__name__": "up", "instance": "a"},
+				configs: []Config{{Regex: p(".*"), Action: ActionLabelDrop}},
+			},
+			map[string]string{"__name__": "up"},
+		},
+		{
+			"labelmap copies matching labels",
+			in{
+				labels:  map[string]string{"__name__": "up", "label_team": "sre"},
+				configs: []Config{{Regex: p("label_(.+)"), Action: ActionLabelMap}},
+			},
+			map[string]string{"__name__": "up", "label_team": "sre", "team": "sre"},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			rules, err := Compile(in.configs)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			got := Process(in.labels, rules)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []Config
+		wantErr bool
+	}{
+		{
+			"replace without target label",
+			[]Config{{SourceLabels: []string{"a"}}},
+			true,
+		},
+		{
+			"replace of metric name",
+			[]Config{{SourceLabels: []string{"a"}, TargetLabel: "__name__"}},
+			true,
+		},
+		{
+			"drop without source labels",
+			[]Config{{Action: ActionDrop}},
+			true,
+		},
+		{
+			"invalid regex",
+			[]Config{{SourceLabels: []string{"a"}, Regex: p("("), Action: ActionKeep}},
+			true,
+		},
+		{
+			"unknown action",
+			[]Config{{Action: "hashmod"}},
+			true,
+		},
+		{
+			"valid",
+			[]Config{{SourceLabels: []string{"a"}, Action: ActionKeep}},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := Compile(in)
+			if (err != nil) != wantErr {
+				t.Errorf("wantErr %v, got %+v", wantErr, err)
+			}
+		})
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"os"
@@ -22,8 +24,313 @@ import (
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+
+	"exporter-merger/internal/openmetrics"
+	"exporter-merger/internal/relabel"
+)
+
+type TargetConfig struct {
+	URL            string            `yaml:"url"`
+	Labels         map[string]string `yaml:"labels"`
+	RelabelConfigs []relabel.Config  `yaml:"relabel_configs"`
+}
+
+type Config struct {
+	Targets        []TargetConfig   `yaml:"targets"`
+	RelabelConfigs []relabel.Config `yaml:"relabel_configs"`
+}
+
+type target struct {
+	url    string
+	labels map[string]string
+	rules  []*relabel.Rule
+}
+
+func loadTargets(configPath string, urls []string) ([]*target, error) {
+	var config Config
+	if configPath != "" {
+		b, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		if err := yaml.Unmarshal(b, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse config: %w", err)
+		}
+	}
+
+	globalRules, err := relabel.Compile(config.RelabelConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*target
+	seen := make(map[string]struct{})
+	for _, targetConfig := range config.Targets {
+		if targetConfig.URL == "" {
+			return nil, errors.New("target url is required")
+		}
+		if _, ok := seen[targetConfig.URL]; ok {
+			return nil, fmt.Errorf("duplicate target: %s", targetConfig.URL)
+		}
+		seen[targetConfig.URL] = struct{}{}
+
+		for name := range targetConfig.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("invalid label name for %s: %s", targetConfig.URL, name)
+			}
+		}
+		rules, err := relabel.Compile(targetConfig.RelabelConfigs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", targetConfig.URL, err)
+		}
+		targets = append(targets, &target{
+			url:    targetConfig.URL,
+			labels: targetConfig.Labels,
+			rules:  append(rules, globalRules...),
+		})
+	}
+	for _, u := range urls {
+		if _, ok := seen[u]; ok {
+			continue
+		}
+		seen[u] = struct{}{}
+		targets = append(targets, &target{
+			url:   u,
+			rules: globalRules,
+		})
+	}
+	return targets, nil
+}
+
+const (
+	conflictPolicyRename = "rename"
+	conflictPolicyDrop   = "drop"
 )
 
+const openMetricsType = "application/openmetrics-text"
+
+// scrapeAcceptHeader prefers protobuf, the only format that carries native histograms, then OpenMetrics for exemplars.
+var scrapeAcceptHeader = strings.Join([]string{
+	fmt.Sprintf("%s;proto=%s;encoding=delimited;q=0.7", expfmt.ProtoType, expfmt.ProtoProtocol),
+	fmt.Sprintf("%s;version=%s;q=0.6", openMetricsType, expfmt.OpenMetricsVersion_1_0_0),
+	fmt.Sprintf("text/plain;version=%s;q=0.5", expfmt.TextVersion),
+	"*/*;q=0.1",
+}, ",")
+
+func scrape(ctx context.Context, t *target) (map[string]*dto.MetricFamily, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", scrapeAcceptHeader)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	mediatype, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	switch mediatype {
+	case expfmt.ProtoType:
+		families := make(map[string]*dto.MetricFamily)
+		decoder := expfmt.NewDecoder(response.Body, expfmt.NewFormat(expfmt.TypeProtoDelim))
+		for {
+			family := &dto.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				if errors.Is(err, io.EOF) {
+					return families, nil
+				}
+				return nil, err
+			}
+			if _, ok := families[family.GetName()]; ok {
+				return nil, fmt.Errorf("duplicate metric family: %s", family.GetName())
+			}
+			families[family.GetName()] = family
+		}
+	case openMetricsType:
+		return openmetrics.Parse(response.Body)
+	default:
+		parser := expfmt.NewTextParser(model.UTF8Validation)
+		return parser.TextToMetricFamilies(response.Body)
+	}
+}
+
+// merger combines the families of all targets into one exposition.
+// Prometheus rejects an exposition in which a series name belongs to two families, which happens not only when one name has two types,
+// but also when the suffixed series of one family, such as a counter's foo_total or a histogram's foo_count, collide with another family.
+type merger struct {
+	families map[string]*dto.MetricFamily
+	// owners maps every series name a family may be exposed under to the name of that family
+	owners map[string]string
+	// reserved are the families of the merger itself, which no target may add series to
+	reserved       map[string]struct{}
+	conflictPolicy string
+}
+
+func newMerger(conflictPolicy string) *merger {
+	return &merger{
+		families:       make(map[string]*dto.MetricFamily),
+		owners:         make(map[string]string),
+		reserved:       make(map[string]struct{}),
+		conflictPolicy: conflictPolicy,
+	}
+}
+
+// reserve adds a family of the merger itself, which must come before any family of targets.
+func (m *merger) reserve(family *dto.MetricFamily) {
+	m.claim(family)
+	m.reserved[family.GetName()] = struct{}{}
+}
+
+func (m *merger) claim(family *dto.MetricFamily) {
+	m.families[family.GetName()] = family
+	for _, name := range seriesNames(family) {
+		m.owners[name] = family.GetName()
+	}
+}
+
+// add merges the series of family from source, renaming it after its type or dropping it when it conflicts with a family already merged.
+func (m *merger) add(family *dto.MetricFamily, source string) {
+	m.merge(family, source, m.conflictPolicy)
+}
+
+func (m *merger) merge(family *dto.MetricFamily, source string, conflictPolicy string) {
+	name := family.GetName()
+	existing, ok := m.conflicting(family)
+	if !ok {
+		m.claim(family)
+		return
+	}
+	if _, reserved := m.reserved[existing.GetName()]; !reserved && sameFamily(existing, family) {
+		existing.Metric = append(existing.Metric, family.Metric...)
+		return
+	}
+
+	if conflictPolicy == conflictPolicyRename {
+		renamed := renameForType(name, family.GetType())
+		log.Printf("warning: renaming metric family %s from %s to %s: type %s conflicts with %s of type %s", name, source, renamed, family.GetType(), existing.GetName(), existing.GetType())
+		family.Name = p(renamed)
+		m.merge(family, source, conflictPolicyDrop)
+		return
+	}
+	log.Printf("warning: dropping metric family %s from %s: type %s conflicts with %s of type %s", name, source, family.GetType(), existing.GetName(), existing.GetType())
+}
+
+// conflicting returns the merged family that shares a series name with family.
+func (m *merger) conflicting(family *dto.MetricFamily) (*dto.MetricFamily, bool) {
+	for _, name := range seriesNames(family) {
+		if owner, ok := m.owners[name]; ok {
+			return m.families[owner], true
+		}
+	}
+	return nil, false
+}
+
+// sameFamily reports whether a and b are one family, which for counters may be named with and without the _total suffix by different exposition formats.
+func sameFamily(a *dto.MetricFamily, b *dto.MetricFamily) bool {
+	if a.GetType() != b.GetType() {
+		return false
+	}
+	if a.GetType() == dto.MetricType_COUNTER {
+		return strings.TrimSuffix(a.GetName(), "_total") == strings.TrimSuffix(b.GetName(), "_total")
+	}
+	return a.GetName() == b.GetName()
+}
+
+// seriesNames returns every name the series of family may have in any of the exposition formats, the family name first.
+func seriesNames(family *dto.MetricFamily) []string {
+	name := family.GetName()
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		// OpenMetrics exposes a counter named either foo or foo_total as foo_total, and the text format as its own name
+		base := strings.TrimSuffix(name, "_total")
+		return []string{name, base, base + "_total", base + "_created"}
+	case dto.MetricType_SUMMARY:
+		return []string{name, name + "_sum", name + "_count", name + "_created"}
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		return []string{name, name + "_bucket", name + "_sum", name + "_count", name + "_created", name + "_gsum", name + "_gcount"}
+	default:
+		return []string{name}
+	}
+}
+
+func renameForType(name string, metricType dto.MetricType) string {
+	suffix := strings.ToLower(metricType.String())
+	if metricType == dto.MetricType_COUNTER {
+		if base, ok := strings.CutSuffix(name, "_total"); ok {
+			return base + "_" + suffix + "_total"
+		}
+	}
+	return name + "_" + suffix
+}
+
+// applyLabels attaches merger_url and the static labels of t to every series, then runs the relabel rules over them.
+func applyLabels(families map[string]*dto.MetricFamily, t *target) {
+	for name, family := range families {
+		kept := family.Metric[:0]
+		for _, m := range family.Metric {
+			labels := make(map[string]string, len(m.Label)+len(t.labels)+2)
+			for _, label := range m.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			for k, v := range t.labels {
+				labels[k] = v
+			}
+			labels["merger_url"] = t.url
+			labels[relabel.MetricNameLabel] = name
+
+			labels = relabel.Process(labels, t.rules)
+			if labels == nil {
+				continue
+			}
+
+			m.Label = m.Label[:0]
+			for k, v := range labels {
+				if strings.HasPrefix(k, "__") {
+					continue
+				}
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  p(k),
+					Value: p(v),
+				})
+			}
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+			kept = append(kept, m)
+		}
+		if len(kept) == 0 {
+			delete(families, name)
+			continue
+		}
+		family.Metric = kept
+	}
+}
+
+func gauge(value float64, labels map[string]string) *dto.Metric {
+	m := &dto.Metric{
+		Gauge: &dto.Gauge{Value: p(value)},
+	}
+	for k, v := range labels {
+		m.Label = append(m.Label, &dto.LabelPair{
+			Name:  p(k),
+			Value: p(v),
+		})
+	}
+	sort.Slice(m.Label, func(i, j int) bool {
+		return m.Label[i].GetName() < m.Label[j].GetName()
+	})
+	return m
+}
+
 func p[T any](v T) *T {
 	return &v
 }
@@ -76,14 +383,24 @@ func main() {
 	var lameduck time.Duration
 	var keepAlive bool
 	var url string
+	var configPath string
+	var scrapeTimeout time.Duration
+	var conflictPolicy string
 
 	flag.StringVar(&port, "port", envOrDefaultValue("MERGER_PORT", "8080"), "Server port")
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
 	flag.StringVar(&url, "url", envOrDefaultValue("MERGER_URLS", ""), "URL to scrape. Can be speficied multiple times. (ENV:MERGER_URLS,space-seperated)")
+	flag.StringVar(&configPath, "config", envOrDefaultValue("MERGER_CONFIG", ""), "Path to a YAML file with per-target labels and relabel rules")
+	flag.DurationVar(&scrapeTimeout, "scrape-timeout", envOrDefaultValue("MERGER_SCRAPE_TIMEOUT", 10*time.Second), "Timeout for scraping each target")
+	flag.StringVar(&conflictPolicy, "conflict-policy", envOrDefaultValue("MERGER_CONFLICT_POLICY", conflictPolicyRename), "What to do with a metric family whose type conflicts with one already merged (rename or drop)")
 	flag.Parse()
 
+	if conflictPolicy != conflictPolicyRename && conflictPolicy != conflictPolicyDrop {
+		log.Fatalf("unknown conflict policy: %s", conflictPolicy)
+	}
+
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = http.DefaultTransport.(*http.Transport).MaxIdleConns
 
 	var urls []string
@@ -96,71 +413,97 @@ func main() {
 		}
 	}
 
+	targets, err := loadTargets(configPath, urls)
+	if err != nil {
+		log.Fatalf("failed to load targets: %+v", err)
+	}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
-		merged := make(map[string]*dto.MetricFamily)
+		up := &dto.MetricFamily{
+			Name: p("merger_up"),
+			Help: p("Whether the last scrape of the target succeeded."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		scrapeDuration := &dto.MetricFamily{
+			Name: p("merger_scrape_duration_seconds"),
+			Help: p("Duration of the last scrape of the target."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		results := make([]map[string]*dto.MetricFamily, len(targets))
 		mutex := &sync.Mutex{}
 		wg := &sync.WaitGroup{}
 
-		for _, u := range urls {
+		for i, t := range targets {
 			wg.Go(func() {
-				request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u, nil)
-				if err != nil {
-					return
-				}
-				response, err := http.DefaultClient.Do(request)
-				if err != nil {
-					return
-				}
-				defer func() {
-					_, _ = io.Copy(io.Discard, response.Body)
-					_ = response.Body.Close()
-				}()
+				ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout)
+				defer cancel()
 
-				if response.StatusCode >= 400 {
-					return
-				}
+				start := time.Now()
+				families, err := scrape(ctx, t)
+				elapsed := time.Since(start).Seconds()
 
-				parser := expfmt.NewTextParser(model.UTF8Validation)
-				families, err := parser.TextToMetricFamilies(response.Body)
-				if err != nil {
-					return
+				labels := map[string]string{"merger_url": t.url}
+				for k, v := range t.labels {
+					labels[k] = v
 				}
-
-				for _, metric := range families {
-					for _, m := range metric.Metric {
-						m.Label = append(m.Label, &dto.LabelPair{
-							Name:  p("merger_url"),
-							Value: p(u),
-						})
-					}
+				upValue := 1.0
+				if err != nil {
+					log.Printf("failed to scrape %s: %+v", t.url, err)
+					upValue = 0
+				} else {
+					applyLabels(families, t)
 				}
 
 				mutex.Lock()
-				for name, family := range families {
-					if existing, ok := merged[name]; ok {
-						existing.Metric = append(existing.Metric, family.Metric...)
-					} else {
-						merged[name] = family
-					}
-				}
-				mutex.Unlock()
+				defer mutex.Unlock()
+				up.Metric = append(up.Metric, gauge(upValue, labels))
+				scrapeDuration.Metric = append(scrapeDuration.Metric, gauge(elapsed, labels))
+				results[i] = families
 			})
 		}
 
 		wg.Wait()
 
+		merger := newMerger(conflictPolicy)
+		if len(targets) > 0 {
+			merger.reserve(up)
+			merger.reserve(scrapeDuration)
+		}
+		// Merge in target order so that which family wins a conflict does not depend on response timing
+		for i, families := range results {
+			names := make([]string, 0, len(families))
+			for name := range families {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				merger.add(families[name], targets[i].url)
+			}
+		}
+
+		merged := merger.families
 		names := make([]string, 0, len(merged))
 		for name := range merged {
 			names = append(names, name)
 		}
 		sort.Strings(names)
 
-		w.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
-		encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		buf := &bytes.Buffer{}
 		for _, name := range names {
-			_ = encoder.Encode(merged[name])
+			// Encode each family on its own so that one the format cannot express does not truncate the rest
+			buf.Reset()
+			if err := expfmt.NewEncoder(buf, format, expfmt.WithCreatedLines()).Encode(merged[name]); err != nil {
+				log.Printf("warning: dropping metric family %s: %+v", name, err)
+				continue
+			}
+			_, _ = w.Write(buf.Bytes())
+		}
+		if closer, ok := expfmt.NewEncoder(w, format).(expfmt.Closer); ok {
+			_ = closer.Close()
 		}
 	})
 
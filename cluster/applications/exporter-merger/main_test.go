@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func family(name string, metricType dto.MetricType, series int) *dto.MetricFamily {
+	f := &dto.MetricFamily{Name: p(name), Type: metricType.Enum()}
+	for range series {
+		f.Metric = append(f.Metric, &dto.Metric{})
+	}
+	return f
+}
+
+func TestMerger(t *testing.T) {
+	type merged struct {
+		Type   dto.MetricType
+		Series int
+	}
+
+	tests := []struct {
+		name           string
+		conflictPolicy string
+		in             []*dto.MetricFamily
+		want           map[string]merged
+	}{
+		{
+			"same family is merged",
+			conflictPolicyRename,
+			[]*dto.MetricFamily{
+				family("foo", dto.MetricType_GAUGE, 1),
+				family("foo", dto.MetricType_GAUGE, 2),
+			},
+			map[string]merged{
+				"merger_up": {dto.MetricType_GAUGE, 0},
+				"foo":       {dto.MetricType_GAUGE, 3},
+			},
+		},
+		{
+			"counter with and without _total is merged",
+			conflictPolicyRename,
+			[]*dto.MetricFamily{
+				family("foo_total", dto.MetricType_COUNTER, 1),
+				family("foo", dto.MetricType_COUNTER, 1),
+			},
+			map[string]merged{
+				"merger_up": {dto.MetricType_GAUGE, 0},
+				"foo_total": {dto.MetricType_COUNTER, 2},
+			},
+		},
+		{
+			"gauge conflicting with the _total of a counter is renamed",
+			conflictPolicyRename,
+			[]*dto.MetricFamily{
+				family("foo_total", dto.MetricType_COUNTER, 1),
+				family("foo", dto.MetricType_GAUGE, 1),
+			},
+			map[string]merged{
+				"merger_up": {dto.MetricType_GAUGE, 0},
+				"foo_total": {dto.MetricType_COUNTER, 1},
+				"foo_gauge": {dto.MetricType_GAUGE, 1},
+			},
+		},
+		{
+			"counter conflicting with a gauge is renamed",
+			conflictPolicyRename,
+			[]*dto.MetricFamily{
+				family("foo", dto.MetricType_GAUGE, 1),
+				family("foo_total", dto.MetricType_COUNTER, 1),
+			},
+			map[string]merged{
+				"merger_up":         {dto.MetricType_GAUGE, 0},
+				"foo":               {dto.MetricType_GAUGE, 1},
+				"foo_counter_total": {dto.MetricType_COUNTER, 1},
+			},
+		},
+		{
+			"gauge conflicting with the _count of a histogram is dropped",
+			conflictPolicyDrop,
+			[]*dto.MetricFamily{
+				family("foo", dto.MetricType_HISTOGRAM, 1),
+				family("foo_count", dto.MetricType_GAUGE, 1),
+			},
+			map[string]merged{
+				"merger_up": {dto.MetricType_GAUGE, 0},
+				"foo":       {dto.MetricType_HISTOGRAM, 1},
+			},
+		},
+		{
+			"histograms sharing a series name are not merged",
+			conflictPolicyDrop,
+			[]*dto.MetricFamily{
+				family("foo", dto.MetricType_HISTOGRAM, 1),
+				family("foo_count", dto.MetricType_HISTOGRAM, 1),
+			},
+			map[string]merged{
+				"merger_up": {dto.MetricType_GAUGE, 0},
+				"foo":       {dto.MetricType_HISTOGRAM, 1},
+			},
+		},
+		{
+			"target exposing merger_up is renamed even with the same type",
+			conflictPolicyRename,
+			[]*dto.MetricFamily{
+				family("merger_up", dto.MetricType_GAUGE, 1),
+			},
+			map[string]merged{
+				"merger_up":       {dto.MetricType_GAUGE, 0},
+				"merger_up_gauge": {dto.MetricType_GAUGE, 1},
+			},
+		},
+		{
+			"target exposing merger_up is dropped",
+			conflictPolicyDrop,
+			[]*dto.MetricFamily{
+				family("merger_up", dto.MetricType_GAUGE, 1),
+			},
+			map[string]merged{
+				"merger_up": {dto.MetricType_GAUGE, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMerger(tt.conflictPolicy)
+			m.reserve(family("merger_up", dto.MetricType_GAUGE, 0))
+			for _, f := range tt.in {
+				m.add(f, "http://127.0.0.1/metrics")
+			}
+
+			got := make(map[string]merged, len(m.families))
+			for name, f := range m.families {
+				got[name] = merged{f.GetType(), len(f.Metric)}
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+type tokenReviewResult struct {
+	username  string
+	expiresAt time.Time
+}
+
+// TokenReviewer authenticates bearer tokens with the TokenReview API, remembering the result for a while
+// so that a burst of requests with the same token reaches the API server once.
+type TokenReviewer struct {
+	URL       string
+	Audiences []string
+	TokenFile string
+	Client    *http.Client
+	CacheTTL  time.Duration
+
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]tokenReviewResult
+}
+
+func (t *TokenReviewer) Review(ctx context.Context, token string) (string, error) {
+	digest := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	t.mutex.Lock()
+	if result, ok := t.cache[digest]; ok && now.Before(result.expiresAt) {
+		t.mutex.Unlock()
+		return result.username, nil
+	}
+	t.mutex.Unlock()
+
+	serviceAccountToken, err := os.ReadFile(t.TokenFile)
+	if err != nil {
+		return "", xerrors.Errorf("failed to read service account token: %w", err)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenReview",
+		"spec": map[string]any{
+			"token":     token,
+			"audiences": t.Audiences,
+		},
+	})
+	if err != nil {
+		return "", xerrors.Errorf("failed to marshal TokenReview: %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", xerrors.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(serviceAccountToken)))
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := t.Client.Do(request)
+	if err != nil {
+		return "", xerrors.Errorf("failed to request TokenReview: %w", err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+		return "", xerrors.Errorf("TokenReview returned %d", response.StatusCode)
+	}
+
+	var review struct {
+		Status struct {
+			Authenticated bool   `json:"authenticated"`
+			Error         string `json:"error"`
+			User          struct {
+				Username string `json:"username"`
+			} `json:"user"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&review); err != nil {
+		return "", xerrors.Errorf("failed to decode TokenReview: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return "", xerrors.Errorf("token is not authenticated: %s", review.Status.Error)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.cache == nil {
+		t.cache = make(map[[sha256.Size]byte]tokenReviewResult)
+	}
+	for k, result := range t.cache {
+		if now.After(result.expiresAt) {
+			delete(t.cache, k)
+		}
+	}
+	t.cache[digest] = tokenReviewResult{
+		username:  review.Status.User.Username,
+		expiresAt: now.Add(t.CacheTTL),
+	}
+	return review.Status.User.Username, nil
+}
+
+// MatchGlob matches s against a pattern where * matches any sequence and ? any single byte.
+func MatchGlob(pattern string, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func MatchAnyGlob(patterns []string, s string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return MatchGlob(pattern, s)
+	})
+}
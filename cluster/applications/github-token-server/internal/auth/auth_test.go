@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		in      string
+		want    bool
+	}{
+		{"exact", "system:serviceaccount:app:job", "system:serviceaccount:app:job", true},
+		{"prefix", "system:serviceaccount:app:*", "system:serviceaccount:app:job", true},
+		{"other namespace", "system:serviceaccount:app:*", "system:serviceaccount:other:job", false},
+		{"star in the middle", "repo-*-server", "repo-token-server", true},
+		{"backtracking", "a*b*c", "aXbYbZc", true},
+		{"question mark", "job-?", "job-1", true},
+		{"question mark needs a byte", "job-?", "job-", false},
+		{"empty pattern", "", "a", false},
+		{"star matches empty", "*", "", true},
+		{"longer input", "abc", "abcd", false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		pattern := tt.pattern
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := MatchGlob(pattern, in); got != want {
+				t.Errorf("MatchGlob(%q, %q) = %v, want %v", pattern, in, got, want)
+			}
+		})
+	}
+}
+
+func TestTokenReviewer_Review(t *testing.T) {
+	var reviews atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews.Add(1)
+		if r.Header.Get("Authorization") != "Bearer service-account-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var review struct {
+			Spec struct {
+				Token     string   `json:"token"`
+				Audiences []string `json:"audiences"`
+			} `json:"spec"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&review)
+
+		w.WriteHeader(http.StatusCreated)
+		if review.Spec.Token == "valid-token" && len(review.Spec.Audiences) == 1 && review.Spec.Audiences[0] == "github-token-server" {
+			_, _ = w.Write([]byte(`{"status": {"authenticated": true, "user": {"username": "system:serviceaccount:app:job"}}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": {"authenticated": false, "error": "invalid token"}}`))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("service-account-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reviewer := &TokenReviewer{
+		URL:       server.URL,
+		Audiences: []string{"github-token-server"},
+		TokenFile: tokenFile,
+		Client:    server.Client(),
+		CacheTTL:  time.Minute,
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		want        string
+		wantErr     bool
+		wantReviews int64
+	}{
+		{"authenticated", "valid-token", "system:serviceaccount:app:job", false, 1},
+		{"cached", "valid-token", "system:serviceaccount:app:job", false, 1},
+		{"unauthenticated", "invalid-token", "", true, 2},
+		{"unauthenticated is not cached", "invalid-token", "", true, 3},
+	}
+
+	for _, tt := range tests {
+		got, err := reviewer.Review(context.Background(), tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if got != tt.want || reviews.Load() != tt.wantReviews {
+			t.Errorf("%s: got %q after %d reviews, want %q after %d", tt.name, got, reviews.Load(), tt.want, tt.wantReviews)
+		}
+	}
+
+	reviewer.TokenFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := reviewer.Review(context.Background(), "other-token"); err == nil {
+		t.Error("reviewed a token without a service account token")
+	}
+}
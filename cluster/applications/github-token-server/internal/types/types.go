@@ -1,6 +1,15 @@
 package types
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github-token-server/internal/auth"
+
+	"gopkg.in/yaml.v3"
+)
 
 type Body struct {
 	Repositories  []string          `json:"repositories,omitempty"`
@@ -8,33 +17,212 @@ type Body struct {
 	Permissions   map[string]string `json:"permissions,omitempty"`
 }
 
-type profile = string
+// Permissions maps a permission of a GitHub App to read, write or admin.
+// https://docs.github.com/en/rest/apps/apps#create-an-installation-access-token-for-an-app
+type Permissions = map[string]string
 
-const (
-	Reader               profile = "reader"
-	Writer                       = "writer"
-	AdministrationReader         = "administration-reader"
-)
+// PermissionNames are the permissions of a GitHub App a token may ask for.
+var PermissionNames = []string{
+	"actions",
+	"administration",
+	"attestations",
+	"checks",
+	"codespaces",
+	"contents",
+	"dependabot_secrets",
+	"deployments",
+	"environments",
+	"issues",
+	"merge_queues",
+	"metadata",
+	"packages",
+	"pages",
+	"pull_requests",
+	"repository_custom_properties",
+	"repository_hooks",
+	"repository_projects",
+	"secret_scanning_alerts",
+	"secrets",
+	"security_events",
+	"single_file",
+	"statuses",
+	"vulnerability_alerts",
+	"workflows",
+	"members",
+	"organization_administration",
+	"organization_announcement_banners",
+	"organization_copilot_seat_management",
+	"organization_custom_org_roles",
+	"organization_custom_properties",
+	"organization_custom_roles",
+	"organization_events",
+	"organization_hooks",
+	"organization_packages",
+	"organization_personal_access_token_requests",
+	"organization_personal_access_tokens",
+	"organization_plan",
+	"organization_projects",
+	"organization_secrets",
+	"organization_self_hosted_runners",
+	"organization_user_blocking",
+	"team_discussions",
+}
+
+// PermissionLevels are the levels a permission may be granted with.
+var PermissionLevels = []string{"read", "write", "admin"}
+
+// MaxRepositories is the most repositories GitHub issues one token for.
+const MaxRepositories = 500
+
+func validatePermissions(permissions Permissions) error {
+	for name, level := range permissions {
+		if !slices.Contains(PermissionNames, name) {
+			return fmt.Errorf("unknown permission: %s", name)
+		}
+		if !slices.Contains(PermissionLevels, level) {
+			return fmt.Errorf("unknown level of %s: %s", name, level)
+		}
+	}
+	return nil
+}
+
+// DefaultProfiles are used when no config file is given, or it has no profiles.
+var DefaultProfiles = map[string]Permissions{
+	"reader": {
+		"contents": "read",
+		"metadata": "read",
+	},
+	"writer": {
+		"contents": "write",
+		"issues":   "write",
+		"metadata": "read",
+	},
+	"administration-reader": {
+		"administration": "read",
+	},
+}
+
+// AnyProfile in Rule.Profiles also allows the routes without a profile, where the caller chooses permissions.
+const AnyProfile = "*"
+
+// Rule lets any of Identities issue tokens of any of Profiles for the repositories of Owners matching Repositories.
+type Rule struct {
+	// Identities are globs of usernames verified by TokenReview, e.g. system:serviceaccount:<namespace>:<name>.
+	Identities []string `yaml:"identities"`
+	// Owners are globs of users or organizations.
+	Owners []string `yaml:"owners"`
+	// Repositories are globs every repository of a token must match. A token for every repository of an owner
+	// is allowed only by "*".
+	Repositories []string `yaml:"repositories"`
+	Profiles     []string `yaml:"profiles"`
+}
+
+type Config struct {
+	Profiles map[string]Permissions `yaml:"profiles"`
+	Rules    []Rule                 `yaml:"rules"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	if config.Profiles == nil {
+		config.Profiles = DefaultProfiles
+	}
+	for name, permissions := range config.Profiles {
+		if name == AnyProfile {
+			return nil, fmt.Errorf("profile must not be named %s", AnyProfile)
+		}
+		if len(permissions) == 0 {
+			return nil, fmt.Errorf("profile %s has no permissions", name)
+		}
+		if err := validatePermissions(permissions); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	for i, rule := range config.Rules {
+		if len(rule.Identities) == 0 || len(rule.Owners) == 0 || len(rule.Profiles) == 0 {
+			return nil, fmt.Errorf("rules[%d]: identities, owners and profiles must not be empty", i)
+		}
+		for _, p := range rule.Profiles {
+			if _, ok := config.Profiles[p]; !ok && p != AnyProfile {
+				return nil, fmt.Errorf("rules[%d]: unknown profile: %s", i, p)
+			}
+		}
+	}
+
+	return &config, nil
+}
+
+func (r *Rule) allowsRepository(repository string) bool {
+	// "*" stands for every repository here, so only a rule allowing every repository matches it.
+	if repository == "*" {
+		return slices.Contains(r.Repositories, "*")
+	}
+	return auth.MatchAnyGlob(r.Repositories, repository)
+}
+
+// Authorize reports whether identity may issue a token of profile for repositories of owner.
+// An empty profile is a request with its own permissions, and no repositories means every repository of owner.
+func (c *Config) Authorize(identity string, owner string, repositories []string, profile string) bool {
+	if profile == "" {
+		profile = AnyProfile
+	}
+	if len(repositories) == 0 {
+		repositories = []string{"*"}
+	}
 
-func (b *Body) ResolveProfile(p profile) error {
-	switch p {
-	case Reader:
-		b.Permissions = map[string]string{
-			"contents": "read",
-			"metadata": "read",
+	for _, rule := range c.Rules {
+		if !auth.MatchAnyGlob(rule.Identities, identity) || !auth.MatchAnyGlob(rule.Owners, owner) {
+			continue
 		}
-	case Writer:
-		b.Permissions = map[string]string{
-			"contents": "write",
-			"issues":   "write",
-			"metadata": "read",
+		if !slices.Contains(rule.Profiles, profile) && !slices.Contains(rule.Profiles, AnyProfile) {
+			continue
 		}
-	case AdministrationReader:
-		b.Permissions = map[string]string{
-			"administration": "read",
+		if slices.ContainsFunc(repositories, func(repository string) bool {
+			return !rule.allowsRepository(repository)
+		}) {
+			continue
 		}
-	default:
+		return true
+	}
+	return false
+}
+
+func (b *Body) ResolveProfile(profiles map[string]Permissions, p string) error {
+	permissions, ok := profiles[p]
+	if !ok {
 		return fmt.Errorf("unknown profile: %s", p)
 	}
+	b.Permissions = permissions
+	return nil
+}
+
+// Canonicalize validates b and sorts and deduplicates its repositories, so that the same token is asked for by
+// the same body whatever order it came in.
+func (b *Body) Canonicalize() error {
+	if err := validatePermissions(b.Permissions); err != nil {
+		return err
+	}
+	for _, repository := range b.Repositories {
+		if repository == "" || strings.ContainsAny(repository, "/*") {
+			return fmt.Errorf("invalid repository: %q", repository)
+		}
+	}
+	if len(b.Repositories)+len(b.RepositoryIds) > MaxRepositories {
+		return fmt.Errorf("more than %d repositories", MaxRepositories)
+	}
+
+	slices.Sort(b.Repositories)
+	b.Repositories = slices.Compact(b.Repositories)
+	slices.Sort(b.RepositoryIds)
+	b.RepositoryIds = slices.Compact(b.RepositoryIds)
 	return nil
 }
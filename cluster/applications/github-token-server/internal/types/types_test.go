@@ -0,0 +1,163 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestConfig_Authorize(t *testing.T) {
+	config := &Config{
+		Profiles: DefaultProfiles,
+		Rules: []Rule{
+			{
+				Identities:   []string{"system:serviceaccount:ci:*"},
+				Owners:       []string{"kaidotio"},
+				Repositories: []string{"hippocampus", "tools-*"},
+				Profiles:     []string{"reader", "writer"},
+			},
+			{
+				Identities:   []string{"system:serviceaccount:ops:admin"},
+				Owners:       []string{"*"},
+				Repositories: []string{"*"},
+				Profiles:     []string{AnyProfile},
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		identity     string
+		owner        string
+		repositories []string
+		profile      string
+		want         bool
+	}{
+		{"allowed", "system:serviceaccount:ci:job", "kaidotio", []string{"hippocampus"}, "reader", true},
+		{"repository glob", "system:serviceaccount:ci:job", "kaidotio", []string{"tools-cli", "hippocampus"}, "writer", true},
+		{"one repository outside", "system:serviceaccount:ci:job", "kaidotio", []string{"hippocampus", "secrets"}, "reader", false},
+		{"every repository", "system:serviceaccount:ci:job", "kaidotio", nil, "reader", false},
+		{"repository named *", "system:serviceaccount:ci:job", "kaidotio", []string{"*"}, "reader", false},
+		{"other owner", "system:serviceaccount:ci:job", "someone", []string{"hippocampus"}, "reader", false},
+		{"other profile", "system:serviceaccount:ci:job", "kaidotio", []string{"hippocampus"}, "administration-reader", false},
+		{"own permissions", "system:serviceaccount:ci:job", "kaidotio", []string{"hippocampus"}, "", false},
+		{"other identity", "system:serviceaccount:app:job", "kaidotio", []string{"hippocampus"}, "reader", false},
+		{"any profile and every repository", "system:serviceaccount:ops:admin", "someone", nil, "administration-reader", true},
+		{"own permissions with any profile", "system:serviceaccount:ops:admin", "someone", []string{"a"}, "", true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		identity := tt.identity
+		owner := tt.owner
+		repositories := tt.repositories
+		profile := tt.profile
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := config.Authorize(identity, owner, repositories, profile); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		wantProfiles map[string]Permissions
+		wantErr      bool
+	}{
+		{
+			"default profiles",
+			"rules:\n  - identities: [a]\n    owners: [kaidotio]\n    profiles: [reader]\n",
+			DefaultProfiles,
+			false,
+		},
+		{
+			"own profiles",
+			"profiles:\n  packages-reader:\n    packages: read\nrules:\n  - identities: [a]\n    owners: [kaidotio]\n    profiles: [packages-reader, '*']\n",
+			map[string]Permissions{"packages-reader": {"packages": "read"}},
+			false,
+		},
+		{"unknown profile", "rules:\n  - identities: [a]\n    owners: [kaidotio]\n    profiles: [deployer]\n", nil, true},
+		{"profile named *", "profiles:\n  '*':\n    contents: read\n", nil, true},
+		{"profile without permissions", "profiles:\n  empty: {}\n", nil, true},
+		{"unknown permission", "profiles:\n  root:\n    everything: admin\n", nil, true},
+		{"unknown level", "profiles:\n  reader:\n    contents: all\n", nil, true},
+		{"rule without owners", "rules:\n  - identities: [a]\n    profiles: [reader]\n", nil, true},
+		{"invalid YAML", "rules: [", nil, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		config := tt.config
+		wantProfiles := tt.wantProfiles
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadConfig(path)
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(wantProfiles, got.Profiles); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBody_Canonicalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    Body
+		want    Body
+		wantErr bool
+	}{
+		{
+			"sorted and deduplicated",
+			Body{Repositories: []string{"b", "a", "b"}, RepositoryIds: []int{3, 1, 3}, Permissions: Permissions{"contents": "read"}},
+			Body{Repositories: []string{"a", "b"}, RepositoryIds: []int{1, 3}, Permissions: Permissions{"contents": "read"}},
+			false,
+		},
+		{"empty", Body{}, Body{}, false},
+		{"unknown permission", Body{Permissions: Permissions{"everything": "read"}}, Body{}, true},
+		{"unknown level", Body{Permissions: Permissions{"contents": "owner"}}, Body{}, true},
+		{"repository with owner", Body{Repositories: []string{"kaidotio/hippocampus"}}, Body{}, true},
+		{"repository glob", Body{Repositories: []string{"*"}}, Body{}, true},
+		{"too many repositories", Body{RepositoryIds: make([]int, MaxRepositories+1)}, Body{}, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		body := tt.body
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			err := body.Canonicalize()
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(want, body); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"github-token-server/internal/auth"
+	"github-token-server/internal/swr"
 	"github-token-server/internal/types"
 	"io"
 	"log"
@@ -22,6 +25,8 @@ import (
 	"runtime/debug"
 	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -47,6 +52,9 @@ import (
 	"golang.org/x/xerrors"
 )
 
+const KubernetesServiceAccountCaCert = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+const KubernetesServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
 func envOrDefaultValue[T any](key string, defaultValue T) T {
 	value, exists := os.LookupEnv(key)
 	if !exists {
@@ -156,6 +164,234 @@ func (m *myRouter) middleware(pattern string, next http.Handler) http.Handler {
 
 var Debug = false
 
+// GitHubError is a response of the GitHub API passed on to the caller as it is.
+type GitHubError struct {
+	StatusCode int
+	Body       []byte
+	RetryAfter time.Duration
+}
+
+func (e *GitHubError) Error() string {
+	return fmt.Sprintf("GitHub returned %d: %s", e.StatusCode, e.Body)
+}
+
+func writeGitHubError(w http.ResponseWriter, err error) {
+	var gitHubError *GitHubError
+	if !errors.As(err, &gitHubError) {
+		slog.Error("failed to call GitHub", "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	if gitHubError.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(gitHubError.RetryAfter.Round(time.Second).Seconds())))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(gitHubError.StatusCode)
+	_, _ = w.Write(gitHubError.Body)
+}
+
+// GitHub calls the GitHub API as the App. It exports X-RateLimit-* and, once throttled,
+// answers 429 itself until GitHub allows requests again.
+type GitHub struct {
+	Client     *http.Client
+	ClientID   string
+	PrivateKey string
+
+	RateLimitLimit     metric.Int64Gauge
+	RateLimitRemaining metric.Int64Gauge
+	RateLimitReset     metric.Int64Gauge
+	ThrottledRequests  metric.Int64Counter
+
+	mutex        sync.Mutex
+	blockedUntil time.Time
+}
+
+func (g *GitHub) Do(ctx context.Context, method string, url string, body []byte) ([]byte, error) {
+	g.mutex.Lock()
+	blockedFor := time.Until(g.blockedUntil)
+	g.mutex.Unlock()
+	if blockedFor > 0 {
+		return nil, &GitHubError{
+			StatusCode: http.StatusTooManyRequests,
+			Body:       []byte(`{"message":"rate limited by GitHub"}`),
+			RetryAfter: blockedFor,
+		}
+	}
+
+	err, jwtToken := signJwt(g.PrivateKey, g.ClientID)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to sign jwt: %w", err)
+	}
+
+	var requestBody io.Reader
+	if body != nil {
+		requestBody = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, requestBody)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *jwtToken))
+	request.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	response, err := g.Client.Do(request)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to do request: %w", err)
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+
+	g.recordRateLimit(ctx, response)
+
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read response: %w", err)
+	}
+
+	if response.StatusCode >= 400 {
+		gitHubError := &GitHubError{
+			StatusCode: response.StatusCode,
+			Body:       b,
+		}
+		if until, ok := throttledUntil(response); ok {
+			g.mutex.Lock()
+			if until.After(g.blockedUntil) {
+				g.blockedUntil = until
+			}
+			g.mutex.Unlock()
+			g.ThrottledRequests.Add(ctx, 1)
+			gitHubError.RetryAfter = time.Until(until)
+			slog.Warn("throttled by GitHub", "until", until)
+		}
+		return nil, gitHubError
+	}
+
+	return b, nil
+}
+
+func (g *GitHub) recordRateLimit(ctx context.Context, response *http.Response) {
+	attributes := metric.WithAttributes(attribute.Key("resource").String(response.Header.Get("X-RateLimit-Resource")))
+	for header, gauge := range map[string]metric.Int64Gauge{
+		"X-RateLimit-Limit":     g.RateLimitLimit,
+		"X-RateLimit-Remaining": g.RateLimitRemaining,
+		"X-RateLimit-Reset":     g.RateLimitReset,
+	} {
+		if v, err := strconv.ParseInt(response.Header.Get(header), 10, 64); err == nil {
+			gauge.Record(ctx, v, attributes)
+		}
+	}
+}
+
+// throttledUntil tells whether a response is a primary or secondary rate limit, and when to try again.
+// https://docs.github.com/en/rest/using-the-rest-api/rate-limits-for-the-rest-api#exceeding-the-rate-limit
+func throttledUntil(response *http.Response) (time.Time, bool) {
+	if response.StatusCode != http.StatusForbidden && response.StatusCode != http.StatusTooManyRequests {
+		return time.Time{}, false
+	}
+
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second), true
+	}
+	if response.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(response.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Unix(reset, 0), true
+		}
+	}
+	if response.StatusCode == http.StatusTooManyRequests {
+		// Secondary rate limits without Retry-After ask to wait at least a minute
+		return time.Now().Add(time.Minute), true
+	}
+	return time.Time{}, false
+}
+
+// AccessToken is an installation access token as GitHub returned it.
+type AccessToken struct {
+	Body         []byte
+	ExpiresAt    time.Time
+	Permissions  map[string]string
+	Repositories []string
+}
+
+func newAccessToken(body []byte) (*AccessToken, error) {
+	response := struct {
+		ExpiresAt    time.Time         `json:"expires_at"`
+		Permissions  map[string]string `json:"permissions"`
+		Repositories []struct {
+			FullName string `json:"full_name"`
+		} `json:"repositories"`
+	}{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, xerrors.Errorf("failed to decode access token: %w", err)
+	}
+
+	accessToken := &AccessToken{
+		Body:        body,
+		ExpiresAt:   response.ExpiresAt,
+		Permissions: response.Permissions,
+	}
+	for _, repository := range response.Repositories {
+		accessToken.Repositories = append(accessToken.Repositories, repository.FullName)
+	}
+	return accessToken, nil
+}
+
+// AccessTokens mints installation access tokens and caches them per installation and canonical body until they expire.
+type AccessTokens struct {
+	GitHub        *GitHub
+	Timeout       time.Duration
+	RefreshBefore time.Duration
+	ExpiryMargin  time.Duration
+
+	cache *swr.Cache[*AccessToken]
+}
+
+// Get returns a token of installationID for body, which must be a canonical types.Body.
+func (a *AccessTokens) Get(installationID int64, body []byte) (*AccessToken, error) {
+	// The fetch may outlive the request to refresh in the background, so it uses its own context
+	return a.cache.Get(fmt.Sprintf("%d %s", installationID, body), func() (swr.FetchResult[*AccessToken], error) {
+		ctx, cancel := context.WithTimeout(context.Background(), a.Timeout)
+		defer cancel()
+
+		response, err := a.GitHub.Do(ctx, http.MethodPost, fmt.Sprintf("https://api.github.com/app/installations/%d/access_tokens", installationID), body)
+		if err != nil {
+			return swr.FetchResult[*AccessToken]{}, err
+		}
+
+		accessToken, err := newAccessToken(response)
+		if err != nil {
+			return swr.FetchResult[*AccessToken]{}, err
+		}
+		slog.Info("minted token",
+			"installation", installationID,
+			"permissions", accessToken.Permissions,
+			"repositories", accessToken.Repositories,
+			"expires_at", accessToken.ExpiresAt,
+		)
+
+		// A token is refreshed in the background once it is stale, and never served once it expires here
+		lifetime := time.Until(accessToken.ExpiresAt)
+		expireAfter := max(lifetime-a.ExpiryMargin, 0)
+		return swr.FetchResult[*AccessToken]{
+			Value:       accessToken,
+			StaleAfter:  min(max(lifetime-a.RefreshBefore, 0), expireAfter),
+			ExpireAfter: expireAfter,
+		}, nil
+	})
+}
+
+// decodeBody reads a body of the routes without a profile. An empty body asks for the permissions of the installation.
+func decodeBody(r *http.Request) (*types.Body, error) {
+	var m types.Body
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return &m, nil
+}
+
 func main() {
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = http.DefaultTransport.(*http.Transport).MaxIdleConns
 
@@ -170,6 +406,14 @@ func main() {
 	var maxConnections int
 	var clientId string
 	var privateKey string
+	var configFile string
+	var tokenReviewURL string
+	var tokenReviewAudiences string
+	var tokenReviewCacheTTL time.Duration
+	var installationCacheTTL time.Duration
+	var tokenRefreshBefore time.Duration
+	var tokenExpiryMargin time.Duration
+	var githubTimeout time.Duration
 	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
 
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
@@ -179,6 +423,14 @@ func main() {
 
 	flag.StringVar(&clientId, "client-id", envOrDefaultValue("CLIENT_ID", ""), "Client ID of the GitHub App")
 	flag.StringVar(&privateKey, "private-key", envOrDefaultValue("PRIVATE_KEY", ""), "Private key of the GitHub App")
+	flag.StringVar(&configFile, "config-file", envOrDefaultValue("CONFIG_FILE", ""), "Path to the config of profiles and the policy of callers. Without it, the default profiles are served to anyone.")
+	flag.StringVar(&tokenReviewURL, "token-review-url", envOrDefaultValue("TOKEN_REVIEW_URL", "https://kubernetes.default.svc.cluster.local/apis/authentication.k8s.io/v1/tokenreviews"), "TokenReview API to authenticate callers with")
+	flag.StringVar(&tokenReviewAudiences, "token-review-audiences", envOrDefaultValue("TOKEN_REVIEW_AUDIENCES", ""), "Comma-separated audiences a caller token must have. Default is the audience of the API server.")
+	flag.DurationVar(&tokenReviewCacheTTL, "token-review-cache-ttl", envOrDefaultValue("TOKEN_REVIEW_CACHE_TTL", 10*time.Second), "How long a TokenReview result is cached")
+	flag.DurationVar(&installationCacheTTL, "installation-cache-ttl", envOrDefaultValue("INSTALLATION_CACHE_TTL", 1*time.Hour), "How long an installation ID is served before it is looked up again in the background. It is served at most twice as long.")
+	flag.DurationVar(&tokenRefreshBefore, "token-refresh-before", envOrDefaultValue("TOKEN_REFRESH_BEFORE", 15*time.Minute), "Mint a new token in the background once a cached one expires within this")
+	flag.DurationVar(&tokenExpiryMargin, "token-expiry-margin", envOrDefaultValue("TOKEN_EXPIRY_MARGIN", 5*time.Minute), "Never serve a cached token that expires within this")
+	flag.DurationVar(&githubTimeout, "github-timeout", envOrDefaultValue("GITHUB_TIMEOUT", 30*time.Second), "Timeout of a request to GitHub")
 	flag.Parse()
 
 	ctx := context.Background()
@@ -256,160 +508,244 @@ func main() {
 		logger = slog.New(slog.NewTextHandler(os.Stderr, handlerOpts))
 	}
 
+	profiles := types.DefaultProfiles
+	var config *types.Config
+	var tokenReviewer *auth.TokenReviewer
+	if configFile != "" {
+		config, err = types.LoadConfig(configFile)
+		if err != nil {
+			log.Fatalf("failed to load config: %+v", err)
+		}
+		profiles = config.Profiles
+
+		caCert, err := os.ReadFile(KubernetesServiceAccountCaCert)
+		if err != nil {
+			log.Fatalf("failed to read CA certificate: %+v", err)
+		}
+		transport := &http.Transport{
+			MaxIdleConnsPerHost: http.DefaultTransport.(*http.Transport).MaxIdleConns,
+			TLSClientConfig: &tls.Config{
+				RootCAs: x509.NewCertPool(),
+			},
+		}
+		transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(caCert)
+
+		var audiences []string
+		for _, audience := range strings.Split(tokenReviewAudiences, ",") {
+			if audience = strings.TrimSpace(audience); audience != "" {
+				audiences = append(audiences, audience)
+			}
+		}
+		tokenReviewer = &auth.TokenReviewer{
+			URL:       tokenReviewURL,
+			Audiences: audiences,
+			TokenFile: KubernetesServiceAccountToken,
+			Client: &http.Client{
+				Transport: transport,
+				Timeout:   10 * time.Second,
+			},
+			CacheTTL: tokenReviewCacheTTL,
+		}
+	} else {
+		logger.Warn("no config file, so any caller can issue tokens of the default profiles")
+	}
+
+	rateLimitLimit, err := meter.Int64Gauge("github_rate_limit_limit")
+	if err != nil {
+		log.Fatalf("failed to create gauge: %+v", err)
+	}
+	rateLimitRemaining, err := meter.Int64Gauge("github_rate_limit_remaining")
+	if err != nil {
+		log.Fatalf("failed to create gauge: %+v", err)
+	}
+	rateLimitReset, err := meter.Int64Gauge("github_rate_limit_reset")
+	if err != nil {
+		log.Fatalf("failed to create gauge: %+v", err)
+	}
+	throttledRequests, err := meter.Int64Counter("github_throttled_requests")
+	if err != nil {
+		log.Fatalf("failed to create counter: %+v", err)
+	}
+	gitHub := &GitHub{
+		Client:             &http.Client{},
+		ClientID:           clientId,
+		PrivateKey:         privateKey,
+		RateLimitLimit:     rateLimitLimit,
+		RateLimitRemaining: rateLimitRemaining,
+		RateLimitReset:     rateLimitReset,
+		ThrottledRequests:  throttledRequests,
+	}
+	installations := swr.New[int64]()
+	accessTokens := &AccessTokens{
+		GitHub:        gitHub,
+		Timeout:       githubTimeout,
+		RefreshBefore: tokenRefreshBefore,
+		ExpiryMargin:  tokenExpiryMargin,
+		cache:         swr.New[*AccessToken](),
+	}
+
 	mux := myRouter{http.NewServeMux(), logger, httpRequestsDurationMicroSeconds, []Middleware{}}
 	routes := []struct {
 		pattern                  string
+		ownerGenerator           func(r *http.Request) string
 		installationURLGenerator func(r *http.Request) string
-		bodyGenerator            func(r *http.Request) (io.ReadCloser, error)
+		bodyGenerator            func(r *http.Request) (*types.Body, error)
 	}{
 		{"POST /users/{username}/access_tokens/{profile}", func(r *http.Request) string {
+			return r.PathValue("username")
+		}, func(r *http.Request) string {
 			return fmt.Sprintf("https://api.github.com/users/%s/installation", r.PathValue("username"))
-		}, func(r *http.Request) (io.ReadCloser, error) {
+		}, func(r *http.Request) (*types.Body, error) {
 			var m types.Body
-			if err := m.ResolveProfile(r.PathValue("profile")); err != nil {
+			if err := m.ResolveProfile(profiles, r.PathValue("profile")); err != nil {
 				return nil, err
 			}
-
-			b, err := json.Marshal(m)
-			if err != nil {
-				return r.Body, nil
-			}
-			return io.NopCloser(bytes.NewReader(b)), nil
+			return &m, nil
 		}},
 		{"POST /users/{username}/access_tokens", func(r *http.Request) string {
+			return r.PathValue("username")
+		}, func(r *http.Request) string {
 			return fmt.Sprintf("https://api.github.com/users/%s/installation", r.PathValue("username"))
-		}, func(r *http.Request) (io.ReadCloser, error) {
-			return r.Body, nil
-		}},
+		}, decodeBody},
 		{"POST /orgs/{org}/access_tokens/{profile}", func(r *http.Request) string {
+			return r.PathValue("org")
+		}, func(r *http.Request) string {
 			return fmt.Sprintf("https://api.github.com/orgs/%s/installation", r.PathValue("org"))
-		}, func(r *http.Request) (io.ReadCloser, error) {
+		}, func(r *http.Request) (*types.Body, error) {
 			var m types.Body
-			if err := m.ResolveProfile(r.PathValue("profile")); err != nil {
+			if err := m.ResolveProfile(profiles, r.PathValue("profile")); err != nil {
 				return nil, err
 			}
-
-			b, err := json.Marshal(m)
-			if err != nil {
-				return r.Body, nil
-			}
-			return io.NopCloser(bytes.NewReader(b)), nil
+			return &m, nil
 		}},
 		{"POST /orgs/{org}/access_tokens", func(r *http.Request) string {
+			return r.PathValue("org")
+		}, func(r *http.Request) string {
 			return fmt.Sprintf("https://api.github.com/orgs/%s/installation", r.PathValue("org"))
-		}, func(r *http.Request) (io.ReadCloser, error) {
-			return r.Body, nil
-		}},
+		}, decodeBody},
 		{"POST /repos/{owner}/{repo}/access_tokens/{profile}", func(r *http.Request) string {
+			return r.PathValue("owner")
+		}, func(r *http.Request) string {
 			return fmt.Sprintf("https://api.github.com/repos/%s/%s/installation", r.PathValue("owner"), r.PathValue("repo"))
-		}, func(r *http.Request) (io.ReadCloser, error) {
+		}, func(r *http.Request) (*types.Body, error) {
 			var m types.Body
-			if err := m.ResolveProfile(r.PathValue("profile")); err != nil {
+			if err := m.ResolveProfile(profiles, r.PathValue("profile")); err != nil {
 				return nil, err
 			}
 
 			// Restrict the repositories that the token can access
 			m.Repositories = []string{r.PathValue("repo")}
-
-			b, err := json.Marshal(m)
-			if err != nil {
-				return r.Body, nil
-			}
-			return io.NopCloser(bytes.NewReader(b)), nil
+			return &m, nil
 		}},
 		{"POST /repos/{owner}/{repo}/access_tokens", func(r *http.Request) string {
+			return r.PathValue("owner")
+		}, func(r *http.Request) string {
 			return fmt.Sprintf("https://api.github.com/repos/%s/%s/installation", r.PathValue("owner"), r.PathValue("repo"))
-		}, func(r *http.Request) (io.ReadCloser, error) {
+		}, func(r *http.Request) (*types.Body, error) {
 			var m types.Body
 
 			_ = json.NewDecoder(r.Body).Decode(&m)
 
 			// Restrict the repositories that the token can access
 			m.Repositories = []string{r.PathValue("repo")}
-
-			b, err := json.Marshal(m)
-			if err != nil {
-				return r.Body, nil
-			}
-			return io.NopCloser(bytes.NewReader(b)), nil
+			m.RepositoryIds = nil
+			return &m, nil
 		}},
 	}
 	for _, route := range routes {
 		mux.HandleFuncWithMiddleware(route.pattern, func(w http.ResponseWriter, r *http.Request) {
-			err, jwtToken := signJwt(privateKey, clientId)
+			body, err := route.bodyGenerator(r)
 			if err != nil {
-				slog.Error("failed to sign jwt", "error", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 				return
 			}
-
-			installationRequest, err := http.NewRequestWithContext(r.Context(), http.MethodGet, route.installationURLGenerator(r), nil)
-			if err != nil {
-				slog.Error("failed to create request", "error", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			if err := body.Canonicalize(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			installationRequest.Header.Set("Accept", "application/vnd.github+json")
-			installationRequest.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *jwtToken))
-			installationRequest.Header.Set("X-GitHub-Api-Version", "2022-11-28")
-			installationResponse, err := http.DefaultClient.Do(installationRequest)
-			if err != nil {
-				slog.Error("failed to do request", "error", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
-			defer func() {
-				_, _ = io.Copy(io.Discard, installationResponse.Body)
-				_ = installationResponse.Body.Close()
-			}()
-
-			if installationResponse.StatusCode >= 400 {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(installationResponse.StatusCode)
-				_, _ = io.Copy(w, installationResponse.Body)
-				return
+			owner := route.ownerGenerator(r)
+			profile := r.PathValue("profile")
+			repositories := body.Repositories
+			if len(body.RepositoryIds) > 0 {
+				// IDs are not resolved to names, so they need a rule allowing every repository
+				repositories = append(slices.Clone(repositories), "*")
 			}
 
-			installation := struct {
-				ID int `json:"id"`
-			}{}
-			if err := json.NewDecoder(installationResponse.Body).Decode(&installation); err != nil {
-				slog.Error("failed to decode installation", "error", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
+			identity := ""
+			if config != nil {
+				bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if !ok || bearer == "" {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+				identity, err = tokenReviewer.Review(r.Context(), bearer)
+				if err != nil {
+					slog.Warn("unauthenticated", "error", err)
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+					return
+				}
+
+				if !config.Authorize(identity, owner, repositories, profile) {
+					slog.Warn("denied", "identity", identity, "owner", owner, "repositories", repositories, "profile", profile)
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
 			}
 
-			body, err := route.bodyGenerator(r)
+			// The fetches below may outlive the request to refresh in the background, so they use their own context
+			installationURL := route.installationURLGenerator(r)
+			installationID, err := installations.Get(installationURL, func() (swr.FetchResult[int64], error) {
+				ctx, cancel := context.WithTimeout(context.Background(), githubTimeout)
+				defer cancel()
+
+				b, err := gitHub.Do(ctx, http.MethodGet, installationURL, nil)
+				if err != nil {
+					return swr.FetchResult[int64]{}, err
+				}
+
+				installation := struct {
+					ID int64 `json:"id"`
+				}{}
+				if err := json.Unmarshal(b, &installation); err != nil {
+					return swr.FetchResult[int64]{}, xerrors.Errorf("failed to decode installation: %w", err)
+				}
+				return swr.FetchResult[int64]{Value: installation.ID, StaleAfter: installationCacheTTL, ExpireAfter: 2 * installationCacheTTL}, nil
+			})
 			if err != nil {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				writeGitHubError(w, err)
 				return
 			}
 
-			accessTokenRequest, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fmt.Sprintf("https://api.github.com/app/installations/%d/access_tokens", installation.ID), body)
+			// The body is canonical, and its permissions are allow-listed, so it is the same key whatever order it was asked in
+			b, err := json.Marshal(body)
 			if err != nil {
-				slog.Error("failed to create request", "error", err)
+				slog.Error("failed to marshal body", "error", err)
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
 			}
 
-			accessTokenRequest.Header.Set("Accept", "application/vnd.github+json")
-			accessTokenRequest.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *jwtToken))
-			accessTokenRequest.Header.Set("X-GitHub-Api-Version", "2022-11-28")
-			accessTokenResponse, err := http.DefaultClient.Do(accessTokenRequest)
+			accessToken, err := accessTokens.Get(installationID, b)
 			if err != nil {
-				slog.Error("failed to do request", "error", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				writeGitHubError(w, err)
 				return
 			}
-			defer func() {
-				_, _ = io.Copy(io.Discard, accessTokenResponse.Body)
-				_ = accessTokenResponse.Body.Close()
-			}()
+
+			slog.Info("issued token",
+				"identity", identity,
+				"owner", owner,
+				"profile", profile,
+				"installation", installationID,
+				"permissions", accessToken.Permissions,
+				"repositories", accessToken.Repositories,
+				"expires_at", accessToken.ExpiresAt,
+			)
 
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(accessTokenResponse.StatusCode)
-			_, _ = io.Copy(w, accessTokenResponse.Body)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(accessToken.Body)
 		})
 	}
 
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github-token-server/internal/swr"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// rewriteTransport sends every request to server whatever host it was made for.
+type rewriteTransport struct {
+	server *httptest.Server
+}
+
+func (t *rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.server.URL)
+	if err != nil {
+		return nil, err
+	}
+	r = r.Clone(r.Context())
+	r.URL.Scheme = u.Scheme
+	r.URL.Host = u.Host
+	return t.server.Client().Transport.RoundTrip(r)
+}
+
+func newTestGitHub(t *testing.T, handler http.HandlerFunc) *GitHub {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	meter := noop.NewMeterProvider().Meter("test")
+	gauge, _ := meter.Int64Gauge("gauge")
+	counter, _ := meter.Int64Counter("counter")
+	return &GitHub{
+		Client:             &http.Client{Transport: &rewriteTransport{server: server}},
+		ClientID:           "client-id",
+		PrivateKey:         string(privateKey),
+		RateLimitLimit:     gauge,
+		RateLimitRemaining: gauge,
+		RateLimitReset:     gauge,
+		ThrottledRequests:  counter,
+	}
+}
+
+func TestGitHub_Do(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int64
+	gitHub := newTestGitHub(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") == "" || r.Header.Get("X-GitHub-Api-Version") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/ok":
+			_, _ = w.Write([]byte(`{"id":1}`))
+		case "/not-found":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"Not Found"}`))
+		case "/throttled":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"message":"slow down"}`))
+		}
+	})
+
+	got, err := gitHub.Do(context.Background(), http.MethodGet, "https://api.github.com/ok", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if diff := cmp.Diff(`{"id":1}`, string(got)); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+
+	_, err = gitHub.Do(context.Background(), http.MethodGet, "https://api.github.com/not-found", nil)
+	var gitHubError *GitHubError
+	if !errors.As(err, &gitHubError) {
+		t.Fatalf("got %v, want a GitHubError", err)
+	}
+	if diff := cmp.Diff(&GitHubError{StatusCode: http.StatusNotFound, Body: []byte(`{"message":"Not Found"}`)}, gitHubError); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+
+	_, err = gitHub.Do(context.Background(), http.MethodGet, "https://api.github.com/throttled", nil)
+	if !errors.As(err, &gitHubError) || gitHubError.StatusCode != http.StatusTooManyRequests || gitHubError.RetryAfter <= 0 {
+		t.Fatalf("got %v, want a throttled GitHubError", err)
+	}
+
+	// Once throttled, requests are answered without calling GitHub
+	_, err = gitHub.Do(context.Background(), http.MethodGet, "https://api.github.com/ok", nil)
+	if !errors.As(err, &gitHubError) || gitHubError.StatusCode != http.StatusTooManyRequests || gitHubError.RetryAfter <= 0 {
+		t.Fatalf("got %v, want a throttled GitHubError", err)
+	}
+	if diff := cmp.Diff(int64(3), requests.Load()); diff != "" {
+		t.Errorf("requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestThrottledUntil(t *testing.T) {
+	reset := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+
+	type in struct {
+		statusCode int
+		header     http.Header
+	}
+	type want struct {
+		after     time.Duration
+		throttled bool
+	}
+	tests := []struct {
+		name string
+		in   in
+		want want
+	}{
+		{"not throttled", in{http.StatusNotFound, http.Header{}}, want{0, false}},
+		{"forbidden without rate limit", in{http.StatusForbidden, http.Header{"X-Ratelimit-Remaining": {"10"}}}, want{0, false}},
+		{"retry after", in{http.StatusForbidden, http.Header{"Retry-After": {"30"}}}, want{30 * time.Second, true}},
+		{"primary rate limit", in{http.StatusForbidden, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {strconv.FormatInt(reset.Unix(), 10)}}}, want{time.Until(reset), true}},
+		{"secondary rate limit without retry after", in{http.StatusTooManyRequests, http.Header{}}, want{time.Minute, true}},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			until, throttled := throttledUntil(&http.Response{StatusCode: in.statusCode, Header: in.header})
+			if throttled != want.throttled {
+				t.Fatalf("got throttled %v, want %v", throttled, want.throttled)
+			}
+			if !throttled {
+				return
+			}
+			if after := time.Until(until); after < want.after-5*time.Second || after > want.after+time.Second {
+				t.Errorf("got %v, want about %v", after, want.after)
+			}
+		})
+	}
+}
+
+func TestAccessTokens_Get(t *testing.T) {
+	t.Parallel()
+
+	type in struct {
+		lifetime time.Duration
+		body     string
+	}
+	type want struct {
+		mints int64
+	}
+	tests := []struct {
+		name string
+		in   []in
+		want want
+	}{
+		{"cache hit", []in{{time.Hour, `{"repositories":["a"]}`}, {time.Hour, `{"repositories":["a"]}`}}, want{1}},
+		{"other body", []in{{time.Hour, `{"repositories":["a"]}`}, {time.Hour, `{"repositories":["b"]}`}}, want{2}},
+		{"expired", []in{{2 * time.Minute, `{"repositories":["a"]}`}, {2 * time.Minute, `{"repositories":["a"]}`}}, want{2}},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		ins := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var mints atomic.Int64
+			lifetime := make(chan time.Duration, 1)
+			gitHub := newTestGitHub(t, func(w http.ResponseWriter, r *http.Request) {
+				mints.Add(1)
+				w.WriteHeader(http.StatusCreated)
+				_, _ = fmt.Fprintf(w, `{"token":"ghs_%d","expires_at":%q}`, mints.Load(), time.Now().Add(<-lifetime).Format(time.RFC3339))
+			})
+			accessTokens := &AccessTokens{
+				GitHub:        gitHub,
+				Timeout:       time.Second,
+				RefreshBefore: time.Minute,
+				ExpiryMargin:  5 * time.Minute,
+				cache:         swr.New[*AccessToken](),
+			}
+
+			for _, in := range ins {
+				lifetime <- in.lifetime
+				accessToken, err := accessTokens.Get(1, []byte(in.body))
+				if err != nil {
+					t.Fatalf("unexpected error: %+v", err)
+				}
+				if accessToken.ExpiresAt.IsZero() {
+					t.Errorf("got no expiry")
+				}
+				// Drain the lifetime of a cache hit, which does not call GitHub
+				select {
+				case <-lifetime:
+				default:
+				}
+			}
+			if diff := cmp.Diff(want.mints, mints.Load()); diff != "" {
+				t.Errorf("mints (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
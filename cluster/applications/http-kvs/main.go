@@ -1,10 +1,12 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -24,6 +26,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	smithyendpoints "github.com/aws/smithy-go/endpoints"
+	"github.com/google/uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
 func envOrDefaultValue[T any](key string, defaultValue T) T {
@@ -85,16 +93,334 @@ func (*resolver) ResolveEndpoint(ctx context.Context, params s3.EndpointParamete
 	return s3.NewDefaultEndpointResolverV2().ResolveEndpoint(ctx, params)
 }
 
+// sniffLen is the number of bytes http.DetectContentType considers.
+const sniffLen = 512
+
+const maxListKeys = 1000
+
+func headerValue(header http.Header, key string) *string {
+	value := header.Get(key)
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// handleS3Error passes through the statuses S3 uses for missing keys, failed preconditions and unsatisfiable ranges so callers can act on them.
+func handleS3Error(w http.ResponseWriter, err error) {
+	var awsErr *awsHTTP.ResponseError
+	if errors.As(err, &awsErr) {
+		switch status := awsErr.HTTPStatusCode(); status {
+		case http.StatusNotModified:
+			if etag := awsErr.Response.Header.Get("ETag"); etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+			w.WriteHeader(status)
+			return
+		case http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable:
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+	}
+	log.Printf("%+v", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+type listEntry struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+type listResponse struct {
+	Keys       []listEntry `json:"keys"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+func listObjects(w http.ResponseWriter, r *http.Request, s3Client *s3.Client, bucket string) {
+	query := r.URL.Query()
+
+	limit := maxListKeys
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxListKeys {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	response := listResponse{
+		Keys: make([]listEntry, 0),
+	}
+
+	// The cursor is the last key listed, so that the pages are filled by the keys left after the expiry index is skipped
+	startAfter := query.Get("cursor")
+	for {
+		input := &s3.ListObjectsV2Input{
+			Bucket:  &bucket,
+			MaxKeys: aws.Int32(int32(limit - len(response.Keys))),
+		}
+		if prefix := query.Get("prefix"); prefix != "" {
+			input.Prefix = &prefix
+		}
+		if startAfter != "" {
+			input.StartAfter = &startAfter
+		}
+
+		output, err := s3Client.ListObjectsV2(r.Context(), input)
+		if err != nil {
+			handleS3Error(w, err)
+			return
+		}
+
+		for _, object := range output.Contents {
+			if strings.HasPrefix(aws.ToString(object.Key), expiryIndexPrefix) {
+				continue
+			}
+			response.Keys = append(response.Keys, listEntry{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				ETag:         aws.ToString(object.ETag),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+		if !aws.ToBool(output.IsTruncated) || len(output.Contents) == 0 {
+			break
+		}
+		if len(response.Keys) == limit {
+			response.NextCursor = response.Keys[len(response.Keys)-1].Key
+			break
+		}
+
+		startAfter = aws.ToString(output.Contents[len(output.Contents)-1].Key)
+		if strings.HasPrefix(startAfter, expiryIndexPrefix) {
+			startAfter = expiryIndexEnd
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("%+v", err)
+	}
+}
+
+const (
+	expiresAfterHeader   = "X-Expires-After"
+	expiresAtHeader      = "X-Expires-At"
+	expiresAtMetadataKey = "expires-at"
+)
+
+// expiryIndexPrefix holds an empty object per key with an expiry, named <expiry in Unix seconds, zero-padded>/<key>,
+// so that the sweeper lists the expired keys in order of expiry instead of reading the metadata of every object.
+const expiryIndexPrefix = ".expiry/"
+
+// expiryIndexEnd sorts after every entry of the expiry index, as those start with digits, so listing skips the index at once.
+const expiryIndexEnd = expiryIndexPrefix + ":"
+
+const (
+	expirySweeperLeaseName = "http-kvs-expiry-sweeper"
+	inClusterNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// parseExpiresAfter accepts either a number of seconds or a Go duration string such as 1h30m.
+func parseExpiresAfter(value string) (time.Duration, error) {
+	var d time.Duration
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else {
+		d, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("expiry must be positive: %s", value)
+	}
+	return d, nil
+}
+
+func expiryIndexKey(expiry time.Time, key string) string {
+	return fmt.Sprintf("%s%020d/%s", expiryIndexPrefix, expiry.Unix(), key)
+}
+
+func parseExpiryIndexKey(indexKey string) (time.Time, string, bool) {
+	ts, key, ok := strings.Cut(strings.TrimPrefix(indexKey, expiryIndexPrefix), "/")
+	if !ok {
+		return time.Time{}, "", false
+	}
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.Unix(seconds, 0), key, true
+}
+
+func expiresAt(metadata map[string]string) (time.Time, bool) {
+	v, ok := metadata[expiresAtMetadataKey]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// sweepExpiredObjects deletes every object whose expiry has passed, as found in the expiry index.
+// The delete is conditional on the ETag that was inspected, so a key rewritten in the meantime survives.
+func sweepExpiredObjects(ctx context.Context, s3Client *s3.Client, bucket string) error {
+	prefix := expiryIndexPrefix
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			expiry, key, ok := parseExpiryIndexKey(aws.ToString(object.Key))
+			if ok && time.Now().Before(expiry) {
+				// The index is ordered by expiry, so the rest is not expired either
+				return nil
+			}
+			if ok {
+				if err := deleteIfExpired(ctx, s3Client, bucket, key); err != nil {
+					return err
+				}
+			}
+
+			// The entry is done with even when the key was rewritten, as every write with an expiry adds its own
+			if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &bucket,
+				Key:    object.Key,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deleteIfExpired(ctx context.Context, s3Client *s3.Client, bucket string, key string) error {
+	output, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var awsErr *awsHTTP.ResponseError
+		if errors.As(err, &awsErr) && awsErr.HTTPStatusCode() == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+
+	expiry, ok := expiresAt(output.Metadata)
+	if !ok || time.Now().Before(expiry) {
+		return nil
+	}
+
+	if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  &bucket,
+		Key:     &key,
+		IfMatch: output.ETag,
+	}); err != nil {
+		var awsErr *awsHTTP.ResponseError
+		if errors.As(err, &awsErr) && (awsErr.HTTPStatusCode() == http.StatusNotFound || awsErr.HTTPStatusCode() == http.StatusPreconditionFailed) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// isExpired reads the metadata of key, for the responses S3 answers before the expiry can be checked on the object.
+func isExpired(ctx context.Context, s3Client *s3.Client, bucket string, key string) bool {
+	output, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return false
+	}
+	expiry, ok := expiresAt(output.Metadata)
+	return ok && !time.Now().Before(expiry)
+}
+
+// runExpirySweeper sweeps expired objects every interval while this replica holds the lease.
+func runExpirySweeper(ctx context.Context, s3Client *s3.Client, bucket string, interval time.Duration) {
+	kubeConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("failed to create kubernetes config: %+v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		log.Fatalf("failed to create kubernetes client: %+v", err)
+	}
+	namespace, err := os.ReadFile(inClusterNamespacePath)
+	if err != nil {
+		log.Fatalf("failed to find leader election namespace: %+v", err)
+	}
+
+	id := uuid.New().String()
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      expirySweeperLeaseName,
+			Namespace: string(namespace),
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   60 * time.Second,
+			RenewDeadline:   15 * time.Second,
+			RetryPeriod:     5 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					ticker := time.NewTicker(interval)
+					defer ticker.Stop()
+					for {
+						if err := sweepExpiredObjects(ctx, s3Client, bucket); err != nil && ctx.Err() == nil {
+							log.Printf("failed to sweep expired objects: %+v", err)
+						}
+						select {
+						case <-ctx.Done():
+							return
+						case <-ticker.C:
+						}
+					}
+				},
+				OnStoppedLeading: func() {
+					log.Printf("leader lost: %s", id)
+				},
+			},
+		})
+	}
+}
+
 func main() {
 	var address string
 	var terminationGracePeriod time.Duration
 	var lameduck time.Duration
 	var keepAlive bool
+	var expirySweepInterval time.Duration
 	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
 
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
+	flag.DurationVar(&expirySweepInterval, "expiry-sweep-interval", envOrDefaultValue("EXPIRY_SWEEP_INTERVAL", time.Duration(0)), "Interval at which the elected leader deletes expired keys from the bucket, 0 to disable")
 	flag.Parse()
 
 	var optsFunc []func(*config.LoadOptions) error
@@ -118,127 +444,235 @@ func main() {
 	s3Client := s3.NewFromConfig(c, func(o *s3.Options) {
 		//o.EndpointResolverV2 = &resolver{}
 		o.UsePathStyle = true
+		// Only send checksums when an operation requires them, as not every S3-compatible store accepts the trailing checksums used for streamed uploads.
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
 	})
 
 	bucket := os.Getenv("S3_BUCKET")
 
+	sweeperCtx, sweeperCancel := context.WithCancel(context.Background())
+	sweeperDone := make(chan struct{})
+	if expirySweepInterval > 0 {
+		go func() {
+			defer close(sweeperDone)
+			runExpirySweeper(sweeperCtx, s3Client, bucket, expirySweepInterval)
+		}()
+	} else {
+		close(sweeperDone)
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", handleObjects(s3Client, bucket))
+
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
+	})
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("failed to listen: %+v", err)
+	}
+
+	server := &http.Server{
+		Handler: mux,
+	}
+	server.SetKeepAlivesEnabled(keepAlive)
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("panic: %+v\n%s", err, debug.Stack())
+			}
+		}()
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to listen: %+v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM)
+	<-quit
+	sweeperCancel()
+	<-sweeperDone
+	time.Sleep(lameduck)
+
+	ctx, cancel := context.WithTimeout(context.Background(), terminationGracePeriod)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Fatalf("failed to shutdown: %+v", err)
+	}
+}
+
+// handleObjects serves the keys of bucket, and lists them at the root.
+func handleObjects(s3Client *s3.Client, bucket string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		key := strings.TrimPrefix(r.URL.Path, "/")
 
 		if key == "" {
+			if r.Method == http.MethodGet {
+				listObjects(w, r, s3Client, bucket)
+				return
+			}
 			http.Error(w, "missing key", http.StatusBadRequest)
 			return
 		}
+		if strings.HasPrefix(key, expiryIndexPrefix) {
+			http.Error(w, "reserved key", http.StatusBadRequest)
+			return
+		}
 
 		switch r.Method {
 		case http.MethodGet:
-			output, err := s3Client.GetObject(r.Context(), &s3.GetObjectInput{
-				Bucket: &bucket,
-				Key:    &key,
-			})
+			input := &s3.GetObjectInput{
+				Bucket:      &bucket,
+				Key:         &key,
+				Range:       headerValue(r.Header, "Range"),
+				IfMatch:     headerValue(r.Header, "If-Match"),
+				IfNoneMatch: headerValue(r.Header, "If-None-Match"),
+			}
+			if v := r.Header.Get("If-Modified-Since"); v != "" {
+				if t, err := http.ParseTime(v); err == nil {
+					input.IfModifiedSince = &t
+				}
+			}
+			output, err := s3Client.GetObject(r.Context(), input)
 			if err != nil {
+				// S3 evaluates preconditions and ranges without the body, so an expired key would answer them instead of 404
 				var awsErr *awsHTTP.ResponseError
 				if errors.As(err, &awsErr) {
-					if awsErr.HTTPStatusCode() == http.StatusNotFound {
-						http.Error(w, http.StatusText(awsErr.HTTPStatusCode()), awsErr.HTTPStatusCode())
-						return
+					switch awsErr.HTTPStatusCode() {
+					case http.StatusNotModified, http.StatusPreconditionFailed, http.StatusRequestedRangeNotSatisfiable:
+						if isExpired(r.Context(), s3Client, bucket, key) {
+							http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+							return
+						}
 					}
 				}
-				log.Printf("%+v", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				handleS3Error(w, err)
 				return
 			}
 
 			defer func() {
 				_ = output.Body.Close()
 			}()
-			response, err := io.ReadAll(output.Body)
-			if err != nil {
+
+			if expiry, ok := expiresAt(output.Metadata); ok {
+				if !time.Now().Before(expiry) {
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					return
+				}
+				w.Header().Set(expiresAtHeader, expiry.UTC().Format(http.TimeFormat))
+			}
+			if output.ContentType != nil {
+				w.Header().Set("Content-Type", *output.ContentType)
+			}
+			if output.ContentLength != nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(*output.ContentLength, 10))
+			}
+			if output.ETag != nil {
+				w.Header().Set("ETag", *output.ETag)
+			}
+			if output.LastModified != nil {
+				w.Header().Set("Last-Modified", output.LastModified.UTC().Format(http.TimeFormat))
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+
+			status := http.StatusOK
+			if output.ContentRange != nil {
+				w.Header().Set("Content-Range", *output.ContentRange)
+				status = http.StatusPartialContent
+			}
+			w.WriteHeader(status)
+			if _, err := io.Copy(w, output.Body); err != nil {
 				log.Printf("%+v", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		case http.MethodPost, http.MethodPut:
+			if r.ContentLength < 0 {
+				http.Error(w, http.StatusText(http.StatusLengthRequired), http.StatusLengthRequired)
 				return
 			}
 
-			w.Header().Set("Content-Type", *output.ContentType)
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write(response)
-		case http.MethodPost:
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
+			// S3 evaluates the preconditions against an expired key as well, so it is deleted first to be absent
+			if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+				if err := deleteIfExpired(r.Context(), s3Client, bucket, key); err != nil {
+					handleS3Error(w, err)
+					return
+				}
+			}
+
+			var metadata map[string]string
+			if v := r.Header.Get(expiresAfterHeader); v != "" {
+				expiresAfter, err := parseExpiresAfter(v)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid %s", expiresAfterHeader), http.StatusBadRequest)
+					return
+				}
+				expiry := time.Now().Add(expiresAfter).UTC()
+				metadata = map[string]string{
+					expiresAtMetadataKey: expiry.Format(time.RFC3339),
+				}
+
+				// Indexed before the write, so that a key is never left without an entry. An entry without its key is dropped by the sweeper.
+				indexKey := expiryIndexKey(expiry, key)
+				if _, err := s3Client.PutObject(r.Context(), &s3.PutObjectInput{
+					Bucket:        &bucket,
+					Key:           &indexKey,
+					Body:          strings.NewReader(""),
+					ContentLength: aws.Int64(0),
+				}); err != nil {
+					handleS3Error(w, err)
+					return
+				}
+			}
+
+			body := bufio.NewReaderSize(r.Body, sniffLen)
+			head, err := body.Peek(sniffLen)
+			if err != nil && !errors.Is(err, io.EOF) {
 				log.Printf("%+v", err)
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
 			}
 
-			contentType := http.DetectContentType(body)
-			if _, err := s3Client.PutObject(r.Context(), &s3.PutObjectInput{
+			contentType := http.DetectContentType(head)
+			output, err := s3Client.PutObject(r.Context(), &s3.PutObjectInput{
 				Bucket:        &bucket,
 				Key:           &key,
-				Body:          bytes.NewReader(body),
-				ContentLength: aws.Int64(int64(len(body))),
+				Body:          body,
+				ContentLength: aws.Int64(r.ContentLength),
 				ContentType:   &contentType,
-			}, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware)); err != nil {
-				log.Printf("%+v", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				Metadata:      metadata,
+				IfMatch:       headerValue(r.Header, "If-Match"),
+				IfNoneMatch:   headerValue(r.Header, "If-None-Match"),
+			}, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware))
+			if err != nil {
+				handleS3Error(w, err)
 				return
 			}
 
+			if output.ETag != nil {
+				w.Header().Set("ETag", *output.ETag)
+			}
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
 		case http.MethodDelete:
 			if _, err := s3Client.DeleteObject(r.Context(), &s3.DeleteObjectInput{
-				Bucket: &bucket,
-				Key:    &key,
+				Bucket:  &bucket,
+				Key:     &key,
+				IfMatch: headerValue(r.Header, "If-Match"),
 			}); err != nil {
-				log.Printf("%+v", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				handleS3Error(w, err)
 				return
 			}
 
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		}
-	})
-
-	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
-	})
-
-	listener, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatalf("failed to listen: %+v", err)
-	}
-
-	server := &http.Server{
-		Handler: mux,
-	}
-	server.SetKeepAlivesEnabled(keepAlive)
-
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				log.Printf("panic: %+v\n%s", err, debug.Stack())
-			}
-		}()
-		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("failed to listen: %+v", err)
-		}
-	}()
-
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGTERM)
-	<-quit
-	time.Sleep(lameduck)
-
-	ctx, cancel := context.WithTimeout(context.Background(), terminationGracePeriod)
-	defer cancel()
-
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("failed to shutdown: %+v", err)
 	}
 }
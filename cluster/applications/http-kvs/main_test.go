@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeObject struct {
+	body     []byte
+	etag     string
+	metadata map[string]string
+}
+
+// fakeS3 serves the path-style S3 requests http-kvs sends, for a single bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+}
+
+func (f *fakeS3) put(key string, body string, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sum := md5.Sum([]byte(body))
+	f.objects[key] = &fakeObject{body: []byte(body), etag: `"` + hex.EncodeToString(sum[:]) + `"`, metadata: metadata}
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.keysLocked()
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if status != http.StatusNotFound || code != "" {
+		_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, exists := f.objects[key]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !exists {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if v := r.Header.Get("If-None-Match"); v != "" && v == object.etag {
+			w.Header().Set("ETag", object.etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		for k, v := range object.metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		w.Header().Set("ETag", object.etag)
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.body)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(object.body)
+		}
+	case http.MethodPut:
+		if v := r.Header.Get("If-None-Match"); v == "*" && exists {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if v := r.Header.Get("If-Match"); v != "" {
+			if !exists {
+				writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			if v != object.etag {
+				writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+				return
+			}
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		sum := md5.Sum(body)
+		object = &fakeObject{body: body, etag: `"` + hex.EncodeToString(sum[:]) + `"`, metadata: map[string]string{}}
+		for k := range r.Header {
+			if name, ok := strings.CutPrefix(strings.ToLower(k), "x-amz-meta-"); ok {
+				object.metadata[name] = r.Header.Get(k)
+			}
+		}
+		f.objects[key] = object
+		w.Header().Set("ETag", object.etag)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if v := r.Header.Get("If-Match"); v != "" && exists && v != object.etag {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type fakeListContents struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int    `xml:"Size"`
+}
+
+type fakeListResult struct {
+	XMLName     xml.Name           `xml:"ListBucketResult"`
+	IsTruncated bool               `xml:"IsTruncated"`
+	KeyCount    int                `xml:"KeyCount"`
+	Contents    []fakeListContents `xml:"Contents"`
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil {
+		maxKeys = 1000
+	}
+
+	var result fakeListResult
+	f.mu.Lock()
+	for _, key := range f.keysLocked() {
+		if !strings.HasPrefix(key, query.Get("prefix")) || key <= query.Get("start-after") {
+			continue
+		}
+		if len(result.Contents) == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		object := f.objects[key]
+		result.Contents = append(result.Contents, fakeListContents{Key: key, ETag: object.etag, Size: len(object.body)})
+	}
+	f.mu.Unlock()
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) keysLocked() []string {
+	var keys []string
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func newTestServer(t *testing.T) (*fakeS3, *s3.Client, *httptest.Server) {
+	t.Helper()
+
+	fake := &fakeS3{objects: make(map[string]*fakeObject)}
+	s3Server := httptest.NewServer(fake)
+	t.Cleanup(s3Server.Close)
+
+	s3Client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(s3Server.URL),
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+		UsePathStyle: true,
+		// Only send checksums when an operation requires them, as the fake does not verify them
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+	})
+
+	server := httptest.NewServer(handleObjects(s3Client, "bucket"))
+	t.Cleanup(server.Close)
+	return fake, s3Client, server
+}
+
+func expiresAtMetadata(expiry time.Time) map[string]string {
+	return map[string]string{expiresAtMetadataKey: expiry.UTC().Format(time.RFC3339)}
+}
+
+func TestHandleObjects_Expiry(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name       string
+		metadata   map[string]string
+		method     string
+		headers    map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{"get live", expiresAtMetadata(future), http.MethodGet, nil, http.StatusOK, "stored"},
+		{"get expired", expiresAtMetadata(past), http.MethodGet, nil, http.StatusNotFound, ""},
+		{"get expired with a matching If-None-Match", expiresAtMetadata(past), http.MethodGet, map[string]string{"If-None-Match": "ETAG"}, http.StatusNotFound, ""},
+		{"get live with a matching If-None-Match", expiresAtMetadata(future), http.MethodGet, map[string]string{"If-None-Match": "ETAG"}, http.StatusNotModified, ""},
+		{"create over live", expiresAtMetadata(future), http.MethodPut, map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed, "stored"},
+		{"create over expired", expiresAtMetadata(past), http.MethodPut, map[string]string{"If-None-Match": "*"}, http.StatusOK, "written"},
+		{"create over unexpiring", nil, http.MethodPut, map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed, "stored"},
+		{"swap live", expiresAtMetadata(future), http.MethodPut, map[string]string{"If-Match": "ETAG"}, http.StatusOK, "written"},
+		{"swap expired", expiresAtMetadata(past), http.MethodPut, map[string]string{"If-Match": "ETAG"}, http.StatusNotFound, ""},
+		{"unconditional write over expired", expiresAtMetadata(past), http.MethodPost, nil, http.StatusOK, "written"},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		metadata := tt.metadata
+		method := tt.method
+		headers := tt.headers
+		wantStatus := tt.wantStatus
+		wantBody := tt.wantBody
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fake, _, server := newTestServer(t)
+			fake.put("key", "stored", metadata)
+			etag := fake.objects["key"].etag
+
+			var body io.Reader
+			if method != http.MethodGet {
+				body = strings.NewReader("written")
+			}
+			req, err := http.NewRequest(method, server.URL+"/key", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range headers {
+				req.Header.Set(k, strings.ReplaceAll(v, "ETAG", etag))
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, wantStatus)
+			}
+
+			// What the key holds afterwards, read from the fake to see past the expiry check
+			var got string
+			fake.mu.Lock()
+			if object, ok := fake.objects["key"]; ok {
+				got = string(object.body)
+			}
+			fake.mu.Unlock()
+			if method == http.MethodGet {
+				return
+			}
+			if got != wantBody {
+				t.Errorf("got %q stored, want %q", got, wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleObjects_WriteWithExpiry(t *testing.T) {
+	t.Parallel()
+
+	fake, _, server := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/key", strings.NewReader("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(expiresAfterHeader, "1h")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	keys := fake.keys()
+	if len(keys) != 2 || keys[1] != "key" {
+		t.Fatalf("got keys %v, want an index entry and key", keys)
+	}
+	expiry, key, ok := parseExpiryIndexKey(keys[0])
+	if !ok || key != "key" {
+		t.Fatalf("got index entry %q, want one of key", keys[0])
+	}
+	if d := time.Until(expiry); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("got expiry in %s, want in 1h", d)
+	}
+	if got, ok := expiresAt(fake.objects["key"].metadata); !ok || !got.Equal(expiry) {
+		t.Errorf("got expires-at %s, want %s", got, expiry)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	index := expiryIndexKey(time.Unix(1, 0), "z")
+
+	tests := []struct {
+		name  string
+		keys  []string
+		query string
+		want  []listResponse
+	}{
+		{
+			"one page",
+			[]string{"a", "b"},
+			"",
+			[]listResponse{{Keys: []listEntry{{Key: "a"}, {Key: "b"}}}},
+		},
+		{
+			"pages filled past the expiry index",
+			[]string{"-a", index, expiryIndexKey(time.Unix(2, 0), "z"), expiryIndexKey(time.Unix(3, 0), "z"), "a", "b", "c"},
+			"limit=2",
+			[]listResponse{
+				{Keys: []listEntry{{Key: "-a"}, {Key: "a"}}, NextCursor: "a"},
+				{Keys: []listEntry{{Key: "b"}, {Key: "c"}}},
+			},
+		},
+		{
+			"only the expiry index",
+			[]string{index},
+			"limit=1",
+			[]listResponse{{Keys: []listEntry{}}},
+		},
+		{
+			"prefix",
+			[]string{"a/1", "a/2", "b/1"},
+			"prefix=a/&limit=1",
+			[]listResponse{
+				{Keys: []listEntry{{Key: "a/1"}}, NextCursor: "a/1"},
+				{Keys: []listEntry{{Key: "a/2"}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		keys := tt.keys
+		query := tt.query
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			fake, _, server := newTestServer(t)
+			for _, key := range keys {
+				fake.put(key, "", nil)
+			}
+
+			var got []listResponse
+			cursor := ""
+			for range want {
+				resp, err := http.Get(server.URL + "/?" + query + "&cursor=" + cursor)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var page listResponse
+				err = json.NewDecoder(resp.Body).Decode(&page)
+				_ = resp.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range page.Keys {
+					page.Keys[i] = listEntry{Key: page.Keys[i].Key}
+				}
+				got = append(got, page)
+				cursor = page.NextCursor
+				if cursor == "" {
+					break
+				}
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSweepExpiredObjects(t *testing.T) {
+	t.Parallel()
+
+	fake, s3Client, _ := newTestServer(t)
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	fake.put("expired", "", expiresAtMetadata(past))
+	fake.put(expiryIndexKey(past, "expired"), "", nil)
+	// Rewritten with a later expiry after its first entry
+	fake.put("rewritten", "", expiresAtMetadata(future))
+	fake.put(expiryIndexKey(past, "rewritten"), "", nil)
+	fake.put(expiryIndexKey(future, "rewritten"), "", nil)
+	fake.put("live", "", expiresAtMetadata(future))
+	fake.put(expiryIndexKey(future, "live"), "", nil)
+
+	if err := sweepExpiredObjects(context.Background(), s3Client, "bucket"); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+
+	want := []string{expiryIndexKey(future, "live"), expiryIndexKey(future, "rewritten"), "live", "rewritten"}
+	if diff := cmp.Diff(want, fake.keys()); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestParseExpiresAfter(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"60", time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"0", 0, true},
+		{"-1s", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExpiresAfter(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseExpiresAfter(%q) = %s, %v, want %s, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
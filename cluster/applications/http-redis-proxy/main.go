@@ -4,18 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -29,6 +40,17 @@ const (
 	RESPTypeInteger      = ':'
 	RESPTypeBulkString   = '$'
 	RESPTypeArray        = '*'
+	// RESP3
+	RESPTypeNull           = '_'
+	RESPTypeBoolean        = '#'
+	RESPTypeDouble         = ','
+	RESPTypeBigNumber      = '('
+	RESPTypeBlobError      = '!'
+	RESPTypeVerbatimString = '='
+	RESPTypeMap            = '%'
+	RESPTypeSet            = '~'
+	RESPTypeAttribute      = '|'
+	RESPTypePush           = '>'
 )
 
 var (
@@ -138,6 +160,235 @@ func (a *RESPArray) MarshalJSON() ([]byte, error) {
 	return json.Marshal(a.a)
 }
 
+type RESPNull struct{}
+
+func (n *RESPNull) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeNull)
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (n *RESPNull) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+type RESPBoolean struct {
+	b bool
+}
+
+func (b *RESPBoolean) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeBoolean)
+	if b.b {
+		buffer.WriteByte('t')
+	} else {
+		buffer.WriteByte('f')
+	}
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (b *RESPBoolean) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.b)
+}
+
+type RESPDouble struct {
+	f float64
+}
+
+func (d *RESPDouble) format() string {
+	switch {
+	case math.IsInf(d.f, 1):
+		return "inf"
+	case math.IsInf(d.f, -1):
+		return "-inf"
+	case math.IsNaN(d.f):
+		return "nan"
+	}
+	return strconv.FormatFloat(d.f, 'g', -1, 64)
+}
+
+func (d *RESPDouble) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeDouble)
+	buffer.WriteString(d.format())
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+// MarshalJSON falls back to a string for infinities and NaN, which JSON numbers cannot represent.
+func (d *RESPDouble) MarshalJSON() ([]byte, error) {
+	if math.IsInf(d.f, 0) || math.IsNaN(d.f) {
+		return json.Marshal(d.format())
+	}
+	return json.Marshal(d.f)
+}
+
+type RESPBigNumber struct {
+	s string
+}
+
+func (n *RESPBigNumber) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeBigNumber)
+	buffer.WriteString(n.s)
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (n *RESPBigNumber) MarshalJSON() ([]byte, error) {
+	return json.Marshal(json.Number(n.s))
+}
+
+type RESPBlobError struct {
+	s string
+}
+
+func (s *RESPBlobError) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeBlobError)
+	buffer.WriteString(strconv.Itoa(len(s.s)))
+	buffer.Write(RESPDelimiter)
+	buffer.WriteString(s.s)
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (s *RESPBlobError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: s.s})
+}
+
+type RESPVerbatimString struct {
+	format string
+	s      string
+}
+
+func (s *RESPVerbatimString) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeVerbatimString)
+	buffer.WriteString(strconv.Itoa(len(s.format) + 1 + len(s.s)))
+	buffer.Write(RESPDelimiter)
+	buffer.WriteString(s.format)
+	buffer.WriteByte(':')
+	buffer.WriteString(s.s)
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (s *RESPVerbatimString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.s)
+}
+
+// RESPMap keeps its entries as alternating keys and values, in the order they were received.
+type RESPMap struct {
+	m []RESPMessage
+}
+
+func (m *RESPMap) String() string {
+	return encodeAggregate(RESPTypeMap, len(m.m)/2, m.m)
+}
+
+// MarshalJSON renders a JSON object, using the text of keys that are not strings.
+func (m *RESPMap) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i := 0; i+1 < len(m.m); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, err := json.Marshal(mapKey(m.m[i]))
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.m[i+1])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+func mapKey(message RESPMessage) string {
+	switch m := message.(type) {
+	case *RESPSimpleString:
+		return m.s
+	case *RESPBulkString:
+		if m.s != nil {
+			return *m.s
+		}
+	case *RESPVerbatimString:
+		return m.s
+	}
+	b, err := json.Marshal(message)
+	if err != nil {
+		return message.String()
+	}
+	return string(b)
+}
+
+type RESPSet struct {
+	a []RESPMessage
+}
+
+func (s *RESPSet) String() string {
+	return encodeAggregate(RESPTypeSet, len(s.a), s.a)
+}
+
+func (s *RESPSet) MarshalJSON() ([]byte, error) {
+	if s.a == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(s.a)
+}
+
+// RESPAttribute carries auxiliary data sent ahead of the reply it describes.
+type RESPAttribute struct {
+	m       []RESPMessage
+	message RESPMessage
+}
+
+func (a *RESPAttribute) String() string {
+	return encodeAggregate(RESPTypeAttribute, len(a.m)/2, a.m) + a.message.String()
+}
+
+// MarshalJSON leaves the attributes out, as they are not part of the reply itself.
+func (a *RESPAttribute) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.message)
+}
+
+type RESPPush struct {
+	a []RESPMessage
+}
+
+func (p *RESPPush) String() string {
+	return encodeAggregate(RESPTypePush, len(p.a), p.a)
+}
+
+func (p *RESPPush) MarshalJSON() ([]byte, error) {
+	if p.a == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(p.a)
+}
+
+func encodeAggregate(t byte, length int, a []RESPMessage) string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(t)
+	buffer.WriteString(strconv.Itoa(length))
+	buffer.Write(RESPDelimiter)
+	for _, m := range a {
+		buffer.WriteString(m.String())
+	}
+	return buffer.String()
+}
+
 type RESPMessage interface {
 	String() string
 	json.Marshaler
@@ -206,11 +457,113 @@ func (p *RedisProtocolParser) Parse() (RESPMessage, error) {
 		}
 
 		return &RESPArray{a: a}, nil
+	case RESPTypeNull:
+		return &RESPNull{}, nil
+	case RESPTypeBoolean:
+		switch string(line[1:]) {
+		case "t":
+			return &RESPBoolean{b: true}, nil
+		case "f":
+			return &RESPBoolean{b: false}, nil
+		}
+		return nil, xerrors.New("invalid RESP boolean")
+	case RESPTypeDouble:
+		f, err := strconv.ParseFloat(string(line[1:]), 64)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPDouble{f: f}, nil
+	case RESPTypeBigNumber:
+		s := string(line[1:])
+		if _, ok := new(big.Int).SetString(s, 10); !ok {
+			return nil, xerrors.New("invalid RESP big number")
+		}
+		return &RESPBigNumber{s: s}, nil
+	case RESPTypeBlobError:
+		s, err := p.readBlob(line)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPBlobError{s: s}, nil
+	case RESPTypeVerbatimString:
+		s, err := p.readBlob(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(s) < 4 || s[3] != ':' {
+			return nil, xerrors.New("invalid RESP verbatim string")
+		}
+		return &RESPVerbatimString{format: s[:3], s: s[4:]}, nil
+	case RESPTypeMap:
+		m, err := p.parseAggregate(line, 2)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPMap{m: m}, nil
+	case RESPTypeSet:
+		a, err := p.parseAggregate(line, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPSet{a: a}, nil
+	case RESPTypeAttribute:
+		m, err := p.parseAggregate(line, 2)
+		if err != nil {
+			return nil, err
+		}
+		message, err := p.Parse()
+		if err != nil {
+			return nil, err
+		}
+		return &RESPAttribute{m: m, message: message}, nil
+	case RESPTypePush:
+		a, err := p.parseAggregate(line, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPPush{a: a}, nil
 	default:
 		return nil, xerrors.New("invalid RESP message type")
 	}
 }
 
+func (p *RedisProtocolParser) readBlob(line []byte) (string, error) {
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return "", err
+	}
+	if length < 0 {
+		return "", xerrors.New("invalid RESP blob length")
+	}
+
+	b := make([]byte, length+len(RESPDelimiter))
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		return "", err
+	}
+	return string(b[:length]), nil
+}
+
+// parseAggregate reads the elements of a map, set, attribute or push, with width elements per entry.
+func (p *RedisProtocolParser) parseAggregate(line []byte, width int) ([]RESPMessage, error) {
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, xerrors.New("invalid RESP aggregate length")
+	}
+
+	a := make([]RESPMessage, 0, length*width)
+	for i := 0; i < length*width; i++ {
+		m, err := p.Parse()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, m)
+	}
+	return a, nil
+}
+
 func encodeCommand(args []string) string {
 	var buffer bytes.Buffer
 	buffer.WriteByte(RESPTypeArray)
@@ -226,41 +579,410 @@ func encodeCommand(args []string) string {
 	return buffer.String()
 }
 
-func executeRedis(remoteAddress string, connectTimeout time.Duration, db int, args []string) (RESPMessage, error) {
-	remote, err := net.DialTimeout("tcp", remoteAddress, connectTimeout)
+type Connection struct {
+	conn       net.Conn
+	parser     *RedisProtocolParser
+	returnedAt time.Time
+}
+
+func (c *Connection) isHealthy() bool {
+	// A reply left in the buffer means the connection is out of step with its commands.
+	if c.parser.r.Buffered() > 0 {
+		return false
+	}
+
+	syscallConnection, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+
+	rawConnection, err := syscallConnection.SyscallConn()
 	if err != nil {
-		return nil, xerrors.Errorf("failed to connect to redis: %w", err)
+		return false
 	}
-	defer remote.Close()
 
-	parser := NewRedisProtocolParser(remote)
+	healthy := false
 
-	if db > 0 {
-		selectCommand := encodeCommand([]string{"SELECT", strconv.Itoa(db)})
-		if _, err := io.Copy(remote, strings.NewReader(selectCommand)); err != nil {
-			return nil, xerrors.Errorf("failed to send SELECT command to redis: %w", err)
+	if err := rawConnection.Read(func(fd uintptr) bool {
+		b := make([]byte, 1)
+		// If read succeeds, it's either EOF or unexpected read; only EAGAIN/EWOULDBLOCK is considered healthy.
+		_, err := syscall.Read(int(fd), b)
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK) {
+			healthy = true
 		}
 
-		selectResponse, err := parser.Parse()
+		return true
+	}); err != nil {
+		return false
+	}
+
+	return healthy
+}
+
+// exchange pipelines commands and reads one reply for each of them.
+func (c *Connection) exchange(commands ...[]string) ([]RESPMessage, error) {
+	var buffer strings.Builder
+	for _, args := range commands {
+		buffer.WriteString(encodeCommand(args))
+	}
+	if _, err := io.Copy(c.conn, strings.NewReader(buffer.String())); err != nil {
+		return nil, xerrors.Errorf("failed to send command to redis: %w", err)
+	}
+
+	messages := make([]RESPMessage, 0, len(commands))
+	for range commands {
+		message, err := c.parser.Parse()
 		if err != nil {
-			return nil, xerrors.Errorf("failed to parse SELECT response: %w", err)
+			return nil, xerrors.Errorf("failed to parse redis response: %w", err)
 		}
-		if e, ok := selectResponse.(*RESPError); ok {
-			return nil, xerrors.Errorf("SELECT failed: %s", e.s)
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+type ConnectionPoolOption struct {
+	MaxIdleConnections int
+	MaxIdleTime        time.Duration
+	Dialer             func(ctx context.Context) (*Connection, error)
+	// IdleConnections counts the idle connections of every pool sharing it, which MaxIdleConnections caps together.
+	IdleConnections *atomic.Int64
+}
+
+// ConnectionPool keeps idle connections that are already switched to one protocol and DB.
+type ConnectionPool struct {
+	option *ConnectionPoolOption
+
+	mutex sync.Mutex
+	idle  []*Connection
+}
+
+func NewConnectionPool(option *ConnectionPoolOption) *ConnectionPool {
+	return &ConnectionPool{
+		option: option,
+	}
+}
+
+func (p *ConnectionPool) IdleConnections() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.idle)
+}
+
+func (p *ConnectionPool) Get(ctx context.Context) (*Connection, error) {
+	p.mutex.Lock()
+	for len(p.idle) > 0 {
+		// LIFO keeps the busiest connections warm and lets the rest reach MaxIdleTime.
+		connection := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.option.IdleConnections.Add(-1)
+
+		if (p.option.MaxIdleTime > 0 && time.Since(connection.returnedAt) > p.option.MaxIdleTime) || !connection.isHealthy() {
+			_ = connection.conn.Close()
+			continue
 		}
+		p.mutex.Unlock()
+		return connection, nil
 	}
+	p.mutex.Unlock()
 
-	command := encodeCommand(args)
-	if _, err := io.Copy(remote, strings.NewReader(command)); err != nil {
-		return nil, xerrors.Errorf("failed to send command to redis: %w", err)
+	connection, err := p.option.Dialer(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create connection: %w", err)
+	}
+	return connection, nil
+}
+
+func (p *ConnectionPool) Put(connection *Connection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.option.IdleConnections.Add(1) > int64(p.option.MaxIdleConnections) {
+		p.option.IdleConnections.Add(-1)
+		_ = connection.conn.Close()
+		return
+	}
+	connection.returnedAt = time.Now()
+	p.idle = append(p.idle, connection)
+}
+
+// Discard closes a connection whose state must not leak into the next request.
+func (p *ConnectionPool) Discard(connection *Connection) {
+	_ = connection.conn.Close()
+}
+
+type ClientOption struct {
+	RemoteAddress      string
+	ConnectTimeout     time.Duration
+	MaxIdleConnections int
+	MaxIdleTime        time.Duration
+}
+
+type poolKey struct {
+	protocol int
+	db       int
+}
+
+// Client runs commands over one connection pool per protocol and DB, with MaxIdleConnections shared by all of them.
+type Client struct {
+	option *ClientOption
+
+	mutex sync.Mutex
+	pools map[poolKey]*ConnectionPool
+	idle  atomic.Int64
+}
+
+func NewClient(option *ClientOption) *Client {
+	return &Client{
+		option: option,
+		pools:  make(map[poolKey]*ConnectionPool),
+	}
+}
+
+func (c *Client) pool(protocol int, db int) *ConnectionPool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := poolKey{protocol: protocol, db: db}
+	if pool, ok := c.pools[key]; ok {
+		return pool
+	}
+	pool := NewConnectionPool(&ConnectionPoolOption{
+		MaxIdleConnections: c.option.MaxIdleConnections,
+		MaxIdleTime:        c.option.MaxIdleTime,
+		Dialer: func(ctx context.Context) (*Connection, error) {
+			return c.dial(ctx, protocol, db)
+		},
+		IdleConnections: &c.idle,
+	})
+	c.pools[key] = pool
+	return pool
+}
+
+func (c *Client) dial(ctx context.Context, protocol int, db int) (*Connection, error) {
+	dialer := &net.Dialer{Timeout: c.option.ConnectTimeout}
+	remote, err := dialer.DialContext(ctx, "tcp", c.option.RemoteAddress)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to connect to redis: %w", err)
+	}
+	connection := &Connection{
+		conn:   remote,
+		parser: NewRedisProtocolParser(remote),
+	}
+
+	var setup [][]string
+	if protocol != 2 {
+		setup = append(setup, []string{"HELLO", strconv.Itoa(protocol)})
+	}
+	if db > 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(db)})
+	}
+	if len(setup) == 0 {
+		return connection, nil
 	}
 
-	message, err := parser.Parse()
+	messages, err := connection.exchange(setup...)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to parse redis response: %w", err)
+		_ = remote.Close()
+		return nil, xerrors.Errorf("failed to set up connection: %w", err)
 	}
+	for i, message := range messages {
+		if e, ok := message.(*RESPError); ok {
+			_ = remote.Close()
+			return nil, xerrors.Errorf("%s failed: %s", setup[i][0], e.s)
+		}
+	}
+	return connection, nil
+}
+
+// statefulCommands leave state on a connection that would surprise the next request using it.
+var statefulCommands = map[string]struct{}{
+	"AUTH":       {},
+	"CLIENT":     {},
+	"HELLO":      {},
+	"MONITOR":    {},
+	"MULTI":      {},
+	"PSUBSCRIBE": {},
+	"READONLY":   {},
+	"READWRITE":  {},
+	"RESET":      {},
+	"SELECT":     {},
+	"SSUBSCRIBE": {},
+	"SUBSCRIBE":  {},
+	"SWAPDB":     {},
+	"WATCH":      {},
+	"QUIT":       {},
+}
 
-	return message, nil
+func isStatefulCommand(args []string) bool {
+	_, ok := statefulCommands[strings.ToUpper(args[0])]
+	return ok
+}
+
+// Pipeline sends commands in one round trip and returns a reply for each of them.
+func (c *Client) Pipeline(ctx context.Context, protocol int, db int, commands [][]string) ([]RESPMessage, error) {
+	pool := c.pool(protocol, db)
+	connection, err := pool.Get(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get connection: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = connection.conn.SetDeadline(deadline)
+	}
+	// A client that goes away unblocks the exchange, rather than leaving the connection waiting on e.g. BLPOP
+	stop := context.AfterFunc(ctx, func() {
+		_ = connection.conn.SetDeadline(time.Now())
+	})
+
+	messages, err := connection.exchange(commands...)
+	if !stop() {
+		pool.Discard(connection)
+		return nil, xerrors.Errorf("failed to execute commands: %w", context.Cause(ctx))
+	}
+	if err != nil {
+		pool.Discard(connection)
+		return nil, xerrors.Errorf("failed to execute commands: %w", err)
+	}
+
+	if slices.ContainsFunc(commands, isStatefulCommand) {
+		pool.Discard(connection)
+	} else {
+		_ = connection.conn.SetDeadline(time.Time{})
+		pool.Put(connection)
+	}
+	return messages, nil
+}
+
+func (c *Client) Execute(ctx context.Context, protocol int, db int, args []string) (RESPMessage, error) {
+	messages, err := c.Pipeline(ctx, protocol, db, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+// Transaction runs commands inside MULTI/EXEC. A command that Redis refuses to queue keeps its own error,
+// and the others get the error of EXEC.
+func (c *Client) Transaction(ctx context.Context, protocol int, db int, commands [][]string) ([]RESPMessage, error) {
+	pipeline := make([][]string, 0, len(commands)+2)
+	pipeline = append(pipeline, []string{"MULTI"})
+	pipeline = append(pipeline, commands...)
+	pipeline = append(pipeline, []string{"EXEC"})
+
+	messages, err := c.Pipeline(ctx, protocol, db, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := messages[0].(*RESPError); ok {
+		return nil, xerrors.Errorf("MULTI failed: %s", e.s)
+	}
+
+	queued := messages[1 : len(messages)-1]
+	switch exec := messages[len(messages)-1].(type) {
+	case *RESPArray:
+		if exec.a != nil && len(exec.a) == len(commands) {
+			return exec.a, nil
+		}
+	case *RESPError, *RESPBlobError:
+		results := make([]RESPMessage, len(commands))
+		for i, message := range queued {
+			if isError(message) {
+				results[i] = message
+			} else {
+				results[i] = exec
+			}
+		}
+		return results, nil
+	}
+	return nil, xerrors.Errorf("unexpected EXEC reply: %s", messages[len(messages)-1].String())
+}
+
+func isError(message RESPMessage) bool {
+	switch message.(type) {
+	case *RESPError, *RESPBlobError:
+		return true
+	}
+	return false
+}
+
+// respTypeName names the RESP type of a reply, so that clients can tell e.g. a status reply from a bulk string.
+func respTypeName(message RESPMessage) string {
+	switch m := message.(type) {
+	case *RESPSimpleString:
+		return "simple-string"
+	case *RESPError:
+		return "error"
+	case *RESPInteger:
+		return "integer"
+	case *RESPBulkString:
+		return "bulk-string"
+	case *RESPArray:
+		return "array"
+	case *RESPNull:
+		return "null"
+	case *RESPBoolean:
+		return "boolean"
+	case *RESPDouble:
+		return "double"
+	case *RESPBigNumber:
+		return "big-number"
+	case *RESPBlobError:
+		return "blob-error"
+	case *RESPVerbatimString:
+		return "verbatim-string"
+	case *RESPMap:
+		return "map"
+	case *RESPSet:
+		return "set"
+	case *RESPAttribute:
+		return respTypeName(m.message)
+	case *RESPPush:
+		return "push"
+	}
+	return "unknown"
+}
+
+type BatchResult struct {
+	Type  string      `json:"type"`
+	Value RESPMessage `json:"value"`
+}
+
+func newBatchResults(messages []RESPMessage) []BatchResult {
+	results := make([]BatchResult, 0, len(messages))
+	for _, message := range messages {
+		results = append(results, BatchResult{Type: respTypeName(message), Value: message})
+	}
+	return results
+}
+
+// transactionCommands cannot be nested in a batch that is wrapped in MULTI/EXEC.
+var transactionCommands = map[string]struct{}{
+	"DISCARD": {},
+	"EXEC":    {},
+	"MULTI":   {},
+	"WATCH":   {},
+	"UNWATCH": {},
+}
+
+// isNull reports whether the message is a RESP2 null bulk string or array, or a RESP3 null.
+func isNull(message RESPMessage) bool {
+	switch m := message.(type) {
+	case *RESPBulkString:
+		return m.s == nil
+	case *RESPArray:
+		return m.a == nil
+	case *RESPNull:
+		return true
+	}
+	return false
+}
+
+// protocolFromQuery returns the RESP version to negotiate with HELLO, 2 unless ?protocol=3 is given.
+func protocolFromQuery(r *http.Request) int {
+	if r.URL.Query().Get("protocol") == "3" {
+		return 3
+	}
+	return 2
 }
 
 func dbFromQuery(r *http.Request) int {
@@ -272,6 +994,533 @@ func dbFromQuery(r *http.Request) int {
 	return 0
 }
 
+const KubernetesServiceAccountCaCert = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+const KubernetesServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// keySpec returns the keys of a command, and false when they cannot be told from its arguments.
+type keySpec func(args []string) ([]string, bool)
+
+// keyAt takes the key at index i.
+func keyAt(i int) keySpec {
+	return func(args []string) ([]string, bool) {
+		if len(args) <= i {
+			return nil, false
+		}
+		return args[i : i+1], true
+	}
+}
+
+// keysFrom takes every argument from index i on, stepping over the values in between.
+func keysFrom(i int, step int) keySpec {
+	return func(args []string) ([]string, bool) {
+		if len(args) <= i || (len(args)-i)%step != 0 {
+			return nil, false
+		}
+		var keys []string
+		for j := i; j < len(args); j += step {
+			keys = append(keys, args[j])
+		}
+		return keys, true
+	}
+}
+
+// keysAt takes the n keys from index i, such as the source and destination of RENAME.
+func keysAt(i int, n int) keySpec {
+	return func(args []string) ([]string, bool) {
+		if len(args) < i+n {
+			return nil, false
+		}
+		return args[i : i+n], true
+	}
+}
+
+// keysBetween takes the arguments from index i up to the last n, such as the timeout of BLPOP.
+func keysBetween(i int, n int) keySpec {
+	return func(args []string) ([]string, bool) {
+		if len(args) <= i+n {
+			return nil, false
+		}
+		return args[i : len(args)-n], true
+	}
+}
+
+// keysAfterNumkeys takes the number of keys at index i and that many keys after it.
+func keysAfterNumkeys(i int) keySpec {
+	return func(args []string) ([]string, bool) {
+		if len(args) <= i {
+			return nil, false
+		}
+		numkeys, err := strconv.Atoi(args[i])
+		if err != nil || numkeys < 0 || len(args) < i+1+numkeys {
+			return nil, false
+		}
+		return args[i+1 : i+1+numkeys], true
+	}
+}
+
+// keyAndKeysAfterNumkeys takes the destination at index 1 and the keys counted at index 2, as ZUNIONSTORE does.
+func keyAndKeysAfterNumkeys(args []string) ([]string, bool) {
+	keys, ok := keysAfterNumkeys(2)(args)
+	if !ok {
+		return nil, false
+	}
+	return append([]string{args[1]}, keys...), true
+}
+
+// subcommandKey takes the key at index 2 of subcommands that have one, such as XINFO STREAM key.
+func subcommandKey(subcommands ...string) keySpec {
+	return func(args []string) ([]string, bool) {
+		if len(args) < 3 || !slices.Contains(subcommands, strings.ToUpper(args[1])) {
+			return nil, false
+		}
+		return args[2:3], true
+	}
+}
+
+func streamsKeys(args []string) ([]string, bool) {
+	for i, arg := range args {
+		if strings.ToUpper(arg) == "STREAMS" {
+			streams := args[i+1:]
+			if len(streams) == 0 || len(streams)%2 != 0 {
+				return nil, false
+			}
+			return streams[:len(streams)/2], true
+		}
+	}
+	return nil, false
+}
+
+// sortKeys takes the key and the STORE destination of SORT. BY and GET patterns with * read keys built from the elements,
+// which cannot be checked against the policy, so they are refused.
+func sortKeys(args []string) ([]string, bool) {
+	if len(args) < 2 {
+		return nil, false
+	}
+	keys := []string{args[1]}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BY", "GET":
+			if i+1 >= len(args) || strings.Contains(args[i+1], "*") {
+				return nil, false
+			}
+			i++
+		case "STORE":
+			if i+1 >= len(args) {
+				return nil, false
+			}
+			keys = append(keys, args[i+1])
+			i++
+		case "LIMIT":
+			i += 2
+		}
+	}
+	return keys, true
+}
+
+// commandKeySpecs lists where the keys of each command of commandCategories are. A command missing here has no keys,
+// and only keylessCommands may run under a rule restricted to keys.
+// https://redis.io/docs/latest/develop/reference/key-specs/
+var commandKeySpecs = func() map[string]keySpec {
+	specs := make(map[string]keySpec)
+	for _, s := range []struct {
+		spec     keySpec
+		commands []string
+	}{
+		{keyAt(1), []string{
+			"GET", "GETRANGE", "SUBSTR", "STRLEN", "TYPE", "TTL", "PTTL", "EXPIRETIME", "PEXPIRETIME", "DUMP",
+			"HGET", "HMGET", "HGETALL", "HKEYS", "HVALS", "HLEN", "HEXISTS", "HSTRLEN", "HSCAN", "HRANDFIELD",
+			"LRANGE", "LINDEX", "LLEN", "LPOS",
+			"SMEMBERS", "SISMEMBER", "SMISMEMBER", "SCARD", "SRANDMEMBER", "SSCAN",
+			"ZRANGE", "ZRANGEBYSCORE", "ZREVRANGE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX", "ZREVRANGEBYLEX", "ZSCORE", "ZMSCORE",
+			"ZRANK", "ZREVRANK", "ZCARD", "ZCOUNT", "ZLEXCOUNT", "ZSCAN", "ZRANDMEMBER",
+			"XRANGE", "XREVRANGE", "XLEN", "XPENDING",
+			"GETBIT", "BITCOUNT", "BITPOS", "BITFIELD_RO", "BITFIELD",
+			"GEOPOS", "GEODIST", "GEOHASH", "GEOSEARCH", "GEORADIUS_RO", "GEORADIUSBYMEMBER_RO",
+			"SET", "SETNX", "SETEX", "PSETEX", "GETSET", "GETDEL", "GETEX", "APPEND", "SETRANGE",
+			"INCR", "INCRBY", "INCRBYFLOAT", "DECR", "DECRBY",
+			"EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "PERSIST", "RESTORE",
+			"HSET", "HSETNX", "HMSET", "HDEL", "HINCRBY", "HINCRBYFLOAT",
+			"LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "LPOP", "RPOP", "LSET", "LREM", "LTRIM", "LINSERT",
+			"SADD", "SREM", "SPOP",
+			"ZADD", "ZREM", "ZINCRBY", "ZPOPMIN", "ZPOPMAX", "ZREMRANGEBYRANK", "ZREMRANGEBYSCORE", "ZREMRANGEBYLEX",
+			"XADD", "XDEL", "XTRIM", "XACK", "XCLAIM", "XAUTOCLAIM", "XSETID",
+			"SETBIT", "PFADD", "GEOADD",
+		}},
+		{keysFrom(1, 1), []string{
+			"MGET", "EXISTS", "TOUCH", "DEL", "UNLINK", "WATCH",
+			"SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE", "PFCOUNT", "PFMERGE",
+		}},
+		{keysFrom(1, 2), []string{"MSET", "MSETNX"}},
+		// BITOP operation destkey key [key ...]
+		{keysFrom(2, 1), []string{"BITOP"}},
+		{keysBetween(1, 1), []string{"BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX"}},
+		{keysAt(1, 2), []string{
+			"RENAME", "RENAMENX", "COPY", "SMOVE", "LMOVE", "BLMOVE", "RPOPLPUSH", "BRPOPLPUSH", "GEOSEARCHSTORE", "ZRANGESTORE", "LCS",
+		}},
+		{keysAfterNumkeys(1), []string{"SINTERCARD", "ZINTERCARD", "ZINTER", "ZUNION", "ZDIFF", "LMPOP", "ZMPOP"}},
+		{keysAfterNumkeys(2), []string{"EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO", "BLMPOP", "BZMPOP"}},
+		{keyAndKeysAfterNumkeys, []string{"ZINTERSTORE", "ZUNIONSTORE", "ZDIFFSTORE"}},
+		{streamsKeys, []string{"XREAD", "XREADGROUP"}},
+		{sortKeys, []string{"SORT", "SORT_RO"}},
+		{subcommandKey("STREAM", "GROUPS", "CONSUMERS"), []string{"XINFO"}},
+		{subcommandKey("CREATE", "SETID", "DESTROY", "CREATECONSUMER", "DELCONSUMER"), []string{"XGROUP"}},
+	} {
+		for _, command := range s.commands {
+			specs[command] = s.spec
+		}
+	}
+	return specs
+}()
+
+// keylessCommands may run under a rule restricted to keys, as they touch no data. Other commands without keys,
+// such as KEYS or PUBLISH, need a rule without keys.
+var keylessCommands = []string{"PING", "ECHO", "MULTI", "EXEC", "DISCARD", "UNWATCH"}
+
+// commandKeys returns the keys args touch, and false when they cannot be told, such as for malformed arguments.
+func commandKeys(args []string) ([]string, bool) {
+	spec, ok := commandKeySpecs[strings.ToUpper(args[0])]
+	if !ok {
+		return nil, true
+	}
+	return spec(args)
+}
+
+const (
+	CategoryRead        = "read"
+	CategoryWrite       = "write"
+	CategoryKeyspace    = "keyspace"
+	CategoryPubSub      = "pubsub"
+	CategoryTransaction = "transaction"
+	CategoryScripting   = "scripting"
+	CategoryConnection  = "connection"
+	CategoryAdmin       = "admin"
+)
+
+var commandCategories = func() map[string]string {
+	categories := make(map[string]string)
+	for category, commands := range map[string][]string{
+		CategoryRead: {
+			"GET", "MGET", "GETRANGE", "SUBSTR", "STRLEN", "LCS", "EXISTS", "TYPE", "TTL", "PTTL", "EXPIRETIME", "PEXPIRETIME", "TOUCH", "DUMP",
+			"HGET", "HMGET", "HGETALL", "HKEYS", "HVALS", "HLEN", "HEXISTS", "HSTRLEN", "HSCAN", "HRANDFIELD",
+			"LRANGE", "LINDEX", "LLEN", "LPOS",
+			"SMEMBERS", "SISMEMBER", "SMISMEMBER", "SCARD", "SRANDMEMBER", "SSCAN", "SINTER", "SUNION", "SDIFF", "SINTERCARD",
+			"ZRANGE", "ZRANGEBYSCORE", "ZREVRANGE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX", "ZREVRANGEBYLEX", "ZSCORE", "ZMSCORE",
+			"ZRANK", "ZREVRANK", "ZCARD", "ZCOUNT", "ZLEXCOUNT", "ZSCAN", "ZRANDMEMBER", "ZINTER", "ZUNION", "ZDIFF", "ZINTERCARD",
+			"XRANGE", "XREVRANGE", "XLEN", "XREAD", "XINFO", "XPENDING",
+			"GETBIT", "BITCOUNT", "BITPOS", "BITFIELD_RO", "PFCOUNT",
+			"GEOPOS", "GEODIST", "GEOHASH", "GEOSEARCH", "GEORADIUS_RO", "GEORADIUSBYMEMBER_RO", "SORT_RO",
+		},
+		CategoryWrite: {
+			"SET", "SETNX", "SETEX", "PSETEX", "MSET", "MSETNX", "GETSET", "GETDEL", "GETEX", "APPEND", "SETRANGE",
+			"INCR", "INCRBY", "INCRBYFLOAT", "DECR", "DECRBY",
+			"DEL", "UNLINK", "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "PERSIST", "RENAME", "RENAMENX", "COPY", "RESTORE",
+			"HSET", "HSETNX", "HMSET", "HDEL", "HINCRBY", "HINCRBYFLOAT",
+			"LPUSH", "RPUSH", "LPUSHX", "RPUSHX", "LPOP", "RPOP", "LSET", "LREM", "LTRIM", "LINSERT", "LMOVE", "RPOPLPUSH", "LMPOP",
+			"BLPOP", "BRPOP", "BLMOVE", "BRPOPLPUSH", "BLMPOP",
+			"SADD", "SREM", "SPOP", "SMOVE", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE",
+			"ZADD", "ZREM", "ZINCRBY", "ZPOPMIN", "ZPOPMAX", "ZMPOP", "BZPOPMIN", "BZPOPMAX", "BZMPOP",
+			"ZREMRANGEBYRANK", "ZREMRANGEBYSCORE", "ZREMRANGEBYLEX", "ZRANGESTORE", "ZINTERSTORE", "ZUNIONSTORE", "ZDIFFSTORE",
+			"XADD", "XDEL", "XTRIM", "XGROUP", "XACK", "XCLAIM", "XAUTOCLAIM", "XREADGROUP", "XSETID",
+			"SETBIT", "BITOP", "BITFIELD", "PFADD", "PFMERGE", "GEOADD", "GEOSEARCHSTORE", "SORT",
+		},
+		CategoryKeyspace:    {"KEYS", "SCAN", "RANDOMKEY", "DBSIZE"},
+		CategoryPubSub:      {"PUBLISH", "SPUBLISH", "PUBSUB"},
+		CategoryTransaction: {"MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH"},
+		CategoryScripting:   {"EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO"},
+		CategoryConnection:  {"PING", "ECHO"},
+	} {
+		for _, command := range commands {
+			categories[command] = category
+		}
+	}
+	return categories
+}()
+
+// commandCategory falls back to admin, so that a command missing from the table is denied unless admin is granted.
+func commandCategory(args []string) string {
+	if category, ok := commandCategories[strings.ToUpper(args[0])]; ok {
+		return category
+	}
+	return CategoryAdmin
+}
+
+// matchGlob matches s against a pattern where * matches any sequence and ? any single byte.
+func matchGlob(pattern string, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func matchAnyGlob(patterns []string, s string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return matchGlob(pattern, s)
+	})
+}
+
+type PolicyRule struct {
+	// Identities are globs of usernames such as system:serviceaccount:default:*, or names of API keys.
+	Identities []string `json:"identities"`
+	Categories []string `json:"categories"`
+	// Keys are globs every key of a command must match. No keys means any key.
+	Keys []string `json:"keys"`
+	// DBs are the databases the rule applies to. No DBs means DB 0 only.
+	DBs []int `json:"dbs"`
+}
+
+type Policy struct {
+	// APIKeys maps an identity to the hex-encoded SHA-256 of its key, so that the policy holds no secret.
+	APIKeys map[string]string `json:"apiKeys"`
+	Rules   []PolicyRule      `json:"rules"`
+}
+
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read policy: %w", err)
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, xerrors.Errorf("failed to parse policy: %w", err)
+	}
+
+	for identity, digest := range policy.APIKeys {
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return nil, xerrors.Errorf("API key of %s is not a hex-encoded SHA-256", identity)
+		}
+	}
+	known := []string{CategoryRead, CategoryWrite, CategoryKeyspace, CategoryPubSub, CategoryTransaction, CategoryScripting, CategoryConnection, CategoryAdmin}
+	for _, rule := range policy.Rules {
+		for _, category := range rule.Categories {
+			if !slices.Contains(known, category) {
+				return nil, xerrors.Errorf("unknown category: %s", category)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// IdentityForAPIKey returns the identity whose key hashes to the same digest.
+func (p *Policy) IdentityForAPIKey(key string) (string, bool) {
+	digest := sha256.Sum256([]byte(key))
+	for identity, want := range p.APIKeys {
+		b, _ := hex.DecodeString(want)
+		if subtle.ConstantTimeCompare(digest[:], b) == 1 {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+// Authorize allows a command on db when one rule of the identity grants its category and covers all of its keys.
+// Under a rule restricted to keys, a command is denied when its keys cannot be told, or when it has none and is not one of keylessCommands.
+func (p *Policy) Authorize(identity string, db int, args []string) error {
+	category := commandCategory(args)
+	keys, known := commandKeys(args)
+	for _, rule := range p.Rules {
+		if !matchAnyGlob(rule.Identities, identity) || !slices.Contains(rule.Categories, category) {
+			continue
+		}
+		if !slices.Contains(rule.DBs, db) && (len(rule.DBs) > 0 || db != 0) {
+			continue
+		}
+		if len(rule.Keys) == 0 {
+			return nil
+		}
+		if !known || (len(keys) == 0 && !slices.Contains(keylessCommands, strings.ToUpper(args[0]))) {
+			continue
+		}
+		if !slices.ContainsFunc(keys, func(key string) bool {
+			return !matchAnyGlob(rule.Keys, key)
+		}) {
+			return nil
+		}
+	}
+	return xerrors.Errorf("%s is not allowed %s of category %s on %v in db %d", identity, strings.ToUpper(args[0]), category, keys, db)
+}
+
+type tokenReviewResult struct {
+	username  string
+	expiresAt time.Time
+}
+
+// TokenReviewer authenticates bearer tokens with the TokenReview API, remembering the result for a while
+// so that a burst of requests with the same token reaches the API server once.
+type TokenReviewer struct {
+	URL       string
+	Audiences []string
+	TokenFile string
+	Client    *http.Client
+	CacheTTL  time.Duration
+
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]tokenReviewResult
+}
+
+func (t *TokenReviewer) Review(ctx context.Context, token string) (string, error) {
+	digest := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	t.mutex.Lock()
+	if result, ok := t.cache[digest]; ok && now.Before(result.expiresAt) {
+		t.mutex.Unlock()
+		return result.username, nil
+	}
+	t.mutex.Unlock()
+
+	serviceAccountToken, err := os.ReadFile(t.TokenFile)
+	if err != nil {
+		return "", xerrors.Errorf("failed to read service account token: %w", err)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenReview",
+		"spec": map[string]any{
+			"token":     token,
+			"audiences": t.Audiences,
+		},
+	})
+	if err != nil {
+		return "", xerrors.Errorf("failed to marshal TokenReview: %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", xerrors.Errorf("failed to create request: %w", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(serviceAccountToken)))
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := t.Client.Do(request)
+	if err != nil {
+		return "", xerrors.Errorf("failed to request TokenReview: %w", err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+		return "", xerrors.Errorf("TokenReview returned %d", response.StatusCode)
+	}
+
+	var review struct {
+		Status struct {
+			Authenticated bool   `json:"authenticated"`
+			Error         string `json:"error"`
+			User          struct {
+				Username string `json:"username"`
+			} `json:"user"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&review); err != nil {
+		return "", xerrors.Errorf("failed to decode TokenReview: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return "", xerrors.Errorf("token is not authenticated: %s", review.Status.Error)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.cache == nil {
+		t.cache = make(map[[sha256.Size]byte]tokenReviewResult)
+	}
+	for k, result := range t.cache {
+		if now.After(result.expiresAt) {
+			delete(t.cache, k)
+		}
+	}
+	t.cache[digest] = tokenReviewResult{
+		username:  review.Status.User.Username,
+		expiresAt: now.Add(t.CacheTTL),
+	}
+	return review.Status.User.Username, nil
+}
+
+// Guard authenticates the caller of a request and authorizes its commands, auditing every refusal.
+type Guard struct {
+	Policy        *Policy
+	TokenReviewer *TokenReviewer
+	Logger        *slog.Logger
+}
+
+func (g *Guard) authenticate(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", xerrors.New("missing bearer token")
+	}
+
+	if identity, ok := g.Policy.IdentityForAPIKey(token); ok {
+		return identity, nil
+	}
+	if g.TokenReviewer == nil {
+		return "", xerrors.New("unknown API key")
+	}
+	identity, err := g.TokenReviewer.Review(r.Context(), token)
+	if err != nil {
+		return "", xerrors.Errorf("failed to review token: %w", err)
+	}
+	return identity, nil
+}
+
+// Authorize writes 401 or 403 and returns false unless every command is allowed on db. A nil Guard allows everything.
+func (g *Guard) Authorize(w http.ResponseWriter, r *http.Request, db int, commands ...[]string) bool {
+	if g == nil {
+		return true
+	}
+
+	identity, err := g.authenticate(r)
+	if err != nil {
+		g.Logger.Warn("unauthenticated",
+			slog.String("remote", r.RemoteAddr),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("error", err.Error()),
+		)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+
+	for _, args := range commands {
+		if err := g.Policy.Authorize(identity, db, args); err != nil {
+			keys, _ := commandKeys(args)
+			g.Logger.Warn("denied",
+				slog.String("identity", identity),
+				slog.String("remote", r.RemoteAddr),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("command", strings.ToUpper(args[0])),
+				slog.String("category", commandCategory(args)),
+				slog.Any("keys", keys),
+				slog.Int("db", db),
+			)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
 func envOrDefaultValue[T any](key string, defaultValue T) T {
 	value, exists := os.LookupEnv(key)
 	if !exists {
@@ -318,17 +1567,102 @@ func main() {
 	var localAddress string
 	var remoteAddress string
 	var connectTimeout time.Duration
+	var maxIdleConnections int
+	var maxIdleTime time.Duration
+	var maxBatchSize int
+	var policyFile string
+	var tokenReviewURL string
+	var tokenReviewAudiences string
+	var tokenReviewCacheTTL time.Duration
 	var terminationGracePeriod time.Duration
 	var lameduck time.Duration
 	var keepAlive bool
 	flag.StringVar(&localAddress, "local-address", envOrDefaultValue("LOCAL_ADDRESS", "0.0.0.0:8080"), "Local listen address")
 	flag.StringVar(&remoteAddress, "remote-address", envOrDefaultValue("REMOTE_ADDRESS", "127.0.0.1:6379"), "Remote upstream address")
 	flag.DurationVar(&connectTimeout, "connect-timeout", envOrDefaultValue("CONNECT_TIMEOUT", 10*time.Second), "TCP connection timeout")
+	flag.IntVar(&maxIdleConnections, "max-idle-connections", envOrDefaultValue("MAX_IDLE_CONNECTIONS", 16), "Maximum number of idle connections kept across all DBs and protocols")
+	flag.DurationVar(&maxIdleTime, "max-idle-time", envOrDefaultValue("MAX_IDLE_TIME", 1*time.Minute), "Maximum idle time of a pooled connection")
+	flag.IntVar(&maxBatchSize, "max-batch-size", envOrDefaultValue("MAX_BATCH_SIZE", 1000), "Maximum number of commands in a batch")
+	flag.StringVar(&policyFile, "policy-file", envOrDefaultValue("POLICY_FILE", ""), "Access control policy file. Every command is allowed without it.")
+	flag.StringVar(&tokenReviewURL, "token-review-url", envOrDefaultValue("TOKEN_REVIEW_URL", "https://kubernetes.default.svc.cluster.local/apis/authentication.k8s.io/v1/tokenreviews"), "TokenReview endpoint to authenticate bearer tokens. Empty accepts only API keys.")
+	flag.StringVar(&tokenReviewAudiences, "token-review-audiences", envOrDefaultValue("TOKEN_REVIEW_AUDIENCES", ""), "Comma-separated audiences a bearer token must be issued for. Default is the API server's.")
+	flag.DurationVar(&tokenReviewCacheTTL, "token-review-cache-ttl", envOrDefaultValue("TOKEN_REVIEW_CACHE_TTL", 1*time.Minute), "How long a reviewed token is trusted without asking again")
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
 	flag.Parse()
 
+	logLevel := slog.LevelInfo
+	if v, ok := os.LookupEnv("GO_LOG"); ok {
+		if err := logLevel.UnmarshalText([]byte(v)); err != nil {
+			log.Fatalf("failed to parse log level: %+v", err)
+		}
+	}
+	handlerOpts := &slog.HandlerOptions{
+		Level: logLevel,
+		// https://opentelemetry.io/docs/specs/otel/logs/data-model/
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			switch a.Key {
+			case slog.LevelKey:
+				a.Key = "severitytext"
+			case slog.MessageKey:
+				a.Key = "body"
+			}
+			return a
+		},
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts))
+
+	var guard *Guard
+	if policyFile != "" {
+		policy, err := LoadPolicy(policyFile)
+		if err != nil {
+			log.Fatalf("failed to load policy: %+v", err)
+		}
+		guard = &Guard{
+			Policy: policy,
+			Logger: logger,
+		}
+
+		if tokenReviewURL != "" {
+			caCert, err := os.ReadFile(KubernetesServiceAccountCaCert)
+			if err != nil {
+				log.Fatalf("failed to read CA certificate: %+v", err)
+			}
+			transport := &http.Transport{
+				MaxIdleConnsPerHost: http.DefaultTransport.(*http.Transport).MaxIdleConns,
+				TLSClientConfig: &tls.Config{
+					RootCAs: x509.NewCertPool(),
+				},
+			}
+			transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(caCert)
+
+			var audiences []string
+			for _, audience := range strings.Split(tokenReviewAudiences, ",") {
+				if audience = strings.TrimSpace(audience); audience != "" {
+					audiences = append(audiences, audience)
+				}
+			}
+			guard.TokenReviewer = &TokenReviewer{
+				URL:       tokenReviewURL,
+				Audiences: audiences,
+				TokenFile: KubernetesServiceAccountToken,
+				Client: &http.Client{
+					Transport: transport,
+					Timeout:   connectTimeout,
+				},
+				CacheTTL: tokenReviewCacheTTL,
+			}
+		}
+	}
+
+	client := NewClient(&ClientOption{
+		RemoteAddress:      remoteAddress,
+		ConnectTimeout:     connectTimeout,
+		MaxIdleConnections: maxIdleConnections,
+		MaxIdleTime:        maxIdleTime,
+	})
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -349,7 +1683,11 @@ func main() {
 			return
 		}
 
-		message, err := executeRedis(remoteAddress, connectTimeout, 0, args)
+		if !guard.Authorize(w, r, 0, args) {
+			return
+		}
+
+		message, err := client.Execute(r.Context(), protocolFromQuery(r), 0, args)
 		if err != nil {
 			log.Printf("redis error: %+v", err)
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
@@ -361,18 +1699,68 @@ func main() {
 		_ = json.NewEncoder(w).Encode(message)
 	})
 
+	mux.HandleFunc("POST /batch", func(w http.ResponseWriter, r *http.Request) {
+		var commands [][]string
+		if err := json.NewDecoder(r.Body).Decode(&commands); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if len(commands) == 0 || len(commands) > maxBatchSize {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		_, transaction := r.URL.Query()["transaction"]
+		for _, args := range commands {
+			if len(args) == 0 {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if _, ok := transactionCommands[strings.ToUpper(args[0])]; ok && transaction {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !guard.Authorize(w, r, dbFromQuery(r), commands...) {
+			return
+		}
+
+		var messages []RESPMessage
+		var err error
+		if transaction {
+			messages, err = client.Transaction(r.Context(), protocolFromQuery(r), dbFromQuery(r), commands)
+		} else {
+			messages, err = client.Pipeline(r.Context(), protocolFromQuery(r), dbFromQuery(r), commands)
+		}
+		if err != nil {
+			log.Printf("redis error: %+v", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(newBatchResults(messages))
+	})
+
 	mux.HandleFunc("GET /{key}/{field}", func(w http.ResponseWriter, r *http.Request) {
 		key := r.PathValue("key")
 		field := r.PathValue("field")
 
-		message, err := executeRedis(remoteAddress, connectTimeout, dbFromQuery(r), []string{"HGET", key, field})
+		if !guard.Authorize(w, r, dbFromQuery(r), []string{"HGET", key, field}) {
+			return
+		}
+
+		message, err := client.Execute(r.Context(), protocolFromQuery(r), dbFromQuery(r), []string{"HGET", key, field})
 		if err != nil {
 			log.Printf("redis error: %+v", err)
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 			return
 		}
 
-		if v, ok := message.(*RESPBulkString); ok && v.s == nil {
+		if isNull(message) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -387,7 +1775,11 @@ func main() {
 		key := r.PathValue("key")
 
 		if r.Method == http.MethodHead {
-			message, err := executeRedis(remoteAddress, connectTimeout, dbFromQuery(r), []string{"EXISTS", key})
+			if !guard.Authorize(w, r, dbFromQuery(r), []string{"EXISTS", key}) {
+				return
+			}
+
+			message, err := client.Execute(r.Context(), protocolFromQuery(r), dbFromQuery(r), []string{"EXISTS", key})
 			if err != nil {
 				log.Printf("redis error: %+v", err)
 				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
@@ -401,14 +1793,18 @@ func main() {
 			return
 		}
 
-		message, err := executeRedis(remoteAddress, connectTimeout, dbFromQuery(r), []string{"GET", key})
+		if !guard.Authorize(w, r, dbFromQuery(r), []string{"GET", key}) {
+			return
+		}
+
+		message, err := client.Execute(r.Context(), protocolFromQuery(r), dbFromQuery(r), []string{"GET", key})
 		if err != nil {
 			log.Printf("redis error: %+v", err)
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
 			return
 		}
 
-		if v, ok := message.(*RESPBulkString); ok && v.s == nil {
+		if isNull(message) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -434,7 +1830,11 @@ func main() {
 			return
 		}
 
-		message, err := executeRedis(remoteAddress, connectTimeout, dbFromQuery(r), []string{"HSET", key, field, value})
+		if !guard.Authorize(w, r, dbFromQuery(r), []string{"HSET", key, field, value}) {
+			return
+		}
+
+		message, err := client.Execute(r.Context(), protocolFromQuery(r), dbFromQuery(r), []string{"HSET", key, field, value})
 		if err != nil {
 			log.Printf("redis error: %+v", err)
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
@@ -475,7 +1875,11 @@ func main() {
 			args = append(args, "XX")
 		}
 
-		message, err := executeRedis(remoteAddress, connectTimeout, dbFromQuery(r), args)
+		if !guard.Authorize(w, r, dbFromQuery(r), args) {
+			return
+		}
+
+		message, err := client.Execute(r.Context(), protocolFromQuery(r), dbFromQuery(r), args)
 		if err != nil {
 			log.Printf("redis error: %+v", err)
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
@@ -483,7 +1887,7 @@ func main() {
 		}
 
 		// SET with NX returns nil when key already exists
-		if v, ok := message.(*RESPBulkString); ok && v.s == nil {
+		if isNull(message) {
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
@@ -497,7 +1901,11 @@ func main() {
 		key := r.PathValue("key")
 		field := r.PathValue("field")
 
-		message, err := executeRedis(remoteAddress, connectTimeout, dbFromQuery(r), []string{"HDEL", key, field})
+		if !guard.Authorize(w, r, dbFromQuery(r), []string{"HDEL", key, field}) {
+			return
+		}
+
+		message, err := client.Execute(r.Context(), protocolFromQuery(r), dbFromQuery(r), []string{"HDEL", key, field})
 		if err != nil {
 			log.Printf("redis error: %+v", err)
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
@@ -515,7 +1923,11 @@ func main() {
 	mux.HandleFunc("DELETE /{key}", func(w http.ResponseWriter, r *http.Request) {
 		key := r.PathValue("key")
 
-		message, err := executeRedis(remoteAddress, connectTimeout, dbFromQuery(r), []string{"DEL", key})
+		if !guard.Authorize(w, r, dbFromQuery(r), []string{"DEL", key}) {
+			return
+		}
+
+		message, err := client.Execute(r.Context(), protocolFromQuery(r), dbFromQuery(r), []string{"DEL", key})
 		if err != nil {
 			log.Printf("redis error: %+v", err)
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
@@ -531,7 +1943,13 @@ func main() {
 	})
 
 	mux.HandleFunc("PURGE /", func(w http.ResponseWriter, r *http.Request) {
-		message, err := executeRedis(remoteAddress, connectTimeout, dbFromQuery(r), []string{"FLUSHALL", "ASYNC"})
+		// Only the DB the caller is authorized for is flushed, as FLUSHALL would reach every other DB too
+		command := []string{"FLUSHDB", "ASYNC"}
+		if !guard.Authorize(w, r, dbFromQuery(r), command) {
+			return
+		}
+
+		message, err := client.Execute(r.Context(), protocolFromQuery(r), dbFromQuery(r), command)
 		if err != nil {
 			log.Printf("redis error: %+v", err)
 			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
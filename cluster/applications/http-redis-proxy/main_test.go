@@ -2,8 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -70,6 +88,84 @@ func TestRedisProtocolParser_Parse(t *testing.T) {
 			}},
 			false,
 		},
+		{
+			"null",
+			[]byte("_\r\n"),
+			&RESPNull{},
+			false,
+		},
+		{
+			"boolean",
+			[]byte("#t\r\n"),
+			&RESPBoolean{b: true},
+			false,
+		},
+		{
+			"double",
+			[]byte(",3.14\r\n"),
+			&RESPDouble{f: 3.14},
+			false,
+		},
+		{
+			"double infinity",
+			[]byte(",-inf\r\n"),
+			&RESPDouble{f: math.Inf(-1)},
+			false,
+		},
+		{
+			"big number",
+			[]byte("(3492890328409238509324850943850943825024385\r\n"),
+			&RESPBigNumber{s: "3492890328409238509324850943850943825024385"},
+			false,
+		},
+		{
+			"blob error",
+			[]byte("!21\r\nSYNTAX invalid syntax\r\n"),
+			&RESPBlobError{s: "SYNTAX invalid syntax"},
+			false,
+		},
+		{
+			"verbatim string",
+			[]byte("=15\r\ntxt:Some string\r\n"),
+			&RESPVerbatimString{format: "txt", s: "Some string"},
+			false,
+		},
+		{
+			"map",
+			[]byte("%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n"),
+			&RESPMap{m: []RESPMessage{&RESPSimpleString{s: "first"}, &RESPInteger{i: 1}, &RESPSimpleString{s: "second"}, &RESPInteger{i: 2}}},
+			false,
+		},
+		{
+			"set",
+			[]byte("~2\r\n+orange\r\n+apple\r\n"),
+			&RESPSet{a: []RESPMessage{&RESPSimpleString{s: "orange"}, &RESPSimpleString{s: "apple"}}},
+			false,
+		},
+		{
+			"attribute",
+			[]byte("|1\r\n+ttl\r\n:3600\r\n+value\r\n"),
+			&RESPAttribute{m: []RESPMessage{&RESPSimpleString{s: "ttl"}, &RESPInteger{i: 3600}}, message: &RESPSimpleString{s: "value"}},
+			false,
+		},
+		{
+			"push",
+			[]byte(">2\r\n+pubsub\r\n+message\r\n"),
+			&RESPPush{a: []RESPMessage{&RESPSimpleString{s: "pubsub"}, &RESPSimpleString{s: "message"}}},
+			false,
+		},
+		{
+			"invalid boolean",
+			[]byte("#x\r\n"),
+			nil,
+			true,
+		},
+		{
+			"invalid big number",
+			[]byte("(12a\r\n"),
+			nil,
+			true,
+		},
 		{
 			"invalid type",
 			[]byte("invalid\r\n"),
@@ -192,6 +288,61 @@ func TestRESPMessage_MarshalJSON(t *testing.T) {
 			&RESPArray{a: nil},
 			`null`,
 		},
+		{
+			"null",
+			&RESPNull{},
+			`null`,
+		},
+		{
+			"boolean",
+			&RESPBoolean{b: false},
+			`false`,
+		},
+		{
+			"double",
+			&RESPDouble{f: 1.5},
+			`1.5`,
+		},
+		{
+			"double infinity",
+			&RESPDouble{f: math.Inf(1)},
+			`"inf"`,
+		},
+		{
+			"big number",
+			&RESPBigNumber{s: "3492890328409238509324850943850943825024385"},
+			`3492890328409238509324850943850943825024385`,
+		},
+		{
+			"blob error",
+			&RESPBlobError{s: "SYNTAX invalid syntax"},
+			`{"error":"SYNTAX invalid syntax"}`,
+		},
+		{
+			"verbatim string",
+			&RESPVerbatimString{format: "txt", s: "Some string"},
+			`"Some string"`,
+		},
+		{
+			"map",
+			&RESPMap{m: []RESPMessage{&RESPSimpleString{s: "server"}, &RESPBulkString{s: p("redis")}, &RESPInteger{i: 1}, &RESPBoolean{b: true}}},
+			`{"server":"redis","1":true}`,
+		},
+		{
+			"set",
+			&RESPSet{a: []RESPMessage{&RESPInteger{i: 1}}},
+			`[1]`,
+		},
+		{
+			"attribute",
+			&RESPAttribute{m: []RESPMessage{&RESPSimpleString{s: "ttl"}, &RESPInteger{i: 3600}}, message: &RESPInteger{i: 42}},
+			`42`,
+		},
+		{
+			"push",
+			&RESPPush{a: []RESPMessage{&RESPBulkString{s: p("message")}}},
+			`["message"]`,
+		},
 	}
 	for _, tt := range tests {
 		name := tt.name
@@ -210,6 +361,52 @@ func TestRESPMessage_MarshalJSON(t *testing.T) {
 	}
 }
 
+func TestIsNull(t *testing.T) {
+	tests := []struct {
+		name string
+		in   RESPMessage
+		want bool
+	}{
+		{
+			"bulk string null",
+			&RESPBulkString{s: nil},
+			true,
+		},
+		{
+			"array null",
+			&RESPArray{a: nil},
+			true,
+		},
+		{
+			"null",
+			&RESPNull{},
+			true,
+		},
+		{
+			"empty bulk string",
+			&RESPBulkString{s: p("")},
+			false,
+		},
+		{
+			"integer",
+			&RESPInteger{i: 0},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := isNull(in)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func BenchmarkEncodeCommand(b *testing.B) {
 	args := []string{"SET", "key", "value"}
 	for i := 0; i < b.N; i++ {
@@ -224,3 +421,659 @@ func BenchmarkRedisProtocolParser_Parse(b *testing.B) {
 		_, _ = parser.Parse()
 	}
 }
+
+// mockRedis understands just enough commands to exercise pooling, pipelining and transactions.
+type mockRedis struct {
+	listener    net.Listener
+	connections atomic.Int64
+
+	mutex sync.Mutex
+	data  map[int]map[string]string
+}
+
+func newMockRedis(t *testing.T) *mockRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockRedis{
+		listener: listener,
+		data:     make(map[int]map[string]string),
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			m.connections.Add(1)
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *mockRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	parser := NewRedisProtocolParser(conn)
+	db := 0
+	var queue [][]string
+	multi := false
+	aborted := false
+	for {
+		message, err := parser.Parse()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range message.(*RESPArray).a {
+			args = append(args, *arg.(*RESPBulkString).s)
+		}
+
+		command := strings.ToUpper(args[0])
+		if multi && command != "EXEC" {
+			if _, ok := map[string]struct{}{"SET": {}, "GET": {}, "INCR": {}}[command]; !ok {
+				aborted = true
+				_, _ = conn.Write([]byte("-ERR unknown command\r\n"))
+				continue
+			}
+			queue = append(queue, args)
+			_, _ = conn.Write([]byte("+QUEUED\r\n"))
+			continue
+		}
+
+		switch command {
+		case "BLPOP":
+			// Never answered, as if the list stayed empty
+		case "SELECT":
+			db = int(args[1][0] - '0')
+			_, _ = conn.Write([]byte("+OK\r\n"))
+		case "MULTI":
+			multi = true
+			_, _ = conn.Write([]byte("+OK\r\n"))
+		case "EXEC":
+			if aborted {
+				_, _ = conn.Write([]byte("-EXECABORT Transaction discarded because of previous errors.\r\n"))
+			} else {
+				reply := "*" + strconv.Itoa(len(queue)) + "\r\n"
+				for _, queued := range queue {
+					reply += m.execute(db, queued)
+				}
+				_, _ = conn.Write([]byte(reply))
+			}
+			multi, aborted, queue = false, false, nil
+		default:
+			_, _ = conn.Write([]byte(m.execute(db, args)))
+		}
+	}
+}
+
+func (m *mockRedis) execute(db int, args []string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.data[db] == nil {
+		m.data[db] = make(map[string]string)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		m.data[db][args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		v, ok := m.data[db][args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func newTestClient(m *mockRedis) *Client {
+	return NewClient(&ClientOption{
+		RemoteAddress:      m.listener.Addr().String(),
+		ConnectTimeout:     time.Second,
+		MaxIdleConnections: 2,
+		MaxIdleTime:        time.Minute,
+	})
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	m := newMockRedis(t)
+	client := newTestClient(m)
+
+	got, err := client.Pipeline(t.Context(), 2, 1, [][]string{{"SET", "a", "1"}, {"GET", "a"}, {"GET", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RESPMessage{&RESPSimpleString{s: "OK"}, &RESPBulkString{s: p("1")}, &RESPBulkString{s: nil}}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(RESPSimpleString{}, RESPBulkString{})); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+
+	// The pooled connection stays on DB 1.
+	message, err := client.Execute(t.Context(), 2, 1, []string{"GET", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(RESPMessage(&RESPBulkString{s: p("1")}), message, cmp.AllowUnexported(RESPBulkString{})); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+	message, err = client.Execute(t.Context(), 2, 0, []string{"GET", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isNull(message) {
+		t.Errorf("got %s from DB 0, want null", message.String())
+	}
+
+	if got := m.connections.Load(); got != 2 {
+		t.Errorf("got %d connections, want one per DB", got)
+	}
+}
+
+func TestClient_Pipeline_StatefulCommand(t *testing.T) {
+	m := newMockRedis(t)
+	client := newTestClient(m)
+
+	if _, err := client.Execute(t.Context(), 2, 0, []string{"SELECT", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Execute(t.Context(), 2, 0, []string{"SET", "a", "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := client.Execute(t.Context(), 2, 2, []string{"GET", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isNull(message) {
+		t.Errorf("SELECT leaked into the pool: got %s from DB 2", message.String())
+	}
+	if got := m.connections.Load(); got != 3 {
+		t.Errorf("got %d connections, want 3", got)
+	}
+}
+
+func TestClient_Pipeline_Canceled(t *testing.T) {
+	m := newMockRedis(t)
+	client := newTestClient(m)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := client.Execute(ctx, 2, 0, []string{"BLPOP", "a", "0"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	// The connection still waiting on BLPOP is not reused
+	if _, err := client.Execute(t.Context(), 2, 0, []string{"SET", "a", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.connections.Load(); got != 2 {
+		t.Errorf("got %d connections, want 2", got)
+	}
+}
+
+func TestClient_MaxIdleConnections(t *testing.T) {
+	client := newTestClient(newMockRedis(t))
+
+	for db := range 4 {
+		if _, err := client.Execute(t.Context(), 2, db, []string{"SET", "a", "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idle := 0
+	for _, pool := range client.pools {
+		idle += pool.IdleConnections()
+	}
+	if idle != 2 {
+		t.Errorf("got %d idle connections across DBs, want 2", idle)
+	}
+}
+
+func TestClient_Transaction(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands [][]string
+		want     []BatchResult
+	}{
+		{
+			"exec",
+			[][]string{{"SET", "a", "1"}, {"GET", "a"}},
+			[]BatchResult{
+				{Type: "simple-string", Value: &RESPSimpleString{s: "OK"}},
+				{Type: "bulk-string", Value: &RESPBulkString{s: p("1")}},
+			},
+		},
+		{
+			"aborted",
+			[][]string{{"SET", "a", "1"}, {"UNKNOWN"}},
+			[]BatchResult{
+				{Type: "error", Value: &RESPError{s: "EXECABORT Transaction discarded because of previous errors."}},
+				{Type: "error", Value: &RESPError{s: "ERR unknown command"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		commands := tt.commands
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			client := newTestClient(newMockRedis(t))
+			messages, err := client.Transaction(t.Context(), 2, 0, commands)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, newBatchResults(messages), cmp.AllowUnexported(RESPSimpleString{}, RESPBulkString{}, RESPError{})); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBatchResult_MarshalJSON(t *testing.T) {
+	results := newBatchResults([]RESPMessage{
+		&RESPSimpleString{s: "OK"},
+		&RESPInteger{i: 1},
+		&RESPBulkString{s: nil},
+		&RESPAttribute{m: []RESPMessage{&RESPSimpleString{s: "ttl"}, &RESPInteger{i: 1}}, message: &RESPBoolean{b: true}},
+	})
+
+	got, err := json.Marshal(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"type":"simple-string","value":"OK"},{"type":"integer","value":1},{"type":"bulk-string","value":null},{"type":"boolean","value":true}]`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"exact", "user:1", "user:1", true},
+		{"star suffix", "user:*", "user:1:profile", true},
+		{"star middle", "user:*:profile", "user:1:profile", true},
+		{"star empty", "user:*", "user:", true},
+		{"question", "user:?", "user:1", true},
+		{"question too short", "user:?", "user:", false},
+		{"mismatch", "user:*", "session:1", false},
+		{"backtrack", "*a*b", "xaxxb", true},
+		{"backtrack mismatch", "*a*b", "xaxxc", false},
+		{"service account", "system:serviceaccount:default:*", "system:serviceaccount:kube-system:a", false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		pattern := tt.pattern
+		in := tt.s
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := matchGlob(pattern, in); got != want {
+				t.Errorf("matchGlob(%q, %q) = %v, want %v", pattern, in, got, want)
+			}
+		})
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantKeys  []string
+		wantKnown bool
+	}{
+		{"single", []string{"get", "a"}, []string{"a"}, true},
+		{"all", []string{"DEL", "a", "b"}, []string{"a", "b"}, true},
+		{"pairs", []string{"MSET", "a", "1", "b", "2"}, []string{"a", "b"}, true},
+		{"odd pairs", []string{"MSET", "a", "1", "b"}, nil, false},
+		{"two keys", []string{"LCS", "a", "b", "LEN"}, []string{"a", "b"}, true},
+		{"timeout", []string{"BLPOP", "a", "b", "0"}, []string{"a", "b"}, true},
+		{"numkeys", []string{"EVAL", "return 1", "2", "a", "b", "arg"}, []string{"a", "b"}, true},
+		{"too few keys", []string{"EVAL", "return 1", "3", "a"}, nil, false},
+		{"destination and numkeys", []string{"ZINTERSTORE", "d", "2", "a", "b", "WEIGHTS", "1", "2"}, []string{"d", "a", "b"}, true},
+		{"streams", []string{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "a", "b", ">", ">"}, []string{"a", "b"}, true},
+		{"streams without IDs", []string{"XREAD", "STREAMS", "a"}, nil, false},
+		{"BITOP", []string{"BITOP", "XOR", "d", "a", "b"}, []string{"d", "a", "b"}, true},
+		{"SORT", []string{"SORT", "a", "BY", "nosort", "GET", "#", "STORE", "d"}, []string{"a", "d"}, true},
+		{"SORT pattern", []string{"SORT", "a", "GET", "b:*->f"}, nil, false},
+		{"XINFO", []string{"XINFO", "STREAM", "a"}, []string{"a"}, true},
+		{"XINFO HELP", []string{"XINFO", "HELP"}, nil, false},
+		{"keyless", []string{"PING"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		args := tt.args
+		wantKeys := tt.wantKeys
+		wantKnown := tt.wantKnown
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			keys, known := commandKeys(args)
+			if known != wantKnown {
+				t.Errorf("got known %v, want %v", known, wantKnown)
+			}
+			if diff := cmp.Diff(wantKeys, keys); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// Every command with a category other than these must say where its keys are, so that none falls back to having no keys.
+func TestCommandKeySpecs(t *testing.T) {
+	keyless := []string{CategoryKeyspace, CategoryPubSub, CategoryTransaction, CategoryConnection}
+	for command, category := range commandCategories {
+		if _, ok := commandKeySpecs[command]; !ok && !slices.Contains(keyless, category) {
+			t.Errorf("%s has no key spec", command)
+		}
+	}
+}
+
+func TestPolicy_Authorize(t *testing.T) {
+	policy := &Policy{
+		Rules: []PolicyRule{
+			{
+				Identities: []string{"system:serviceaccount:app:*"},
+				Categories: []string{CategoryRead, CategoryWrite, CategoryKeyspace, CategoryConnection},
+				Keys:       []string{"app:*"},
+			},
+			{
+				Identities: []string{"system:serviceaccount:app:reader"},
+				Categories: []string{CategoryRead},
+			},
+			{
+				Identities: []string{"operator"},
+				Categories: []string{CategoryAdmin},
+			},
+			{
+				Identities: []string{"system:serviceaccount:cache:*"},
+				Categories: []string{CategoryRead, CategoryWrite, CategoryKeyspace},
+				DBs:        []int{1, 2},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		identity string
+		db       int
+		args     []string
+		wantErr  bool
+	}{
+		{"allowed key", "system:serviceaccount:app:writer", 0, []string{"SET", "app:1", "v"}, false},
+		{"other key", "system:serviceaccount:app:writer", 0, []string{"SET", "other:1", "v"}, true},
+		{"one of many keys outside", "system:serviceaccount:app:writer", 0, []string{"MSET", "app:1", "v", "other:1", "v"}, true},
+		{"second key of LCS", "system:serviceaccount:app:writer", 0, []string{"LCS", "app:1", "other:1"}, true},
+		{"destination of BITOP", "system:serviceaccount:app:writer", 0, []string{"BITOP", "AND", "other:1", "app:1"}, true},
+		{"source of BITOP", "system:serviceaccount:app:writer", 0, []string{"BITOP", "OR", "app:1", "app:2", "other:1"}, true},
+		{"BITOP within keys", "system:serviceaccount:app:writer", 0, []string{"BITOP", "NOT", "app:1", "app:2"}, false},
+		{"SORT within keys", "system:serviceaccount:app:writer", 0, []string{"SORT", "app:1", "LIMIT", "0", "10", "GET", "#", "STORE", "app:2"}, false},
+		{"SORT stores outside", "system:serviceaccount:app:writer", 0, []string{"SORT", "app:1", "STORE", "other:1"}, true},
+		{"SORT BY pattern", "system:serviceaccount:app:writer", 0, []string{"SORT", "app:1", "BY", "other:*"}, true},
+		{"SORT_RO GET pattern", "system:serviceaccount:app:writer", 0, []string{"SORT_RO", "app:1", "GET", "other:*"}, true},
+		{"ZUNIONSTORE source outside", "system:serviceaccount:app:writer", 0, []string{"ZUNIONSTORE", "app:1", "2", "app:2", "other:1"}, true},
+		{"XREAD streams", "system:serviceaccount:app:writer", 0, []string{"XREAD", "COUNT", "1", "STREAMS", "app:1", "other:1", "0", "0"}, true},
+		{"malformed keys", "system:serviceaccount:app:writer", 0, []string{"EVAL", "return 1", "3", "app:1"}, true},
+		{"missing key", "system:serviceaccount:app:writer", 0, []string{"GET"}, true},
+		{"KEYS under keys", "system:serviceaccount:app:writer", 0, []string{"KEYS", "app:*"}, true},
+		{"SCAN under keys", "system:serviceaccount:app:writer", 0, []string{"SCAN", "0", "MATCH", "app:*"}, true},
+		{"PING under keys", "system:serviceaccount:app:writer", 0, []string{"PING"}, false},
+		{"reader any key", "system:serviceaccount:app:reader", 0, []string{"GET", "other:1"}, false},
+		{"reader cannot write other key", "system:serviceaccount:app:reader", 0, []string{"DEL", "other:1"}, true},
+		{"admin denied by default", "system:serviceaccount:app:writer", 0, []string{"FLUSHALL"}, true},
+		{"config denied by default", "system:serviceaccount:app:reader", 0, []string{"CONFIG", "SET", "maxmemory", "0"}, true},
+		{"unknown command is admin", "system:serviceaccount:app:reader", 0, []string{"NEWCOMMAND", "app:1"}, true},
+		{"admin granted", "operator", 0, []string{"flushall", "async"}, false},
+		{"FLUSHDB of the granted DB", "operator", 0, []string{"FLUSHDB", "ASYNC"}, false},
+		{"FLUSHDB of another DB", "operator", 1, []string{"FLUSHDB", "ASYNC"}, true},
+		{"unknown identity", "system:serviceaccount:other:a", 0, []string{"GET", "app:1"}, true},
+		{"DB 0 by default", "system:serviceaccount:app:reader", 1, []string{"GET", "app:1"}, true},
+		{"allowed DB", "system:serviceaccount:cache:a", 2, []string{"GET", "other:1"}, false},
+		{"other DB", "system:serviceaccount:cache:a", 3, []string{"GET", "other:1"}, true},
+		{"DB 0 not listed", "system:serviceaccount:cache:a", 0, []string{"GET", "other:1"}, true},
+		{"keyspace without keys", "system:serviceaccount:cache:a", 1, []string{"KEYS", "*"}, false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		identity := tt.identity
+		db := tt.db
+		args := tt.args
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := policy.Authorize(identity, db, args); (err != nil) != wantErr {
+				t.Errorf("got error %v, want error %v", err, wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	digest := sha256.Sum256([]byte("secret"))
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{"valid", `{"apiKeys": {"job": "` + hex.EncodeToString(digest[:]) + `"}, "rules": [{"identities": ["job"], "categories": ["read"]}]}`, false},
+		{"plain API key", `{"apiKeys": {"job": "secret"}}`, true},
+		{"unknown category", `{"rules": [{"identities": ["job"], "categories": ["@read"]}]}`, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		policy := tt.policy
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadPolicy(path); (err != nil) != wantErr {
+				t.Errorf("got error %v, want error %v", err, wantErr)
+			}
+		})
+	}
+}
+
+func TestGuard_Authorize(t *testing.T) {
+	digest := sha256.Sum256([]byte("api-key"))
+
+	var reviews atomic.Int64
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews.Add(1)
+		if r.Header.Get("Authorization") != "Bearer service-account-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var review struct {
+			Spec struct {
+				Token string `json:"token"`
+			} `json:"spec"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&review)
+
+		w.WriteHeader(http.StatusCreated)
+		if review.Spec.Token == "valid-token" {
+			_, _ = w.Write([]byte(`{"status": {"authenticated": true, "user": {"username": "system:serviceaccount:app:reader"}}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": {"authenticated": false, "error": "invalid token"}}`))
+	}))
+	defer apiServer.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("service-account-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var audit bytes.Buffer
+	guard := &Guard{
+		Policy: &Policy{
+			APIKeys: map[string]string{"job": hex.EncodeToString(digest[:])},
+			Rules: []PolicyRule{
+				{Identities: []string{"job"}, Categories: []string{CategoryWrite}},
+				{Identities: []string{"system:serviceaccount:app:*"}, Categories: []string{CategoryRead}},
+			},
+		},
+		TokenReviewer: &TokenReviewer{
+			URL:       apiServer.URL,
+			TokenFile: tokenFile,
+			Client:    apiServer.Client(),
+			CacheTTL:  time.Minute,
+		},
+		Logger: slog.New(slog.NewJSONHandler(&audit, nil)),
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		args          []string
+		want          int
+	}{
+		{"API key", "Bearer api-key", []string{"SET", "a", "1"}, http.StatusOK},
+		{"API key denied", "Bearer api-key", []string{"GET", "a"}, http.StatusForbidden},
+		{"token", "Bearer valid-token", []string{"GET", "a"}, http.StatusOK},
+		{"token cached", "Bearer valid-token", []string{"GET", "b"}, http.StatusOK},
+		{"token denied", "Bearer valid-token", []string{"FLUSHALL"}, http.StatusForbidden},
+		{"invalid token", "Bearer invalid-token", []string{"GET", "a"}, http.StatusUnauthorized},
+		{"missing", "", []string{"GET", "a"}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/", nil)
+		if tt.authorization != "" {
+			request.Header.Set("Authorization", tt.authorization)
+		}
+		recorder := httptest.NewRecorder()
+
+		allowed := guard.Authorize(recorder, request, 0, tt.args)
+		if allowed != (tt.want == http.StatusOK) || (!allowed && recorder.Code != tt.want) {
+			t.Errorf("%s: got allowed %v with %d, want %d", tt.name, allowed, recorder.Code, tt.want)
+		}
+	}
+
+	// The second request with the valid token is served from the cache.
+	if got := reviews.Load(); got != 2 {
+		t.Errorf("got %d TokenReviews, want 2", got)
+	}
+
+	var entries []map[string]any
+	decoder := json.NewDecoder(&audit)
+	for {
+		var entry map[string]any
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d audit entries, want 4", len(entries))
+	}
+	if entries[1]["identity"] != "system:serviceaccount:app:reader" || entries[1]["command"] != "FLUSHALL" {
+		t.Errorf("unexpected audit entry: %v", entries[1])
+	}
+}
+
+func TestGuard_Nil(t *testing.T) {
+	var guard *Guard
+	if !guard.Authorize(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil), 0, []string{"FLUSHALL"}) {
+		t.Error("nil guard denied a command")
+	}
+}
+
+func TestTokenReviewer_Review(t *testing.T) {
+	var reviews atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews.Add(1)
+		if r.Header.Get("Authorization") != "Bearer service-account-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var review struct {
+			Spec struct {
+				Token     string   `json:"token"`
+				Audiences []string `json:"audiences"`
+			} `json:"spec"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&review)
+
+		w.WriteHeader(http.StatusCreated)
+		if review.Spec.Token == "valid-token" && len(review.Spec.Audiences) == 1 && review.Spec.Audiences[0] == "http-redis-proxy" {
+			_, _ = w.Write([]byte(`{"status": {"authenticated": true, "user": {"username": "system:serviceaccount:app:worker"}}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": {"authenticated": false, "error": "invalid token"}}`))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("service-account-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reviewer := &TokenReviewer{
+		URL:       server.URL,
+		Audiences: []string{"http-redis-proxy"},
+		TokenFile: tokenFile,
+		Client:    server.Client(),
+		CacheTTL:  time.Minute,
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		want        string
+		wantErr     bool
+		wantReviews int64
+	}{
+		{"authenticated", "valid-token", "system:serviceaccount:app:worker", false, 1},
+		{"cached", "valid-token", "system:serviceaccount:app:worker", false, 1},
+		{"unauthenticated", "invalid-token", "", true, 2},
+		{"unauthenticated is not cached", "invalid-token", "", true, 3},
+	}
+
+	for _, tt := range tests {
+		got, err := reviewer.Review(context.Background(), tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if got != tt.want || reviews.Load() != tt.wantReviews {
+			t.Errorf("%s: got %q after %d reviews, want %q after %d", tt.name, got, reviews.Load(), tt.want, tt.wantReviews)
+		}
+	}
+
+	reviewer.TokenFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := reviewer.Review(context.Background(), "other-token"); err == nil {
+		t.Error("reviewed a token without a service account token")
+	}
+}
@@ -3,3 +3,9 @@ module mcp-stdio-proxy
 go 1.25.0
 
 require github.com/google/uuid v1.6.0
+
+require github.com/golang-jwt/jwt/v5 v5.3.0
+
+require github.com/google/go-cmp v0.7.0
+
+require golang.org/x/sync v0.20.0
@@ -2,24 +2,39 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"regexp"
 	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
 )
 
 func envOrDefaultValue[T any](key string, defaultValue T) T {
@@ -94,24 +109,1005 @@ type MCPMessage struct {
 	ID      any       `json:"id,omitempty"`
 }
 
+// maxMessageSize bounds one line of JSON-RPC from a child.
+const maxMessageSize = 16 * 1024 * 1024
+
+// execWithRlimitsArg makes the proxy re-execute itself as a wrapper that sets rlimits before exec'ing the command,
+// as exec.Cmd cannot set rlimits of a child without affecting the proxy itself.
+const execWithRlimitsArg = "__exec-with-rlimits"
+
+// JSON-RPC error code sent for requests that a child can no longer answer.
+// https://www.jsonrpc.org/specification#error_object
+const childExitedErrorCode = -32000
+
+type ChildLimits struct {
+	// MaxMemory limits the address space in bytes.
+	MaxMemory uint64
+	// MaxCPU limits CPU time in seconds.
+	MaxCPU       uint64
+	MaxOpenFiles uint64
+}
+
+func (l *ChildLimits) args() []string {
+	var args []string
+	if l.MaxMemory > 0 {
+		args = append(args, fmt.Sprintf("%d=%d", syscall.RLIMIT_AS, l.MaxMemory))
+	}
+	if l.MaxCPU > 0 {
+		args = append(args, fmt.Sprintf("%d=%d", syscall.RLIMIT_CPU, l.MaxCPU))
+	}
+	if l.MaxOpenFiles > 0 {
+		args = append(args, fmt.Sprintf("%d=%d", syscall.RLIMIT_NOFILE, l.MaxOpenFiles))
+	}
+	return args
+}
+
+// execWithRlimits is the wrapper side of execWithRlimitsArg: resource=value pairs, "--", then the command.
+func execWithRlimits(args []string) error {
+	i := slices.Index(args, "--")
+	if i < 0 || i == len(args)-1 {
+		return errors.New("command not specified")
+	}
+
+	for _, arg := range args[:i] {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("invalid rlimit: %s", arg)
+		}
+		resource, err := strconv.Atoi(k)
+		if err != nil {
+			return fmt.Errorf("invalid rlimit resource: %w", err)
+		}
+		limit, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid rlimit value: %w", err)
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			return fmt.Errorf("failed to set rlimit %d: %w", resource, err)
+		}
+	}
+
+	command := args[i+1:]
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return fmt.Errorf("failed to find command: %w", err)
+	}
+	return syscall.Exec(path, command, os.Environ())
+}
+
+type ChildOption struct {
+	Name   string
+	Arg    []string
+	Limits ChildLimits
+	// UID and GID run the child as another user when not negative. The proxy needs CAP_SETUID and CAP_SETGID for it.
+	UID int
+	GID int
+}
+
+// childWaitDelay bounds how long stdout and stderr of a child are still read after it exits.
+const childWaitDelay = 5 * time.Second
+
+// maxStderrLine bounds one logged line of stderr. The rest of a longer line is dropped, so that stderr is always drained.
+const maxStderrLine = 64 * 1024
+
+// stderrLogger logs what a child writes to stderr line by line.
+type stderrLogger struct {
+	sessionID string
+
+	mutex     sync.Mutex
+	line      []byte
+	truncated bool
+}
+
+func (l *stderrLogger) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		i := bytes.IndexByte(p, '\n')
+		if i >= 0 {
+			chunk = p[:i]
+		}
+		if room := maxStderrLine - len(l.line); len(chunk) > room {
+			chunk = chunk[:room]
+			l.truncated = true
+		}
+		l.line = append(l.line, chunk...)
+		if i < 0 {
+			break
+		}
+		l.flush()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Flush logs the last line if it did not end with a newline.
+func (l *stderrLogger) Flush() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.line) > 0 || l.truncated {
+		l.flush()
+	}
+}
+
+// flush logs the line so far. The caller must hold the mutex.
+func (l *stderrLogger) flush() {
+	if l.truncated {
+		log.Printf("%s: stderr: %s... (truncated)", l.sessionID, l.line)
+	} else {
+		log.Printf("%s: stderr: %s", l.sessionID, l.line)
+	}
+	l.line = l.line[:0]
+	l.truncated = false
+}
+
+// child is a running stdio MCP server. Every line it writes to stdout is one JSON-RPC message.
+type child struct {
+	sessionID string
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	mutex     sync.Mutex
+	messages  chan []byte
+	exited    chan struct{}
+	// lastActive is the UnixNano of the last message in either direction.
+	lastActive atomic.Int64
+
+	pendingMutex sync.Mutex
+	pending      map[string]json.RawMessage
+}
+
+// startChild runs the command for a session, adding env to the environment of the proxy.
+func startChild(sessionID string, option *ChildOption, env []string) (*child, error) {
+	var cmd *exec.Cmd
+	if limits := option.Limits.args(); len(limits) > 0 {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find own executable: %w", err)
+		}
+		args := append([]string{execWithRlimitsArg}, limits...)
+		args = append(args, "--", option.Name)
+		cmd = exec.Command(self, append(args, option.Arg...)...)
+	} else {
+		cmd = exec.Command(option.Name, option.Arg...)
+	}
+	if option.UID >= 0 {
+		gid := option.GID
+		if gid < 0 {
+			gid = option.UID
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(option.UID), Gid: uint32(gid)},
+		}
+	}
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+
+	// stdout and stderr are copied by exec.Cmd rather than read from pipes of its own, so that WaitDelay bounds them:
+	// Wait closes them this long after the child exits even if a process it spawned still holds them.
+	stdout, stdoutWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	stderr := &stderrLogger{sessionID: sessionID}
+	cmd.Stderr = stderr
+	cmd.WaitDelay = childWaitDelay
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start command: %w", err)
+	}
+
+	c := &child{
+		sessionID: sessionID,
+		cmd:       cmd,
+		stdin:     stdin,
+		messages:  make(chan []byte, 65536),
+		exited:    make(chan struct{}),
+		pending:   make(map[string]json.RawMessage),
+	}
+	c.touch()
+
+	waited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		stderr.Flush()
+		_ = stdoutWriter.Close()
+		waited <- err
+	}()
+
+	go func() {
+		defer close(c.exited)
+		defer close(c.messages)
+
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
+		for scanner.Scan() {
+			line := bytes.Clone(scanner.Bytes())
+			c.touch()
+			c.answered(line)
+			c.messages <- line
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("%s: failed to read stdout: %+v", sessionID, err)
+			_ = cmd.Process.Kill()
+			_ = stdout.CloseWithError(err)
+		}
+
+		err := <-waited
+		log.Printf("%s: child exited: %v", sessionID, cmd.ProcessState)
+		for _, message := range c.exitErrors(err) {
+			c.messages <- message
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *child) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// IdleSince returns when a message last went to or came from the child.
+func (c *child) IdleSince() time.Time {
+	return time.Unix(0, c.lastActive.Load())
+}
+
+// answered forgets the requests whose responses are in a line from the child.
+func (c *child) answered(line []byte) {
+	messages, _, err := splitMessages(line)
+	if err != nil {
+		return
+	}
+
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	for _, message := range messages {
+		var envelope jsonrpcEnvelope
+		if err := json.Unmarshal(message, &envelope); err == nil && envelope.isResponse() {
+			delete(c.pending, idKey(envelope.ID))
+		}
+	}
+}
+
+// exitErrors answers every pending request with an error, or sends one error without an ID when none is pending,
+// so that a client learns that the child is gone instead of waiting forever.
+func (c *child) exitErrors(err error) [][]byte {
+	reason := "MCP server exited"
+	if err != nil {
+		reason = fmt.Sprintf("MCP server exited: %v", err)
+	}
+
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	ids := make([]json.RawMessage, 0, len(c.pending))
+	for _, id := range c.pending {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		ids = append(ids, json.RawMessage("null"))
+	}
+	clear(c.pending)
+
+	messages := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		message, _ := json.Marshal(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"error": map[string]any{
+				"code":    childExitedErrorCode,
+				"message": reason,
+			},
+		})
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// Send writes one message as a line, so that concurrent requests do not interleave on stdin.
+func (c *child) Send(message []byte) error {
+	var envelope jsonrpcEnvelope
+	if err := json.Unmarshal(message, &envelope); err == nil && envelope.isRequest() {
+		c.pendingMutex.Lock()
+		c.pending[idKey(envelope.ID)] = envelope.ID
+		c.pendingMutex.Unlock()
+	}
+	c.touch()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	line := make([]byte, 0, len(message)+1)
+	line = append(line, message...)
+	line = append(line, '\n')
+	if _, err := c.stdin.Write(line); err != nil {
+		return fmt.Errorf("failed to write to stdin: %w", err)
+	}
+	return nil
+}
+
+// Close kills the child and waits for it to be reaped. It is safe to call more than once.
+func (c *child) Close() {
+	_ = c.cmd.Process.Kill()
+	<-c.exited
+}
+
 type session struct {
-	id            string
-	responseQueue chan []byte
-	requestQueue  chan []byte
+	id      string
+	subject string
+	child   *child
+}
+
+// jsonrpcEnvelope tells requests, notifications and responses apart.
+type jsonrpcEnvelope struct {
+	Method string          `json:"method"`
+	ID     json.RawMessage `json:"id"`
+}
+
+func (e *jsonrpcEnvelope) isRequest() bool {
+	return e.Method != "" && len(e.ID) > 0
+}
+
+func (e *jsonrpcEnvelope) isResponse() bool {
+	return e.Method == "" && len(e.ID) > 0
+}
+
+// idKey normalizes an ID so that a response finds its request whatever whitespace the child used.
+func idKey(id json.RawMessage) string {
+	var buffer bytes.Buffer
+	if err := json.Compact(&buffer, id); err != nil {
+		return string(id)
+	}
+	return buffer.String()
+}
+
+// splitMessages returns the messages of a single JSON-RPC message or a batch.
+func splitMessages(body []byte) ([]json.RawMessage, bool, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, true, err
+		}
+		return batch, true, nil
+	}
+
+	var message json.RawMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, false, err
+	}
+	return []json.RawMessage{message}, false, nil
+}
+
+// maxEvents is how many events a session keeps to replay for Last-Event-ID.
+const maxEvents = 1024
+
+type event struct {
+	id     int64
+	stream int64
+	data   []byte
+}
+
+// standaloneStream carries what the child sends outside of a response, and is read with GET /mcp.
+const standaloneStream int64 = 0
+
+// streamableSession multiplexes one child over the streams of the Streamable HTTP transport.
+// Every message from the child becomes an event of one stream: a response goes to the stream of the POST
+// that sent its request, anything else to the standalone stream or, if no GET is attached, to a POST stream still open.
+// A stream is written to one client at a time, so that no event is delivered twice.
+type streamableSession struct {
+	id      string
+	subject string
+	child   *child
+
+	mutex        sync.Mutex
+	notify       chan struct{}
+	closed       bool
+	nextEventID  int64
+	nextStreamID int64
+	events       []event
+	pending      map[string]int64
+	remaining    map[int64]int
+	sseStreams   map[int64]struct{}
+	attached     map[int64]bool
+	sent         map[int64]int64
+}
+
+func newStreamableSession(id string, subject string, c *child) *streamableSession {
+	s := &streamableSession{
+		id:           id,
+		subject:      subject,
+		child:        c,
+		notify:       make(chan struct{}),
+		nextEventID:  1,
+		nextStreamID: standaloneStream + 1,
+		pending:      make(map[string]int64),
+		remaining:    make(map[int64]int),
+		sseStreams:   make(map[int64]struct{}),
+		attached:     make(map[int64]bool),
+		sent:         make(map[int64]int64),
+	}
+	return s
+}
+
+// broadcast wakes up every stream writer. The caller must hold the mutex.
+func (s *streamableSession) broadcast() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// dispatch turns the output of the child into events until the child exits.
+func (s *streamableSession) dispatch() {
+	for line := range s.child.messages {
+		messages, _, err := splitMessages(line)
+		if err != nil {
+			log.Printf("%s: invalid message from child: %+v", s.id, err)
+			continue
+		}
+
+		s.mutex.Lock()
+		for _, message := range messages {
+			var envelope jsonrpcEnvelope
+			_ = json.Unmarshal(message, &envelope)
+
+			stream := standaloneStream
+			if envelope.isResponse() {
+				key := idKey(envelope.ID)
+				if sid, ok := s.pending[key]; ok {
+					stream = sid
+					delete(s.pending, key)
+					s.remaining[sid]--
+				}
+			} else if !s.attached[standaloneStream] {
+				// Requests and notifications of the child, such as progress or sampling, may ride on an open POST stream.
+				for sid := range s.sseStreams {
+					if s.remaining[sid] > 0 && sid > stream {
+						stream = sid
+					}
+				}
+			}
+			s.appendEvent(stream, message)
+		}
+		s.broadcast()
+		s.mutex.Unlock()
+	}
+
+	s.mutex.Lock()
+	s.closed = true
+	s.broadcast()
+	s.mutex.Unlock()
+}
+
+// appendEvent records an event, forgetting the oldest ones beyond maxEvents. The caller must hold the mutex.
+func (s *streamableSession) appendEvent(stream int64, data []byte) {
+	s.events = append(s.events, event{id: s.nextEventID, stream: stream, data: data})
+	s.nextEventID++
+	if len(s.events) > maxEvents {
+		s.events = append([]event(nil), s.events[len(s.events)-maxEvents:]...)
+	}
+}
+
+// openStream registers the requests of a POST, so that their responses are routed to a new stream.
+// An SSE stream is attached to the POST that opens it.
+func (s *streamableSession) openStream(requestIDs []json.RawMessage, sse bool) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sid := s.nextStreamID
+	s.nextStreamID++
+	for _, id := range requestIDs {
+		s.pending[idKey(id)] = sid
+	}
+	s.remaining[sid] = len(requestIDs)
+	if sse {
+		s.sseStreams[sid] = struct{}{}
+		s.attached[sid] = true
+	}
+	return sid
+}
+
+// next returns the events of a stream after cursor, whether the stream has nothing more to send,
+// and a channel that is closed on the next change.
+func (s *streamableSession) next(stream int64, cursor int64) ([]event, bool, <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var events []event
+	for _, e := range s.events {
+		if e.id > cursor && e.stream == stream {
+			events = append(events, e)
+		}
+	}
+	if len(events) > 0 && events[len(events)-1].id > s.sent[stream] {
+		s.sent[stream] = events[len(events)-1].id
+	}
+
+	done := s.closed || (stream != standaloneStream && s.remaining[stream] <= 0)
+	if done && len(events) == 0 && stream != standaloneStream {
+		delete(s.remaining, stream)
+		delete(s.sseStreams, stream)
+	}
+	return events, done, s.notify
+}
+
+// resume finds the stream of the event a client saw last. Unknown IDs resume the standalone stream.
+func (s *streamableSession) resume(lastEventID string) (int64, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if lastEventID == "" {
+		return standaloneStream, s.sent[standaloneStream]
+	}
+	cursor, err := strconv.ParseInt(lastEventID, 10, 64)
+	if err != nil {
+		return standaloneStream, s.sent[standaloneStream]
+	}
+	for _, e := range s.events {
+		if e.id == cursor {
+			return e.stream, cursor
+		}
+	}
+	return standaloneStream, cursor
+}
+
+// attach claims a stream for one client. It returns false while another client has it.
+func (s *streamableSession) attach(stream int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.attached[stream] {
+		return false
+	}
+	s.attached[stream] = true
+	return true
+}
+
+func (s *streamableSession) detach(stream int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.attached, stream)
+}
+
+// closeStream forgets a POST stream whose client went away before every response arrived.
+// The responses still to come go to the standalone stream instead.
+func (s *streamableSession) closeStream(stream int64) {
+	if stream == standaloneStream {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, sid := range s.pending {
+		if sid == stream {
+			delete(s.pending, key)
+		}
+	}
+	delete(s.remaining, stream)
+	delete(s.sseStreams, stream)
+	delete(s.sent, stream)
+}
+
+// writeStream sends the events of a stream as SSE until the stream is done or the client goes away.
+// The caller must have attached the stream.
+func (s *streamableSession) writeStream(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, stream int64, cursor int64) {
+	for {
+		events, done, changed := s.next(stream, cursor)
+		for _, e := range events {
+			_, _ = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", e.id, e.data)
+			cursor = e.id
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+			continue
+		}
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.closeStream(stream)
+			return
+		}
+	}
+}
+
+// collect waits for every response of a stream, for a client that does not accept SSE.
+func (s *streamableSession) collect(ctx context.Context, stream int64) ([]json.RawMessage, error) {
+	var cursor int64
+	var messages []json.RawMessage
+	for {
+		events, done, changed := s.next(stream, cursor)
+		for _, e := range events {
+			messages = append(messages, e.data)
+			cursor = e.id
+		}
+		if len(events) > 0 {
+			continue
+		}
+		if done {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed && len(messages) == 0 {
+				return nil, errors.New("child exited before responding")
+			}
+			return messages, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.closeStream(stream)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// JWKS verifies JWT signatures with the keys published at a JWKS URL.
+// Keys are fetched again when a token names an unknown kid, at most once per MinRefreshInterval.
+// Concurrent lookups of unknown kids share one fetch, and lookups of known kids never wait for it.
+type JWKS struct {
+	URL                string
+	Client             *http.Client
+	MinRefreshInterval time.Duration
+
+	keys atomic.Pointer[map[string]any]
+	// fetchedAt is the UnixNano of the last fetch.
+	fetchedAt atomic.Int64
+	group     singleflight.Group
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (any, error) {
+	decode := func(s string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid e: %w", err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid x")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+func (j *JWKS) refresh(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, j.URL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	response, err := j.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS returned %d", response.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("skipping JWK %s: %+v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	j.keys.Store(&keys)
+	return nil
+}
+
+func (j *JWKS) key(kid string) (any, bool) {
+	keys := j.keys.Load()
+	if keys == nil {
+		return nil, false
+	}
+	key, ok := (*keys)[kid]
+	return key, ok
+}
+
+// Keyfunc is a jwt.Keyfunc that finds the key named by the kid of a token.
+func (j *JWKS) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	if key, ok := j.key(kid); ok {
+		return key, nil
+	}
+
+	_, err, _ := j.group.Do("", func() (any, error) {
+		if time.Since(time.Unix(0, j.fetchedAt.Load())) < j.MinRefreshInterval {
+			return nil, nil
+		}
+		j.fetchedAt.Store(time.Now().UnixNano())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return nil, j.refresh(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := j.key(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown kid: %s", kid)
+}
+
+// Authenticator accepts static bearer tokens and JWTs signed by a JWKS. A nil Authenticator accepts everyone.
+type Authenticator struct {
+	// StaticTokens maps a token to the subject it stands for.
+	StaticTokens map[string]string
+	JWKS         *JWKS
+	Issuer       string
+	Audience     string
+}
+
+// Authenticate returns the claims of the caller. A static token yields only a sub claim.
+func (a *Authenticator) Authenticate(r *http.Request) (jwt.MapClaims, error) {
+	if a == nil {
+		return jwt.MapClaims{}, nil
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+
+	subject := ""
+	for t, s := range a.StaticTokens {
+		// Compare every token in constant time, so that timing does not tell how close a guess is.
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			subject = s
+		}
+	}
+	if subject != "" {
+		return jwt.MapClaims{"sub": subject}, nil
+	}
+
+	if a.JWKS == nil {
+		return nil, errors.New("unknown token")
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		options = append(options, jwt.WithAudience(a.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, a.JWKS.Keyfunc, options...); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	// Sessions belong to the subject, so tokens without one would share them.
+	if subject, err := claims.GetSubject(); err != nil || subject == "" {
+		return nil, errors.New("invalid token: missing sub claim")
+	}
+	return claims, nil
+}
+
+func loadStaticTokens(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens: %w", err)
+	}
+
+	tokens := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		subject, token, ok := strings.Cut(line, "=")
+		if !ok || subject == "" || token == "" {
+			// Don't quote the line, it may be a token.
+			return nil, fmt.Errorf("line %d: expected subject=token", i+1)
+		}
+		tokens[token] = subject
+	}
+	return tokens, nil
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnvMapping parses from=ENV_NAME pairs separated by commas.
+func parseEnvMapping(s string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, name, ok := strings.Cut(pair, "=")
+		if !ok || from == "" || !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid mapping, expected from=ENV_NAME: %s", pair)
+		}
+		mapping[from] = name
+	}
+	return mapping, nil
+}
+
+// claimValue looks up a claim by a dot-separated path, rendering anything but a string as JSON.
+func claimValue(claims jwt.MapClaims, path string) (string, bool) {
+	var value any = map[string]any(claims)
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// childEnv maps claims and request headers to NAME=value entries for the child of a new session.
+func childEnv(claims jwt.MapClaims, r *http.Request, claimEnv map[string]string, headerEnv map[string]string) []string {
+	var env []string
+	for path, name := range claimEnv {
+		if value, ok := claimValue(claims, path); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	for header, name := range headerEnv {
+		if value := r.Header.Get(header); value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	slices.Sort(env)
+	return env
+}
+
+// subjectOf identifies who a session belongs to, so that only they can use it.
+func subjectOf(claims jwt.MapClaims) string {
+	subject, _ := claims.GetSubject()
+	return subject
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			if mediaType, _, _ := strings.Cut(strings.TrimSpace(mediaRange), ";"); mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // https://github.com/modelcontextprotocol/modelcontextprotocol/blob/main/docs/specification/2024-11-05/basic/transports.mdx#http-with-sse
+// https://github.com/modelcontextprotocol/modelcontextprotocol/blob/main/docs/specification/2025-03-26/basic/transports.mdx#streamable-http
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == execWithRlimitsArg {
+		if err := execWithRlimits(os.Args[2:]); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%+v\n", err)
+			os.Exit(127)
+		}
+		return
+	}
+
 	var address string
 	var terminationGracePeriod time.Duration
 	var lameduck time.Duration
 	var keepAlive bool
 	var verbose bool
+	var maxSessions int
+	var sessionIdleTimeout time.Duration
+	var childMaxMemory uint64
+	var childMaxCPU uint64
+	var childMaxOpenFiles uint64
+	var childUID int
+	var childGID int
+	var authTokensFile string
+	var jwksURL string
+	var jwtIssuer string
+	var jwtAudience string
+	var claimEnv string
+	var headerEnv string
 	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
 	flag.BoolVar(&verbose, "verbose", envOrDefaultValue("VERBOSE", false), "Enable verbose logging")
+	flag.IntVar(&maxSessions, "max-sessions", envOrDefaultValue("MAX_SESSIONS", 0), "Maximum number of concurrent sessions, each running a child. Default 0 is unlimited.")
+	flag.DurationVar(&sessionIdleTimeout, "session-idle-timeout", envOrDefaultValue("SESSION_IDLE_TIMEOUT", 30*time.Minute), "Ends a session after no message in either direction for this long. 0 disables it.")
+	flag.Uint64Var(&childMaxMemory, "child-max-memory", envOrDefaultValue("CHILD_MAX_MEMORY", uint64(0)), "RLIMIT_AS of a child in bytes. 0 is unlimited.")
+	flag.Uint64Var(&childMaxCPU, "child-max-cpu", envOrDefaultValue("CHILD_MAX_CPU", uint64(0)), "RLIMIT_CPU of a child in seconds. 0 is unlimited.")
+	flag.Uint64Var(&childMaxOpenFiles, "child-max-open-files", envOrDefaultValue("CHILD_MAX_OPEN_FILES", uint64(0)), "RLIMIT_NOFILE of a child. 0 keeps the proxy's.")
+	flag.IntVar(&childUID, "child-uid", envOrDefaultValue("CHILD_UID", -1), "Run children as this uid. Default -1 keeps the proxy's.")
+	flag.IntVar(&childGID, "child-gid", envOrDefaultValue("CHILD_GID", -1), "Run children as this gid. Default -1 is the same as --child-uid.")
+	flag.StringVar(&authTokensFile, "auth-tokens-file", envOrDefaultValue("AUTH_TOKENS_FILE", ""), "File of subject=token lines accepted as bearer tokens")
+	flag.StringVar(&jwksURL, "jwks-url", envOrDefaultValue("JWKS_URL", ""), "Accept JWT bearer tokens signed by the keys at this JWKS URL")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", envOrDefaultValue("JWT_ISSUER", ""), "Required iss claim of a JWT")
+	flag.StringVar(&jwtAudience, "jwt-audience", envOrDefaultValue("JWT_AUDIENCE", ""), "Required aud claim of a JWT")
+	flag.StringVar(&claimEnv, "claim-env", envOrDefaultValue("CLAIM_ENV", ""), "Comma-separated claim=ENV_NAME pairs passed to a child. A claim may be a dot-separated path.")
+	flag.StringVar(&headerEnv, "header-env", envOrDefaultValue("HEADER_ENV", ""), "Comma-separated Header-Name=ENV_NAME pairs passed to a child")
 	flag.Parse()
 
 	args := flag.Args()
@@ -124,7 +1120,100 @@ func main() {
 		arg = args[1:]
 	}
 
+	childOption := &ChildOption{
+		Name: name,
+		Arg:  arg,
+		Limits: ChildLimits{
+			MaxMemory:    childMaxMemory,
+			MaxCPU:       childMaxCPU,
+			MaxOpenFiles: childMaxOpenFiles,
+		},
+		UID: childUID,
+		GID: childGID,
+	}
+
+	var authenticator *Authenticator
+	if authTokensFile != "" || jwksURL != "" {
+		authenticator = &Authenticator{
+			Issuer:   jwtIssuer,
+			Audience: jwtAudience,
+		}
+		if authTokensFile != "" {
+			tokens, err := loadStaticTokens(authTokensFile)
+			if err != nil {
+				log.Fatalf("%+v", err)
+			}
+			authenticator.StaticTokens = tokens
+		}
+		if jwksURL != "" {
+			authenticator.JWKS = &JWKS{
+				URL:                jwksURL,
+				Client:             &http.Client{Timeout: 10 * time.Second},
+				MinRefreshInterval: 1 * time.Minute,
+			}
+		}
+	}
+
+	claimEnvMapping, err := parseEnvMapping(claimEnv)
+	if err != nil {
+		log.Fatalf("invalid --claim-env: %+v", err)
+	}
+	headerEnvMapping, err := parseEnvMapping(headerEnv)
+	if err != nil {
+		log.Fatalf("invalid --header-env: %+v", err)
+	}
+
+	// authenticate answers 401 itself when it returns false.
+	authenticate := func(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, bool) {
+		claims, err := authenticator.Authenticate(r)
+		if err != nil {
+			if verbose {
+				log.Printf("unauthenticated: %+v", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mcp"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return nil, false
+		}
+		return claims, true
+	}
+
 	sessions := &sync.Map{}
+	streamableSessions := &sync.Map{}
+
+	var sessionCount atomic.Int64
+	acquireSession := func() bool {
+		if n := sessionCount.Add(1); maxSessions > 0 && n > int64(maxSessions) {
+			sessionCount.Add(-1)
+			return false
+		}
+		return true
+	}
+
+	if sessionIdleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(min(sessionIdleTimeout/2, time.Minute))
+			defer ticker.Stop()
+
+			for range ticker.C {
+				reap := func(id string, c *child) {
+					if time.Since(c.IdleSince()) > sessionIdleTimeout {
+						log.Printf("%s: closing idle session", id)
+						go c.Close()
+					}
+				}
+				sessions.Range(func(_, value any) bool {
+					s := value.(*session)
+					reap(s.id, s.child)
+					return true
+				})
+				streamableSessions.Range(func(_, value any) bool {
+					s := value.(*streamableSession)
+					reap(s.id, s.child)
+					return true
+				})
+			}
+		}()
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /sse", func(w http.ResponseWriter, r *http.Request) {
@@ -139,50 +1228,36 @@ func main() {
 			return
 		}
 
-		cmd := exec.Command(name, arg...)
-
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			log.Printf("failed to create stdin pipe: %+v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		claims, ok := authenticate(w, r)
+		if !ok {
 			return
 		}
 
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Printf("failed to create stdout pipe: %+v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if !acquireSession() {
+			http.Error(w, "too many sessions", http.StatusServiceUnavailable)
 			return
 		}
+		defer sessionCount.Add(-1)
 
-		if err := cmd.Start(); err != nil {
-			log.Printf("failed to start command: %+v", err)
+		id := uuid.New().String()
+		c, err := startChild(id, childOption, childEnv(claims, r, claimEnvMapping, headerEnvMapping))
+		if err != nil {
+			log.Printf("%+v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
 		s := &session{
-			id:            uuid.New().String(),
-			requestQueue:  make(chan []byte, 65536),
-			responseQueue: make(chan []byte, 65536),
+			id:      id,
+			subject: subjectOf(claims),
+			child:   c,
 		}
 
 		sessions.Store(s.id, s)
 
-		go func() {
-			scanner := bufio.NewScanner(stdout)
-			for scanner.Scan() {
-				s.responseQueue <- scanner.Bytes()
-			}
-		}()
-
 		defer func() {
 			sessions.Delete(s.id)
-			_ = cmd.Process.Kill()
-			_ = cmd.Wait()
-
-			close(s.requestQueue)
-			close(s.responseQueue)
+			c.Close()
 		}()
 
 		_, _ = fmt.Fprintf(w, "event: endpoint\ndata: %s\n\n", fmt.Sprintf("http://%s/messages?sessionId=%s", r.Host, s.id))
@@ -190,9 +1265,10 @@ func main() {
 
 		for {
 			select {
-			case data := <-s.requestQueue:
-				_, _ = stdin.Write(data)
-			case data := <-s.responseQueue:
+			case data, ok := <-c.messages:
+				if !ok {
+					return
+				}
 				_, _ = fmt.Fprint(w, fmt.Sprintf("event: message\ndata: %s\n\n", data))
 				flusher.Flush()
 			case <-r.Context().Done():
@@ -202,6 +1278,11 @@ func main() {
 	})
 
 	mux.HandleFunc("POST /messages", func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+
 		id := r.URL.Query().Get("sessionId")
 		if id == "" {
 			http.Error(w, "missing sessionId parameter", http.StatusBadRequest)
@@ -214,6 +1295,10 @@ func main() {
 			return
 		}
 		s := sany.(*session)
+		if s.subject != subjectOf(claims) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
 
 		var rawMessage json.RawMessage
 		if err := json.NewDecoder(r.Body).Decode(&rawMessage); err != nil {
@@ -231,14 +1316,222 @@ func main() {
 			log.Printf("%s: %s", id, mcpMessage.Method)
 		}
 
-		s.requestQueue <- rawMessage
-		s.requestQueue <- []byte("\n")
+		if err := s.child.Send(rawMessage); err != nil {
+			log.Printf("%+v", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
 		_, _ = w.Write([]byte(http.StatusText(http.StatusAccepted)))
 	})
 
+	mux.HandleFunc("POST /mcp", func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		messages, batch, err := splitMessages(body)
+		if err != nil || len(messages) == 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		var requestIDs []json.RawMessage
+		initialize := false
+		for _, message := range messages {
+			var envelope jsonrpcEnvelope
+			if err := json.Unmarshal(message, &envelope); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if envelope.isRequest() {
+				requestIDs = append(requestIDs, envelope.ID)
+			}
+			if envelope.Method == InitializeRequest {
+				initialize = true
+			}
+		}
+
+		var s *streamableSession
+		if id := r.Header.Get("Mcp-Session-Id"); id != "" {
+			sany, ok := streamableSessions.Load(id)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			s = sany.(*streamableSession)
+			if s.subject != subjectOf(claims) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		} else {
+			if !initialize {
+				http.Error(w, "missing Mcp-Session-Id header", http.StatusBadRequest)
+				return
+			}
+
+			if !acquireSession() {
+				http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+				return
+			}
+
+			id := uuid.New().String()
+			c, err := startChild(id, childOption, childEnv(claims, r, claimEnvMapping, headerEnvMapping))
+			if err != nil {
+				sessionCount.Add(-1)
+				log.Printf("%+v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			s = newStreamableSession(id, subjectOf(claims), c)
+			streamableSessions.Store(s.id, s)
+
+			go func() {
+				defer sessionCount.Add(-1)
+
+				s.dispatch()
+				streamableSessions.Delete(s.id)
+				c.Close()
+			}()
+		}
+		w.Header().Set("Mcp-Session-Id", s.id)
+
+		sse := acceptsEventStream(r)
+		var stream int64
+		if len(requestIDs) > 0 {
+			stream = s.openStream(requestIDs, sse)
+			if sse {
+				defer s.detach(stream)
+			}
+		}
+
+		for _, message := range messages {
+			if verbose {
+				var mcpMessage MCPMessage
+				_ = json.Unmarshal(message, &mcpMessage)
+				log.Printf("%s: %s", s.id, mcpMessage.Method)
+			}
+			if err := s.child.Send(message); err != nil {
+				log.Printf("%+v", err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+		}
+
+		if len(requestIDs) == 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		if sse {
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				log.Printf("failed to assert http.Flusher")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
+
+			s.writeStream(r.Context(), w, flusher, stream, 0)
+			return
+		}
+
+		responses, err := s.collect(r.Context(), stream)
+		if err != nil {
+			log.Printf("%s: %+v", s.id, err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if batch {
+			_ = json.NewEncoder(w).Encode(responses)
+		} else {
+			_, _ = w.Write(responses[0])
+		}
+	})
+
+	mux.HandleFunc("GET /mcp", func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		if !acceptsEventStream(r) {
+			http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+			return
+		}
+
+		sany, ok := streamableSessions.Load(r.Header.Get("Mcp-Session-Id"))
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		s := sany.(*streamableSession)
+		if s.subject != subjectOf(claims) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Printf("failed to assert http.Flusher")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		stream, cursor := s.resume(r.Header.Get("Last-Event-ID"))
+		if !s.attach(stream) {
+			http.Error(w, "stream already attached", http.StatusConflict)
+			return
+		}
+		defer s.detach(stream)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Mcp-Session-Id", s.id)
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		s.writeStream(r.Context(), w, flusher, stream, cursor)
+	})
+
+	mux.HandleFunc("DELETE /mcp", func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		sany, ok := streamableSessions.Load(r.Header.Get("Mcp-Session-Id"))
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		s := sany.(*streamableSession)
+		if s.subject != subjectOf(claims) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		streamableSessions.Delete(s.id)
+		s.child.Close()
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
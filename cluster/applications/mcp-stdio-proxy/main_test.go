@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/go-cmp/cmp"
+)
+
+// newTestSession returns a session whose child is fed through the returned channel instead of a process.
+func newTestSession(t *testing.T) (*streamableSession, chan<- []byte) {
+	t.Helper()
+
+	messages := make(chan []byte)
+	s := newStreamableSession("test", "subject", &child{messages: messages})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.dispatch()
+	}()
+	t.Cleanup(func() {
+		close(messages)
+		<-done
+	})
+	return s, messages
+}
+
+// streamsOf returns the stream of each event by its data.
+func streamsOf(s *streamableSession) map[string]int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	streams := make(map[string]int64)
+	for _, e := range s.events {
+		streams[string(e.data)] = e.stream
+	}
+	return streams
+}
+
+func TestStreamableSession_Routing(t *testing.T) {
+	s, messages := newTestSession(t)
+
+	sse := s.openStream([]json.RawMessage{json.RawMessage(`1`)}, true)
+	plain := s.openStream([]json.RawMessage{json.RawMessage(`"a"`)}, false)
+
+	// Without a GET attached, a notification rides on the open SSE stream, but not on the one answered with JSON.
+	messages <- []byte(`{"jsonrpc":"2.0","method":"notifications/progress"}`)
+	messages <- []byte(`{"jsonrpc":"2.0","id":"a","result":{}}`)
+	messages <- []byte(`{"jsonrpc":"2.0","id": 1,"result":{}}`)
+
+	if !s.attach(standaloneStream) {
+		t.Fatal("failed to attach the standalone stream")
+	}
+	if s.attach(standaloneStream) {
+		t.Error("attached the standalone stream twice")
+	}
+	if s.attach(sse) {
+		t.Error("attached a POST stream twice")
+	}
+	messages <- []byte(`{"jsonrpc":"2.0","method":"notifications/message"}`)
+	messages <- []byte(`{"jsonrpc":"2.0","id":2,"result":{}}`)
+
+	want := map[string]int64{
+		`{"jsonrpc":"2.0","method":"notifications/progress"}`: sse,
+		`{"jsonrpc":"2.0","id":"a","result":{}}`:              plain,
+		`{"jsonrpc":"2.0","id": 1,"result":{}}`:               sse,
+		`{"jsonrpc":"2.0","method":"notifications/message"}`:  standaloneStream,
+		`{"jsonrpc":"2.0","id":2,"result":{}}`:                standaloneStream,
+	}
+	// dispatch may still be appending the last message.
+	deadline := time.Now().Add(time.Second)
+	for len(streamsOf(s)) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if diff := cmp.Diff(want, streamsOf(s)); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+
+	s.detach(standaloneStream)
+	if !s.attach(standaloneStream) {
+		t.Error("failed to attach the standalone stream again")
+	}
+}
+
+func TestStreamableSession_Resume(t *testing.T) {
+	s, messages := newTestSession(t)
+
+	stream := s.openStream([]json.RawMessage{json.RawMessage(`1`), json.RawMessage(`2`)}, true)
+	messages <- []byte(`{"jsonrpc":"2.0","method":"notifications/progress"}`)
+	messages <- []byte(`{"jsonrpc":"2.0","id":1,"result":{}}`)
+	messages <- []byte(`{"jsonrpc":"2.0","id":2,"result":{}}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	responses, err := s.collect(ctx, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("got %d events, want 3", len(responses))
+	}
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		wantStream  int64
+		wantEvents  []int64
+	}{
+		{"after the first event", "1", stream, []int64{2, 3}},
+		{"after the last event", "3", stream, nil},
+		{"unknown event", "100", standaloneStream, nil},
+		{"invalid event", "a", standaloneStream, nil},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		lastEventID := tt.lastEventID
+		wantStream := tt.wantStream
+		wantEvents := tt.wantEvents
+		t.Run(name, func(t *testing.T) {
+			gotStream, cursor := s.resume(lastEventID)
+			if gotStream != wantStream {
+				t.Errorf("got stream %d, want %d", gotStream, wantStream)
+			}
+			events, _, _ := s.next(gotStream, cursor)
+			var gotEvents []int64
+			for _, e := range events {
+				gotEvents = append(gotEvents, e.id)
+			}
+			if diff := cmp.Diff(wantEvents, gotEvents); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStreamableSession_CloseStream(t *testing.T) {
+	s, messages := newTestSession(t)
+
+	stream := s.openStream([]json.RawMessage{json.RawMessage(`1`)}, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.collect(ctx, stream); err == nil {
+		t.Fatal("collect returned without the client")
+	}
+
+	s.mutex.Lock()
+	pending, remaining := len(s.pending), len(s.remaining)
+	s.mutex.Unlock()
+	if pending != 0 || remaining != 0 {
+		t.Errorf("got %d pending requests and %d open streams, want none", pending, remaining)
+	}
+
+	// The response of the request whose client went away is sent on the standalone stream.
+	messages <- []byte(`{"jsonrpc":"2.0","id":1,"result":{}}`)
+	deadline := time.Now().Add(time.Second)
+	for len(streamsOf(s)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if diff := cmp.Diff(map[string]int64{`{"jsonrpc":"2.0","id":1,"result":{}}`: standaloneStream}, streamsOf(s)); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestStderrLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	l := &stderrLogger{sessionID: "s"}
+	for _, p := range []string{"first\nsec", "ond\n", strings.Repeat("x", maxStderrLine+1), "\nlast"} {
+		if n, err := l.Write([]byte(p)); n != len(p) || err != nil {
+			t.Fatalf("got %d, %v, want %d, nil", n, err, len(p))
+		}
+	}
+	l.Flush()
+
+	want := "s: stderr: first\ns: stderr: second\ns: stderr: " + strings.Repeat("x", maxStderrLine) + "... (truncated)\ns: stderr: last\n"
+	if diff := cmp.Diff(want, buffer.String()); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+// newTestJWKS serves the public key of the returned signer as a JWKS with the kid "key", counting the fetches.
+func newTestJWKS(t *testing.T) (*JWKS, *ecdsa.PrivateKey, *atomic.Int64) {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	set, _ := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kid": "key",
+			"kty": "EC",
+			"use": "sig",
+			"crv": "P-256",
+			"x":   encode(privateKey.X.FillBytes(make([]byte, 32))),
+			"y":   encode(privateKey.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+
+	var fetches atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		// Let concurrent lookups pile up behind one fetch.
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(set)
+	}))
+	t.Cleanup(server.Close)
+
+	return &JWKS{URL: server.URL, Client: server.Client(), MinRefreshInterval: time.Minute}, privateKey, &fetches
+}
+
+func signToken(t *testing.T, privateKey *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	jwks, privateKey, _ := newTestJWKS(t)
+	authenticator := &Authenticator{
+		StaticTokens: map[string]string{"static-token": "robot"},
+		JWKS:         jwks,
+		Issuer:       "https://issuer.example.com",
+		Audience:     "mcp",
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := jwt.MapClaims{"iss": "https://issuer.example.com", "aud": "mcp", "sub": "alice", "exp": exp}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantSubject   string
+		wantErr       bool
+	}{
+		{"static token", "Bearer static-token", "robot", false},
+		{"JWT", "Bearer " + signToken(t, privateKey, "key", valid), "alice", false},
+		{"missing", "", "", true},
+		{"not bearer", "Basic static-token", "", true},
+		{"unknown token", "Bearer other-token", "", true},
+		{"no sub", "Bearer " + signToken(t, privateKey, "key", jwt.MapClaims{"iss": "https://issuer.example.com", "aud": "mcp", "exp": exp}), "", true},
+		{"empty sub", "Bearer " + signToken(t, privateKey, "key", jwt.MapClaims{"iss": "https://issuer.example.com", "aud": "mcp", "sub": "", "exp": exp}), "", true},
+		{"no exp", "Bearer " + signToken(t, privateKey, "key", jwt.MapClaims{"iss": "https://issuer.example.com", "aud": "mcp", "sub": "alice"}), "", true},
+		{"other issuer", "Bearer " + signToken(t, privateKey, "key", jwt.MapClaims{"iss": "https://other.example.com", "aud": "mcp", "sub": "alice", "exp": exp}), "", true},
+		{"other audience", "Bearer " + signToken(t, privateKey, "key", jwt.MapClaims{"iss": "https://issuer.example.com", "aud": "other", "sub": "alice", "exp": exp}), "", true},
+		{"unknown kid", "Bearer " + signToken(t, privateKey, "other", valid), "", true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		authorization := tt.authorization
+		wantSubject := tt.wantSubject
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodPost, "/mcp", nil)
+			if authorization != "" {
+				r.Header.Set("Authorization", authorization)
+			}
+			claims, err := authenticator.Authenticate(r)
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if err == nil && subjectOf(claims) != wantSubject {
+				t.Errorf("got subject %q, want %q", subjectOf(claims), wantSubject)
+			}
+		})
+	}
+}
+
+func TestJWKS_Keyfunc(t *testing.T) {
+	jwks, privateKey, fetches := newTestJWKS(t)
+	claims := jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	known := signToken(t, privateKey, "key", claims)
+	unknown := signToken(t, privateKey, "other", claims)
+
+	// Concurrent lookups share one fetch.
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Go(func() {
+			if _, err := jwt.Parse(known, jwks.Keyfunc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("got %d fetches, want 1", got)
+	}
+
+	// An unknown kid does not fetch again within MinRefreshInterval.
+	for range 3 {
+		if _, err := jwt.Parse(unknown, jwks.Keyfunc); err == nil {
+			t.Error("accepted an unknown kid")
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("got %d fetches, want 1", got)
+	}
+}
+
+func TestLoadStaticTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"tokens", "# comment\nalice=token-a\n\n  bob=token=b  \n", map[string]string{"token-a": "alice", "token=b": "bob"}, false},
+		{"empty", "", map[string]string{}, false},
+		{"missing token", "alice=\n", nil, true},
+		{"missing subject", "=secret-token\n", nil, true},
+		{"no separator", "secret-token\n", nil, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		content := tt.content
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "tokens")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadStaticTokens(path)
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if err != nil && strings.Contains(err.Error(), "secret") {
+				t.Errorf("error leaks the token: %v", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := loadStaticTokens(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestParseEnvMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"pairs", "sub=MCP_USER, groups=MCP_GROUPS,", map[string]string{"sub": "MCP_USER", "groups": "MCP_GROUPS"}, false},
+		{"nested claim", "org.id=ORG_ID", map[string]string{"org.id": "ORG_ID"}, false},
+		{"empty", "", map[string]string{}, false},
+		{"no separator", "sub", nil, true},
+		{"empty from", "=MCP_USER", nil, true},
+		{"invalid name", "sub=MCP-USER", nil, true},
+		{"name starting with a digit", "sub=1USER", nil, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseEnvMapping(in)
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClaimValue(t *testing.T) {
+	claims := jwt.MapClaims{
+		"sub":    "alice",
+		"groups": []any{"a", "b"},
+		"org":    map[string]any{"id": "org-1", "size": float64(3)},
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		want   string
+		wantOK bool
+	}{
+		{"string", "sub", "alice", true},
+		{"array as JSON", "groups", `["a","b"]`, true},
+		{"nested", "org.id", "org-1", true},
+		{"nested number", "org.size", "3", true},
+		{"object as JSON", "org", `{"id":"org-1","size":3}`, true},
+		{"missing", "email", "", false},
+		{"missing nested", "org.name", "", false},
+		{"through a string", "sub.id", "", false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		path := tt.path
+		want := tt.want
+		wantOK := tt.wantOK
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := claimValue(claims, path)
+			if got != want || ok != wantOK {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, want, wantOK)
+			}
+		})
+	}
+}
@@ -10,12 +10,14 @@ import (
 	"io"
 	"log"
 	"math"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -38,6 +40,17 @@ const (
 	RESPTypeInteger      = ':'
 	RESPTypeBulkString   = '$'
 	RESPTypeArray        = '*'
+	// RESP3
+	RESPTypeNull           = '_'
+	RESPTypeBoolean        = '#'
+	RESPTypeDouble         = ','
+	RESPTypeBigNumber      = '('
+	RESPTypeBlobError      = '!'
+	RESPTypeVerbatimString = '='
+	RESPTypeMap            = '%'
+	RESPTypeSet            = '~'
+	RESPTypeAttribute      = '|'
+	RESPTypePush           = '>'
 )
 
 var (
@@ -147,6 +160,235 @@ func (a *RESPArray) MarshalJSON() ([]byte, error) {
 	return json.Marshal(a.a)
 }
 
+type RESPNull struct{}
+
+func (n *RESPNull) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeNull)
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (n *RESPNull) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+type RESPBoolean struct {
+	b bool
+}
+
+func (b *RESPBoolean) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeBoolean)
+	if b.b {
+		buffer.WriteByte('t')
+	} else {
+		buffer.WriteByte('f')
+	}
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (b *RESPBoolean) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.b)
+}
+
+type RESPDouble struct {
+	f float64
+}
+
+func (d *RESPDouble) format() string {
+	switch {
+	case math.IsInf(d.f, 1):
+		return "inf"
+	case math.IsInf(d.f, -1):
+		return "-inf"
+	case math.IsNaN(d.f):
+		return "nan"
+	}
+	return strconv.FormatFloat(d.f, 'g', -1, 64)
+}
+
+func (d *RESPDouble) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeDouble)
+	buffer.WriteString(d.format())
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+// MarshalJSON falls back to a string for infinities and NaN, which JSON numbers cannot represent.
+func (d *RESPDouble) MarshalJSON() ([]byte, error) {
+	if math.IsInf(d.f, 0) || math.IsNaN(d.f) {
+		return json.Marshal(d.format())
+	}
+	return json.Marshal(d.f)
+}
+
+type RESPBigNumber struct {
+	s string
+}
+
+func (n *RESPBigNumber) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeBigNumber)
+	buffer.WriteString(n.s)
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (n *RESPBigNumber) MarshalJSON() ([]byte, error) {
+	return json.Marshal(json.Number(n.s))
+}
+
+type RESPBlobError struct {
+	s string
+}
+
+func (s *RESPBlobError) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeBlobError)
+	buffer.WriteString(strconv.Itoa(len(s.s)))
+	buffer.Write(RESPDelimiter)
+	buffer.WriteString(s.s)
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (s *RESPBlobError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: s.s})
+}
+
+type RESPVerbatimString struct {
+	format string
+	s      string
+}
+
+func (s *RESPVerbatimString) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(RESPTypeVerbatimString)
+	buffer.WriteString(strconv.Itoa(len(s.format) + 1 + len(s.s)))
+	buffer.Write(RESPDelimiter)
+	buffer.WriteString(s.format)
+	buffer.WriteByte(':')
+	buffer.WriteString(s.s)
+	buffer.Write(RESPDelimiter)
+	return buffer.String()
+}
+
+func (s *RESPVerbatimString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.s)
+}
+
+// RESPMap keeps its entries as alternating keys and values, in the order they were received.
+type RESPMap struct {
+	m []RESPMessage
+}
+
+func (m *RESPMap) String() string {
+	return encodeAggregate(RESPTypeMap, len(m.m)/2, m.m)
+}
+
+// MarshalJSON renders a JSON object, using the text of keys that are not strings.
+func (m *RESPMap) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i := 0; i+1 < len(m.m); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, err := json.Marshal(mapKey(m.m[i]))
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.m[i+1])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+func mapKey(message RESPMessage) string {
+	switch m := message.(type) {
+	case *RESPSimpleString:
+		return m.s
+	case *RESPBulkString:
+		if m.s != nil {
+			return *m.s
+		}
+	case *RESPVerbatimString:
+		return m.s
+	}
+	b, err := json.Marshal(message)
+	if err != nil {
+		return message.String()
+	}
+	return string(b)
+}
+
+type RESPSet struct {
+	a []RESPMessage
+}
+
+func (s *RESPSet) String() string {
+	return encodeAggregate(RESPTypeSet, len(s.a), s.a)
+}
+
+func (s *RESPSet) MarshalJSON() ([]byte, error) {
+	if s.a == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(s.a)
+}
+
+// RESPAttribute carries auxiliary data sent ahead of the reply it describes.
+type RESPAttribute struct {
+	m       []RESPMessage
+	message RESPMessage
+}
+
+func (a *RESPAttribute) String() string {
+	return encodeAggregate(RESPTypeAttribute, len(a.m)/2, a.m) + a.message.String()
+}
+
+// MarshalJSON leaves the attributes out, as they are not part of the reply itself.
+func (a *RESPAttribute) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.message)
+}
+
+type RESPPush struct {
+	a []RESPMessage
+}
+
+func (p *RESPPush) String() string {
+	return encodeAggregate(RESPTypePush, len(p.a), p.a)
+}
+
+func (p *RESPPush) MarshalJSON() ([]byte, error) {
+	if p.a == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(p.a)
+}
+
+func encodeAggregate(t byte, length int, a []RESPMessage) string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(t)
+	buffer.WriteString(strconv.Itoa(length))
+	buffer.Write(RESPDelimiter)
+	for _, m := range a {
+		buffer.WriteString(m.String())
+	}
+	return buffer.String()
+}
+
 type RESPMessage interface {
 	String() string
 	json.Marshaler
@@ -215,11 +457,113 @@ func (p *RedisProtocolParser) Parse() (RESPMessage, error) {
 		}
 
 		return &RESPArray{a: a}, nil
+	case RESPTypeNull:
+		return &RESPNull{}, nil
+	case RESPTypeBoolean:
+		switch string(line[1:]) {
+		case "t":
+			return &RESPBoolean{b: true}, nil
+		case "f":
+			return &RESPBoolean{b: false}, nil
+		}
+		return nil, xerrors.New("invalid RESP boolean")
+	case RESPTypeDouble:
+		f, err := strconv.ParseFloat(string(line[1:]), 64)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPDouble{f: f}, nil
+	case RESPTypeBigNumber:
+		s := string(line[1:])
+		if _, ok := new(big.Int).SetString(s, 10); !ok {
+			return nil, xerrors.New("invalid RESP big number")
+		}
+		return &RESPBigNumber{s: s}, nil
+	case RESPTypeBlobError:
+		s, err := p.readBlob(line)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPBlobError{s: s}, nil
+	case RESPTypeVerbatimString:
+		s, err := p.readBlob(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(s) < 4 || s[3] != ':' {
+			return nil, xerrors.New("invalid RESP verbatim string")
+		}
+		return &RESPVerbatimString{format: s[:3], s: s[4:]}, nil
+	case RESPTypeMap:
+		m, err := p.parseAggregate(line, 2)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPMap{m: m}, nil
+	case RESPTypeSet:
+		a, err := p.parseAggregate(line, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPSet{a: a}, nil
+	case RESPTypeAttribute:
+		m, err := p.parseAggregate(line, 2)
+		if err != nil {
+			return nil, err
+		}
+		message, err := p.Parse()
+		if err != nil {
+			return nil, err
+		}
+		return &RESPAttribute{m: m, message: message}, nil
+	case RESPTypePush:
+		a, err := p.parseAggregate(line, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &RESPPush{a: a}, nil
 	default:
 		return nil, xerrors.New("invalid RESP message type")
 	}
 }
 
+func (p *RedisProtocolParser) readBlob(line []byte) (string, error) {
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return "", err
+	}
+	if length < 0 {
+		return "", xerrors.New("invalid RESP blob length")
+	}
+
+	b := make([]byte, length+len(RESPDelimiter))
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		return "", err
+	}
+	return string(b[:length]), nil
+}
+
+// parseAggregate reads the elements of a map, set, attribute or push, with width elements per entry.
+func (p *RedisProtocolParser) parseAggregate(line []byte, width int) ([]RESPMessage, error) {
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, xerrors.New("invalid RESP aggregate length")
+	}
+
+	a := make([]RESPMessage, 0, length*width)
+	for i := 0; i < length*width; i++ {
+		m, err := p.Parse()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, m)
+	}
+	return a, nil
+}
+
 var nowFunc = time.Now
 
 type Connection struct {
@@ -227,6 +571,8 @@ type Connection struct {
 	createdAt  time.Time
 	returnedAt time.Time
 	readonly   bool
+	// protocol is the RESP version negotiated with HELLO; connections start with RESP2.
+	protocol int
 }
 
 func NewConnection(conn net.Conn) *Connection {
@@ -235,6 +581,7 @@ func NewConnection(conn net.Conn) *Connection {
 		createdAt:  nowFunc(),
 		returnedAt: nowFunc(),
 		readonly:   false,
+		protocol:   2,
 	}
 }
 
@@ -516,54 +863,1571 @@ func (p *ConnectionPool) topologyName(addr net.Addr) string {
 	return ""
 }
 
-func envOrDefaultValue[T any](key string, defaultValue T) T {
-	value, exists := os.LookupEnv(key)
-	if !exists {
-		return defaultValue
+func (p *ConnectionPool) Discard(ctx context.Context, connection *Connection) {
+	p.connectionMutex.Lock()
+	defer p.connectionMutex.Unlock()
+
+	_ = connection.Close()
+	p.removeConnection(ctx, p.topologyName(connection.RemoteAddr()), connection)
+}
+
+// Session tracks the state a client leaves behind on an upstream connection,
+// so that the connection only goes back to the pool when the next client cannot observe it.
+type Session struct {
+	mutex       sync.Mutex
+	transaction bool
+	watching    bool
+	subscribed  bool
+	dirty       bool
+	// pending may drop below zero for a moment, when a reply is tracked before the command it answers.
+	pending int
+}
+
+// Command records a command forwarded to the upstream connection.
+func (s *Session) Command(args []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pending++
+
+	switch strings.ToUpper(args[0]) {
+	case "MULTI":
+		s.transaction = true
+	case "EXEC", "DISCARD":
+		s.transaction = false
+		s.watching = false
+	case "WATCH":
+		s.watching = true
+	case "UNWATCH":
+		s.watching = false
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE":
+		s.subscribed = true
+	case "RESET":
+		s.transaction = false
+		s.watching = false
+	case "SELECT", "SWAPDB", "CLIENT", "READONLY", "READWRITE", "HELLO", "AUTH", "MONITOR":
+		s.dirty = true
 	}
+}
 
-	switch any(defaultValue).(type) {
-	case string:
-		return any(value).(T)
-	case int:
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return any(intValue).(T)
-		}
-	case int64:
-		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
-			return any(intValue).(T)
+// Reply records a reply read from the upstream connection.
+func (s *Session) Reply() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pending--
+}
+
+// Taint marks the connection as not reusable, for a stream whose state cannot be followed anymore.
+func (s *Session) Taint() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.dirty = true
+}
+
+// Pinned reports whether following commands must stay on the same upstream connection.
+func (s *Session) Pinned() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.transaction || s.watching || s.subscribed
+}
+
+// Reusable reports whether the upstream connection can be handed to another client.
+// Subscriptions are not tracked down to zero, and an unanswered command, typically a blocking one, would reply to the next client.
+func (s *Session) Reusable() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return !s.transaction && !s.watching && !s.subscribed && !s.dirty && s.pending == 0
+}
+
+// tee passes src through while tracking each RESP message read from it.
+// The returned function has to be called once src is drained, and returns once every message has been tracked.
+func tee(src io.Reader, session *Session, track func(message RESPMessage)) (io.Reader, func()) {
+	pr, pw := io.Pipe()
+	parsed := make(chan struct{})
+	go func() {
+		defer close(parsed)
+		parser := NewRedisProtocolParser(pr)
+		for {
+			message, err := parser.Parse()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					session.Taint()
+				}
+				_, _ = io.Copy(io.Discard, pr)
+				return
+			}
+			track(message)
 		}
-	case uint:
-		if uintValue, err := strconv.ParseUint(value, 10, 0); err == nil {
-			return any(uint(uintValue)).(T)
+	}()
+	return io.TeeReader(src, pw), func() {
+		_ = pw.Close()
+		<-parsed
+	}
+}
+
+// replyOrder writes the replies of the writer and the reader connections to the client in the order of the commands they answer,
+// as each connection answers in order but the two are read concurrently, and the proxy answers some commands on its own.
+type replyOrder struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	dst    io.Writer
+	slots  []*replySlot
+	closed bool
+}
+
+type replySlot struct {
+	// session is the one of the connection the reply comes from, or nil for a reply of the proxy itself.
+	session *Session
+	message RESPMessage
+	// swallow hides the reply to a command the proxy sent on its own from the client.
+	swallow bool
+}
+
+func newReplyOrder(dst io.Writer) *replyOrder {
+	o := &replyOrder{dst: dst}
+	o.cond = sync.NewCond(&o.mutex)
+	return o
+}
+
+// Expect reserves the place of the reply to a command about to be sent on the connection of session.
+func (o *replyOrder) Expect(session *Session) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.slots = append(o.slots, &replySlot{session: session})
+}
+
+// Swallow reserves the place of the reply to a command the proxy is about to send on its own on the connection of session,
+// so that the reply is dropped instead of taking the place of the next one.
+func (o *replyOrder) Swallow(session *Session) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.slots = append(o.slots, &replySlot{session: session, swallow: true})
+}
+
+// Answer writes a reply of the proxy itself once the replies to earlier commands have been written.
+func (o *replyOrder) Answer(message RESPMessage) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.slots = append(o.slots, &replySlot{message: message})
+	return o.flush()
+}
+
+// Write writes message, read from the connection of session, once the replies to earlier commands have been written.
+// A message no command waits for, such as a push, is written as it comes.
+func (o *replyOrder) Write(session *Session, message RESPMessage) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for {
+		if o.closed {
+			return io.ErrClosedPipe
 		}
-	case uint64:
-		if uintValue, err := strconv.ParseUint(value, 10, 64); err == nil {
-			return any(uintValue).(T)
+		i := slices.IndexFunc(o.slots, func(slot *replySlot) bool {
+			return slot.session == session
+		})
+		if i < 0 {
+			_, err := io.WriteString(o.dst, message.String())
+			return err
 		}
-	case float64:
-		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
-			return any(floatValue).(T)
+		if o.slots[i].swallow {
+			o.slots = slices.Delete(o.slots, i, i+1)
+			o.cond.Broadcast()
+			if i == 0 {
+				return o.flush()
+			}
+			return nil
 		}
-	case bool:
-		if boolValue, err := strconv.ParseBool(value); err == nil {
-			return any(boolValue).(T)
+		if i == 0 {
+			o.slots = o.slots[1:]
+			o.cond.Broadcast()
+			if _, err := io.WriteString(o.dst, message.String()); err != nil {
+				return err
+			}
+			return o.flush()
 		}
-	case time.Duration:
-		if durationValue, err := time.ParseDuration(value); err == nil {
-			return any(durationValue).(T)
+		o.cond.Wait()
+	}
+}
+
+// flush writes the replies of the proxy that have come to the head.
+func (o *replyOrder) flush() error {
+	for len(o.slots) > 0 && o.slots[0].session == nil {
+		message := o.slots[0].message
+		o.slots = o.slots[1:]
+		if _, err := io.WriteString(o.dst, message.String()); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return defaultValue
+// Close releases the writers waiting for a reply that will never come.
+func (o *replyOrder) Close() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.closed = true
+	o.cond.Broadcast()
 }
 
-func main() {
-	var localAddress string
-	var remoteAddress string
-	var monitorAddress string
-	var readerRouting bool
-	var readerRemoteAddress string
+// stop unblocks every copy between local and remotes once one of them has ended.
+func stop(local net.Conn, remotes ...*Connection) {
+	_ = local.SetDeadline(time.Now())
+	for _, remote := range remotes {
+		_ = remote.Cancel()
+	}
+}
+
+// closeWrite tells the client that no more replies follow while still reading what it sends.
+func closeWrite(local net.Conn) {
+	if c, ok := local.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	}
+}
+
+// passThrough copies between the client and one upstream connection while session follows the commands and the replies.
+// It returns once both directions have stopped, so that session is final when the connection is checked for reuse.
+func passThrough(local net.Conn, remote *Connection, session *Session, shutdown <-chan struct{}) {
+	c := make(chan struct{}, 2)
+	streams := sync.WaitGroup{}
+
+	streams.Go(func() {
+		src, done := tee(local, session, func(message RESPMessage) {
+			if a, ok := message.(*RESPArray); ok {
+				if args, ok := commandArgs(a); ok {
+					session.Command(args)
+					return
+				}
+			}
+			session.Taint()
+		})
+		_, _ = io.Copy(remote, src)
+		done()
+		c <- struct{}{}
+	})
+	streams.Go(func() {
+		src, done := tee(remote, session, func(message RESPMessage) {
+			session.Reply()
+		})
+		_, _ = io.Copy(local, src)
+		done()
+		c <- struct{}{}
+	})
+
+	select {
+	case <-c:
+	case <-shutdown:
+		closeWrite(local)
+	}
+	stop(local, remote)
+	streams.Wait()
+}
+
+// splitReads sends the read commands of the client to reader and everything else to writer.
+// It returns once every stream has stopped, so that both sessions are final when the connections are checked for reuse.
+func splitReads(local net.Conn, writer *Connection, reader *Connection, session *Session, readerSession *Session, shutdown <-chan struct{}, onCommand func(args []string)) {
+	order := newReplyOrder(local)
+	c := make(chan struct{}, 3)
+	streams := sync.WaitGroup{}
+
+	streams.Go(func() {
+		defer func() {
+			c <- struct{}{}
+		}()
+
+		parser := NewRedisProtocolParser(local)
+		for {
+			message, err := parser.Parse()
+			if err != nil {
+				return
+			}
+
+			// Commands are forwarded one by one, so that each of them lands on the connection it is routed to.
+			a, ok := message.(*RESPArray)
+			var args []string
+			if ok {
+				args, ok = commandArgs(a)
+			}
+			if !ok {
+				session.Taint()
+				order.Expect(session)
+				_, _ = io.WriteString(writer, message.String())
+				continue
+			}
+
+			onCommand(args)
+
+			// SELECT and the like would only apply to one of the two upstream connections.
+			if err := unsupportedCommand(args); err != nil {
+				if err := order.Answer(err); err != nil {
+					return
+				}
+				continue
+			}
+
+			// Both connections have to speak the RESP version the client negotiated, but only the writer answers.
+			if strings.ToUpper(args[0]) == "HELLO" {
+				readerSession.Command(args)
+				order.Swallow(readerSession)
+				_, _ = io.WriteString(reader, message.String())
+			}
+
+			// A transaction or subscription must stay on the writer, and so must the reads inside it.
+			if !session.Pinned() && isReadCommand(args[0]) {
+				readerSession.Command(args)
+				order.Expect(readerSession)
+				_, _ = io.WriteString(reader, message.String())
+				continue
+			}
+
+			session.Command(args)
+			order.Expect(session)
+			_, _ = io.WriteString(writer, message.String())
+		}
+	})
+
+	response := func(src *Connection, session *Session) {
+		defer func() {
+			c <- struct{}{}
+		}()
+
+		parser := NewRedisProtocolParser(src)
+		for {
+			message, err := parser.Parse()
+			if err != nil {
+				return
+			}
+			session.Reply()
+
+			if e, ok := message.(*RESPError); ok && e.s == "READONLY You can't write against a read only replica." {
+				src.markReadonly()
+			}
+
+			// Replies are written one by one, so that swallowed ones never reach the client.
+			if err := order.Write(session, message); err != nil {
+				return
+			}
+		}
+	}
+	streams.Go(func() {
+		response(writer, session)
+	})
+	streams.Go(func() {
+		response(reader, readerSession)
+	})
+
+	select {
+	case <-c:
+	case <-shutdown:
+		closeWrite(local)
+	}
+	stop(local, writer, reader)
+	order.Close()
+	streams.Wait()
+}
+
+func isBlockingCommand(args []string) bool {
+	switch strings.ToUpper(args[0]) {
+	case "BLPOP", "BRPOP", "BRPOPLPUSH", "BLMOVE", "BLMPOP", "BZPOPMIN", "BZPOPMAX", "BZMPOP", "WAIT", "WAITAOF":
+		return true
+	case "XREAD", "XREADGROUP":
+		for _, arg := range args[1:] {
+			switch strings.ToUpper(arg) {
+			case "BLOCK":
+				return true
+			case "STREAMS":
+				return false
+			}
+		}
+	}
+	return false
+}
+
+func isSubscribeCommand(command string) bool {
+	switch strings.ToUpper(command) {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE":
+		return true
+	}
+	return false
+}
+
+// unsupportedCommand returns an error for commands whose effect would leak into pooled or shared upstream connections.
+func unsupportedCommand(args []string) *RESPError {
+	command := strings.ToUpper(args[0])
+	switch command {
+	case "SELECT":
+		if len(args) == 2 && args[1] == "0" {
+			return nil
+		}
+		return &RESPError{s: "ERR SELECT is not supported by redis-proxy because upstream connections are pooled; use database 0"}
+	case "SWAPDB", "MONITOR", "SYNC", "PSYNC", "READONLY", "READWRITE":
+		return &RESPError{s: "ERR " + command + " is not supported by redis-proxy because upstream connections are pooled"}
+	case "CLIENT":
+		if len(args) > 1 {
+			switch subcommand := strings.ToUpper(args[1]); subcommand {
+			case "REPLY", "TRACKING", "CACHING", "NO-EVICT", "NO-TOUCH":
+				return &RESPError{s: "ERR CLIENT " + subcommand + " is not supported by redis-proxy because upstream connections are pooled"}
+			}
+		}
+	}
+	return nil
+}
+
+// https://redis.io/docs/latest/operate/oss_and_stack/reference/cluster-spec/#key-distribution-model
+const ClusterSlots = 16384
+
+var errCrossSlot = xerrors.New("keys in request don't hash to the same slot")
+
+// crc16Table is the CRC16-CCITT (XMODEM) table Redis Cluster uses for key slots.
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^c]
+	}
+	return crc
+}
+
+// keySlot hashes only the hash tag when the key contains a non-empty {...} section.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key)) % ClusterSlots)
+}
+
+// commandSlot returns -1 when the command has no keys.
+func commandSlot(keys []string) (int, error) {
+	slot := -1
+	for _, key := range keys {
+		s := keySlot(key)
+		if slot != -1 && slot != s {
+			return 0, errCrossSlot
+		}
+		slot = s
+	}
+	return slot, nil
+}
+
+func commandArgs(a *RESPArray) ([]string, bool) {
+	if len(a.a) == 0 {
+		return nil, false
+	}
+
+	args := make([]string, 0, len(a.a))
+	for _, m := range a.a {
+		s, ok := m.(*RESPBulkString)
+		if !ok || s.s == nil {
+			return nil, false
+		}
+		args = append(args, *s.s)
+	}
+	return args, true
+}
+
+func newCommand(args ...string) *RESPArray {
+	a := make([]RESPMessage, 0, len(args))
+	for _, arg := range args {
+		a = append(a, &RESPBulkString{s: &arg})
+	}
+	return &RESPArray{a: a}
+}
+
+// https://redis.io/docs/latest/develop/reference/key-specs/
+func commandKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING", "ECHO", "AUTH", "HELLO", "SELECT", "QUIT", "RESET", "INFO", "TIME", "DBSIZE", "LASTSAVE", "RANDOMKEY",
+		"KEYS", "SCAN", "FLUSHALL", "FLUSHDB", "CLIENT", "CLUSTER", "COMMAND", "CONFIG", "SCRIPT", "FUNCTION",
+		"ASKING", "READONLY", "READWRITE", "MULTI", "EXEC", "DISCARD", "UNWATCH",
+		"PUBLISH", "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PUBSUB", "FT.SEARCH":
+		return nil
+	case "DEL", "UNLINK", "EXISTS", "TOUCH", "MGET", "WATCH", "RENAME", "RENAMENX", "RPOPLPUSH",
+		"SINTER", "SUNION", "SDIFF", "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE", "PFCOUNT", "PFMERGE":
+		return args[1:]
+	case "MSET", "MSETNX":
+		var keys []string
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "SMOVE", "LMOVE", "BLMOVE", "COPY", "BRPOPLPUSH", "GEOSEARCHSTORE", "ZRANGESTORE":
+		if len(args) < 3 {
+			return args[1:]
+		}
+		return args[1:3]
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX":
+		return args[1 : len(args)-1]
+	case "OBJECT", "MEMORY":
+		if len(args) < 3 {
+			return nil
+		}
+		return args[2:3]
+	case "SINTERCARD", "ZINTERCARD", "ZINTER", "ZUNION", "ZDIFF", "LMPOP", "ZMPOP":
+		return numkeysKeys(args, 1)
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO", "BLMPOP", "BZMPOP":
+		return numkeysKeys(args, 2)
+	case "ZINTERSTORE", "ZUNIONSTORE", "ZDIFFSTORE":
+		return append([]string{args[1]}, numkeysKeys(args, 2)...)
+	case "XREAD", "XREADGROUP":
+		for i, arg := range args {
+			if strings.ToUpper(arg) == "STREAMS" {
+				streams := args[i+1:]
+				return streams[:len(streams)/2]
+			}
+		}
+		return nil
+	}
+
+	return args[1:2]
+}
+
+func numkeysKeys(args []string, numkeysIndex int) []string {
+	if len(args) <= numkeysIndex {
+		return nil
+	}
+	numkeys, err := strconv.Atoi(args[numkeysIndex])
+	if err != nil || numkeys < 0 || len(args) < numkeysIndex+1+numkeys {
+		return nil
+	}
+	return args[numkeysIndex+1 : numkeysIndex+1+numkeys]
+}
+
+// parseRedirect parses "MOVED <slot> <address>" and "ASK <slot> <address>" errors.
+func parseRedirect(s string) (string, int, string, bool) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= ClusterSlots {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+type ClusterSlotRange struct {
+	Start   int
+	End     int
+	Address string
+}
+
+// https://redis.io/docs/latest/commands/cluster-slots/
+func parseClusterSlots(message RESPMessage, seedHost string) ([]ClusterSlotRange, error) {
+	a, ok := message.(*RESPArray)
+	if !ok {
+		return nil, xerrors.Errorf("unexpected CLUSTER SLOTS response: %s", message.String())
+	}
+
+	var ranges []ClusterSlotRange
+	for _, m := range a.a {
+		entry, ok := m.(*RESPArray)
+		if !ok || len(entry.a) < 3 {
+			return nil, xerrors.New("invalid CLUSTER SLOTS entry")
+		}
+		start, ok := entry.a[0].(*RESPInteger)
+		if !ok {
+			return nil, xerrors.New("invalid CLUSTER SLOTS start slot")
+		}
+		end, ok := entry.a[1].(*RESPInteger)
+		if !ok {
+			return nil, xerrors.New("invalid CLUSTER SLOTS end slot")
+		}
+		node, ok := entry.a[2].(*RESPArray)
+		if !ok || len(node.a) < 2 {
+			return nil, xerrors.New("invalid CLUSTER SLOTS node")
+		}
+		host, ok := node.a[0].(*RESPBulkString)
+		if !ok || host.s == nil {
+			return nil, xerrors.New("invalid CLUSTER SLOTS node host")
+		}
+		port, ok := node.a[1].(*RESPInteger)
+		if !ok {
+			return nil, xerrors.New("invalid CLUSTER SLOTS node port")
+		}
+
+		ranges = append(ranges, ClusterSlotRange{
+			Start:   start.i,
+			End:     end.i,
+			Address: nodeAddress(*host.s, port.i, seedHost),
+		})
+	}
+	return ranges, nil
+}
+
+// https://redis.io/docs/latest/commands/cluster-shards/
+func parseClusterShards(message RESPMessage, seedHost string) ([]ClusterSlotRange, error) {
+	a, ok := message.(*RESPArray)
+	if !ok {
+		return nil, xerrors.Errorf("unexpected CLUSTER SHARDS response: %s", message.String())
+	}
+
+	var ranges []ClusterSlotRange
+	for _, m := range a.a {
+		shard, ok := m.(*RESPArray)
+		if !ok {
+			return nil, xerrors.New("invalid CLUSTER SHARDS entry")
+		}
+		fields := respMap(shard)
+
+		slots, ok := fields["slots"].(*RESPArray)
+		if !ok || len(slots.a)%2 != 0 {
+			return nil, xerrors.New("invalid CLUSTER SHARDS slots")
+		}
+		nodes, ok := fields["nodes"].(*RESPArray)
+		if !ok {
+			return nil, xerrors.New("invalid CLUSTER SHARDS nodes")
+		}
+
+		address := ""
+		for _, n := range nodes.a {
+			node, ok := n.(*RESPArray)
+			if !ok {
+				return nil, xerrors.New("invalid CLUSTER SHARDS node")
+			}
+			nodeFields := respMap(node)
+			if respString(nodeFields["role"]) != "master" || respString(nodeFields["health"]) == "fail" {
+				continue
+			}
+			port, ok := nodeFields["port"].(*RESPInteger)
+			if !ok {
+				port, ok = nodeFields["tls-port"].(*RESPInteger)
+			}
+			if !ok {
+				return nil, xerrors.New("invalid CLUSTER SHARDS node port")
+			}
+			host := respString(nodeFields["endpoint"])
+			if host == "" || host == "?" {
+				host = respString(nodeFields["ip"])
+			}
+			address = nodeAddress(host, port.i, seedHost)
+			break
+		}
+		if address == "" {
+			continue
+		}
+
+		for i := 0; i < len(slots.a); i += 2 {
+			start, ok := slots.a[i].(*RESPInteger)
+			if !ok {
+				return nil, xerrors.New("invalid CLUSTER SHARDS start slot")
+			}
+			end, ok := slots.a[i+1].(*RESPInteger)
+			if !ok {
+				return nil, xerrors.New("invalid CLUSTER SHARDS end slot")
+			}
+			ranges = append(ranges, ClusterSlotRange{
+				Start:   start.i,
+				End:     end.i,
+				Address: address,
+			})
+		}
+	}
+	return ranges, nil
+}
+
+// respMap reads a RESP2 flattened map of alternating names and values.
+func respMap(a *RESPArray) map[string]RESPMessage {
+	m := make(map[string]RESPMessage, len(a.a)/2)
+	for i := 0; i+1 < len(a.a); i += 2 {
+		m[respString(a.a[i])] = a.a[i+1]
+	}
+	return m
+}
+
+func respString(message RESPMessage) string {
+	switch m := message.(type) {
+	case *RESPBulkString:
+		if m.s != nil {
+			return *m.s
+		}
+	case *RESPSimpleString:
+		return m.s
+	}
+	return ""
+}
+
+// nodeAddress falls back to the seed host when a node announces an empty or unknown endpoint.
+func nodeAddress(host string, port int, seedHost string) string {
+	if host == "" || host == "?" {
+		host = seedHost
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+type ClusterRouterOption struct {
+	SeedAddress       string
+	MaxRedirects      int
+	NewConnectionPool func(address string) *ConnectionPool
+	OnRedirect        func(kind string, address string)
+}
+
+type ClusterRouter struct {
+	option *ClusterRouterOption
+
+	mutex      sync.RWMutex
+	slots      [ClusterSlots]string
+	pools      map[string]*ConnectionPool
+	refreshing atomic.Bool
+}
+
+func NewClusterRouter(option *ClusterRouterOption) *ClusterRouter {
+	return &ClusterRouter{
+		option: option,
+		pools:  make(map[string]*ConnectionPool),
+	}
+}
+
+func (r *ClusterRouter) Pools() map[string]*ConnectionPool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	pools := make(map[string]*ConnectionPool, len(r.pools))
+	for address, pool := range r.pools {
+		pools[address] = pool
+	}
+	return pools
+}
+
+func (r *ClusterRouter) pool(address string) *ConnectionPool {
+	r.mutex.RLock()
+	pool, ok := r.pools[address]
+	r.mutex.RUnlock()
+	if ok {
+		return pool
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if pool, ok := r.pools[address]; ok {
+		return pool
+	}
+	pool = r.option.NewConnectionPool(address)
+	r.pools[address] = pool
+	return pool
+}
+
+// address returns the seed for keyless commands and slots that are not known yet.
+func (r *ClusterRouter) address(slot int) string {
+	if slot < 0 {
+		return r.option.SeedAddress
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if address := r.slots[slot]; address != "" {
+		return address
+	}
+	return r.option.SeedAddress
+}
+
+func (r *ClusterRouter) Refresh(ctx context.Context) error {
+	candidates := []string{r.option.SeedAddress}
+	for address := range r.Pools() {
+		if address != r.option.SeedAddress {
+			candidates = append(candidates, address)
+		}
+	}
+
+	var errs []error
+	for _, address := range candidates {
+		ranges, err := r.loadSlots(ctx, address)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var slots [ClusterSlots]string
+		for _, rng := range ranges {
+			for slot := rng.Start; slot <= rng.End && slot < ClusterSlots; slot++ {
+				slots[slot] = rng.Address
+			}
+		}
+
+		r.mutex.Lock()
+		r.slots = slots
+		r.mutex.Unlock()
+
+		return nil
+	}
+
+	return xerrors.Errorf("failed to load cluster slots: %w", errors.Join(errs...))
+}
+
+// refreshInBackground coalesces the refreshes that a burst of MOVED redirects asks for.
+func (r *ClusterRouter) refreshInBackground() {
+	if !r.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer r.refreshing.Store(false)
+
+		if err := r.Refresh(context.Background()); err != nil {
+			log.Printf("%+v", err)
+		}
+	}()
+}
+
+func (r *ClusterRouter) loadSlots(ctx context.Context, address string) ([]ClusterSlotRange, error) {
+	seedHost, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to split host and port: %w", err)
+	}
+
+	response, err := r.send(ctx, address, "", newCommand("CLUSTER", "SHARDS"), false, 2)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to send CLUSTER SHARDS: %w", err)
+	}
+	if _, ok := response.(*RESPError); !ok {
+		return parseClusterShards(response, seedHost)
+	}
+
+	// CLUSTER SHARDS is only available since Redis 7.0.
+	response, err = r.send(ctx, address, "", newCommand("CLUSTER", "SLOTS"), false, 2)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to send CLUSTER SLOTS: %w", err)
+	}
+	if e, ok := response.(*RESPError); ok {
+		return nil, xerrors.Errorf("failed to load CLUSTER SLOTS: %s", e.s)
+	}
+	return parseClusterSlots(response, seedHost)
+}
+
+// exchange pipelines the commands and reads one reply for each of them.
+func exchange(connection *Connection, parser *RedisProtocolParser, commands ...*RESPArray) ([]RESPMessage, error) {
+	var buffer bytes.Buffer
+	for _, command := range commands {
+		buffer.WriteString(command.String())
+	}
+	if _, err := connection.Write(buffer.Bytes()); err != nil {
+		return nil, xerrors.Errorf("failed to write commands: %w", err)
+	}
+
+	replies := make([]RESPMessage, 0, len(commands))
+	for range commands {
+		reply, err := parser.Parse()
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read reply: %w", err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+func (r *ClusterRouter) send(ctx context.Context, address string, topologyName string, command *RESPArray, asking bool, protocol int) (RESPMessage, error) {
+	pinned, err := r.pin(ctx, address, topologyName, protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	args, ok := commandArgs(command)
+	// A blocking command may wait forever, so give up on it once the client is gone.
+	if ok && isBlockingCommand(args) {
+		stop := context.AfterFunc(ctx, func() {
+			_ = pinned.connection.Cancel()
+		})
+		defer stop()
+	}
+
+	commands := []*RESPArray{command}
+	if asking {
+		commands = []*RESPArray{newCommand("ASKING"), command}
+	}
+	replies, err := exchange(pinned.connection, pinned.parser, commands...)
+	if err != nil {
+		pinned.release(ctx, false)
+		return nil, err
+	}
+
+	reply := replies[len(replies)-1]
+	if _, isError := replies[0].(*RESPError); isError && asking {
+		reply = replies[0]
+	}
+	if version, ok := helloProtocol(args); ok {
+		if _, isError := reply.(*RESPError); !isError {
+			pinned.connection.protocol = version
+		}
+	}
+	pinned.release(ctx, true)
+
+	return reply, nil
+}
+
+// redirect reports whether the reply is a MOVED or ASK redirect, updating the slot map on MOVED.
+func (r *ClusterRouter) redirect(reply RESPMessage) (string, string, bool) {
+	e, ok := reply.(*RESPError)
+	if !ok {
+		return "", "", false
+	}
+	kind, slot, target, ok := parseRedirect(e.s)
+	if !ok {
+		return "", "", false
+	}
+
+	if r.option.OnRedirect != nil {
+		r.option.OnRedirect(kind, target)
+	}
+	if kind == "MOVED" {
+		r.mutex.Lock()
+		r.slots[slot] = target
+		r.mutex.Unlock()
+		r.refreshInBackground()
+	}
+	return kind, target, true
+}
+
+// Do sends the command to the node owning its keys, following MOVED and ASK redirects.
+// protocol is the RESP version the client negotiated, which the upstream connection is switched to.
+func (r *ClusterRouter) Do(ctx context.Context, topologyName string, command *RESPArray, protocol int) RESPMessage {
+	args, ok := commandArgs(command)
+	if !ok {
+		return &RESPError{s: "ERR Protocol error: expected an array of bulk strings"}
+	}
+
+	slot, err := commandSlot(commandKeys(args))
+	if err != nil {
+		return &RESPError{s: "CROSSSLOT Keys in request don't hash to the same slot"}
+	}
+
+	address := r.address(slot)
+	asking := false
+	for redirects := 0; ; redirects++ {
+		response, err := r.send(ctx, address, topologyName, command, asking, protocol)
+		if err != nil {
+			log.Printf("%+v", err)
+			return &RESPError{s: "ERR failed to reach cluster node " + address}
+		}
+
+		if redirects >= r.option.MaxRedirects {
+			return response
+		}
+		kind, target, ok := r.redirect(response)
+		if !ok {
+			return response
+		}
+		asking = kind == "ASK"
+		address = target
+	}
+}
+
+type clientMessage struct {
+	message RESPMessage
+	err     error
+}
+
+// pinnedConnection is an upstream connection held by one client across commands.
+type pinnedConnection struct {
+	pool       *ConnectionPool
+	connection *Connection
+	parser     *RedisProtocolParser
+}
+
+// pin takes a connection out of the pool of the node, speaking the RESP version of the client.
+func (r *ClusterRouter) pin(ctx context.Context, address string, topologyName string, protocol int) (*pinnedConnection, error) {
+	pool := r.pool(address)
+	connection, err := pool.Get(ctx, topologyName)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get connection: %w", err)
+	}
+	pinned := &pinnedConnection{
+		pool:       pool,
+		connection: connection,
+		parser:     NewRedisProtocolParser(connection),
+	}
+
+	if connection.protocol != protocol {
+		replies, err := exchange(connection, pinned.parser, newCommand("HELLO", strconv.Itoa(protocol)))
+		if err != nil {
+			pinned.release(ctx, false)
+			return nil, xerrors.Errorf("failed to send HELLO: %w", err)
+		}
+		if e, ok := replies[0].(*RESPError); ok {
+			pinned.release(ctx, true)
+			return nil, xerrors.Errorf("failed to switch to RESP%d: %s", protocol, e.s)
+		}
+		connection.protocol = protocol
+	}
+
+	return pinned, nil
+}
+
+// helloProtocol returns the RESP version a HELLO command asks for.
+func helloProtocol(args []string) (int, bool) {
+	if len(args) < 2 || strings.ToUpper(args[0]) != "HELLO" {
+		return 0, false
+	}
+	version, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+func (c *pinnedConnection) release(ctx context.Context, reusable bool) {
+	if reusable {
+		_ = c.pool.Put(ctx, c.connection)
+	} else {
+		c.pool.Discard(ctx, c.connection)
+	}
+}
+
+// clusterSession holds the per-client state of a transaction, which Redis Cluster confines to a single slot.
+// MULTI is queued by the proxy and sent together with EXEC, so only WATCH pins a connection ahead of EXEC.
+type clusterSession struct {
+	router       *ClusterRouter
+	topologyName string
+	protocol     int
+
+	watched *pinnedConnection
+	multi   bool
+	aborted bool
+	queue   []*RESPArray
+	slot    int
+}
+
+func newClusterSession(router *ClusterRouter, topologyName string) *clusterSession {
+	return &clusterSession{
+		router:       router,
+		topologyName: topologyName,
+		protocol:     2,
+		slot:         -1,
+	}
+}
+
+func (s *clusterSession) reset(ctx context.Context, reusable bool) {
+	if s.watched != nil {
+		s.watched.release(ctx, reusable)
+		s.watched = nil
+	}
+	s.multi = false
+	s.aborted = false
+	s.queue = nil
+	s.slot = -1
+}
+
+// Close releases the connection of an unfinished WATCH; it still watches keys, so it is not reused.
+func (s *clusterSession) Close(ctx context.Context) {
+	s.reset(ctx, false)
+}
+
+// bindSlot binds the session to the slot of the command keys, rejecting keys of another slot.
+func (s *clusterSession) bindSlot(args []string) bool {
+	slot, err := commandSlot(commandKeys(args))
+	if err != nil {
+		return false
+	}
+	if slot == -1 {
+		return true
+	}
+	if s.slot != -1 && s.slot != slot {
+		return false
+	}
+	s.slot = slot
+	return true
+}
+
+func (s *clusterSession) Handle(ctx context.Context, command *RESPArray, args []string) RESPMessage {
+	if err := unsupportedCommand(args); err != nil {
+		if s.multi {
+			s.aborted = true
+		}
+		return err
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		// Only SELECT 0 gets here, which is what every pooled connection uses already.
+		return &RESPSimpleString{s: "OK"}
+	case "HELLO":
+		if s.multi {
+			break
+		}
+		for _, arg := range args[1:] {
+			switch option := strings.ToUpper(arg); option {
+			case "AUTH", "SETNAME":
+				return &RESPError{s: "ERR HELLO " + option + " is not supported by redis-proxy because upstream connections are pooled"}
+			}
+		}
+		reply := s.router.Do(ctx, s.topologyName, command, s.protocol)
+		if version, ok := helloProtocol(args); ok {
+			if _, isError := reply.(*RESPError); !isError {
+				s.protocol = version
+			}
+		}
+		return reply
+	case "MULTI":
+		if s.multi {
+			return &RESPError{s: "ERR MULTI calls can not be nested"}
+		}
+		s.multi = true
+		return &RESPSimpleString{s: "OK"}
+	case "EXEC":
+		if !s.multi {
+			return &RESPError{s: "ERR EXEC without MULTI"}
+		}
+		if s.aborted {
+			s.reset(ctx, s.unwatch())
+			return &RESPError{s: "EXECABORT Transaction discarded because of previous errors."}
+		}
+		return s.exec(ctx)
+	case "DISCARD":
+		if !s.multi {
+			return &RESPError{s: "ERR DISCARD without MULTI"}
+		}
+		s.reset(ctx, s.unwatch())
+		return &RESPSimpleString{s: "OK"}
+	case "WATCH":
+		if s.multi {
+			return &RESPError{s: "ERR WATCH inside MULTI is not allowed"}
+		}
+		return s.watch(ctx, command, args)
+	case "UNWATCH":
+		if !s.multi {
+			s.reset(ctx, s.unwatch())
+			return &RESPSimpleString{s: "OK"}
+		}
+	}
+
+	if s.multi {
+		if !s.bindSlot(args) {
+			s.aborted = true
+			return &RESPError{s: "CROSSSLOT Keys in request don't hash to the same slot"}
+		}
+		s.queue = append(s.queue, command)
+		return &RESPSimpleString{s: "QUEUED"}
+	}
+
+	return s.router.Do(ctx, s.topologyName, command, s.protocol)
+}
+
+// unwatch clears the watched keys and reports whether the connection is reusable afterwards.
+func (s *clusterSession) unwatch() bool {
+	if s.watched == nil {
+		return true
+	}
+	replies, err := exchange(s.watched.connection, s.watched.parser, newCommand("UNWATCH"))
+	if err != nil {
+		log.Printf("%+v", err)
+		return false
+	}
+	_, ok := replies[0].(*RESPError)
+	return !ok
+}
+
+func (s *clusterSession) watch(ctx context.Context, command *RESPArray, args []string) RESPMessage {
+	if !s.bindSlot(args) {
+		return &RESPError{s: "CROSSSLOT Keys in request don't hash to the same slot"}
+	}
+
+	for redirects := 0; ; redirects++ {
+		fresh := s.watched == nil
+		if fresh {
+			watched, err := s.router.pin(ctx, s.router.address(s.slot), s.topologyName, s.protocol)
+			if err != nil {
+				log.Printf("%+v", err)
+				s.reset(ctx, false)
+				return &RESPError{s: "ERR failed to reach cluster node"}
+			}
+			s.watched = watched
+		}
+
+		replies, err := exchange(s.watched.connection, s.watched.parser, command)
+		if err != nil {
+			log.Printf("%+v", err)
+			s.reset(ctx, false)
+			return &RESPError{s: "ERR failed to reach cluster node"}
+		}
+
+		// A MOVED reply watched nothing, so a connection pinned for this WATCH alone can be swapped for one to the new owner.
+		if fresh && redirects < s.router.option.MaxRedirects {
+			if kind, _, ok := s.router.redirect(replies[0]); ok && kind == "MOVED" {
+				s.watched.release(ctx, true)
+				s.watched = nil
+				continue
+			}
+		}
+		return replies[0]
+	}
+}
+
+// exec sends MULTI, the queued commands and EXEC to the owner of the transaction slot in one round trip.
+func (s *clusterSession) exec(ctx context.Context) RESPMessage {
+	commands := append([]*RESPArray{newCommand("MULTI")}, s.queue...)
+	commands = append(commands, newCommand("EXEC"))
+
+	if s.watched != nil {
+		replies, err := exchange(s.watched.connection, s.watched.parser, commands...)
+		if err != nil {
+			log.Printf("%+v", err)
+			s.reset(ctx, false)
+			return &RESPError{s: "ERR failed to reach cluster node"}
+		}
+		s.reset(ctx, true)
+		return replies[len(replies)-1]
+	}
+
+	slot := s.slot
+	s.reset(ctx, true)
+
+	for redirects := 0; ; redirects++ {
+		pinned, err := s.router.pin(ctx, s.router.address(slot), s.topologyName, s.protocol)
+		if err != nil {
+			log.Printf("%+v", err)
+			return &RESPError{s: "ERR failed to reach cluster node"}
+		}
+
+		replies, err := exchange(pinned.connection, pinned.parser, commands...)
+		if err != nil {
+			log.Printf("%+v", err)
+			pinned.release(ctx, false)
+			return &RESPError{s: "ERR failed to reach cluster node"}
+		}
+		pinned.release(ctx, true)
+
+		// Every queued command of a moved slot answers MOVED and EXEC aborts, so the whole transaction can be retried on the new owner.
+		if len(commands) > 2 && redirects < s.router.option.MaxRedirects {
+			if kind, _, ok := s.router.redirect(replies[1]); ok && kind == "MOVED" {
+				continue
+			}
+		}
+		return replies[len(replies)-1]
+	}
+}
+
+// subscriptionReply returns the kind of a Pub/Sub reply and whether it answers a command rather than delivering a message.
+func subscriptionReply(message RESPMessage) (string, bool) {
+	a := subscriptionElements(message)
+	if len(a) == 0 {
+		return "", true
+	}
+	kind := strings.ToLower(respString(a[0]))
+	switch kind {
+	case "message", "pmessage", "smessage":
+		return kind, false
+	}
+	return kind, true
+}
+
+// subscriptionElements returns the elements of a Pub/Sub reply, an array in RESP2 and a push in RESP3.
+func subscriptionElements(message RESPMessage) []RESPMessage {
+	switch m := message.(type) {
+	case *RESPArray:
+		return m.a
+	case *RESPPush:
+		return m.a
+	}
+	return nil
+}
+
+// subscribe streams a subscription over one pinned connection until the client unsubscribes from everything.
+func (s *clusterSession) subscribe(ctx context.Context, local io.Writer, commands <-chan clientMessage, command *RESPArray, args []string) error {
+	address := s.router.address(-1)
+	if strings.ToUpper(args[0]) == "SSUBSCRIBE" {
+		slot, err := commandSlot(args[1:])
+		if err != nil {
+			_, err := io.WriteString(local, (&RESPError{s: "CROSSSLOT Keys in request don't hash to the same slot"}).String())
+			return err
+		}
+		address = s.router.address(slot)
+	}
+
+	pinned, err := s.router.pin(ctx, address, s.topologyName, s.protocol)
+	if err != nil {
+		log.Printf("%+v", err)
+		_, err := io.WriteString(local, (&RESPError{s: "ERR failed to reach cluster node"}).String())
+		return err
+	}
+
+	replies := make(chan clientMessage)
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			message, err := pinned.parser.Parse()
+			select {
+			case replies <- clientMessage{message: message, err: err}:
+			case <-quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	release := func(reusable bool) {
+		close(quit)
+		_ = pinned.connection.Cancel()
+		<-stopped
+		pinned.release(ctx, reusable)
+	}
+
+	subscriptions := map[string]map[string]struct{}{
+		"subscribe":  {},
+		"psubscribe": {},
+		"ssubscribe": {},
+	}
+	unsubscribeKinds := map[string]string{
+		"unsubscribe":  "subscribe",
+		"punsubscribe": "psubscribe",
+		"sunsubscribe": "ssubscribe",
+	}
+	// awaiting counts the replies still owed to the client; its next command is only read once they arrived.
+	awaiting := 0
+	forward := func(command *RESPArray, args []string) error {
+		kind := strings.ToLower(args[0])
+		switch {
+		case len(args) > 1:
+			awaiting += len(args) - 1
+		case unsubscribeKinds[kind] != "":
+			awaiting += max(1, len(subscriptions[unsubscribeKinds[kind]]))
+		default:
+			awaiting++
+		}
+		_, err := io.WriteString(pinned.connection, command.String())
+		return err
+	}
+
+	if err := forward(command, args); err != nil {
+		release(false)
+		return nil
+	}
+
+	for {
+		var next <-chan clientMessage
+		if awaiting == 0 {
+			if len(subscriptions["subscribe"])+len(subscriptions["psubscribe"])+len(subscriptions["ssubscribe"]) == 0 {
+				release(true)
+				return nil
+			}
+			next = commands
+		}
+
+		select {
+		case reply := <-replies:
+			if reply.err != nil {
+				release(false)
+				_, err := io.WriteString(local, (&RESPError{s: "ERR connection to cluster node lost"}).String())
+				return err
+			}
+
+			kind, answer := subscriptionReply(reply.message)
+			if _, ok := reply.message.(*RESPError); ok {
+				// An error answers the whole command, whatever number of channels it named.
+				awaiting = 0
+			} else if answer {
+				awaiting--
+			}
+			if a := subscriptionElements(reply.message); len(a) == 3 {
+				channel := respString(a[1])
+				if _, ok := subscriptions[kind]; ok {
+					subscriptions[kind][channel] = struct{}{}
+				} else if subscribed, ok := unsubscribeKinds[kind]; ok {
+					delete(subscriptions[subscribed], channel)
+				}
+			}
+			if respString(reply.message) == "RESET" {
+				for _, channels := range subscriptions {
+					clear(channels)
+				}
+			}
+
+			if _, err := io.WriteString(local, reply.message.String()); err != nil {
+				release(false)
+				return err
+			}
+		case <-ctx.Done():
+			release(false)
+			return ctx.Err()
+		case command := <-next:
+			if command.err != nil {
+				release(false)
+				return command.err
+			}
+
+			a, ok := command.message.(*RESPArray)
+			var args []string
+			if ok {
+				args, ok = commandArgs(a)
+			}
+			if !ok {
+				if _, err := io.WriteString(local, (&RESPError{s: "ERR Protocol error: expected an array of bulk strings"}).String()); err != nil {
+					release(false)
+					return err
+				}
+				continue
+			}
+
+			switch name := strings.ToUpper(args[0]); name {
+			case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE", "PING", "RESET":
+				if err := forward(a, args); err != nil {
+					release(false)
+					return nil
+				}
+			case "QUIT":
+				release(false)
+				_, _ = io.WriteString(local, (&RESPSimpleString{s: "OK"}).String())
+				return io.EOF
+			default:
+				// RESP3 lets a subscribed client run any command, which is routed like outside of the subscription.
+				if s.protocol == 3 {
+					if _, err := io.WriteString(local, s.Handle(ctx, a, args).String()); err != nil {
+						release(false)
+						return err
+					}
+					continue
+				}
+				message := "ERR Can't execute '" + strings.ToLower(name) + "': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"
+				if _, err := io.WriteString(local, (&RESPError{s: message}).String()); err != nil {
+					release(false)
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Serve proxies one client connection until it closes.
+func (r *ClusterRouter) Serve(ctx context.Context, topologyName string, local io.ReadWriter, onCommand func(args []string)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session := newClusterSession(r, topologyName)
+	defer session.Close(ctx)
+
+	commands := make(chan clientMessage)
+	go func() {
+		parser := NewRedisProtocolParser(local)
+		for {
+			message, err := parser.Parse()
+			if err != nil {
+				// Unblocks a blocking command waiting for a client that has gone away.
+				cancel()
+			}
+			select {
+			case commands <- clientMessage{message: message, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var command clientMessage
+		select {
+		case command = <-commands:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if command.err != nil {
+			return command.err
+		}
+
+		var response RESPMessage
+		a, ok := command.message.(*RESPArray)
+		var args []string
+		if ok {
+			args, ok = commandArgs(a)
+		}
+		switch {
+		case !ok:
+			response = &RESPError{s: "ERR Protocol error: expected an array of bulk strings"}
+		case isSubscribeCommand(args[0]) && !session.multi:
+			onCommand(args)
+			if err := session.subscribe(ctx, local, commands, a, args); err != nil {
+				return err
+			}
+			continue
+		default:
+			onCommand(args)
+			response = session.Handle(ctx, a, args)
+		}
+
+		if _, err := io.WriteString(local, response.String()); err != nil {
+			return err
+		}
+	}
+}
+
+func envOrDefaultValue[T any](key string, defaultValue T) T {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+
+	switch any(defaultValue).(type) {
+	case string:
+		return any(value).(T)
+	case int:
+		if intValue, err := strconv.Atoi(value); err == nil {
+			return any(intValue).(T)
+		}
+	case int64:
+		if intValue, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return any(intValue).(T)
+		}
+	case uint:
+		if uintValue, err := strconv.ParseUint(value, 10, 0); err == nil {
+			return any(uint(uintValue)).(T)
+		}
+	case uint64:
+		if uintValue, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return any(uintValue).(T)
+		}
+	case float64:
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return any(floatValue).(T)
+		}
+	case bool:
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return any(boolValue).(T)
+		}
+	case time.Duration:
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			return any(durationValue).(T)
+		}
+	}
+
+	return defaultValue
+}
+
+func main() {
+	var localAddress string
+	var remoteAddress string
+	var monitorAddress string
+	var readerRouting bool
+	var readerRemoteAddress string
 	var connectTimeout time.Duration
 	var maxConnections int
 	var maxIdleConnections int
@@ -574,6 +2438,9 @@ func main() {
 	var topologyAwareRouting bool
 	var topologies string
 	var ownIP string
+	var clusterMode bool
+	var clusterRefreshInterval time.Duration
+	var clusterMaxRedirects int
 	var terminationGracePeriod time.Duration
 	var lameduck time.Duration
 	var keepalive bool
@@ -592,12 +2459,19 @@ func main() {
 	flag.BoolVar(&topologyAwareRouting, "topology-aware-routing", envOrDefaultValue("TOPOLOGY_AWARE_ROUTING", false), "Topology-aware routing")
 	flag.StringVar(&topologies, "topologies", envOrDefaultValue("TOPOLOGIES", ""), "TopologyList in the format of name1=192.168.0.0/24,name2=192.168.1.0/24")
 	flag.StringVar(&ownIP, "own-ip", envOrDefaultValue("OWN_IP", ""), "Own IP address for topology-aware routing")
+	flag.BoolVar(&clusterMode, "cluster-mode", envOrDefaultValue("CLUSTER_MODE", false), "Route commands to the Redis Cluster node owning their hash slot. --remote-address is used as the seed node.")
+	flag.DurationVar(&clusterRefreshInterval, "cluster-refresh-interval", envOrDefaultValue("CLUSTER_REFRESH_INTERVAL", 30*time.Second), "Interval to reload the cluster slot map")
+	flag.IntVar(&clusterMaxRedirects, "cluster-max-redirects", envOrDefaultValue("CLUSTER_MAX_REDIRECTS", 5), "Maximum number of MOVED/ASK redirects to follow per command")
 
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepalive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
 	flag.Parse()
 
+	if clusterMode && readerRouting {
+		log.Fatalf("--cluster-mode and --reader-routing cannot be used together")
+	}
+
 	exporter, err := otelprometheus.New()
 	if err != nil {
 		log.Fatalf("failed to create exporter: %+v", err)
@@ -615,6 +2489,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to create counter: %+v", err)
 	}
+	redisClusterRedirectsTotal, err := meter.Int64Counter("redis_cluster_redirects_total")
+	if err != nil {
+		log.Fatalf("failed to create counter: %+v", err)
+	}
 
 	opt := metric.WithAttributes(
 		attribute.Key("upstream").String(remoteAddress),
@@ -710,7 +2588,61 @@ func main() {
 		})
 	}
 
+	var clusterRouter *ClusterRouter
+	if clusterMode {
+		clusterRouter = NewClusterRouter(&ClusterRouterOption{
+			SeedAddress:  remoteAddress,
+			MaxRedirects: clusterMaxRedirects,
+			NewConnectionPool: func(address string) *ConnectionPool {
+				return NewConnectionPool(&ConnectionPoolOption{
+					MaxConnections:     uint(maxConnections),
+					MaxIdleConnections: uint(maxIdleConnections),
+					MinIdleConnections: uint(minIdleConnections),
+					MaxIdleTime:        maxIdleTime,
+					MaxLifetime:        maxLifetime,
+					Jitter: func(duration time.Duration) time.Duration {
+						jitter := time.Duration(float64(duration) * jitterPercentage * (rand.Float64()*2 - 1))
+						return duration + jitter
+					},
+					TopologyList: topologyList,
+					Dialer: func(ctx context.Context) (net.Conn, error) {
+						return net.DialTimeout("tcp", address, connectTimeout)
+					},
+					ConnectionPoolStrategy: FIFO,
+				})
+			},
+			OnRedirect: func(kind string, address string) {
+				redisClusterRedirectsTotal.Add(context.Background(), 1, metric.WithAttributes(
+					attribute.Key("type").String(kind),
+					attribute.Key("upstream").String(address),
+				))
+			},
+		})
+		if err := clusterRouter.Refresh(context.Background()); err != nil {
+			log.Fatalf("failed to refresh cluster slots: %+v", err)
+		}
+
+		go func() {
+			ticker := time.NewTicker(clusterRefreshInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if err := clusterRouter.Refresh(context.Background()); err != nil {
+					log.Printf("%+v", err)
+				}
+			}
+		}()
+	}
+
 	if _, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		if clusterMode {
+			for address, pool := range clusterRouter.Pools() {
+				o.ObserveInt64(tcpIdleConnections, int64(pool.IdleConnections()), metric.WithAttributes(
+					attribute.Key("upstream").String(address),
+				))
+			}
+			return nil
+		}
 		o.ObserveInt64(tcpIdleConnections, int64(connectionPool.IdleConnections()), opt)
 		if readerRouting {
 			o.ObserveInt64(tcpIdleConnections, int64(readerConnectionPool.IdleConnections()), readerOpt)
@@ -761,127 +2693,67 @@ func main() {
 				tcpConnections.Add(ctx, 1, opt)
 				defer tcpConnections.Add(ctx, -1, opt)
 
+				if clusterMode {
+					c := make(chan struct{}, 1)
+
+					go func() {
+						_ = clusterRouter.Serve(ctx, topologyName, local, func(args []string) {
+							if strings.ToUpper(args[0]) != "COMMAND" {
+								redisCommandsTotal.Add(ctx, 1, metric.WithAttributes(
+									attribute.Key("cmd").String(args[0]),
+								))
+							}
+						})
+						c <- struct{}{}
+					}()
+
+					select {
+					case <-c:
+					case <-shutdown:
+						local.CloseWrite()
+					}
+					return
+				}
+
+				session := &Session{}
 				remote, err := connectionPool.Get(ctx, topologyName)
 				if err != nil {
 					return
 				}
 				defer func() {
-					if remote.readonly {
-						remote.Close()
+					if remote.readonly || !session.Reusable() {
+						connectionPool.Discard(ctx, remote)
 					} else {
 						connectionPool.Put(ctx, remote)
 					}
 				}()
-				defer remote.Cancel()
 
-				f := func(c chan struct{}, dst io.Writer, src io.Reader) {
-					_, _ = io.Copy(dst, src)
-					c <- struct{}{}
-				}
 				if readerRouting {
 					tcpConnections.Add(ctx, 1, readerOpt)
 					defer tcpConnections.Add(ctx, -1, readerOpt)
 
+					readerSession := &Session{}
 					readerRemote, err := readerConnectionPool.Get(ctx, topologyName)
 					if err != nil {
 						return
 					}
-					defer readerConnectionPool.Put(ctx, readerRemote)
-					defer readerRemote.Cancel()
-
-					c := make(chan struct{}, 3)
-
-					request := func(c chan struct{}, writer io.Writer, reader io.Writer, src io.Reader) {
-						var buffer bytes.Buffer
-
-						parser := NewRedisProtocolParser(io.TeeReader(src, &buffer))
-						for {
-							message, err := parser.Parse()
-							if err != nil {
-								if err == io.EOF {
-									break
-								}
-								return
-							}
-
-							switch message.(type) {
-							case *RESPArray:
-								a := message.(*RESPArray)
-								if a.a != nil && len(a.a) > 0 {
-									command := a.a[0]
-									switch command.(type) {
-									case *RESPBulkString:
-										s := command.(*RESPBulkString)
-										if s.s != nil && *s.s != "COMMAND" {
-											redisCommandsTotal.Add(ctx, 1, metric.WithAttributes(
-												attribute.Key("cmd").String(*s.s),
-											))
-
-											if isReadCommand(*s.s) {
-												_, _ = io.Copy(reader, bytes.NewReader(buffer.Bytes()))
-												buffer.Reset()
-												continue
-											}
-										}
-									}
-								}
-							}
-
-							_, _ = io.Copy(writer, bytes.NewReader(buffer.Bytes()))
-							buffer.Reset()
+					defer func() {
+						if !readerSession.Reusable() {
+							readerConnectionPool.Discard(ctx, readerRemote)
+						} else {
+							readerConnectionPool.Put(ctx, readerRemote)
 						}
+					}()
 
-						c <- struct{}{}
-					}
-
-					response := func(c chan struct{}, dst net.Conn, src *Connection) {
-						var buffer bytes.Buffer
-
-						parser := NewRedisProtocolParser(io.TeeReader(src, &buffer))
-						for {
-							message, err := parser.Parse()
-							if err != nil {
-								if err == io.EOF {
-									break
-								}
-								return
-							}
-
-							switch message.(type) {
-							case *RESPError:
-								s := message.(*RESPError)
-								if s.s == "READONLY You can't write against a read only replica." {
-									src.markReadonly()
-								}
-							}
-
-							_, _ = io.Copy(dst, bytes.NewReader(buffer.Bytes()))
-							buffer.Reset()
+					splitReads(local, remote, readerRemote, session, readerSession, shutdown, func(args []string) {
+						if strings.ToUpper(args[0]) != "COMMAND" {
+							redisCommandsTotal.Add(ctx, 1, metric.WithAttributes(
+								attribute.Key("cmd").String(args[0]),
+							))
 						}
-
-						c <- struct{}{}
-					}
-
-					go request(c, remote, readerRemote, local)
-					go response(c, local, remote)
-					go f(c, local, readerRemote)
-
-					select {
-					case <-c:
-					case <-shutdown:
-						local.CloseWrite()
-					}
+					})
 				} else {
-					c := make(chan struct{}, 2)
-
-					go f(c, remote, local)
-					go f(c, local, remote)
-
-					select {
-					case <-c:
-					case <-shutdown:
-						local.CloseWrite()
-					}
+					passThrough(local, remote, session, shutdown)
 				}
 			}()
 		}
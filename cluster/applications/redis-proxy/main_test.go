@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func p[T any](v T) *T {
@@ -59,6 +68,84 @@ func TestRedisProtocolParser_Parse(t *testing.T) {
 			want:    &RESPArray{a: nil},
 			wantErr: false,
 		},
+		{
+			name:    "null",
+			input:   []byte("_\r\n"),
+			want:    &RESPNull{},
+			wantErr: false,
+		},
+		{
+			name:    "boolean",
+			input:   []byte("#t\r\n"),
+			want:    &RESPBoolean{b: true},
+			wantErr: false,
+		},
+		{
+			name:    "double",
+			input:   []byte(",3.14\r\n"),
+			want:    &RESPDouble{f: 3.14},
+			wantErr: false,
+		},
+		{
+			name:    "double infinity",
+			input:   []byte(",-inf\r\n"),
+			want:    &RESPDouble{f: math.Inf(-1)},
+			wantErr: false,
+		},
+		{
+			name:    "big number",
+			input:   []byte("(3492890328409238509324850943850943825024385\r\n"),
+			want:    &RESPBigNumber{s: "3492890328409238509324850943850943825024385"},
+			wantErr: false,
+		},
+		{
+			name:    "blob error",
+			input:   []byte("!21\r\nSYNTAX invalid syntax\r\n"),
+			want:    &RESPBlobError{s: "SYNTAX invalid syntax"},
+			wantErr: false,
+		},
+		{
+			name:    "verbatim string",
+			input:   []byte("=15\r\ntxt:Some string\r\n"),
+			want:    &RESPVerbatimString{format: "txt", s: "Some string"},
+			wantErr: false,
+		},
+		{
+			name:    "map",
+			input:   []byte("%2\r\n+first\r\n:1\r\n+second\r\n:2\r\n"),
+			want:    &RESPMap{m: []RESPMessage{&RESPSimpleString{s: "first"}, &RESPInteger{i: 1}, &RESPSimpleString{s: "second"}, &RESPInteger{i: 2}}},
+			wantErr: false,
+		},
+		{
+			name:    "set",
+			input:   []byte("~2\r\n+orange\r\n+apple\r\n"),
+			want:    &RESPSet{a: []RESPMessage{&RESPSimpleString{s: "orange"}, &RESPSimpleString{s: "apple"}}},
+			wantErr: false,
+		},
+		{
+			name:    "attribute",
+			input:   []byte("|1\r\n+ttl\r\n:3600\r\n+value\r\n"),
+			want:    &RESPAttribute{m: []RESPMessage{&RESPSimpleString{s: "ttl"}, &RESPInteger{i: 3600}}, message: &RESPSimpleString{s: "value"}},
+			wantErr: false,
+		},
+		{
+			name:    "push",
+			input:   []byte(">2\r\n+pubsub\r\n+message\r\n"),
+			want:    &RESPPush{a: []RESPMessage{&RESPSimpleString{s: "pubsub"}, &RESPSimpleString{s: "message"}}},
+			wantErr: false,
+		},
+		{
+			name:    "invalid boolean",
+			input:   []byte("#x\r\n"),
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "invalid big number",
+			input:   []byte("(12a\r\n"),
+			want:    nil,
+			wantErr: true,
+		},
 		{
 			name:    "invalid type",
 			input:   []byte("invalid\r\n"),
@@ -141,6 +228,61 @@ func TestRESPMessage_MarshalJSON(t *testing.T) {
 			&RESPArray{a: nil},
 			`null`,
 		},
+		{
+			"null",
+			&RESPNull{},
+			`null`,
+		},
+		{
+			"boolean",
+			&RESPBoolean{b: false},
+			`false`,
+		},
+		{
+			"double",
+			&RESPDouble{f: 1.5},
+			`1.5`,
+		},
+		{
+			"double infinity",
+			&RESPDouble{f: math.Inf(1)},
+			`"inf"`,
+		},
+		{
+			"big number",
+			&RESPBigNumber{s: "3492890328409238509324850943850943825024385"},
+			`3492890328409238509324850943850943825024385`,
+		},
+		{
+			"blob error",
+			&RESPBlobError{s: "SYNTAX invalid syntax"},
+			`{"error":"SYNTAX invalid syntax"}`,
+		},
+		{
+			"verbatim string",
+			&RESPVerbatimString{format: "txt", s: "Some string"},
+			`"Some string"`,
+		},
+		{
+			"map",
+			&RESPMap{m: []RESPMessage{&RESPSimpleString{s: "server"}, &RESPBulkString{s: p("redis")}, &RESPInteger{i: 1}, &RESPBoolean{b: true}}},
+			`{"server":"redis","1":true}`,
+		},
+		{
+			"set",
+			&RESPSet{a: []RESPMessage{&RESPInteger{i: 1}}},
+			`[1]`,
+		},
+		{
+			"attribute",
+			&RESPAttribute{m: []RESPMessage{&RESPSimpleString{s: "ttl"}, &RESPInteger{i: 3600}}, message: &RESPInteger{i: 42}},
+			`42`,
+		},
+		{
+			"push",
+			&RESPPush{a: []RESPMessage{&RESPBulkString{s: p("message")}}},
+			`["message"]`,
+		},
 	}
 	for _, tt := range tests {
 		name := tt.name
@@ -159,6 +301,781 @@ func TestRESPMessage_MarshalJSON(t *testing.T) {
 	}
 }
 
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want int
+	}{
+		{
+			"plain key",
+			"somekey",
+			11058,
+		},
+		{
+			"check value",
+			"123456789",
+			0x31C3,
+		},
+		{
+			"hash tag",
+			"foo{hash_tag}",
+			2515,
+		},
+		{
+			"hash tag only",
+			"hash_tag",
+			2515,
+		},
+		{
+			"first hash tag wins",
+			"{hash_tag}{other}",
+			2515,
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := keySlot(in)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			"single key",
+			[]string{"GET", "foo"},
+			[]string{"foo"},
+		},
+		{
+			"keyless",
+			[]string{"PING"},
+			nil,
+		},
+		{
+			"keyless with arguments",
+			[]string{"CLIENT", "SETNAME", "foo"},
+			nil,
+		},
+		{
+			"all arguments",
+			[]string{"MGET", "foo", "bar"},
+			[]string{"foo", "bar"},
+		},
+		{
+			"key value pairs",
+			[]string{"MSET", "foo", "1", "bar", "2"},
+			[]string{"foo", "bar"},
+		},
+		{
+			"blocking with timeout",
+			[]string{"BLPOP", "foo", "bar", "0"},
+			[]string{"foo", "bar"},
+		},
+		{
+			"numkeys",
+			[]string{"EVAL", "return 1", "2", "foo", "bar", "arg"},
+			[]string{"foo", "bar"},
+		},
+		{
+			"destination and numkeys",
+			[]string{"ZUNIONSTORE", "dst", "2", "foo", "bar", "WEIGHTS", "1", "2"},
+			[]string{"dst", "foo", "bar"},
+		},
+		{
+			"streams",
+			[]string{"XREAD", "COUNT", "2", "STREAMS", "foo", "bar", "0", "0"},
+			[]string{"foo", "bar"},
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := commandKeys(in)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCommandSlot(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []string
+		want    int
+		wantErr bool
+	}{
+		{
+			"no keys",
+			nil,
+			-1,
+			false,
+		},
+		{
+			"same slot",
+			[]string{"{user}.a", "{user}.b"},
+			keySlot("user"),
+			false,
+		},
+		{
+			"cross slot",
+			[]string{"foo", "bar"},
+			0,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got, err := commandSlot(in)
+			if (err != nil) != wantErr {
+				t.Fatalf("commandSlot() error = %+v, wantErr %v", err, wantErr)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	type result struct {
+		Kind    string
+		Slot    int
+		Address string
+		OK      bool
+	}
+	tests := []struct {
+		name string
+		in   string
+		want result
+	}{
+		{
+			"moved",
+			"MOVED 3999 127.0.0.1:6381",
+			result{"MOVED", 3999, "127.0.0.1:6381", true},
+		},
+		{
+			"ask",
+			"ASK 3999 127.0.0.1:6381",
+			result{"ASK", 3999, "127.0.0.1:6381", true},
+		},
+		{
+			"other error",
+			"ERR unknown command",
+			result{},
+		},
+		{
+			"invalid slot",
+			"MOVED 16384 127.0.0.1:6381",
+			result{},
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			kind, slot, address, ok := parseRedirect(in)
+			got := result{kind, slot, address, ok}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseClusterTopology(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		parse func(RESPMessage, string) ([]ClusterSlotRange, error)
+		want  []ClusterSlotRange
+	}{
+		{
+			"cluster slots",
+			"*2\r\n" +
+				"*3\r\n:0\r\n:5460\r\n*3\r\n$9\r\n127.0.0.1\r\n:30001\r\n$2\r\nid\r\n" +
+				"*3\r\n:5461\r\n:16383\r\n*3\r\n$0\r\n\r\n:30002\r\n$2\r\nid\r\n",
+			parseClusterSlots,
+			[]ClusterSlotRange{
+				{Start: 0, End: 5460, Address: "127.0.0.1:30001"},
+				{Start: 5461, End: 16383, Address: "10.0.0.1:30002"},
+			},
+		},
+		{
+			"cluster shards",
+			"*1\r\n" +
+				"*4\r\n$5\r\nslots\r\n*4\r\n:0\r\n:5460\r\n:10923\r\n:16383\r\n$5\r\nnodes\r\n*2\r\n" +
+				"*8\r\n$4\r\nport\r\n:30004\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n$4\r\nrole\r\n$7\r\nreplica\r\n$6\r\nhealth\r\n$6\r\nonline\r\n" +
+				"*10\r\n$4\r\nport\r\n:30001\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n$8\r\nendpoint\r\n$9\r\nredis-0.a\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$6\r\nhealth\r\n$6\r\nonline\r\n",
+			parseClusterShards,
+			[]ClusterSlotRange{
+				{Start: 0, End: 5460, Address: "redis-0.a:30001"},
+				{Start: 10923, End: 16383, Address: "redis-0.a:30001"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		parse := tt.parse
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			message, err := NewRedisProtocolParser(bytes.NewReader([]byte(in))).Parse()
+			if err != nil {
+				t.Fatalf("RedisProtocolParser.Parse() error = %+v", err)
+			}
+			got, err := parse(message, "10.0.0.1")
+			if err != nil {
+				t.Fatalf("parse() error = %+v", err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func serveRedis(t *testing.T, reply func(args []string) string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %+v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				parser := NewRedisProtocolParser(bufio.NewReader(conn))
+				for {
+					message, err := parser.Parse()
+					if err != nil {
+						return
+					}
+					args, _ := commandArgs(message.(*RESPArray))
+					if _, err := io.WriteString(conn, reply(args)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestClusterRouter_Do(t *testing.T) {
+	owner := serveRedis(t, func(args []string) string {
+		return "+OK\r\n"
+	})
+	importing := serveRedis(t, func(args []string) string {
+		return "+" + args[0] + "\r\n"
+	})
+	seed := serveRedis(t, func(args []string) string {
+		switch args[1] {
+		case "foo":
+			return "-MOVED 12182 " + owner + "\r\n"
+		case "bar":
+			return "-ASK 5061 " + importing + "\r\n"
+		}
+		return "+PONG\r\n"
+	})
+
+	router := NewClusterRouter(&ClusterRouterOption{
+		SeedAddress:  seed,
+		MaxRedirects: 5,
+		NewConnectionPool: func(address string) *ConnectionPool {
+			return NewConnectionPool(&ConnectionPoolOption{
+				Jitter: func(duration time.Duration) time.Duration {
+					return duration
+				},
+				Dialer: func(ctx context.Context) (net.Conn, error) {
+					return net.Dial("tcp", address)
+				},
+				ConnectionPoolStrategy: FIFO,
+			})
+		},
+	})
+
+	tests := []struct {
+		name string
+		in   []string
+		want string
+	}{
+		{
+			"moved",
+			[]string{"SET", "foo", "1"},
+			"+OK\r\n",
+		},
+		{
+			"ask",
+			[]string{"GET", "bar"},
+			"+GET\r\n",
+		},
+		{
+			"cross slot",
+			[]string{"MGET", "foo", "bar"},
+			"-CROSSSLOT Keys in request don't hash to the same slot\r\n",
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			got := router.Do(context.Background(), "", newCommand(in...), 2)
+			if diff := cmp.Diff(want, got.String()); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if got := router.address(12182); got != owner {
+		t.Errorf("router.address(12182) = %s, want %s", got, owner)
+	}
+}
+
+func TestSession(t *testing.T) {
+	type step struct {
+		Command []string
+		Reply   bool
+	}
+	type result struct {
+		Pinned   bool
+		Reusable bool
+	}
+	tests := []struct {
+		name string
+		in   []step
+		want result
+	}{
+		{
+			"answered",
+			[]step{{Command: []string{"GET", "foo"}}, {Reply: true}},
+			result{Pinned: false, Reusable: true},
+		},
+		{
+			"reply tracked before its command",
+			[]step{{Reply: true}, {Command: []string{"GET", "foo"}}},
+			result{Pinned: false, Reusable: true},
+		},
+		{
+			"unanswered blocking command",
+			[]step{{Command: []string{"BLPOP", "foo", "0"}}},
+			result{Pinned: false, Reusable: false},
+		},
+		{
+			"open transaction",
+			[]step{{Command: []string{"MULTI"}}, {Reply: true}, {Command: []string{"SET", "foo", "1"}}, {Reply: true}},
+			result{Pinned: true, Reusable: false},
+		},
+		{
+			"executed transaction",
+			[]step{{Command: []string{"WATCH", "foo"}}, {Reply: true}, {Command: []string{"MULTI"}}, {Reply: true}, {Command: []string{"EXEC"}}, {Reply: true}},
+			result{Pinned: false, Reusable: true},
+		},
+		{
+			"watching",
+			[]step{{Command: []string{"WATCH", "foo"}}, {Reply: true}},
+			result{Pinned: true, Reusable: false},
+		},
+		{
+			"subscribed",
+			[]step{{Command: []string{"SUBSCRIBE", "foo"}}, {Reply: true}},
+			result{Pinned: true, Reusable: false},
+		},
+		{
+			"selected database",
+			[]step{{Command: []string{"SELECT", "1"}}, {Reply: true}},
+			result{Pinned: false, Reusable: false},
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			session := &Session{}
+			for _, step := range in {
+				if step.Reply {
+					session.Reply()
+				} else {
+					session.Command(step.Command)
+				}
+			}
+			got := result{Pinned: session.Pinned(), Reusable: session.Reusable()}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIsBlockingCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want bool
+	}{
+		{
+			"blocking list pop",
+			[]string{"blpop", "foo", "0"},
+			true,
+		},
+		{
+			"stream read with block",
+			[]string{"XREAD", "COUNT", "1", "BLOCK", "0", "STREAMS", "foo", "$"},
+			true,
+		},
+		{
+			"stream read without block",
+			[]string{"XREAD", "STREAMS", "block", "0"},
+			false,
+		},
+		{
+			"plain read",
+			[]string{"GET", "foo"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := isBlockingCommand(in)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClusterRouter_Serve(t *testing.T) {
+	node := serveRedis(t, func(args []string) string {
+		switch args[0] {
+		case "MULTI":
+			return "+OK\r\n"
+		case "EXEC":
+			return "*2\r\n+OK\r\n+OK\r\n"
+		case "SET":
+			return "+QUEUED\r\n"
+		case "SUBSCRIBE":
+			reply := "*3\r\n$9\r\nsubscribe\r\n$1\r\n" + args[1] + "\r\n:1\r\n"
+			if args[1] == "a" {
+				reply += "*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nhello\r\n"
+			}
+			return reply
+		case "HELLO":
+			return "%1\r\n$5\r\nproto\r\n:" + args[1] + "\r\n"
+		case "UNSUBSCRIBE":
+			return "*3\r\n$11\r\nunsubscribe\r\n$1\r\n" + args[1] + "\r\n:0\r\n"
+		}
+		return "+PONG\r\n"
+	})
+
+	router := NewClusterRouter(&ClusterRouterOption{
+		SeedAddress:  node,
+		MaxRedirects: 5,
+		NewConnectionPool: func(address string) *ConnectionPool {
+			return NewConnectionPool(&ConnectionPoolOption{
+				Jitter: func(duration time.Duration) time.Duration {
+					return duration
+				},
+				Dialer: func(ctx context.Context) (net.Conn, error) {
+					return net.Dial("tcp", address)
+				},
+				ConnectionPoolStrategy: FIFO,
+			})
+		},
+	})
+
+	tests := []struct {
+		name string
+		in   [][]string
+		want []string
+	}{
+		{
+			"transaction",
+			[][]string{{"MULTI"}, {"SET", "{a}x", "1"}, {"SET", "{a}y", "2"}, {"EXEC"}},
+			[]string{"+OK\r\n", "+QUEUED\r\n", "+QUEUED\r\n", "*2\r\n+OK\r\n+OK\r\n"},
+		},
+		{
+			"cross slot transaction",
+			[][]string{{"MULTI"}, {"SET", "foo", "1"}, {"SET", "bar", "2"}, {"EXEC"}},
+			[]string{"+OK\r\n", "+QUEUED\r\n", "-CROSSSLOT Keys in request don't hash to the same slot\r\n", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		},
+		{
+			"subscription",
+			[][]string{{"SUBSCRIBE", "a"}, {"UNSUBSCRIBE", "a"}, {"PING"}},
+			[]string{
+				"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n",
+				"*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nhello\r\n",
+				"*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:0\r\n",
+				"+PONG\r\n",
+			},
+		},
+		{
+			"command while subscribed",
+			[][]string{{"SUBSCRIBE", "b"}, {"GET", "b"}, {"UNSUBSCRIBE", "b"}},
+			[]string{
+				"*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:1\r\n",
+				"-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n",
+				"*3\r\n$11\r\nunsubscribe\r\n$1\r\nb\r\n:0\r\n",
+			},
+		},
+		{
+			"hello",
+			[][]string{{"HELLO", "3"}, {"PING"}, {"HELLO", "3", "AUTH", "user", "password"}},
+			[]string{
+				"%1\r\n$5\r\nproto\r\n:3\r\n",
+				"+PONG\r\n",
+				"-ERR HELLO AUTH is not supported by redis-proxy because upstream connections are pooled\r\n",
+			},
+		},
+		{
+			"select",
+			[][]string{{"SELECT", "1"}, {"SELECT", "0"}},
+			[]string{"-ERR SELECT is not supported by redis-proxy because upstream connections are pooled; use database 0\r\n", "+OK\r\n"},
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				_ = router.Serve(context.Background(), "", server, func(args []string) {})
+			}()
+
+			go func() {
+				for _, args := range in {
+					if _, err := io.WriteString(client, newCommand(args...).String()); err != nil {
+						return
+					}
+				}
+			}()
+
+			parser := NewRedisProtocolParser(client)
+			var got []string
+			for range want {
+				message, err := parser.Parse()
+				if err != nil {
+					t.Fatalf("RedisProtocolParser.Parse() error = %+v", err)
+				}
+				got = append(got, message.String())
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func dialRedis(t *testing.T, address string) *Connection {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("net.Dial() error = %+v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return NewConnection(conn)
+}
+
+func TestPassThrough(t *testing.T) {
+	upstream := serveRedis(t, func(args []string) string {
+		if args[0] == "BLPOP" {
+			// Blocks until the client has gone away
+			return ""
+		}
+		return "+OK\r\n"
+	})
+
+	tests := []struct {
+		name string
+		in   [][]string
+		want bool
+	}{
+		{
+			"answered",
+			[][]string{{"SET", "foo", "1"}},
+			true,
+		},
+		{
+			"client gone while blocking",
+			[][]string{{"BLPOP", "foo", "0"}},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			remote := dialRedis(t, upstream)
+			session := &Session{}
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				passThrough(server, remote, session, nil)
+			}()
+
+			parser := NewRedisProtocolParser(client)
+			for _, args := range in {
+				if _, err := io.WriteString(client, newCommand(args...).String()); err != nil {
+					t.Fatalf("io.WriteString() error = %+v", err)
+				}
+				if args[0] != "BLPOP" {
+					if _, err := parser.Parse(); err != nil {
+						t.Fatalf("RedisProtocolParser.Parse() error = %+v", err)
+					}
+				}
+			}
+			_ = client.Close()
+			<-done
+
+			if got := session.Reusable(); got != want {
+				t.Errorf("session.Reusable() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSplitReads(t *testing.T) {
+	writer := serveRedis(t, func(args []string) string {
+		switch args[0] {
+		case "HELLO":
+			return "%1\r\n$5\r\nproto\r\n:" + args[1] + "\r\n"
+		case "SET":
+			return "+OK\r\n"
+		}
+		return "-ERR writer got " + args[0] + "\r\n"
+	})
+	reader := serveRedis(t, func(args []string) string {
+		switch args[0] {
+		case "HELLO":
+			return "%1\r\n$6\r\nreader\r\n:" + args[1] + "\r\n"
+		case "GET":
+			// Answers after the writer, so that only ordering keeps the replies in place
+			time.Sleep(50 * time.Millisecond)
+			return "$" + strconv.Itoa(len(args[1])) + "\r\n" + args[1] + "\r\n"
+		}
+		return "-ERR reader got " + args[0] + "\r\n"
+	})
+
+	type result struct {
+		Replies  []string
+		Reusable bool
+	}
+	tests := []struct {
+		name string
+		in   [][]string
+		want result
+	}{
+		{
+			"pipelined reads and writes",
+			[][]string{{"GET", "a"}, {"SET", "b", "1"}, {"GET", "c"}, {"SET", "d", "1"}},
+			result{Replies: []string{"$1\r\na\r\n", "+OK\r\n", "$1\r\nc\r\n", "+OK\r\n"}, Reusable: true},
+		},
+		{
+			"unsupported command behind a pending read",
+			[][]string{{"GET", "a"}, {"SELECT", "1"}, {"SET", "b", "1"}},
+			result{Replies: []string{"$1\r\na\r\n", "-ERR SELECT is not supported by redis-proxy because upstream connections are pooled; use database 0\r\n", "+OK\r\n"}, Reusable: true},
+		},
+		{
+			"hello between pipelined reads",
+			[][]string{{"GET", "a"}, {"HELLO", "3"}, {"GET", "c"}},
+			result{Replies: []string{"$1\r\na\r\n", "%1\r\n$5\r\nproto\r\n:3\r\n", "$1\r\nc\r\n"}, Reusable: false},
+		},
+	}
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			session := &Session{}
+			readerSession := &Session{}
+			writerRemote := dialRedis(t, writer)
+			readerRemote := dialRedis(t, reader)
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				splitReads(server, writerRemote, readerRemote, session, readerSession, nil, func(args []string) {})
+			}()
+
+			go func() {
+				for _, args := range in {
+					if _, err := io.WriteString(client, newCommand(args...).String()); err != nil {
+						return
+					}
+				}
+			}()
+
+			parser := NewRedisProtocolParser(client)
+			var got result
+			for range want.Replies {
+				message, err := parser.Parse()
+				if err != nil {
+					t.Fatalf("RedisProtocolParser.Parse() error = %+v", err)
+				}
+				got.Replies = append(got.Replies, message.String())
+			}
+			_ = client.Close()
+			<-done
+
+			got.Reusable = session.Reusable() && readerSession.Reusable()
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func BenchmarkRedisProtocolParser_Parse(b *testing.B) {
 	input := []byte("*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n")
 	parser := NewRedisProtocolParser(bytes.NewReader(input))
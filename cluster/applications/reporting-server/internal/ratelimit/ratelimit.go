@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// overflowKey is the key of the bucket shared by the keys beyond MaxKeys.
+const overflowKey = "\x00overflow"
+
+type entry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// KeyedLimiter is a token bucket per key. Buckets idle for IdleTimeout are dropped by Sweep.
+// Once there are MaxKeys buckets, new keys share one bucket until Sweep makes room, so that keys
+// chosen by clients cannot grow it without bound.
+type KeyedLimiter struct {
+	Rate        rate.Limit
+	Burst       int
+	IdleTimeout time.Duration
+	// MaxKeys bounds the number of buckets of their own, besides the shared one. 0 is unbounded.
+	MaxKeys int
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+func (l *KeyedLimiter) entry(key string, now time.Time) *entry {
+	if l.entries == nil {
+		l.entries = make(map[string]*entry)
+	}
+	e, ok := l.entries[key]
+	if !ok {
+		if l.MaxKeys > 0 && len(l.entries) >= l.MaxKeys {
+			key = overflowKey
+			e, ok = l.entries[key]
+		}
+		if !ok {
+			e = &entry{limiter: rate.NewLimiter(l.Rate, l.Burst)}
+			l.entries[key] = e
+		}
+	}
+	e.lastSeen = now
+	return e
+}
+
+// TakeN consumes up to n tokens of key at now, and returns how many it consumed, so that part of
+// a batch larger than Burst still gets through.
+func (l *KeyedLimiter) TakeN(key string, n int, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.entry(key, now)
+	taken := min(n, int(e.limiter.TokensAt(now)))
+	if taken <= 0 || !e.limiter.AllowN(now, taken) {
+		return 0
+	}
+	return taken
+}
+
+func (l *KeyedLimiter) Sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, e := range l.entries {
+		if now.Sub(e.lastSeen) > l.IdleTimeout {
+			delete(l.entries, key)
+		}
+	}
+}
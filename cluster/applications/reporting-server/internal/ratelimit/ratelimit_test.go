@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestKeyedLimiter_TakeN(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type take struct {
+		key string
+		n   int
+		at  time.Duration
+	}
+	tests := []struct {
+		name  string
+		takes []take
+		want  []int
+	}{
+		{"within burst", []take{{"a", 3, 0}, {"a", 2, 0}}, []int{3, 2}},
+		{"over burst is partly taken", []take{{"a", 8, 0}, {"a", 1, 0}}, []int{5, 0}},
+		{"refilled", []take{{"a", 5, 0}, {"a", 1, 0}, {"a", 1, time.Second}}, []int{5, 0, 1}},
+		{"per key", []take{{"a", 5, 0}, {"b", 5, 0}}, []int{5, 5}},
+		{"beyond max keys share a bucket", []take{{"a", 1, 0}, {"b", 1, 0}, {"c", 3, 0}, {"d", 3, 0}}, []int{1, 1, 3, 2}},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		takes := tt.takes
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			l := &KeyedLimiter{Rate: 1, Burst: 5, IdleTimeout: time.Minute, MaxKeys: 2}
+			var got []int
+			for _, take := range takes {
+				got = append(got, l.TakeN(take.key, take.n, now.Add(take.at)))
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+			if len(l.entries) > l.MaxKeys+1 {
+				t.Errorf("got %d buckets, want at most %d", len(l.entries), l.MaxKeys+1)
+			}
+		})
+	}
+}
+
+func TestKeyedLimiter_Sweep(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := &KeyedLimiter{Rate: 1, Burst: 5, IdleTimeout: time.Minute, MaxKeys: 2}
+	l.TakeN("idle", 5, now)
+	l.TakeN("active", 1, now.Add(time.Minute))
+
+	l.Sweep(now.Add(90 * time.Second))
+
+	if _, ok := l.entries["idle"]; ok {
+		t.Error("kept an idle bucket")
+	}
+	if _, ok := l.entries["active"]; !ok {
+		t.Error("dropped an active bucket")
+	}
+	// The room made by Sweep goes to a key of its own, with a full bucket
+	if got := l.TakeN("new", 5, now.Add(90*time.Second)); got != 5 {
+		t.Errorf("got %d, want 5", got)
+	}
+}
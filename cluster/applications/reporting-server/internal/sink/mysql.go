@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"context"
+	"time"
+
+	"github.com/XSAM/otelsql"
+	_ "github.com/go-sql-driver/mysql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"golang.org/x/xerrors"
+)
+
+const (
+	maxIdleConns    = 10
+	connMaxLifetime = 5 * time.Minute
+	connMaxIdleTime = 30 * time.Second
+)
+
+var mysqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS reports (
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+	fingerprint CHAR(64) NOT NULL,
+	bucket BIGINT NULL,
+	type VARCHAR(64) NOT NULL,
+	origin VARCHAR(255) NOT NULL,
+	url TEXT NOT NULL,
+	directive VARCHAR(255) NOT NULL,
+	blocked_url TEXT NOT NULL,
+	disposition VARCHAR(32) NOT NULL,
+	user_agent TEXT NOT NULL,
+	body MEDIUMTEXT NOT NULL,
+	count BIGINT UNSIGNED NOT NULL,
+	first_seen BIGINT NOT NULL,
+	last_seen BIGINT NOT NULL,
+	PRIMARY KEY (id),
+	UNIQUE INDEX reports_fingerprint_bucket (fingerprint, bucket),
+	INDEX reports_last_seen (last_seen)
+) CHARSET utf8mb4 COLLATE utf8mb4_0900_ai_ci`,
+}
+
+const mysqlUpsert = `INSERT INTO reports (fingerprint, bucket, type, origin, url, directive, blocked_url, disposition, user_agent, body, count, first_seen, last_seen)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?)
+ON DUPLICATE KEY UPDATE count = count + 1, last_seen = VALUES(last_seen)`
+
+func NewMySQLSink(dsn string, dedupeWindow time.Duration) (Sink, error) {
+	database, err := otelsql.Open("mysql", dsn,
+		otelsql.WithAttributes(semconv.DBSystemNameMySQL),
+		otelsql.WithSQLCommenter(true),
+	)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open database: %w", err)
+	}
+
+	database.SetMaxIdleConns(maxIdleConns)
+	database.SetConnMaxLifetime(connMaxLifetime)
+	database.SetConnMaxIdleTime(connMaxIdleTime)
+
+	if err := otelsql.RegisterDBStatsMetrics(
+		database,
+		otelsql.WithAttributes(semconv.DBSystemNameMySQL),
+	); err != nil {
+		return nil, xerrors.Errorf("failed to register DB stats metrics: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := database.PingContext(ctx); err != nil {
+		return nil, xerrors.Errorf("failed to ping database: %w", err)
+	}
+
+	s := &sqlSink{db: database, dedupeWindow: dedupeWindow, upsert: mysqlUpsert}
+	if err := s.migrate(ctx, mysqlSchema); err != nil {
+		_ = database.Close()
+		return nil, err
+	}
+	return s, nil
+}
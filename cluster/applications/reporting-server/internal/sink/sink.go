@@ -0,0 +1,71 @@
+package sink
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Report is a report received from a browser, flattened to the attributes that are filtered and aggregated by.
+type Report struct {
+	Type   string `json:"type"`
+	Origin string `json:"origin"`
+	URL    string `json:"url"`
+	// Directive is the effective directive of a CSP violation, or the feature of a permissions or document policy violation.
+	Directive   string          `json:"directive"`
+	BlockedURL  string          `json:"blocked_url"`
+	Disposition string          `json:"disposition"`
+	UserAgent   string          `json:"user_agent"`
+	Body        json.RawMessage `json:"body"`
+}
+
+// Fingerprint identifies identical reports. The user agent is left out so that a report from many browsers is counted once.
+func (r *Report) Fingerprint() string {
+	h := sha256.New()
+	for _, s := range []string{r.Type, r.URL, string(r.Body)} {
+		_, _ = h.Write([]byte(s))
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// StoredReport is a Report with the number of identical reports deduplicated into it.
+type StoredReport struct {
+	ID int64 `json:"id"`
+	Report
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type Query struct {
+	Type      string
+	Origin    string
+	Directive string
+	Since     *time.Time
+	Until     *time.Time
+	Limit     int
+	Offset    int
+}
+
+type Aggregation struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// GroupableFields are the fields Top can aggregate by.
+var GroupableFields = []string{"type", "origin", "url", "directive", "blocked_url", "disposition"}
+
+type Sink interface {
+	// Write stores report, or counts it into an identical report of the same dedupe window.
+	Write(ctx context.Context, report *Report, now time.Time) error
+	// Prune deletes the reports last seen before before, and returns how many were deleted.
+	Prune(ctx context.Context, before time.Time) (int64, error)
+	// Query returns the reports matching query, the most recently seen first.
+	Query(ctx context.Context, query *Query) ([]*StoredReport, error)
+	// Top returns the values of field with the most reports matching query.
+	Top(ctx context.Context, query *Query, field string) ([]*Aggregation, error)
+	Close() error
+}
@@ -0,0 +1,158 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// sqlSink stores reports in a table that is the same for SQLite and MySQL, so that the queries can be shared.
+type sqlSink struct {
+	db           *sql.DB
+	dedupeWindow time.Duration
+	// upsert inserts a report, or counts it into the row of the same fingerprint and bucket, in the dialect of db.
+	upsert string
+}
+
+func (s *sqlSink) migrate(ctx context.Context, statements []string) error {
+	for _, statement := range statements {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			return xerrors.Errorf("failed to migrate: %w", err)
+		}
+	}
+	return nil
+}
+
+// bucket is the dedupe window a report falls in. Reports are deduplicated by a unique key of fingerprint and bucket,
+// so that concurrent writers count into one row instead of racing to insert it. Without a window, it is NULL,
+// which never conflicts.
+func (s *sqlSink) bucket(now time.Time) any {
+	if s.dedupeWindow < time.Millisecond {
+		return nil
+	}
+	return now.UnixMilli() / s.dedupeWindow.Milliseconds()
+}
+
+func (s *sqlSink) Write(ctx context.Context, report *Report, now time.Time) error {
+	if _, err := s.db.ExecContext(ctx, s.upsert,
+		report.Fingerprint(), s.bucket(now), report.Type, report.Origin, report.URL, report.Directive, report.BlockedURL, report.Disposition, report.UserAgent, string(report.Body), now.UnixMilli(), now.UnixMilli(),
+	); err != nil {
+		return xerrors.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlSink) Prune(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM reports WHERE last_seen < ?", before.UnixMilli())
+	if err != nil {
+		return 0, xerrors.Errorf("failed to prune reports: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, xerrors.Errorf("failed to get affected rows: %w", err)
+	}
+	return deleted, nil
+}
+
+func where(query *Query) (string, []any) {
+	var conditions []string
+	var args []any
+	for _, c := range []struct {
+		column string
+		value  string
+	}{
+		{"type", query.Type},
+		{"origin", query.Origin},
+		{"directive", query.Directive},
+	} {
+		if c.value != "" {
+			conditions = append(conditions, c.column+" = ?")
+			args = append(args, c.value)
+		}
+	}
+	if query.Since != nil {
+		conditions = append(conditions, "last_seen >= ?")
+		args = append(args, query.Since.UnixMilli())
+	}
+	if query.Until != nil {
+		conditions = append(conditions, "first_seen < ?")
+		args = append(args, query.Until.UnixMilli())
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (s *sqlSink) Query(ctx context.Context, query *Query) ([]*StoredReport, error) {
+	w, args := where(query)
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, type, origin, url, directive, blocked_url, disposition, user_agent, body, count, first_seen, last_seen FROM reports"+w+" ORDER BY last_seen DESC, id DESC LIMIT ? OFFSET ?",
+		append(args, query.Limit, query.Offset)...,
+	)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to query reports: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	reports := []*StoredReport{}
+	for rows.Next() {
+		var report StoredReport
+		var body string
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&report.ID, &report.Type, &report.Origin, &report.URL, &report.Directive, &report.BlockedURL, &report.Disposition, &report.UserAgent, &body, &report.Count, &firstSeen, &lastSeen); err != nil {
+			return nil, xerrors.Errorf("failed to scan report: %w", err)
+		}
+		report.Body = []byte(body)
+		report.FirstSeen = time.UnixMilli(firstSeen).UTC()
+		report.LastSeen = time.UnixMilli(lastSeen).UTC()
+		reports = append(reports, &report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("failed to iterate reports: %w", err)
+	}
+	return reports, nil
+}
+
+func (s *sqlSink) Top(ctx context.Context, query *Query, field string) ([]*Aggregation, error) {
+	// field is interpolated into SQL, so it must be one of the known columns
+	if !slices.Contains(GroupableFields, field) {
+		return nil, xerrors.Errorf("unknown field: %s", field)
+	}
+
+	w, args := where(query)
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+field+", SUM(count) AS total FROM reports"+w+" GROUP BY "+field+" ORDER BY total DESC LIMIT ? OFFSET ?",
+		append(args, query.Limit, query.Offset)...,
+	)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to aggregate reports: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	aggregations := []*Aggregation{}
+	for rows.Next() {
+		var aggregation Aggregation
+		if err := rows.Scan(&aggregation.Value, &aggregation.Count); err != nil {
+			return nil, xerrors.Errorf("failed to scan aggregation: %w", err)
+		}
+		aggregations = append(aggregations, &aggregation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("failed to iterate aggregations: %w", err)
+	}
+	return aggregations, nil
+}
+
+func (s *sqlSink) Close() error {
+	return s.db.Close()
+}
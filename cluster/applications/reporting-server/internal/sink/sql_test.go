@@ -0,0 +1,225 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func newTestSink(t *testing.T, dedupeWindow time.Duration) Sink {
+	t.Helper()
+
+	s, err := NewSQLiteSink(filepath.Join(t.TempDir(), "reports.db"), dedupeWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+	return s
+}
+
+func newTestReport(url string, directive string) *Report {
+	return &Report{
+		Type:        "csp-violation",
+		Origin:      "https://example.com",
+		URL:         url,
+		Directive:   directive,
+		BlockedURL:  "https://evil.example.com/script.js",
+		Disposition: "enforce",
+		UserAgent:   "Mozilla/5.0",
+		Body:        json.RawMessage(`{"effectiveDirective":"` + directive + `"}`),
+	}
+}
+
+func TestSQLSink_Write(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	report := newTestReport("https://example.com/", "script-src")
+
+	type write struct {
+		report *Report
+		at     time.Duration
+	}
+	tests := []struct {
+		name         string
+		dedupeWindow time.Duration
+		writes       []write
+		want         []int64
+	}{
+		{"same window", time.Minute, []write{{report, 0}, {report, 10 * time.Second}, {report, 59 * time.Second}}, []int64{3}},
+		{"next window", time.Minute, []write{{report, 0}, {report, 30 * time.Second}, {report, 61 * time.Second}}, []int64{1, 2}},
+		{"other report", time.Minute, []write{{report, 0}, {newTestReport("https://example.com/other", "script-src"), time.Second}}, []int64{1, 1}},
+		{"without dedupe", 0, []write{{report, 0}, {report, 0}}, []int64{1, 1}},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		dedupeWindow := tt.dedupeWindow
+		writes := tt.writes
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newTestSink(t, dedupeWindow)
+			for _, w := range writes {
+				if err := s.Write(context.Background(), w.report, base.Add(w.at)); err != nil {
+					t.Fatalf("unexpected error: %+v", err)
+				}
+			}
+
+			reports, err := s.Query(context.Background(), &Query{Limit: 10})
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			var got []int64
+			for _, r := range reports {
+				got = append(got, r.Count)
+			}
+			if diff := cmp.Diff(want, got, cmpopts.SortSlices(func(a, b int64) bool { return a < b })); diff != "" {
+				t.Errorf("counts (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSQLSink_Write_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSink(t, time.Hour)
+	report := newTestReport("https://example.com/", "script-src")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Go(func() {
+			if err := s.Write(context.Background(), report, now); err != nil {
+				t.Errorf("unexpected error: %+v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	reports, err := s.Query(context.Background(), &Query{Limit: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if len(reports) != 1 || reports[0].Count != 50 {
+		t.Errorf("got %d reports, want 1 counting 50", len(reports))
+	}
+}
+
+func TestSQLSink_Query(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSink(t, time.Minute)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, report := range []*Report{
+		newTestReport("https://example.com/a", "script-src"),
+		newTestReport("https://example.com/b", "style-src"),
+		newTestReport("https://example.com/c", "script-src"),
+	} {
+		if err := s.Write(context.Background(), report, base.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	since := base.Add(time.Hour)
+	until := base.Add(2 * time.Hour)
+
+	tests := []struct {
+		name  string
+		query *Query
+		want  []string
+	}{
+		{"all, the most recent first", &Query{Limit: 10}, []string{"https://example.com/c", "https://example.com/b", "https://example.com/a"}},
+		{"directive", &Query{Directive: "script-src", Limit: 10}, []string{"https://example.com/c", "https://example.com/a"}},
+		{"since", &Query{Since: &since, Limit: 10}, []string{"https://example.com/c", "https://example.com/b"}},
+		{"until", &Query{Until: &until, Limit: 10}, []string{"https://example.com/b", "https://example.com/a"}},
+		{"limit and offset", &Query{Limit: 1, Offset: 1}, []string{"https://example.com/b"}},
+		{"other origin", &Query{Origin: "https://other.example.com", Limit: 10}, nil},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		query := tt.query
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			reports, err := s.Query(context.Background(), query)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			var got []string
+			for _, r := range reports {
+				got = append(got, r.URL)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSQLSink_Top(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSink(t, time.Minute)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, report := range []*Report{
+		newTestReport("https://example.com/a", "script-src"),
+		newTestReport("https://example.com/a", "script-src"),
+		newTestReport("https://example.com/b", "script-src"),
+		newTestReport("https://example.com/c", "style-src"),
+	} {
+		if err := s.Write(context.Background(), report, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.Top(context.Background(), &Query{Limit: 10}, "directive")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if diff := cmp.Diff([]*Aggregation{{Value: "script-src", Count: 3}, {Value: "style-src", Count: 1}}, got); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+
+	if _, err := s.Top(context.Background(), &Query{Limit: 10}, "body; DROP TABLE reports"); err == nil {
+		t.Error("aggregated by an unknown field")
+	}
+}
+
+func TestSQLSink_Prune(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSink(t, time.Minute)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := s.Write(context.Background(), newTestReport("https://example.com/old", "script-src"), base); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(context.Background(), newTestReport("https://example.com/new", "script-src"), base.Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := s.Prune(context.Background(), base.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("got %d deleted, want 1", deleted)
+	}
+
+	reports, err := s.Query(context.Background(), &Query{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].URL != "https://example.com/new" {
+		t.Errorf("got %d reports left, want only the new one", len(reports))
+	}
+}
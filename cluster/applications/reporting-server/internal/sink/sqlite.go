@@ -0,0 +1,58 @@
+package sink
+
+import (
+	"context"
+	"time"
+
+	"github.com/XSAM/otelsql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"golang.org/x/xerrors"
+	_ "modernc.org/sqlite"
+)
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS reports (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	fingerprint TEXT NOT NULL,
+	bucket INTEGER,
+	type TEXT NOT NULL,
+	origin TEXT NOT NULL,
+	url TEXT NOT NULL,
+	directive TEXT NOT NULL,
+	blocked_url TEXT NOT NULL,
+	disposition TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	body TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	first_seen INTEGER NOT NULL,
+	last_seen INTEGER NOT NULL
+)`,
+	"CREATE UNIQUE INDEX IF NOT EXISTS reports_fingerprint_bucket ON reports (fingerprint, bucket)",
+	"CREATE INDEX IF NOT EXISTS reports_last_seen ON reports (last_seen)",
+}
+
+const sqliteUpsert = `INSERT INTO reports (fingerprint, bucket, type, origin, url, directive, blocked_url, disposition, user_agent, body, count, first_seen, last_seen)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?)
+ON CONFLICT (fingerprint, bucket) DO UPDATE SET count = count + 1, last_seen = excluded.last_seen`
+
+func NewSQLiteSink(path string, dedupeWindow time.Duration) (Sink, error) {
+	// SQLite allows a single writer, so wait for a lock rather than failing with SQLITE_BUSY
+	database, err := otelsql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+		otelsql.WithAttributes(semconv.DBSystemNameSQLite),
+		otelsql.WithSQLCommenter(true),
+	)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open database: %w", err)
+	}
+	database.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := &sqlSink{db: database, dedupeWindow: dedupeWindow, upsert: sqliteUpsert}
+	if err := s.migrate(ctx, sqliteSchema); err != nil {
+		_ = database.Close()
+		return nil, err
+	}
+	return s, nil
+}
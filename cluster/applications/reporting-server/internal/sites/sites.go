@@ -0,0 +1,141 @@
+package sites
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EndpointGroup is the name of the endpoint in Reporting-Endpoints and the group in Report-To.
+	EndpointGroup = "default"
+	// ReportToMaxAge is how long browsers remember Report-To, in seconds.
+	ReportToMaxAge = 86400
+
+	defaultPolicy = "default-src 'self'"
+)
+
+// Site ties reports sent to its own reporting URLs to one application.
+type Site struct {
+	Application string `yaml:"application"`
+	// Origins are the only origins whose reports are accepted.
+	Origins []string `yaml:"origins"`
+	// Policy is the Content-Security-Policy-Report-Only to hand out, without report-uri and report-to.
+	Policy string `yaml:"policy"`
+}
+
+type Config struct {
+	Sites map[string]*Site `yaml:"sites"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	for id, site := range config.Sites {
+		if id == "" || url.PathEscape(id) != id {
+			return nil, fmt.Errorf("site ID must be a path segment: %q", id)
+		}
+		if site.Application == "" {
+			return nil, fmt.Errorf("sites[%s]: application must not be empty", id)
+		}
+		if len(site.Origins) == 0 {
+			return nil, fmt.Errorf("sites[%s]: origins must not be empty", id)
+		}
+		for i, origin := range site.Origins {
+			normalized := OriginOf(origin)
+			if normalized == "" {
+				return nil, fmt.Errorf("sites[%s]: invalid origin: %s", id, origin)
+			}
+			site.Origins[i] = normalized
+		}
+		if site.Policy == "" {
+			site.Policy = defaultPolicy
+		}
+	}
+
+	return &config, nil
+}
+
+func (s *Site) Allows(origin string) bool {
+	return slices.Contains(s.Origins, origin)
+}
+
+// ByOrigin returns the ID and the site allowing origin, for the reporting URLs without a site ID.
+func (c *Config) ByOrigin(origin string) (string, *Site, bool) {
+	ids := make([]string, 0, len(c.Sites))
+	for id := range c.Sites {
+		ids = append(ids, id)
+	}
+	// Stable when several sites share an origin
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		if c.Sites[id].Allows(origin) {
+			return id, c.Sites[id], true
+		}
+	}
+	return "", nil, false
+}
+
+type Headers struct {
+	ReportingEndpoints              string `json:"Reporting-Endpoints"`
+	ReportTo                        string `json:"Report-To"`
+	ContentSecurityPolicyReportOnly string `json:"Content-Security-Policy-Report-Only"`
+}
+
+// Headers returns the response headers that make browsers send the reports of the site to baseURL.
+func (s *Site) Headers(id string, baseURL string) (*Headers, error) {
+	reportsURL, err := url.JoinPath(baseURL, "reports", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build reports URL: %w", err)
+	}
+	cspReportsURL, err := url.JoinPath(baseURL, "csp-reports", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build CSP reports URL: %w", err)
+	}
+
+	// https://w3c.github.io/reporting/#header
+	reportingEndpoints := fmt.Sprintf("%s=%q", EndpointGroup, reportsURL)
+
+	// https://www.w3.org/TR/reporting/#header, still the only one some browsers understand
+	reportTo, err := json.Marshal(map[string]any{
+		"group":     EndpointGroup,
+		"max_age":   ReportToMaxAge,
+		"endpoints": []map[string]string{{"url": reportsURL}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Report-To: %w", err)
+	}
+
+	// report-uri is for browsers not supporting report-to, and ignored by the others
+	policy := strings.TrimRight(strings.TrimSpace(s.Policy), ";")
+	csp := fmt.Sprintf("%s; report-uri %s; report-to %s", policy, cspReportsURL, EndpointGroup)
+
+	return &Headers{
+		ReportingEndpoints:              reportingEndpoints,
+		ReportTo:                        string(reportTo),
+		ContentSecurityPolicyReportOnly: csp,
+	}, nil
+}
+
+// OriginOf returns the serialized origin of rawURL, or an empty string if it has none.
+func OriginOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
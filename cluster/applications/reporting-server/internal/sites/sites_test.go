@@ -0,0 +1,130 @@
+package sites
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    *Config
+		wantErr bool
+	}{
+		{
+			"normalized",
+			"sites:\n  httpbin:\n    application: httpbin\n    origins: [HTTPS://HTTPBIN.example.com/path]\n",
+			&Config{Sites: map[string]*Site{"httpbin": {Application: "httpbin", Origins: []string{"https://httpbin.example.com"}, Policy: defaultPolicy}}},
+			false,
+		},
+		{
+			"own policy",
+			"sites:\n  httpbin:\n    application: httpbin\n    origins: [https://httpbin.example.com]\n    policy: \"script-src 'self'\"\n",
+			&Config{Sites: map[string]*Site{"httpbin": {Application: "httpbin", Origins: []string{"https://httpbin.example.com"}, Policy: "script-src 'self'"}}},
+			false,
+		},
+		{"ID with a slash", "sites:\n  a/b:\n    application: a\n    origins: [https://a.example.com]\n", nil, true},
+		{"without application", "sites:\n  a:\n    origins: [https://a.example.com]\n", nil, true},
+		{"without origins", "sites:\n  a:\n    application: a\n", nil, true},
+		{"invalid origin", "sites:\n  a:\n    application: a\n    origins: [a.example.com]\n", nil, true},
+		{"invalid YAML", "sites: [", nil, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		config := tt.config
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "sites.yaml")
+			if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadConfig(path)
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConfig_ByOrigin(t *testing.T) {
+	config := &Config{Sites: map[string]*Site{
+		"b":     {Application: "b", Origins: []string{"https://shared.example.com"}},
+		"a":     {Application: "a", Origins: []string{"https://shared.example.com"}},
+		"other": {Application: "other", Origins: []string{"https://other.example.com"}},
+	}}
+
+	tests := []struct {
+		name   string
+		origin string
+		wantID string
+		wantOK bool
+	}{
+		{"shared origin takes the first ID", "https://shared.example.com", "a", true},
+		{"own origin", "https://other.example.com", "other", true},
+		{"unknown origin", "https://unknown.example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		origin := tt.origin
+		wantID := tt.wantID
+		wantOK := tt.wantOK
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			id, site, ok := config.ByOrigin(origin)
+			if id != wantID || ok != wantOK {
+				t.Errorf("got %q, %v, want %q, %v", id, ok, wantID, wantOK)
+			}
+			if ok && site != config.Sites[wantID] {
+				t.Errorf("got another site than %s", wantID)
+			}
+		})
+	}
+}
+
+func TestSite_Headers(t *testing.T) {
+	site := &Site{Application: "httpbin", Origins: []string{"https://httpbin.example.com"}, Policy: "default-src 'self'; "}
+
+	got, err := site.Headers("httpbin", "https://reporting.example.com/")
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	want := &Headers{
+		ReportingEndpoints:              `default="https://reporting.example.com/reports/httpbin"`,
+		ReportTo:                        `{"endpoints":[{"url":"https://reporting.example.com/reports/httpbin"}],"group":"default","max_age":86400}`,
+		ContentSecurityPolicyReportOnly: "default-src 'self'; report-uri https://reporting.example.com/csp-reports/httpbin; report-to default",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
+
+func TestOriginOf(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"https://Example.com:8443/path?q", "https://example.com:8443"},
+		{"http://example.com", "http://example.com"},
+		{"example.com", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := OriginOf(tt.in); got != tt.want {
+			t.Errorf("OriginOf(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
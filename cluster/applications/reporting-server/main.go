@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
 	"reflect"
@@ -22,6 +23,11 @@ import (
 	"syscall"
 	"time"
 
+	"reporting-server/internal/ratelimit"
+	"reporting-server/internal/sink"
+	"reporting-server/internal/sites"
+
+	"github.com/go-sql-driver/mysql"
 	otelpyroscope "github.com/grafana/otel-profiling-go"
 	"github.com/grafana/pyroscope-go"
 	pyroscopepprof "github.com/grafana/pyroscope-go/http/pprof"
@@ -40,6 +46,7 @@ import (
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/netutil"
+	"golang.org/x/time/rate"
 )
 
 // SecurityPolicyViolationEvent https://w3c.github.io/webappsec-csp/#securitypolicyviolationevent
@@ -253,22 +260,364 @@ func envOrDefaultValue[T any](key string, defaultValue T) T {
 	return defaultValue
 }
 
+// reportHandlers receive the reports browsers send, for the sites of sites, or from any origin if it is nil.
+type reportHandlers struct {
+	sites       *sites.Config
+	limiter     *ratelimit.KeyedLimiter
+	maxBodySize int64
+	store       func(ctx context.Context, report *sink.Report)
+
+	cspViolationsTotal               metric.Int64Counter
+	networkErrorsTotal               metric.Int64Counter
+	deprecationsTotal                metric.Int64Counter
+	crashesTotal                     metric.Int64Counter
+	interventionsTotal               metric.Int64Counter
+	permissionsPolicyViolationsTotal metric.Int64Counter
+	documentPolicyViolationsTotal    metric.Int64Counter
+}
+
+// authorize returns the application that reports from origin to site belong to and the key to rate limit them by,
+// or the status code to refuse them with. The URLs without a site ID take the site by origin.
+// Reports are rate limited per site, or per origin without sites, where the limiter bounds the number of origins.
+func (h *reportHandlers) authorize(siteID string, origin string) (string, string, int) {
+	if h.sites == nil {
+		if siteID != "" {
+			return "", "", http.StatusNotFound
+		}
+		return "", origin, 0
+	}
+
+	if siteID == "" {
+		id, site, ok := h.sites.ByOrigin(origin)
+		if !ok {
+			return "", "", http.StatusForbidden
+		}
+		return site.Application, id, 0
+	}
+
+	site, ok := h.sites.Sites[siteID]
+	if !ok {
+		return "", "", http.StatusNotFound
+	}
+	if !site.Allows(origin) {
+		return "", "", http.StatusForbidden
+	}
+	return site.Application, siteID, 0
+}
+
+func (h *reportHandlers) CSPReports(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	// https://github.com/w3c/reporting/issues/41
+	case http.MethodOptions:
+		origin := r.Header.Get("Origin")
+		if _, _, status := h.authorize(r.PathValue("site"), origin); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNoContent)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusNoContent)))
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
+
+		switch r.Header.Get("Content-Type") {
+		case "application/csp-report":
+			var event SecurityPolicyViolationEvent
+
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				writeDecodeError(w, err)
+				return
+			}
+
+			origin := requestOrigin(r, event.CSPReport.DocumentURI)
+			application, key, status := h.authorize(r.PathValue("site"), origin)
+			if status != 0 {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			if h.limiter.TakeN(key, 1, time.Now()) == 0 {
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
+
+			h.cspViolationsTotal.Add(r.Context(), 1, metric.WithAttributes(
+				attribute.Key("application").String(application),
+				attribute.Key("effective-directive").String(event.CSPReport.EffectiveDirective),
+				attribute.Key("disposition").String(event.CSPReport.Disposition),
+			))
+
+			slog.Info("csp-violation", keyvalues(event.CSPReport)...)
+
+			body, err := json.Marshal(event.CSPReport)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			h.store(r.Context(), &sink.Report{
+				Type:        "csp-violation",
+				Origin:      sites.OriginOf(event.CSPReport.DocumentURI),
+				URL:         event.CSPReport.DocumentURI,
+				Directive:   event.CSPReport.EffectiveDirective,
+				BlockedURL:  deref(event.CSPReport.BlockedURI),
+				Disposition: event.CSPReport.Disposition,
+				UserAgent:   r.Header.Get("User-Agent"),
+				Body:        body,
+			})
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
+		default:
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *reportHandlers) Reports(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	// https://github.com/w3c/reporting/issues/41
+	case http.MethodOptions:
+		origin := r.Header.Get("Origin")
+		if _, _, status := h.authorize(r.PathValue("site"), origin); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNoContent)
+		_, _ = w.Write([]byte(http.StatusText(http.StatusNoContent)))
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
+
+		switch r.Header.Get("Content-Type") {
+		case "application/reports+json":
+			var reports ReportBodies
+
+			if err := json.NewDecoder(r.Body).Decode(&reports); err != nil {
+				writeDecodeError(w, err)
+				return
+			}
+			if len(reports) == 0 {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
+				return
+			}
+
+			// A browser batches reports per origin, so the whole batch is of the origin of the first one
+			origin := requestOrigin(r, reports[0].URL)
+			application, key, status := h.authorize(r.PathValue("site"), origin)
+			if status != 0 {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			// Decode the whole batch before storing any of it or spending tokens on it, so that a browser retrying a
+			// refused batch does not count its reports twice
+			bodies := make([]any, len(reports))
+			for i, report := range reports {
+				if sites.OriginOf(report.URL) != origin {
+					continue
+				}
+
+				var body any
+				switch report.Type {
+				case "csp-violation":
+					body = &CSPReport{}
+				case "network-error":
+					body = &NetworkError{}
+				case "deprecation":
+					body = &DeprecationReport{}
+				case "crash":
+					body = &CrashReport{}
+				case "intervention":
+					body = &InterventionReport{}
+				case "permissions-policy-violation":
+					body = &PermissionsPolicyViolationReport{}
+				case "document-policy-violation":
+					body = &DocumentPolicyViolationReport{}
+				default:
+					continue
+				}
+				if err := json.Unmarshal(report.Body, body); err != nil {
+					http.Error(w, fmt.Sprintf("invalid %s report", report.Type), http.StatusBadRequest)
+					return
+				}
+				bodies[i] = body
+			}
+
+			admitted := h.limiter.TakeN(key, len(reports), time.Now())
+			if admitted == 0 {
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			// The rest of a batch over the limit is dropped rather than refused, since browsers would send it all again
+			if admitted < len(reports) {
+				slog.Warn("dropped reports over the rate limit", "key", key, "admitted", admitted, "dropped", len(reports)-admitted)
+				reports = reports[:admitted]
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
+
+			for i, report := range reports {
+				if sites.OriginOf(report.URL) != origin {
+					slog.Warn("report of another origin", "origin", origin, "url", report.URL)
+					continue
+				}
+
+				stored := &sink.Report{
+					Type:      report.Type,
+					Origin:    origin,
+					URL:       report.URL,
+					UserAgent: report.UserAgent,
+					Body:      report.Body,
+				}
+
+				switch body := bodies[i].(type) {
+				case *CSPReport:
+					h.cspViolationsTotal.Add(r.Context(), 1, metric.WithAttributes(
+						attribute.Key("application").String(application),
+						attribute.Key("effective-directive").String(body.EffectiveDirective),
+						attribute.Key("disposition").String(body.Disposition),
+					))
+
+					slog.Info(report.Type, keyvalues(*body)...)
+
+					stored.Directive = body.EffectiveDirective
+					stored.BlockedURL = deref(body.BlockedURL)
+					stored.Disposition = body.Disposition
+				case *NetworkError:
+					h.networkErrorsTotal.Add(r.Context(), 1, metric.WithAttributes(
+						attribute.Key("application").String(application),
+						attribute.Key("phase").String(body.Phase),
+						attribute.Key("type").String(body.Type),
+					))
+
+					slog.Info(report.Type, keyvalues(*body)...)
+				case *DeprecationReport:
+					h.deprecationsTotal.Add(r.Context(), 1, metric.WithAttributes(
+						attribute.Key("application").String(application),
+						attribute.Key("id").String(body.ID),
+					))
+
+					slog.Info(report.Type, keyvalues(*body)...)
+				case *CrashReport:
+					h.crashesTotal.Add(r.Context(), 1, metric.WithAttributes(
+						attribute.Key("application").String(application),
+						attribute.Key("reason").String(body.Reason),
+					))
+
+					slog.Info(report.Type, keyvalues(*body)...)
+				case *InterventionReport:
+					h.interventionsTotal.Add(r.Context(), 1, metric.WithAttributes(
+						attribute.Key("application").String(application),
+						attribute.Key("id").String(body.ID),
+					))
+
+					slog.Info(report.Type, keyvalues(*body)...)
+				case *PermissionsPolicyViolationReport:
+					h.permissionsPolicyViolationsTotal.Add(r.Context(), 1, metric.WithAttributes(
+						attribute.Key("application").String(application),
+						attribute.Key("featureId").String(body.FeatureID),
+						attribute.Key("disposition").String(body.Disposition),
+					))
+
+					slog.Info(report.Type, keyvalues(*body)...)
+
+					stored.Directive = body.FeatureID
+					stored.Disposition = body.Disposition
+				case *DocumentPolicyViolationReport:
+					h.documentPolicyViolationsTotal.Add(r.Context(), 1, metric.WithAttributes(
+						attribute.Key("application").String(application),
+						attribute.Key("featureId").String(body.FeatureID),
+						attribute.Key("disposition").String(body.Disposition),
+					))
+
+					slog.Info(report.Type, keyvalues(*body)...)
+
+					stored.Directive = body.FeatureID
+					stored.Disposition = body.Disposition
+				default:
+					slog.Error("unknown report type", "type", report.Type)
+					continue
+				}
+
+				h.store(r.Context(), stored)
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
+		default:
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
 func main() {
 	if Debug {
 		_ = godotenv.Load()
 	}
 
 	var address string
+	var apiAddress string
 	var terminationGracePeriod time.Duration
 	var lameduck time.Duration
 	var keepAlive bool
 	var maxConnections int
+	var sinkType string
+	var sqlitePath string
+	var mysqlAddress string
+	var mysqlDatabase string
+	var mysqlUser string
+	var mysqlPassword string
+	var dedupeWindow time.Duration
+	var retention time.Duration
+	var sitesFile string
+	var publicURL string
+	var maxBodySize int64
+	var reportRate float64
+	var reportBurst int
+	var maxRateLimitKeys int
 	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
+	flag.StringVar(&apiAddress, "api-address", envOrDefaultValue("API_ADDRESS", "0.0.0.0:8081"), "HTTP server address of /api/, kept off the address browsers send reports to so that it can be authenticated apart")
 
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
 	flag.IntVar(&maxConnections, "max-connections", envOrDefaultValue("MAX_CONNECTIONS", 65532), "Maximum number of connections")
+	flag.StringVar(&sinkType, "sink", envOrDefaultValue("SINK_TYPE", ""), "Sink type to store reports: sqlite, mysql, or empty not to store them")
+	flag.StringVar(&sqlitePath, "sqlite-path", envOrDefaultValue("SQLITE_PATH", "reporting-server.db"), "SQLite database path")
+	flag.StringVar(&mysqlAddress, "mysql-address", envOrDefaultValue("MYSQL_ADDRESS", ""), "MySQL address")
+	flag.StringVar(&mysqlDatabase, "mysql-database", envOrDefaultValue("MYSQL_DATABASE", "reporting_server"), "MySQL database name")
+	flag.StringVar(&mysqlUser, "mysql-user", envOrDefaultValue("MYSQL_USER", ""), "MySQL user")
+	flag.StringVar(&mysqlPassword, "mysql-password", envOrDefaultValue("MYSQL_PASSWORD", ""), "MySQL password")
+	flag.DurationVar(&dedupeWindow, "dedupe-window", envOrDefaultValue("DEDUPE_WINDOW", 1*time.Minute), "Window in which identical reports are stored as one with a count")
+	flag.DurationVar(&retention, "retention", envOrDefaultValue("RETENTION", 30*24*time.Hour), "How long a report is kept after it was last seen; 0 keeps reports forever")
+	flag.StringVar(&sitesFile, "sites-file", envOrDefaultValue("SITES_FILE", ""), "Path to the config of sites allowed to send reports; any origin is allowed if empty")
+	flag.StringVar(&publicURL, "public-url", envOrDefaultValue("PUBLIC_URL", ""), "URL browsers send reports to, used in the headers handed out by /api/sites/{site}/headers; https://<Host> if empty")
+	flag.Int64Var(&maxBodySize, "max-body-size", envOrDefaultValue("MAX_BODY_SIZE", int64(64*1024)), "Maximum size of a request body in bytes")
+	flag.Float64Var(&reportRate, "report-rate", envOrDefaultValue("REPORT_RATE", 10.0), "Reports per second accepted for a site, or from an origin without --sites-file")
+	flag.IntVar(&reportBurst, "report-burst", envOrDefaultValue("REPORT_BURST", 100), "Reports accepted for a site, or from an origin without --sites-file, at once. The rest of a larger batch is dropped")
+	flag.IntVar(&maxRateLimitKeys, "max-rate-limit-keys", envOrDefaultValue("MAX_RATE_LIMIT_KEYS", 10000), "Maximum number of origins rate limited apart without --sites-file; the others share one limit")
 	flag.Parse()
 
 	ctx := context.Background()
@@ -374,180 +723,177 @@ func main() {
 		logger = slog.New(slog.NewTextHandler(os.Stderr, handlerOpts))
 	}
 
-	mux := myRouter{http.NewServeMux(), logger, httpRequestsDurationMicroSeconds, []Middleware{}}
-	mux.HandleFuncWithMiddleware("/csp-reports", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		// https://github.com/w3c/reporting/issues/41
-		case http.MethodOptions:
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			w.Header().Set("Access-Control-Allow-Methods", "POST")
-			w.Header().Set("Access-Control-Max-Age", "86400")
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusNoContent)
-			_, _ = w.Write([]byte(http.StatusText(http.StatusNoContent)))
-		case http.MethodPost:
-			switch r.Header.Get("Content-Type") {
-			case "application/csp-report":
-				var event SecurityPolicyViolationEvent
-
-				if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
-					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-					return
+	var reportSink sink.Sink
+	switch sinkType {
+	case "":
+	case "sqlite":
+		var err error
+		reportSink, err = sink.NewSQLiteSink(sqlitePath, dedupeWindow)
+		if err != nil {
+			log.Fatalf("failed to create SQLite sink: %+v", err)
+		}
+	case "mysql":
+		if mysqlAddress == "" {
+			log.Fatalf("--mysql-address must be set when --sink=mysql")
+		}
+		if mysqlUser == "" || mysqlPassword == "" {
+			log.Fatalf("--mysql-user and --mysql-password must be set when --sink=mysql")
+		}
+
+		config := mysql.NewConfig()
+		config.Net = "tcp"
+		config.Addr = mysqlAddress
+		config.DBName = mysqlDatabase
+		config.User = mysqlUser
+		config.Passwd = mysqlPassword
+		config.ParseTime = true
+		config.Loc = time.UTC
+		config.AllowNativePasswords = true
+
+		var err error
+		reportSink, err = sink.NewMySQLSink(config.FormatDSN(), dedupeWindow)
+		if err != nil {
+			log.Fatalf("failed to create MySQL sink: %+v", err)
+		}
+	default:
+		log.Fatalf("unknown sink type: %s (only 'sqlite' and 'mysql' are supported)", sinkType)
+	}
+
+	if reportSink != nil && retention > 0 {
+		go func() {
+			ticker := time.NewTicker(min(retention, time.Hour))
+			defer ticker.Stop()
+			for now := range ticker.C {
+				deleted, err := reportSink.Prune(context.Background(), now.Add(-retention))
+				if err != nil {
+					slog.Error("failed to prune reports", "error", err)
+					continue
 				}
+				if deleted > 0 {
+					slog.Info("pruned reports", "deleted", deleted)
+				}
+			}
+		}()
+	}
 
-				cspViolationsTotal.Add(r.Context(), 1, metric.WithAttributes(
-					attribute.Key("origin").String(r.Header.Get("Origin")),
-					attribute.Key("effective-directive").String(event.CSPReport.EffectiveDirective),
-					attribute.Key("disposition").String(event.CSPReport.Disposition),
-				))
+	store := func(ctx context.Context, report *sink.Report) {
+		if reportSink == nil {
+			return
+		}
+		// A report that fails to be stored is still counted and logged, so the browser is not asked to retry
+		if err := reportSink.Write(ctx, report, time.Now()); err != nil {
+			slog.Error("failed to store report", "type", report.Type, "error", err)
+		}
+	}
 
-				slog.Info("csp-violation", keyvalues(event.CSPReport)...)
+	var sitesConfig *sites.Config
+	if sitesFile != "" {
+		var err error
+		sitesConfig, err = sites.LoadConfig(sitesFile)
+		if err != nil {
+			log.Fatalf("failed to load sites: %+v", err)
+		}
+	}
 
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
-				_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
-			default:
-				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
-			}
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	limiter := &ratelimit.KeyedLimiter{
+		Rate:        rate.Limit(reportRate),
+		Burst:       reportBurst,
+		IdleTimeout: 10 * time.Minute,
+		MaxKeys:     maxRateLimitKeys,
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			limiter.Sweep(now)
 		}
-	})
+	}()
 
-	mux.HandleFuncWithMiddleware("/reports", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		// https://github.com/w3c/reporting/issues/41
-		case http.MethodOptions:
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			w.Header().Set("Access-Control-Allow-Methods", "POST")
-			w.Header().Set("Access-Control-Max-Age", "86400")
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusNoContent)
-			_, _ = w.Write([]byte(http.StatusText(http.StatusNoContent)))
-		case http.MethodPost:
-			switch r.Header.Get("Content-Type") {
-			case "application/reports+json":
-				var reports ReportBodies
-
-				if err := json.NewDecoder(r.Body).Decode(&reports); err != nil {
-					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	handlers := &reportHandlers{
+		sites:                            sitesConfig,
+		limiter:                          limiter,
+		maxBodySize:                      maxBodySize,
+		store:                            store,
+		cspViolationsTotal:               cspViolationsTotal,
+		networkErrorsTotal:               networkErrorsTotal,
+		deprecationsTotal:                deprecationsTotal,
+		crashesTotal:                     crashesTotal,
+		interventionsTotal:               interventionsTotal,
+		permissionsPolicyViolationsTotal: permissionsPolicyViolationsTotal,
+		documentPolicyViolationsTotal:    documentPolicyViolationsTotal,
+	}
+
+	mux := myRouter{http.NewServeMux(), logger, httpRequestsDurationMicroSeconds, []Middleware{}}
+	mux.HandleFuncWithMiddleware("/csp-reports", handlers.CSPReports)
+	mux.HandleFuncWithMiddleware("/csp-reports/{site}", handlers.CSPReports)
+
+	mux.HandleFuncWithMiddleware("/reports", handlers.Reports)
+	mux.HandleFuncWithMiddleware("/reports/{site}", handlers.Reports)
+
+	apiMux := myRouter{http.NewServeMux(), logger, httpRequestsDurationMicroSeconds, []Middleware{}}
+	if sitesConfig != nil {
+		apiMux.HandleFuncWithMiddleware("GET /api/sites/{site}/headers", func(w http.ResponseWriter, r *http.Request) {
+			site, ok := sitesConfig.Sites[r.PathValue("site")]
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+
+			baseURL := publicURL
+			if baseURL == "" {
+				baseURL = "https://" + r.Host
+			}
+
+			headers, err := site.Headers(r.PathValue("site"), baseURL)
+			if err != nil {
+				slog.Error("failed to build headers", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(headers)
+		})
+	}
+
+	if reportSink != nil {
+		apiMux.HandleFuncWithMiddleware("GET /api/reports", func(w http.ResponseWriter, r *http.Request) {
+			query, err := parseQuery(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var response any
+			if field := r.URL.Query().Get("top"); field != "" {
+				if !slices.Contains(sink.GroupableFields, field) {
+					http.Error(w, fmt.Sprintf("top must be one of %s", strings.Join(sink.GroupableFields, ", ")), http.StatusBadRequest)
 					return
 				}
 
-				for _, report := range reports {
-					switch report.Type {
-					case "csp-violation":
-						var cspReport CSPReport
-
-						if err := json.Unmarshal(report.Body, &cspReport); err != nil {
-							http.Error(w, "invalid csp-violation report", http.StatusBadRequest)
-							return
-						}
-
-						cspViolationsTotal.Add(r.Context(), 1, metric.WithAttributes(
-							attribute.Key("effective-directive").String(cspReport.EffectiveDirective),
-							attribute.Key("disposition").String(cspReport.Disposition),
-						))
-
-						slog.Info(report.Type, keyvalues(cspReport)...)
-					case "network-error":
-						var networkError NetworkError
-
-						if err := json.Unmarshal(report.Body, &networkError); err != nil {
-							http.Error(w, "invalid network-error report", http.StatusBadRequest)
-							return
-						}
-
-						networkErrorsTotal.Add(r.Context(), 1, metric.WithAttributes(
-							attribute.Key("phase").String(networkError.Phase),
-							attribute.Key("type").String(networkError.Type),
-						))
-
-						slog.Info(report.Type, keyvalues(networkError)...)
-					case "deprecation":
-						var deprecationReport DeprecationReport
-
-						if err := json.Unmarshal(report.Body, &deprecationReport); err != nil {
-							http.Error(w, "invalid deprecation report", http.StatusBadRequest)
-							return
-						}
-
-						deprecationsTotal.Add(r.Context(), 1, metric.WithAttributes(
-							attribute.Key("id").String(deprecationReport.ID),
-						))
-
-						slog.Info(report.Type, keyvalues(deprecationReport)...)
-					case "crash":
-						var crashReport CrashReport
-
-						if err := json.Unmarshal(report.Body, &crashReport); err != nil {
-							http.Error(w, "invalid crash report", http.StatusBadRequest)
-							return
-						}
-
-						crashesTotal.Add(r.Context(), 1, metric.WithAttributes(
-							attribute.Key("reason").String(crashReport.Reason),
-						))
-
-						slog.Info(report.Type, keyvalues(crashReport)...)
-					case "intervention":
-						var interventionReport InterventionReport
-
-						if err := json.Unmarshal(report.Body, &interventionReport); err != nil {
-							http.Error(w, "invalid intervention report", http.StatusBadRequest)
-							return
-						}
-
-						interventionsTotal.Add(r.Context(), 1, metric.WithAttributes(
-							attribute.Key("id").String(interventionReport.ID),
-						))
-
-						slog.Info(report.Type, keyvalues(interventionReport)...)
-					case "permissions-policy-violation":
-						var permissionsPolicyViolationReport PermissionsPolicyViolationReport
-
-						if err := json.Unmarshal(report.Body, &permissionsPolicyViolationReport); err != nil {
-							http.Error(w, "invalid permissions-policy-violation report", http.StatusBadRequest)
-							return
-						}
-
-						permissionsPolicyViolationsTotal.Add(r.Context(), 1, metric.WithAttributes(
-							attribute.Key("featureId").String(permissionsPolicyViolationReport.FeatureID),
-							attribute.Key("disposition").String(permissionsPolicyViolationReport.Disposition),
-						))
-
-						slog.Info(report.Type, keyvalues(permissionsPolicyViolationReport)...)
-					case "document-policy-violation":
-						var documentPolicyViolationReport DocumentPolicyViolationReport
-
-						if err := json.Unmarshal(report.Body, &documentPolicyViolationReport); err != nil {
-							http.Error(w, "invalid document-policy-violation report", http.StatusBadRequest)
-							return
-						}
-
-						documentPolicyViolationsTotal.Add(r.Context(), 1, metric.WithAttributes(
-							attribute.Key("featureId").String(documentPolicyViolationReport.FeatureID),
-							attribute.Key("disposition").String(documentPolicyViolationReport.Disposition),
-						))
-
-						slog.Info(report.Type, keyvalues(documentPolicyViolationReport)...)
-					default:
-						slog.Error("unknown report type", "type", report.Type)
-					}
+				aggregations, err := reportSink.Top(r.Context(), query, field)
+				if err != nil {
+					slog.Error("failed to aggregate reports", "error", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
 				}
-
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
-				_, _ = w.Write([]byte(http.StatusText(http.StatusOK)))
-			default:
-				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+				response = map[string]any{"top": aggregations}
+			} else {
+				reports, err := reportSink.Query(r.Context(), query)
+				if err != nil {
+					slog.Error("failed to query reports", "error", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				response = map[string]any{"reports": reports}
 			}
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		}
-	})
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(response)
+		})
+	}
 
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -579,12 +925,28 @@ func main() {
 	}
 	server.SetKeepAlivesEnabled(keepAlive)
 
+	apiListener, err := net.Listen("tcp", apiAddress)
+	if err != nil {
+		log.Fatalf("failed to listen: %+v", err)
+	}
+
+	apiServer := &http.Server{
+		Handler: apiMux,
+	}
+	apiServer.SetKeepAlivesEnabled(keepAlive)
+
 	go func() {
 		if err := server.Serve(netutil.LimitListener(listener, maxConnections)); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("failed to listen: %+v", err)
 		}
 	}()
 
+	go func() {
+		if err := apiServer.Serve(netutil.LimitListener(apiListener, maxConnections)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to listen: %+v", err)
+		}
+	}()
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM)
 	<-quit
@@ -597,6 +959,16 @@ func main() {
 		log.Fatalf("failed to shutdown: %+v", err)
 	}
 
+	if err := apiServer.Shutdown(ctx); err != nil {
+		log.Fatalf("failed to shutdown: %+v", err)
+	}
+
+	if reportSink != nil {
+		if err := reportSink.Close(); err != nil {
+			log.Fatalf("failed to close sink: %+v", err)
+		}
+	}
+
 	if err := traceProvider.Shutdown(ctx); err != nil {
 		log.Fatalf("failed to shutdown trace provider: %+v", err)
 	}
@@ -606,6 +978,72 @@ func main() {
 	}
 }
 
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// parseQuery reads the filters of /api/reports, where since and until are RFC 3339.
+func parseQuery(values url.Values) (*sink.Query, error) {
+	query := &sink.Query{
+		Type:      values.Get("type"),
+		Origin:    values.Get("origin"),
+		Directive: values.Get("directive"),
+		Limit:     defaultQueryLimit,
+	}
+
+	for key, t := range map[string]**time.Time{"since": &query.Since, "until": &query.Until} {
+		if v := values.Get(key); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*t = &parsed
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit: %s", v)
+		}
+		query.Limit = min(limit, maxQueryLimit)
+	}
+	if v := values.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset: %s", v)
+		}
+		query.Offset = offset
+	}
+
+	return query, nil
+}
+
+// requestOrigin prefers the Origin header, and falls back to the URL of the report since report-uri is sent without it.
+func requestOrigin(r *http.Request, reportURL string) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return strings.ToLower(origin)
+	}
+	return sites.OriginOf(reportURL)
+}
+
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 func keyvalues(i any) []any {
 	var keyvalues []any
 
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"reporting-server/internal/ratelimit"
+	"reporting-server/internal/sink"
+	"reporting-server/internal/sites"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+func TestParseQuery(t *testing.T) {
+	since := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		values  url.Values
+		want    *sink.Query
+		wantErr bool
+	}{
+		{"default", url.Values{}, &sink.Query{Limit: defaultQueryLimit}, false},
+		{
+			"filters",
+			url.Values{"type": {"csp-violation"}, "origin": {"https://example.com"}, "directive": {"script-src"}, "since": {"2026-01-01T00:00:00Z"}, "until": {"2026-01-02T00:00:00Z"}, "limit": {"10"}, "offset": {"20"}},
+			&sink.Query{Type: "csp-violation", Origin: "https://example.com", Directive: "script-src", Since: &since, Until: &until, Limit: 10, Offset: 20},
+			false,
+		},
+		{"limit is capped", url.Values{"limit": {"100000"}}, &sink.Query{Limit: maxQueryLimit}, false},
+		{"invalid since", url.Values{"since": {"yesterday"}}, nil, true},
+		{"zero limit", url.Values{"limit": {"0"}}, nil, true},
+		{"negative offset", url.Values{"offset": {"-1"}}, nil, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		values := tt.values
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseQuery(values)
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func newTestReportHandlers(burst int, maxBodySize int64) (*http.ServeMux, func() []*sink.Report) {
+	meter := noop.NewMeterProvider().Meter("")
+	counter, _ := meter.Int64Counter("")
+
+	var mu sync.Mutex
+	var stored []*sink.Report
+	h := &reportHandlers{
+		sites: &sites.Config{Sites: map[string]*sites.Site{
+			"httpbin": {Application: "httpbin", Origins: []string{"https://httpbin.example.com"}},
+		}},
+		limiter:     &ratelimit.KeyedLimiter{Rate: 0, Burst: burst, IdleTimeout: time.Minute, MaxKeys: 10},
+		maxBodySize: maxBodySize,
+		store: func(_ context.Context, report *sink.Report) {
+			mu.Lock()
+			defer mu.Unlock()
+			stored = append(stored, report)
+		},
+		cspViolationsTotal:               counter,
+		networkErrorsTotal:               counter,
+		deprecationsTotal:                counter,
+		crashesTotal:                     counter,
+		interventionsTotal:               counter,
+		permissionsPolicyViolationsTotal: counter,
+		documentPolicyViolationsTotal:    counter,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/csp-reports", h.CSPReports)
+	mux.HandleFunc("/csp-reports/{site}", h.CSPReports)
+	mux.HandleFunc("/reports", h.Reports)
+	mux.HandleFunc("/reports/{site}", h.Reports)
+	return mux, func() []*sink.Report {
+		mu.Lock()
+		defer mu.Unlock()
+		return stored
+	}
+}
+
+func deprecationReports(n int, reportURL string) string {
+	reports := make([]string, n)
+	for i := range reports {
+		reports[i] = `{"type":"deprecation","url":"` + reportURL + `","body":{"id":"test"}}`
+	}
+	return "[" + strings.Join(reports, ",") + "]"
+}
+
+func TestReportHandlers(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		origin      string
+		body        string
+		want        []int
+		wantStored  int
+	}{
+		{
+			"csp report",
+			"/csp-reports/httpbin",
+			"application/csp-report",
+			"",
+			`{"csp-report":{"document-uri":"https://httpbin.example.com/","effective-directive":"script-src"}}`,
+			[]int{http.StatusOK},
+			1,
+		},
+		{
+			"origin not allowed",
+			"/reports/httpbin",
+			"application/reports+json",
+			"https://evil.example.com",
+			deprecationReports(1, "https://evil.example.com/"),
+			[]int{http.StatusForbidden},
+			0,
+		},
+		{
+			"unknown origin without site",
+			"/reports",
+			"application/reports+json",
+			"https://evil.example.com",
+			deprecationReports(1, "https://evil.example.com/"),
+			[]int{http.StatusForbidden},
+			0,
+		},
+		{
+			"unknown site",
+			"/reports/unknown",
+			"application/reports+json",
+			"https://httpbin.example.com",
+			deprecationReports(1, "https://httpbin.example.com/"),
+			[]int{http.StatusNotFound},
+			0,
+		},
+		{
+			"body too large",
+			"/reports/httpbin",
+			"application/reports+json",
+			"https://httpbin.example.com",
+			deprecationReports(100, "https://httpbin.example.com/"),
+			[]int{http.StatusRequestEntityTooLarge},
+			0,
+		},
+		{
+			"batch over the burst is admitted in part",
+			"/reports",
+			"application/reports+json",
+			"https://httpbin.example.com",
+			deprecationReports(5, "https://httpbin.example.com/"),
+			[]int{http.StatusOK, http.StatusTooManyRequests},
+			3,
+		},
+		{
+			"csp reports over the burst",
+			"/csp-reports",
+			"application/csp-report",
+			"https://httpbin.example.com",
+			`{"csp-report":{"document-uri":"https://httpbin.example.com/"}}`,
+			[]int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+			3,
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		path := tt.path
+		contentType := tt.contentType
+		origin := tt.origin
+		body := tt.body
+		want := tt.want
+		wantStored := tt.wantStored
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			mux, stored := newTestReportHandlers(3, 1024)
+
+			var got []int
+			for range want {
+				r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+				r.Header.Set("Content-Type", contentType)
+				if origin != "" {
+					r.Header.Set("Origin", origin)
+				}
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				got = append(got, w.Code)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("(-want +got):\n%s", diff)
+			}
+			if got := len(stored()); got != wantStored {
+				t.Errorf("got %d stored reports, want %d", got, wantStored)
+			}
+		})
+	}
+}
+
+func TestReportHandlers_MalformedBatch(t *testing.T) {
+	mux, stored := newTestReportHandlers(3, 1024)
+
+	post := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/reports/httpbin", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/reports+json")
+		r.Header.Set("Origin", "https://httpbin.example.com")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	malformed := `[` +
+		`{"type":"deprecation","url":"https://httpbin.example.com/","body":{"id":"test"}},` +
+		`{"type":"crash","url":"https://httpbin.example.com/","body":"not an object"},` +
+		`{"type":"deprecation","url":"https://httpbin.example.com/","body":{"id":"test"}}` +
+		`]`
+	if got := post(malformed); got != http.StatusBadRequest {
+		t.Fatalf("got %d, want %d", got, http.StatusBadRequest)
+	}
+	if got := len(stored()); got != 0 {
+		t.Errorf("got %d stored reports of a refused batch, want 0", got)
+	}
+
+	// The refused batch spent no tokens, so the whole burst is left for its retry
+	if got := post(deprecationReports(3, "https://httpbin.example.com/")); got != http.StatusOK {
+		t.Fatalf("got %d, want %d", got, http.StatusOK)
+	}
+	if got := len(stored()); got != 3 {
+		t.Errorf("got %d stored reports, want 3", got)
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"flag"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"math"
@@ -13,6 +20,8 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,6 +39,22 @@ import (
 
 var nowFunc = time.Now
 
+// errConnectionPoolFull is returned when the pool holds MaxConnections, which says nothing about the backend.
+var errConnectionPoolFull = xerrors.New("connection pool is full")
+
+// dialError is a failure to reach the backend, including the TLS handshake done by the dialer.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return "failed to dial: " + e.err.Error()
+}
+
+func (e *dialError) Unwrap() error {
+	return e.err
+}
+
 type Connection struct {
 	conn       net.Conn
 	createdAt  time.Time
@@ -72,7 +97,16 @@ func (c *Connection) isHealthy() bool {
 	// A zero time value disables the deadline.
 	_ = c.conn.SetReadDeadline(time.Time{})
 
-	syscallConnection, ok := c.conn.(syscall.Conn)
+	conn := c.conn
+	peek := false
+	if tlsConnection, ok := conn.(*tls.Conn); ok {
+		// Peek rather than read, as a byte taken from under the TLS layer would corrupt the record stream.
+		// Any pending record still makes the connection unhealthy, as it may be a close_notify or an alert.
+		conn = tlsConnection.NetConn()
+		peek = true
+	}
+
+	syscallConnection, ok := conn.(syscall.Conn)
 	if !ok {
 		return false
 	}
@@ -86,8 +120,13 @@ func (c *Connection) isHealthy() bool {
 
 	if err := rawConnection.Read(func(fd uintptr) bool {
 		b := make([]byte, 1)
+		var err error
+		if peek {
+			_, _, err = syscall.Recvfrom(int(fd), b, syscall.MSG_PEEK)
+		} else {
+			_, err = syscall.Read(int(fd), b)
+		}
 		// If read succeeds, it's either EOF or unexpected read; only EAGAIN/EWOULDBLOCK is considered healthy.
-		_, err := syscall.Read(int(fd), b)
 		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK) {
 			healthy = true
 		}
@@ -96,8 +135,17 @@ func (c *Connection) isHealthy() bool {
 	}); err != nil {
 		return false
 	}
+	if !healthy || !peek {
+		return healthy
+	}
 
-	return healthy
+	// The TLS layer may already hold a record read along with the last reply, such as a close_notify.
+	// With the deadline passed, a read only goes through those, and times out if none of them is application data or an alert.
+	tlsConnection := c.conn.(*tls.Conn)
+	_ = tlsConnection.SetReadDeadline(time.Now())
+	_, err = tlsConnection.Read(make([]byte, 1))
+	_ = tlsConnection.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
 }
 
 type ConnectionPoolStrategy int
@@ -131,6 +179,7 @@ type ConnectionPool struct {
 	connections          []*Connection
 	idleConnections      map[string][]*Connection
 	idleConnectionsCount int64
+	closed               bool
 }
 
 func NewConnectionPool(option *ConnectionPoolOption) *ConnectionPool {
@@ -171,6 +220,10 @@ func (p *ConnectionPool) newIdleConnection(ctx context.Context) (*Connection, er
 
 	p.connectionMutex.Lock()
 	defer p.connectionMutex.Unlock()
+	if p.closed {
+		_ = connection.Close()
+		return nil, xerrors.New("connection pool is closed")
+	}
 	if p.option.MaxIdleConnections > 0 && p.IdleConnections() >= int(p.option.MaxIdleConnections) {
 		_ = connection.Close()
 		return nil, xerrors.New("idle connection pool is full")
@@ -186,12 +239,12 @@ func (p *ConnectionPool) newIdleConnection(ctx context.Context) (*Connection, er
 
 func (p *ConnectionPool) newConnection(ctx context.Context) (*Connection, error) {
 	if p.option.MaxConnections > 0 && p.Connections() >= int(p.option.MaxConnections) {
-		return nil, xerrors.New("connection pool is full")
+		return nil, errConnectionPoolFull
 	}
 
 	conn, err := p.option.Dialer(ctx)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to dial: %w", err)
+		return nil, &dialError{err: err}
 	}
 
 	connection := NewConnection(conn)
@@ -273,7 +326,7 @@ func (p *ConnectionPool) Put(ctx context.Context, connection *Connection) error
 
 	topologyName := p.topologyName(connection.RemoteAddr())
 
-	if p.IdleConnections() < int(p.option.MaxIdleConnections) {
+	if !p.closed && p.IdleConnections() < int(p.option.MaxIdleConnections) {
 		connection.returnedAt = nowFunc()
 		p.idleConnections[topologyName] = append(p.idleConnections[topologyName], connection)
 		atomic.AddInt64(&p.idleConnectionsCount, 1)
@@ -285,6 +338,15 @@ func (p *ConnectionPool) Put(ctx context.Context, connection *Connection) error
 	return nil
 }
 
+// Discard closes a connection that must not be handed to another client.
+func (p *ConnectionPool) Discard(ctx context.Context, connection *Connection) {
+	p.connectionMutex.Lock()
+	defer p.connectionMutex.Unlock()
+
+	_ = connection.Close()
+	p.removeConnection(ctx, p.topologyName(connection.RemoteAddr()), connection)
+}
+
 func (p *ConnectionPool) removeConnection(ctx context.Context, topologyName string, connection *Connection) {
 	for i, c := range p.connections {
 		if c == connection {
@@ -318,6 +380,711 @@ func (p *ConnectionPool) topologyName(addr net.Addr) string {
 	return ""
 }
 
+// Close stops the pool from keeping connections, for a backend that is gone.
+func (p *ConnectionPool) Close() {
+	p.connectionMutex.Lock()
+	defer p.connectionMutex.Unlock()
+
+	p.closed = true
+	for topologyName, connections := range p.idleConnections {
+		for _, connection := range connections {
+			_ = connection.Close()
+			p.removeConnection(context.Background(), topologyName, connection)
+		}
+		atomic.AddInt64(&p.idleConnectionsCount, -int64(len(connections)))
+		delete(p.idleConnections, topologyName)
+	}
+}
+
+type LoadBalancingPolicy int
+
+const (
+	RoundRobin LoadBalancingPolicy = iota
+	LeastConnections
+	ConsistentHash
+)
+
+func ParseLoadBalancingPolicy(s string) (LoadBalancingPolicy, error) {
+	switch s {
+	case "round-robin":
+		return RoundRobin, nil
+	case "least-connections":
+		return LeastConnections, nil
+	case "consistent-hash":
+		return ConsistentHash, nil
+	default:
+		return 0, xerrors.Errorf("invalid load balancing policy: %s", s)
+	}
+}
+
+type Backend struct {
+	Address string
+	Pool    *ConnectionPool
+
+	activeConnections int64
+	healthy           atomic.Bool
+	failures          atomic.Int64
+	ejectedUntil      atomic.Int64
+}
+
+func NewBackend(address string, pool *ConnectionPool) *Backend {
+	b := &Backend{
+		Address: address,
+		Pool:    pool,
+	}
+	// A backend is trusted until a health check or a connection proves otherwise.
+	b.healthy.Store(true)
+	return b
+}
+
+func (b *Backend) ActiveConnections() int {
+	return int(atomic.LoadInt64(&b.activeConnections))
+}
+
+func (b *Backend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+func (b *Backend) Acquire() {
+	atomic.AddInt64(&b.activeConnections, 1)
+}
+
+func (b *Backend) Release() {
+	atomic.AddInt64(&b.activeConnections, -1)
+}
+
+func (b *Backend) available(now time.Time) bool {
+	return b.healthy.Load() && now.UnixNano() >= b.ejectedUntil.Load()
+}
+
+type UpstreamOption struct {
+	Resolver            func(context.Context) ([]string, error)
+	NewConnectionPool   func(address string) *ConnectionPool
+	LoadBalancingPolicy LoadBalancingPolicy
+	EjectionDuration    time.Duration
+	HealthCheckDialer   func(ctx context.Context, address string) (net.Conn, error)
+	UnhealthyThreshold  int
+}
+
+type ringEntry struct {
+	hash    uint32
+	backend *Backend
+}
+
+// virtualNodes is the number of points each backend owns on the consistent hash ring.
+const virtualNodes = 100
+
+type Upstream struct {
+	option *UpstreamOption
+
+	mutex    sync.RWMutex
+	backends []*Backend
+	ring     []ringEntry
+	next     atomic.Uint64
+}
+
+func NewUpstream(option *UpstreamOption) *Upstream {
+	return &Upstream{
+		option: option,
+	}
+}
+
+func (u *Upstream) Backends() []*Backend {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return append([]*Backend(nil), u.backends...)
+}
+
+// Resolve refreshes the backend list, keeping the list it has when the resolver fails.
+func (u *Upstream) Resolve(ctx context.Context) error {
+	addresses, err := u.option.Resolver(ctx)
+	if err != nil {
+		return xerrors.Errorf("failed to resolve upstream: %w", err)
+	}
+	if len(addresses) == 0 {
+		return xerrors.New("upstream resolved to no address")
+	}
+
+	u.update(addresses)
+	return nil
+}
+
+// update keeps the backends, and so the pools, of addresses that are still present.
+func (u *Upstream) update(addresses []string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	current := make(map[string]*Backend, len(u.backends))
+	for _, b := range u.backends {
+		current[b.Address] = b
+	}
+
+	backends := make([]*Backend, 0, len(addresses))
+	for _, address := range addresses {
+		if b, ok := current[address]; ok {
+			backends = append(backends, b)
+			delete(current, address)
+			continue
+		}
+		if slices.ContainsFunc(backends, func(b *Backend) bool { return b.Address == address }) {
+			continue
+		}
+		backends = append(backends, NewBackend(address, u.option.NewConnectionPool(address)))
+	}
+	for _, b := range current {
+		b.Pool.Close()
+	}
+
+	ring := make([]ringEntry, 0, len(backends)*virtualNodes)
+	for _, b := range backends {
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, ringEntry{hash: hash32(b.Address + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	u.backends = backends
+	u.ring = ring
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// Pick chooses a backend that is neither excluded nor, if any other is left, unhealthy or ejected.
+func (u *Upstream) Pick(clientIP string, exclude map[*Backend]struct{}) *Backend {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	now := nowFunc()
+	candidate := func(b *Backend) bool {
+		_, excluded := exclude[b]
+		return !excluded && b.available(now)
+	}
+	if !slices.ContainsFunc(u.backends, candidate) {
+		// Failing open beats refusing every connection when all backends look down.
+		candidate = func(b *Backend) bool {
+			_, excluded := exclude[b]
+			return !excluded
+		}
+	}
+
+	switch u.option.LoadBalancingPolicy {
+	case LeastConnections:
+		var picked *Backend
+		for _, b := range u.backends {
+			if candidate(b) && (picked == nil || b.ActiveConnections() < picked.ActiveConnections()) {
+				picked = b
+			}
+		}
+		return picked
+	case ConsistentHash:
+		if len(u.ring) == 0 {
+			return nil
+		}
+		h := hash32(clientIP)
+		start := sort.Search(len(u.ring), func(i int) bool {
+			return u.ring[i].hash >= h
+		})
+		for i := 0; i < len(u.ring); i++ {
+			if b := u.ring[(start+i)%len(u.ring)].backend; candidate(b) {
+				return b
+			}
+		}
+		return nil
+	default:
+		n := len(u.backends)
+		offset := int(u.next.Add(1) % uint64(max(n, 1)))
+		for i := 0; i < n; i++ {
+			if b := u.backends[(offset+i)%n]; candidate(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+// Eject takes a backend out of rotation for the ejection duration after a failed connection.
+func (u *Upstream) Eject(b *Backend) {
+	b.ejectedUntil.Store(nowFunc().Add(u.option.EjectionDuration).UnixNano())
+}
+
+// Get returns a connection from the pool of a picked backend, moving on to the next backend when one cannot be reached or is full.
+func (u *Upstream) Get(ctx context.Context, clientIP string, topologyName string) (*Backend, *Connection, error) {
+	exclude := make(map[*Backend]struct{})
+	var errs []error
+	for {
+		b := u.Pick(clientIP, exclude)
+		if b == nil {
+			return nil, nil, xerrors.Errorf("no backend available: %w", errors.Join(errs...))
+		}
+
+		connection, err := b.Pool.Get(ctx, topologyName)
+		if err != nil {
+			// A full pool only means this backend is busy, so it is skipped without being taken out of rotation
+			if e := (*dialError)(nil); errors.As(err, &e) {
+				u.Eject(b)
+			}
+			exclude[b] = struct{}{}
+			errs = append(errs, xerrors.Errorf("failed to connect to %s: %w", b.Address, err))
+			continue
+		}
+		return b, connection, nil
+	}
+}
+
+// CheckHealth dials every backend, marking it unhealthy after consecutive failures and healthy again after a success.
+func (u *Upstream) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range u.Backends() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := u.option.HealthCheckDialer(ctx, b.Address)
+			if err != nil {
+				if b.failures.Add(1) >= int64(u.option.UnhealthyThreshold) && b.healthy.Swap(false) {
+					log.Printf("backend %s is unhealthy: %+v", b.Address, err)
+				}
+				return
+			}
+			_ = conn.Close()
+
+			b.failures.Store(0)
+			if !b.healthy.Swap(true) {
+				log.Printf("backend %s is healthy", b.Address)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func staticResolver(addresses string) func(context.Context) ([]string, error) {
+	var list []string
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			list = append(list, address)
+		}
+	}
+	return func(context.Context) ([]string, error) {
+		return list, nil
+	}
+}
+
+// dnsResolver resolves host:port to one address per A/AAAA record of host.
+func dnsResolver(resolver *net.Resolver, address string) func(context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to split host and port: %w", err)
+		}
+		ips, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to lookup host: %w", err)
+		}
+
+		addresses := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip, port))
+		}
+		slices.Sort(addresses)
+		return addresses, nil
+	}
+}
+
+// srvResolver resolves a name like _postgresql._tcp.example.com to the targets and ports of its SRV records.
+func srvResolver(resolver *net.Resolver, name string) func(context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		_, records, err := resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to lookup SRV: %w", err)
+		}
+
+		addresses := make([]string, 0, len(records))
+		for _, record := range records {
+			addresses = append(addresses, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+		slices.Sort(addresses)
+		return addresses, nil
+	}
+}
+
+// certificateReloader serves a key pair from disk, loading it again whenever one of the files changes.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.load(); err != nil {
+		return nil, xerrors.Errorf("failed to load certificate: %w", err)
+	}
+	return r, nil
+}
+
+func (r *certificateReloader) load() (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if r.certificate != nil {
+				log.Printf("failed to stat %s, keeping the current certificate: %+v", file, err)
+				return r.certificate, nil
+			}
+			return nil, xerrors.Errorf("failed to stat %s: %w", file, err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.certificate != nil && modTime.Equal(r.modTime) {
+		return r.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// A secret is often updated one file at a time; keep serving the old pair until both match.
+		if r.certificate != nil {
+			log.Printf("failed to reload certificate, keeping the current one: %+v", err)
+			return r.certificate, nil
+		}
+		return nil, xerrors.Errorf("failed to load key pair: %w", err)
+	}
+	r.certificate = &certificate
+	r.modTime = modTime
+	return r.certificate, nil
+}
+
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+func (r *certificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+var proxyProtocolV2Signature = [12]byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+const (
+	proxyProtocolV2VersionCommand = 0x21 // version 2, PROXY command
+
+	proxyProtocolV2FamilyTCP4 = 0x11 // AF_INET + STREAM
+	proxyProtocolV2FamilyTCP6 = 0x21 // AF_INET6 + STREAM
+
+	proxyProtocolV2IPv4AddrLen = 12 // 4+4+2+2
+	proxyProtocolV2IPv6AddrLen = 36 // 16+16+2+2
+
+	// proxyProtocolV1MaxLength is the longest v1 header including CRLF.
+	proxyProtocolV1MaxLength = 107
+)
+
+func buildProxyProtocolV1Header(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	if (src.IP.To4() != nil) != (dst.IP.To4() != nil) {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	protocol := "TCP6"
+	if src.IP.To4() != nil {
+		protocol = "TCP4"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", protocol, src.IP.String(), dst.IP.String(), src.Port, dst.Port))
+}
+
+func buildProxyProtocolV2Header(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	srcIsIPv4 := src.IP.To4() != nil
+	dstIsIPv4 := dst.IP.To4() != nil
+	if srcIsIPv4 != dstIsIPv4 {
+		return nil
+	}
+	isIPv4 := srcIsIPv4
+
+	var family byte
+	var addrLen int
+	if isIPv4 {
+		addrLen = proxyProtocolV2IPv4AddrLen
+		family = proxyProtocolV2FamilyTCP4
+	} else {
+		addrLen = proxyProtocolV2IPv6AddrLen
+		family = proxyProtocolV2FamilyTCP6
+	}
+
+	header := make([]byte, 16+addrLen)
+	copy(header[0:12], proxyProtocolV2Signature[:])
+	header[12] = proxyProtocolV2VersionCommand
+	header[13] = family
+	binary.BigEndian.PutUint16(header[14:16], uint16(addrLen))
+
+	offset := 16
+	if isIPv4 {
+		copy(header[offset:offset+4], src.IP.To4())
+		copy(header[offset+4:offset+8], dst.IP.To4())
+		binary.BigEndian.PutUint16(header[offset+8:offset+10], uint16(src.Port))
+		binary.BigEndian.PutUint16(header[offset+10:offset+12], uint16(dst.Port))
+	} else {
+		copy(header[offset:offset+16], src.IP.To16())
+		copy(header[offset+16:offset+32], dst.IP.To16())
+		binary.BigEndian.PutUint16(header[offset+32:offset+34], uint16(src.Port))
+		binary.BigEndian.PutUint16(header[offset+34:offset+36], uint16(dst.Port))
+	}
+
+	return header
+}
+
+// readProxyProtocolHeader consumes a v1 or v2 header. The addresses are nil for LOCAL and UNKNOWN headers.
+func readProxyProtocolHeader(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+
+	switch first[0] {
+	case 'P':
+		return readProxyProtocolV1Header(r)
+	case proxyProtocolV2Signature[0]:
+		return readProxyProtocolV2Header(r)
+	default:
+		return nil, nil, xerrors.New("missing PROXY protocol header")
+	}
+}
+
+func readProxyProtocolV1Header(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, nil, xerrors.New("PROXY protocol v1 header is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, xerrors.Errorf("failed to read PROXY protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, xerrors.Errorf("invalid PROXY protocol v1 header: %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, xerrors.Errorf("unsupported PROXY protocol v1 protocol: %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, nil, xerrors.Errorf("invalid PROXY protocol v1 header: %q", line)
+	}
+
+	parse := func(ip string, port string) (*net.TCPAddr, error) {
+		parsedIP := net.ParseIP(ip)
+		if parsedIP == nil {
+			return nil, xerrors.Errorf("invalid address: %s", ip)
+		}
+		parsedPort, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid port: %w", err)
+		}
+		return &net.TCPAddr{IP: parsedIP, Port: int(parsedPort)}, nil
+	}
+	src, err := parse(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid PROXY protocol v1 source: %w", err)
+	}
+	dst, err := parse(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, xerrors.Errorf("invalid PROXY protocol v1 destination: %w", err)
+	}
+	return src, dst, nil
+}
+
+func readProxyProtocolV2Header(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, xerrors.Errorf("failed to read PROXY protocol v2 header: %w", err)
+	}
+	if !bytes.Equal(header[0:12], proxyProtocolV2Signature[:]) {
+		return nil, nil, xerrors.New("invalid PROXY protocol v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, xerrors.Errorf("unsupported PROXY protocol version: %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, xerrors.Errorf("failed to read PROXY protocol v2 addresses: %w", err)
+	}
+
+	switch header[12] & 0x0F {
+	case 0x00:
+		// LOCAL: a health check from the proxy itself.
+		return nil, nil, nil
+	case 0x01:
+	default:
+		return nil, nil, xerrors.Errorf("unsupported PROXY protocol v2 command: %d", header[12]&0x0F)
+	}
+
+	// TLVs after the addresses are skipped.
+	switch header[13] {
+	case proxyProtocolV2FamilyTCP4:
+		if len(payload) < proxyProtocolV2IPv4AddrLen {
+			return nil, nil, xerrors.New("short PROXY protocol v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}, nil
+	case proxyProtocolV2FamilyTCP6:
+		if len(payload) < proxyProtocolV2IPv6AddrLen {
+			return nil, nil, xerrors.New("short PROXY protocol v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// proxiedConn reports the addresses from a PROXY protocol header and reads what followed the header from the buffer.
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	source *net.TCPAddr
+	dest   *net.TCPAddr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	if c.dest != nil {
+		return c.dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	if closeWriter, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closeWriter.CloseWrite()
+	}
+	return nil
+}
+
+type clientConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
+type ListenerOption struct {
+	AcceptProxyProtocol bool
+	TLSConfig           *tls.Config
+	HandshakeTimeout    time.Duration
+}
+
+// accept reads a PROXY protocol header and completes a TLS handshake, in that order, as configured.
+func accept(conn *net.TCPConn, option *ListenerOption) (clientConn, error) {
+	var local clientConn = conn
+	if option.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(nowFunc().Add(option.HandshakeTimeout))
+	}
+
+	if option.AcceptProxyProtocol {
+		reader := bufio.NewReader(conn)
+		src, dst, err := readProxyProtocolHeader(reader)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to accept PROXY protocol: %w", err)
+		}
+		local = &proxiedConn{
+			Conn:   conn,
+			reader: reader,
+			source: src,
+			dest:   dst,
+		}
+	}
+
+	if option.TLSConfig != nil {
+		tlsConnection := tls.Server(local, option.TLSConfig)
+		if err := tlsConnection.Handshake(); err != nil {
+			return nil, xerrors.Errorf("failed to handshake: %w", err)
+		}
+		local = tlsConnection
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return local, nil
+}
+
+func proxyProtocolHeader(version string, local net.Conn) ([]byte, error) {
+	src, ok := local.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, xerrors.Errorf("unexpected client address: %s", local.RemoteAddr())
+	}
+	dst, ok := local.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, xerrors.Errorf("unexpected local address: %s", local.LocalAddr())
+	}
+
+	switch version {
+	case "v1":
+		return buildProxyProtocolV1Header(src, dst), nil
+	case "v2":
+		if header := buildProxyProtocolV2Header(src, dst); header != nil {
+			return header, nil
+		}
+		return nil, xerrors.New("client and local addresses are of different families")
+	default:
+		return nil, xerrors.Errorf("invalid PROXY protocol version: %s", version)
+	}
+}
+
+func newRemoteTLSConfig(serverName string, caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, xerrors.Errorf("no certificate found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		reloader, err := newCertificateReloader(certFile, keyFile)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to load client certificate: %w", err)
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return config, nil
+}
+
 func envOrDefaultValue[T any](key string, defaultValue T) T {
 	value, exists := os.LookupEnv(key)
 	if !exists {
@@ -374,11 +1141,28 @@ func main() {
 	var topologyAwareRouting bool
 	var topologies string
 	var ownIP string
+	var remoteDiscovery string
+	var resolveInterval time.Duration
+	var loadBalancingPolicy string
+	var healthCheckInterval time.Duration
+	var healthCheckTimeout time.Duration
+	var unhealthyThreshold int
+	var ejectionDuration time.Duration
+	var tlsCertFile string
+	var tlsKeyFile string
+	var remoteTLS bool
+	var remoteTLSServerName string
+	var remoteTLSCAFile string
+	var remoteTLSCertFile string
+	var remoteTLSKeyFile string
+	var acceptProxyProtocol bool
+	var sendProxyProtocol string
+	var handshakeTimeout time.Duration
 	var terminationGracePeriod time.Duration
 	var lameduck time.Duration
 	var keepalive bool
 	flag.StringVar(&localAddress, "local-address", envOrDefaultValue("LOCAL_ADDRESS", "127.0.0.1:18888"), "Local listen address")
-	flag.StringVar(&remoteAddress, "remote-address", envOrDefaultValue("REMOTE_ADDRESS", "127.0.0.1:8888"), "Remote upstream address")
+	flag.StringVar(&remoteAddress, "remote-address", envOrDefaultValue("REMOTE_ADDRESS", "127.0.0.1:8888"), "Remote upstream address. A comma-separated list with --remote-discovery=static, host:port with dns, or an SRV name with srv")
 	flag.StringVar(&monitorAddress, "monitor-address", envOrDefaultValue("MONITOR_ADDRESS", "127.0.0.1:8080"), "Monitor server address")
 	flag.DurationVar(&connectTimeout, "connect-timeout", envOrDefaultValue("CONNECT_TIMEOUT", 10*time.Second), "TCP connection timeout. Default is 10s.")
 	flag.IntVar(&maxConnections, "max-connections", envOrDefaultValue("MAX_CONNECTIONS", math.MaxInt32), "Maximum number of TCP connections to a remote address. Default 2^32-1.")
@@ -390,6 +1174,23 @@ func main() {
 	flag.BoolVar(&topologyAwareRouting, "topology-aware-routing", envOrDefaultValue("TOPOLOGY_AWARE_ROUTING", false), "Topology-aware routing")
 	flag.StringVar(&topologies, "topologies", envOrDefaultValue("TOPOLOGIES", ""), "TopologyList in the format of name1=192.168.0.0/24,name2=192.168.1.0/24")
 	flag.StringVar(&ownIP, "own-ip", envOrDefaultValue("OWN_IP", ""), "Own IP address for topology-aware routing")
+	flag.StringVar(&remoteDiscovery, "remote-discovery", envOrDefaultValue("REMOTE_DISCOVERY", "static"), "How to find upstream backends from --remote-address: static, dns or srv")
+	flag.DurationVar(&resolveInterval, "resolve-interval", envOrDefaultValue("RESOLVE_INTERVAL", 30*time.Second), "Interval to re-resolve upstream backends with --remote-discovery=dns or srv")
+	flag.StringVar(&loadBalancingPolicy, "load-balancing-policy", envOrDefaultValue("LOAD_BALANCING_POLICY", "round-robin"), "Load balancing policy: round-robin, least-connections or consistent-hash by client IP")
+	flag.DurationVar(&healthCheckInterval, "health-check-interval", envOrDefaultValue("HEALTH_CHECK_INTERVAL", time.Duration(0)), "Interval of active TCP health checks. Default 0 disables them.")
+	flag.DurationVar(&healthCheckTimeout, "health-check-timeout", envOrDefaultValue("HEALTH_CHECK_TIMEOUT", 1*time.Second), "Timeout of an active TCP health check")
+	flag.IntVar(&unhealthyThreshold, "unhealthy-threshold", envOrDefaultValue("UNHEALTHY_THRESHOLD", 3), "Consecutive failed health checks before a backend is marked unhealthy")
+	flag.DurationVar(&ejectionDuration, "ejection-duration", envOrDefaultValue("EJECTION_DURATION", 30*time.Second), "How long a backend is skipped after a connection to it fails")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", envOrDefaultValue("TLS_CERT_FILE", ""), "Certificate file to terminate TLS on the local listener. Reloaded when it changes.")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", envOrDefaultValue("TLS_KEY_FILE", ""), "Private key file to terminate TLS on the local listener. Reloaded when it changes.")
+	flag.BoolVar(&remoteTLS, "remote-tls", envOrDefaultValue("REMOTE_TLS", false), "Connect to the remote with TLS")
+	flag.StringVar(&remoteTLSServerName, "remote-tls-server-name", envOrDefaultValue("REMOTE_TLS_SERVER_NAME", ""), "SNI and verified name of the remote. Default is the host of each backend address.")
+	flag.StringVar(&remoteTLSCAFile, "remote-tls-ca-file", envOrDefaultValue("REMOTE_TLS_CA_FILE", ""), "CA file to verify the remote. Default is the system roots.")
+	flag.StringVar(&remoteTLSCertFile, "remote-tls-cert-file", envOrDefaultValue("REMOTE_TLS_CERT_FILE", ""), "Client certificate file for mTLS to the remote")
+	flag.StringVar(&remoteTLSKeyFile, "remote-tls-key-file", envOrDefaultValue("REMOTE_TLS_KEY_FILE", ""), "Client private key file for mTLS to the remote")
+	flag.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", envOrDefaultValue("ACCEPT_PROXY_PROTOCOL", false), "Require a PROXY protocol v1 or v2 header from clients")
+	flag.StringVar(&sendProxyProtocol, "send-proxy-protocol", envOrDefaultValue("SEND_PROXY_PROTOCOL", ""), "Send a PROXY protocol header of this version (v1 or v2) to the remote")
+	flag.DurationVar(&handshakeTimeout, "handshake-timeout", envOrDefaultValue("HANDSHAKE_TIMEOUT", 10*time.Second), "Timeout to receive a PROXY protocol header and to complete a TLS handshake from a client")
 
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
@@ -409,6 +1210,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to create gauge: %+v", err)
 	}
+	upstreamHealthy, err := meter.Int64ObservableGauge("upstream_healthy")
+	if err != nil {
+		log.Fatalf("failed to create gauge: %+v", err)
+	}
 
 	opt := metric.WithAttributes(
 		attribute.Key("upstream").String(remoteAddress),
@@ -464,27 +1269,137 @@ func main() {
 		}
 	}
 
-	connectionPool := NewConnectionPool(&ConnectionPoolOption{
-		MaxConnections:     uint(maxConnections),
-		MaxIdleConnections: uint(maxIdleConnections),
-		MinIdleConnections: uint(minIdleConnections),
-		MaxIdleTime:        maxIdleTime,
-		MaxLifetime:        maxLifetime,
-		Jitter: func(duration time.Duration) time.Duration {
-			jitter := time.Duration(float64(duration) * jitterPercentage * (rand.Float64()*2 - 1))
-			return duration + jitter
+	listenerOption := &ListenerOption{
+		AcceptProxyProtocol: acceptProxyProtocol,
+		HandshakeTimeout:    handshakeTimeout,
+	}
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		reloader, err := newCertificateReloader(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			log.Fatalf("failed to load certificate: %+v", err)
+		}
+		listenerOption.TLSConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	var remoteTLSConfig *tls.Config
+	if remoteTLS {
+		remoteTLSConfig, err = newRemoteTLSConfig(remoteTLSServerName, remoteTLSCAFile, remoteTLSCertFile, remoteTLSKeyFile)
+		if err != nil {
+			log.Fatalf("failed to create remote TLS config: %+v", err)
+		}
+	}
+
+	switch sendProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		log.Fatalf("invalid PROXY protocol version: %s", sendProxyProtocol)
+	}
+
+	policy, err := ParseLoadBalancingPolicy(loadBalancingPolicy)
+	if err != nil {
+		log.Fatalf("failed to parse load balancing policy: %+v", err)
+	}
+
+	var resolver func(context.Context) ([]string, error)
+	switch remoteDiscovery {
+	case "static":
+		resolver = staticResolver(remoteAddress)
+	case "dns":
+		resolver = dnsResolver(net.DefaultResolver, remoteAddress)
+	case "srv":
+		resolver = srvResolver(net.DefaultResolver, remoteAddress)
+	default:
+		log.Fatalf("invalid remote discovery: %s", remoteDiscovery)
+	}
+
+	upstream := NewUpstream(&UpstreamOption{
+		Resolver: resolver,
+		NewConnectionPool: func(address string) *ConnectionPool {
+			return NewConnectionPool(&ConnectionPoolOption{
+				MaxConnections:     uint(maxConnections),
+				MaxIdleConnections: uint(maxIdleConnections),
+				MinIdleConnections: uint(minIdleConnections),
+				MaxIdleTime:        maxIdleTime,
+				MaxLifetime:        maxLifetime,
+				Jitter: func(duration time.Duration) time.Duration {
+					jitter := time.Duration(float64(duration) * jitterPercentage * (rand.Float64()*2 - 1))
+					return duration + jitter
+				},
+				TopologyList: topologyList,
+				Dialer: func(ctx context.Context) (net.Conn, error) {
+					if remoteTLSConfig == nil {
+						return net.DialTimeout("tcp", address, connectTimeout)
+					}
+
+					config := remoteTLSConfig.Clone()
+					if config.ServerName == "" {
+						host, _, err := net.SplitHostPort(address)
+						if err != nil {
+							return nil, xerrors.Errorf("failed to split host and port: %w", err)
+						}
+						config.ServerName = host
+					}
+					dialer := &tls.Dialer{
+						NetDialer: &net.Dialer{Timeout: connectTimeout},
+						Config:    config,
+					}
+					return dialer.DialContext(ctx, "tcp", address)
+				},
+				ConnectionPoolStrategy: FIFO,
+			})
 		},
-		TopologyList: topologyList,
-		Dialer: func(ctx context.Context) (net.Conn, error) {
-			return net.DialTimeout("tcp", remoteAddress, connectTimeout)
+		LoadBalancingPolicy: policy,
+		EjectionDuration:    ejectionDuration,
+		HealthCheckDialer: func(ctx context.Context, address string) (net.Conn, error) {
+			return net.DialTimeout("tcp", address, healthCheckTimeout)
 		},
-		ConnectionPoolStrategy: FIFO,
+		UnhealthyThreshold: unhealthyThreshold,
 	})
+	if err := upstream.Resolve(context.Background()); err != nil {
+		log.Fatalf("failed to resolve upstream: %+v", err)
+	}
+
+	if remoteDiscovery != "static" {
+		go func() {
+			ticker := time.NewTicker(resolveInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if err := upstream.Resolve(context.Background()); err != nil {
+					log.Printf("%+v", err)
+				}
+			}
+		}()
+	}
+
+	if healthCheckInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(healthCheckInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				upstream.CheckHealth(context.Background())
+			}
+		}()
+	}
 
 	if _, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
-		o.ObserveInt64(tcpIdleConnections, int64(connectionPool.IdleConnections()), opt)
+		for _, b := range upstream.Backends() {
+			backendOpt := metric.WithAttributes(
+				attribute.Key("upstream").String(b.Address),
+			)
+			o.ObserveInt64(tcpIdleConnections, int64(b.Pool.IdleConnections()), backendOpt)
+			healthy := int64(0)
+			if b.Healthy() {
+				healthy = 1
+			}
+			o.ObserveInt64(upstreamHealthy, healthy, backendOpt)
+		}
 		return nil
-	}, tcpIdleConnections); err != nil {
+	}, tcpIdleConnections, upstreamHealthy); err != nil {
 		log.Fatalf("failed to register callback: %+v", err)
 	}
 
@@ -507,7 +1422,7 @@ func main() {
 	go func() {
 		ctx := context.Background()
 		for {
-			local, err := listener.AcceptTCP()
+			conn, err := listener.AcceptTCP()
 			if err != nil {
 				select {
 				case <-shutdown:
@@ -526,13 +1441,44 @@ func main() {
 					tcpConnections.Add(ctx, -1, opt)
 				}()
 
+				defer conn.Close()
+
+				local, err := accept(conn, listenerOption)
+				if err != nil {
+					log.Printf("%+v", err)
+					return
+				}
 				defer local.Close()
 
-				remote, err := connectionPool.Get(ctx, topologyName)
+				var clientIP string
+				if addr, ok := local.RemoteAddr().(*net.TCPAddr); ok {
+					clientIP = addr.IP.String()
+				}
+
+				backend, remote, err := upstream.Get(ctx, clientIP, topologyName)
 				if err != nil {
+					log.Printf("%+v", err)
 					return
 				}
-				defer connectionPool.Put(ctx, remote)
+				backend.Acquire()
+				defer backend.Release()
+
+				if sendProxyProtocol != "" {
+					// The header describes this client only, so the connection cannot be pooled for the next one.
+					defer backend.Pool.Discard(ctx, remote)
+
+					header, err := proxyProtocolHeader(sendProxyProtocol, local)
+					if err != nil {
+						log.Printf("%+v", err)
+						return
+					}
+					if _, err := remote.Write(header); err != nil {
+						log.Printf("failed to send PROXY protocol header: %+v", err)
+						return
+					}
+				} else {
+					defer backend.Pool.Put(ctx, remote)
+				}
 				defer remote.Cancel()
 
 				c := make(chan struct{}, 2)
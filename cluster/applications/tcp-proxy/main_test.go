@@ -1,8 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -1074,3 +1088,590 @@ func TestConnection_Concurrency(t *testing.T) {
 		t.Error("expected all connections are idle")
 	}
 }
+
+func newTestUpstream(policy LoadBalancingPolicy, addresses ...string) *Upstream {
+	u := NewUpstream(&UpstreamOption{
+		NewConnectionPool: func(address string) *ConnectionPool {
+			return NewConnectionPool(&ConnectionPoolOption{
+				MaxConnections: 10,
+				Jitter: func(duration time.Duration) time.Duration {
+					return duration
+				},
+				Dialer: func(ctx context.Context) (net.Conn, error) {
+					return net.Dial("tcp", address)
+				},
+				ConnectionPoolStrategy: FIFO,
+			})
+		},
+		LoadBalancingPolicy: policy,
+		EjectionDuration:    time.Minute,
+		UnhealthyThreshold:  2,
+	})
+	u.update(addresses)
+	return u
+}
+
+func TestUpstream_RoundRobin(t *testing.T) {
+	u := newTestUpstream(RoundRobin, "a:1", "b:1", "c:1")
+
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[u.Pick("", nil).Address]++
+	}
+	for _, address := range []string{"a:1", "b:1", "c:1"} {
+		if seen[address] != 2 {
+			t.Errorf("%s was picked %d times, want 2", address, seen[address])
+		}
+	}
+}
+
+func TestUpstream_LeastConnections(t *testing.T) {
+	u := newTestUpstream(LeastConnections, "a:1", "b:1", "c:1")
+	backends := u.Backends()
+	backends[0].Acquire()
+	backends[1].Acquire()
+	backends[1].Acquire()
+
+	if got := u.Pick("", nil); got != backends[2] {
+		t.Errorf("picked %s, want c:1", got.Address)
+	}
+	backends[2].Acquire()
+	backends[2].Acquire()
+	if got := u.Pick("", nil); got != backends[0] {
+		t.Errorf("picked %s, want a:1", got.Address)
+	}
+}
+
+func TestUpstream_ConsistentHash(t *testing.T) {
+	u := newTestUpstream(ConsistentHash, "a:1", "b:1", "c:1")
+
+	picked := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		clientIP := net.IPv4(10, 0, byte(i/256), byte(i)).String()
+		picked[clientIP] = u.Pick(clientIP, nil).Address
+		if got := u.Pick(clientIP, nil).Address; got != picked[clientIP] {
+			t.Errorf("%s moved from %s to %s", clientIP, picked[clientIP], got)
+		}
+	}
+
+	// Removing a backend only moves the clients that were on it.
+	u.update([]string{"a:1", "b:1"})
+	for clientIP, address := range picked {
+		got := u.Pick(clientIP, nil).Address
+		if address != "c:1" && got != address {
+			t.Errorf("%s moved from %s to %s", clientIP, address, got)
+		}
+	}
+}
+
+func TestUpstream_Ejection(t *testing.T) {
+	now := time.Now()
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	u := newTestUpstream(RoundRobin, "a:1", "b:1")
+	backends := u.Backends()
+	u.Eject(backends[0])
+
+	for i := 0; i < 4; i++ {
+		if got := u.Pick("", nil); got != backends[1] {
+			t.Errorf("picked %s while a:1 is ejected", got.Address)
+		}
+	}
+
+	// With every backend down, picking fails open.
+	u.Eject(backends[1])
+	if got := u.Pick("", nil); got == nil {
+		t.Error("no backend was picked while all are ejected")
+	}
+
+	now = now.Add(2 * time.Minute)
+	seen := make(map[*Backend]bool)
+	for i := 0; i < 2; i++ {
+		seen[u.Pick("", nil)] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("ejected backends did not come back")
+	}
+}
+
+func TestUpstream_Failover(t *testing.T) {
+	mockServer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockServer.Close()
+
+	go func() {
+		for {
+			conn, err := mockServer.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := closed.Addr().String()
+	_ = closed.Close()
+
+	u := newTestUpstream(RoundRobin, closedAddress, mockServer.Addr().String())
+	for i := 0; i < 3; i++ {
+		backend, conn, err := u.Get(t.Context(), "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backend.Address != mockServer.Addr().String() {
+			t.Errorf("got %s, want %s", backend.Address, mockServer.Addr().String())
+		}
+		_ = conn.Close()
+	}
+	if u.Backends()[0].available(time.Now()) {
+		t.Error("unreachable backend was not ejected")
+	}
+}
+
+func TestUpstream_PoolFull(t *testing.T) {
+	mockServer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockServer.Close()
+
+	go func() {
+		for {
+			conn, err := mockServer.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	u := NewUpstream(&UpstreamOption{
+		NewConnectionPool: func(address string) *ConnectionPool {
+			return NewConnectionPool(&ConnectionPoolOption{
+				MaxConnections: 1,
+				Jitter: func(duration time.Duration) time.Duration {
+					return duration
+				},
+				Dialer: func(ctx context.Context) (net.Conn, error) {
+					return net.Dial("tcp", mockServer.Addr().String())
+				},
+				ConnectionPoolStrategy: FIFO,
+			})
+		},
+		LoadBalancingPolicy: LeastConnections,
+		EjectionDuration:    time.Minute,
+	})
+	u.update([]string{"a:1", "b:1"})
+	backends := u.Backends()
+
+	// Fills the pool of a:1, which least connections keeps picking first
+	if _, err := backends[0].Pool.Get(t.Context(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, conn, err := u.Get(t.Context(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if backend != backends[1] {
+		t.Errorf("got %s, want b:1", backend.Address)
+	}
+	if !backends[0].available(time.Now()) {
+		t.Error("backend with a full pool was ejected")
+	}
+
+	// With every pool full, Get fails without ejecting anything
+	if _, _, err := u.Get(t.Context(), "", ""); !errors.Is(err, errConnectionPoolFull) {
+		t.Errorf("got %v, want %v", err, errConnectionPoolFull)
+	}
+	for _, b := range backends {
+		if !b.available(time.Now()) {
+			t.Errorf("%s was ejected", b.Address)
+		}
+	}
+}
+
+func TestUpstream_Update(t *testing.T) {
+	u := newTestUpstream(RoundRobin, "a:1", "b:1")
+	before := u.Backends()
+
+	u.update([]string{"b:1", "c:1", "c:1"})
+	after := u.Backends()
+	if len(after) != 2 {
+		t.Fatalf("got %d backends, want 2", len(after))
+	}
+	if after[0] != before[1] {
+		t.Error("backend b:1 was recreated")
+	}
+	if !before[0].Pool.closed {
+		t.Error("pool of removed backend a:1 was not closed")
+	}
+}
+
+func TestUpstream_CheckHealth(t *testing.T) {
+	var fail atomic.Bool
+	u := newTestUpstream(RoundRobin, "a:1")
+	u.option.HealthCheckDialer = func(ctx context.Context, address string) (net.Conn, error) {
+		if fail.Load() {
+			return nil, net.ErrClosed
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+	backend := u.Backends()[0]
+
+	fail.Store(true)
+	u.CheckHealth(t.Context())
+	if !backend.Healthy() {
+		t.Error("backend is unhealthy before reaching the threshold")
+	}
+	u.CheckHealth(t.Context())
+	if backend.Healthy() {
+		t.Error("backend is healthy after reaching the threshold")
+	}
+
+	fail.Store(false)
+	u.CheckHealth(t.Context())
+	if !backend.Healthy() {
+		t.Error("backend is unhealthy after a successful check")
+	}
+}
+
+func TestStaticResolver(t *testing.T) {
+	got, err := staticResolver(" a:1, b:2,,c:3 ")(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a:1", "b:2", "c:3"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	type in struct {
+		build func(src *net.TCPAddr, dst *net.TCPAddr) []byte
+		src   *net.TCPAddr
+		dst   *net.TCPAddr
+	}
+
+	tests := []struct {
+		name string
+		in   in
+	}{
+		{
+			"v1 IPv4",
+			in{buildProxyProtocolV1Header, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}},
+		},
+		{
+			"v1 IPv6",
+			in{buildProxyProtocolV1Header, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		},
+		{
+			"v2 IPv4",
+			in{buildProxyProtocolV2Header, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}},
+		},
+		{
+			"v2 IPv6",
+			in{buildProxyProtocolV2Header, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			payload := append(in.build(in.src, in.dst), []byte("payload")...)
+			reader := bufio.NewReader(bytes.NewReader(payload))
+			src, dst, err := readProxyProtocolHeader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !src.IP.Equal(in.src.IP) || src.Port != in.src.Port {
+				t.Errorf("source: got %s, want %s", src, in.src)
+			}
+			if !dst.IP.Equal(in.dst.IP) || dst.Port != in.dst.Port {
+				t.Errorf("destination: got %s, want %s", dst, in.dst)
+			}
+
+			rest := make([]byte, 16)
+			n, _ := reader.Read(rest)
+			if string(rest[:n]) != "payload" {
+				t.Errorf("got %q after the header, want %q", rest[:n], "payload")
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolHeader_NoAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr bool
+	}{
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), false},
+		{"v2 LOCAL", append(append(proxyProtocolV2Signature[:12:12], 0x20, 0x00), 0x00, 0x00), false},
+		{"missing", []byte("GET / HTTP/1.1\r\n"), true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), true},
+		{"v1 invalid address", []byte("PROXY TCP4 a b 1 2\r\n"), true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		in := tt.in
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			src, dst, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(in)))
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if src != nil || dst != nil {
+				t.Errorf("got %s and %s, want no address", src, dst)
+			}
+		})
+	}
+}
+
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, serial int64) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccept_ProxyProtocolAndTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	option := &ListenerOption{
+		AcceptProxyProtocol: true,
+		TLSConfig:           &tls.Config{GetCertificate: reloader.GetCertificate},
+		HandshakeTimeout:    5 * time.Second,
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+
+	handshake := func() int64 {
+		t.Helper()
+
+		serial := make(chan int64, 1)
+		go func() {
+			defer close(serial)
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, err := conn.Write(buildProxyProtocolV2Header(src, dst)); err != nil {
+				return
+			}
+			tlsConnection := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			if _, err := tlsConnection.Write([]byte("ping")); err != nil {
+				return
+			}
+			serial <- tlsConnection.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+		}()
+
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		local, err := accept(conn, option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local.RemoteAddr().String() != src.String() {
+			t.Errorf("got client address %s, want %s", local.RemoteAddr(), src)
+		}
+
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(local, b); err != nil || string(b) != "ping" {
+			t.Errorf("got %q, %v, want %q", b, err, "ping")
+		}
+		return <-serial
+	}
+
+	if got := handshake(); got != 1 {
+		t.Errorf("got certificate %d, want 1", got)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := handshake(); got != 2 {
+		t.Errorf("got reloaded certificate %d, want 2", got)
+	}
+}
+
+func TestConnectionPool_ReUseTLSConnection(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := newRemoteTLSConfig("", certFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ServerName = "127.0.0.1"
+
+	tests := []struct {
+		name string
+		// closeAfterEcho makes the server send close_notify once it has echoed the first message
+		closeAfterEcho bool
+		want           bool
+	}{
+		{
+			"idle connection is reused",
+			false,
+			true,
+		},
+		{
+			"connection closed by the server is not reused",
+			true,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mockServer.Close()
+
+			closed := make(chan struct{}, 1)
+			go func() {
+				for {
+					conn, err := mockServer.Accept()
+					if err != nil {
+						return
+					}
+
+					go func() {
+						defer conn.Close()
+						if tt.closeAfterEcho {
+							b := make([]byte, 4)
+							if _, err := io.ReadFull(conn, b); err == nil {
+								_, _ = conn.Write(b)
+							}
+							_ = conn.(*tls.Conn).CloseWrite()
+							closed <- struct{}{}
+						}
+						_, _ = io.Copy(conn, conn)
+					}()
+				}
+			}()
+
+			pool := NewConnectionPool(&ConnectionPoolOption{
+				MaxConnections:     1,
+				MaxIdleConnections: 1,
+				Jitter: func(duration time.Duration) time.Duration {
+					return duration
+				},
+				Dialer: func(ctx context.Context) (net.Conn, error) {
+					dialer := &tls.Dialer{Config: config}
+					return dialer.DialContext(ctx, "tcp", mockServer.Addr().String())
+				},
+				ConnectionPoolStrategy: FIFO,
+			})
+
+			first, err := pool.Get(t.Context(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := first.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(first, make([]byte, 4)); err != nil {
+				t.Fatal(err)
+			}
+			_ = pool.Put(t.Context(), first)
+			if tt.closeAfterEcho {
+				<-closed
+				// Let close_notify reach the socket of the client
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			second, err := pool.Get(t.Context(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := second == first; got != tt.want {
+				t.Errorf("reused = %v, want %v", got, tt.want)
+			}
+			if _, err := second.Write([]byte("pong")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(second, b); err != nil || string(b) != "pong" {
+				t.Errorf("got %q, %v, want %q", b, err, "pong")
+			}
+		})
+	}
+}
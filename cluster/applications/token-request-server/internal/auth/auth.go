@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// MatchGlob matches s against a pattern where * matches any sequence and ? any single byte.
+func MatchGlob(pattern string, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func MatchAnyGlob(patterns []string, s string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return MatchGlob(pattern, s)
+	})
+}
+
+type tokenReviewCacheEntry struct {
+	username  string
+	expiresAt time.Time
+}
+
+// TokenReviewer authenticates callers by their own bearer token.
+type TokenReviewer struct {
+	Clientset kubernetes.Interface
+	Audiences []string
+	CacheTTL  time.Duration
+
+	mutex sync.Mutex
+	cache map[string]tokenReviewCacheEntry
+}
+
+// Review returns the username of a token, or an empty string if it is not authenticated.
+func (t *TokenReviewer) Review(ctx context.Context, token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	t.mutex.Lock()
+	if entry, ok := t.cache[key]; ok && time.Now().Before(entry.expiresAt) {
+		t.mutex.Unlock()
+		return entry.username, nil
+	}
+	t.mutex.Unlock()
+
+	review, err := t.Clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: t.Audiences,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create token review: %w", err)
+	}
+
+	username := ""
+	if review.Status.Authenticated {
+		username = review.Status.User.Username
+	}
+
+	if t.CacheTTL > 0 {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		if t.cache == nil {
+			t.cache = make(map[string]tokenReviewCacheEntry)
+		}
+		now := time.Now()
+		for k, entry := range t.cache {
+			if now.After(entry.expiresAt) {
+				delete(t.cache, k)
+			}
+		}
+		t.cache[key] = tokenReviewCacheEntry{username: username, expiresAt: now.Add(t.CacheTTL)}
+	}
+
+	return username, nil
+}
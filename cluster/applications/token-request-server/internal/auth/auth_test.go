@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		in      string
+		want    bool
+	}{
+		{"exact", "system:serviceaccount:runner:job", "system:serviceaccount:runner:job", true},
+		{"prefix", "system:serviceaccount:runner:*", "system:serviceaccount:runner:job", true},
+		{"other namespace", "system:serviceaccount:runner:*", "system:serviceaccount:other:job", false},
+		{"star in the middle", "https://*.example.com", "https://api.example.com", true},
+		{"backtracking", "a*b*c", "aXbYbZc", true},
+		{"question mark", "job-?", "job-1", true},
+		{"question mark needs a byte", "job-?", "job-", false},
+		{"empty pattern", "", "a", false},
+		{"star matches empty", "*", "", true},
+		{"longer input", "abc", "abcd", false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		pattern := tt.pattern
+		in := tt.in
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := MatchGlob(pattern, in); got != want {
+				t.Errorf("MatchGlob(%q, %q) = %v, want %v", pattern, in, got, want)
+			}
+		})
+	}
+}
+
+func TestTokenReviewer_Review(t *testing.T) {
+	clientset := fake.NewClientset()
+	reviews := 0
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "valid" && len(review.Spec.Audiences) == 1 && review.Spec.Audiences[0] == "token-request-server" {
+			review.Status = authenticationv1.TokenReviewStatus{
+				Authenticated: true,
+				User:          authenticationv1.UserInfo{Username: "system:serviceaccount:runner:job"},
+			}
+		}
+		return true, review, nil
+	})
+
+	reviewer := &TokenReviewer{
+		Clientset: clientset,
+		Audiences: []string{"token-request-server"},
+		CacheTTL:  time.Minute,
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		want        string
+		wantReviews int
+	}{
+		{"authenticated", "valid", "system:serviceaccount:runner:job", 1},
+		{"cached", "valid", "system:serviceaccount:runner:job", 1},
+		{"unauthenticated", "invalid", "", 2},
+		{"unauthenticated cached", "invalid", "", 2},
+	}
+
+	for _, tt := range tests {
+		got, err := reviewer.Review(context.Background(), tt.token)
+		if err != nil {
+			t.Fatalf("%s: %+v", tt.name, err)
+		}
+		if got != tt.want || reviews != tt.wantReviews {
+			t.Errorf("%s: got %q after %d reviews, want %q after %d", tt.name, got, reviews, tt.want, tt.wantReviews)
+		}
+	}
+
+	// An expired result is reviewed again.
+	reviewer.mutex.Lock()
+	for key, entry := range reviewer.cache {
+		entry.expiresAt = time.Now().Add(-time.Second)
+		reviewer.cache[key] = entry
+	}
+	reviewer.mutex.Unlock()
+	if _, err := reviewer.Review(context.Background(), "valid"); err != nil {
+		t.Fatal(err)
+	}
+	if reviews != 3 {
+		t.Errorf("got %d reviews, want 3", reviews)
+	}
+}
@@ -0,0 +1,64 @@
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Verifier authenticates JWTs of an OIDC issuer that the API server does not trust, such as GitHub Actions,
+// with the keys the issuer publishes. go-oidc caches the keys, and fetches them again in one request shared by
+// the concurrent verifications of a kid it does not know, as when the issuer rotates them.
+type Verifier struct {
+	issuer    string
+	audiences []string
+	verifier  *oidc.IDTokenVerifier
+}
+
+// NewVerifier verifies JWTs of issuer against the keys at jwksURL. A token must have one of audiences, or any
+// audience when there are none.
+func NewVerifier(issuer string, jwksURL string, audiences []string, client *http.Client) *Verifier {
+	keySet := oidc.NewRemoteKeySet(oidc.ClientContext(context.Background(), client), jwksURL)
+	return &Verifier{
+		issuer:    issuer,
+		audiences: audiences,
+		verifier: oidc.NewVerifier(issuer, keySet, &oidc.Config{
+			// The audiences are checked by Verify, as go-oidc takes only one
+			SkipClientIDCheck:    true,
+			SupportedSigningAlgs: []string{oidc.RS256, oidc.RS384, oidc.RS512},
+		}),
+	}
+}
+
+// Issues reports whether token claims to be from the issuer, without verifying it.
+func (v *Verifier) Issues(token string) bool {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return false
+	}
+	issuer, _ := claims.GetIssuer()
+	return issuer == v.issuer
+}
+
+// Verify returns the username of a token, named <issuer>#<sub> as the API server names OIDC users by default.
+func (v *Verifier) Verify(ctx context.Context, token string) (string, error) {
+	idToken, err := v.verifier.Verify(ctx, token)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %w", err)
+	}
+
+	if len(v.audiences) > 0 && !slices.ContainsFunc(idToken.Audience, func(audience string) bool {
+		return slices.Contains(v.audiences, audience)
+	}) {
+		return "", fmt.Errorf("invalid token: unexpected audience %v", idToken.Audience)
+	}
+
+	if idToken.Subject == "" {
+		return "", fmt.Errorf("invalid token: missing sub claim")
+	}
+	return v.issuer + "#" + idToken.Subject, nil
+}
@@ -0,0 +1,193 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const issuer = "https://token.actions.githubusercontent.com"
+
+// testIssuer publishes the keys of an issuer at its URL, and counts how often they are fetched.
+type testIssuer struct {
+	*httptest.Server
+	fetches atomic.Int64
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) (*testIssuer, *rsa.PrivateKey) {
+	t.Helper()
+
+	i := &testIssuer{keys: make(map[string]*rsa.PrivateKey)}
+	privateKey := i.addKey(t, "key")
+	i.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i.fetches.Add(1)
+		// Let concurrent verifications pile up behind one fetch.
+		time.Sleep(10 * time.Millisecond)
+
+		i.mu.Lock()
+		var keys []map[string]string
+		for kid, privateKey := range i.keys {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes()),
+			})
+		}
+		i.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(i.Close)
+	return i, privateKey
+}
+
+func (i *testIssuer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys[kid] = privateKey
+	return privateKey
+}
+
+func newVerifier(t *testing.T) (*Verifier, *rsa.PrivateKey, *testIssuer) {
+	t.Helper()
+
+	i, privateKey := newTestIssuer(t)
+	return NewVerifier(issuer, i.URL, nil, i.Client()), privateKey, i
+}
+
+func sign(t *testing.T, privateKey *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	verifier, privateKey, i := newVerifier(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audienceVerifier := NewVerifier(issuer, i.URL, []string{"https://github.com/kaidotio"}, i.Client())
+
+	exp := time.Now().Add(time.Hour).Unix()
+	sub := "repo:kaidotio/hippocampus:ref:refs/heads/main"
+
+	tests := []struct {
+		name     string
+		verifier *Verifier
+		token    string
+		want     string
+		wantErr  bool
+	}{
+		{"valid", verifier, sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer, "sub": sub, "exp": exp}), issuer + "#" + sub, false},
+		{"expired", verifier, sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer, "sub": sub, "exp": time.Now().Add(-time.Minute).Unix()}), "", true},
+		{"no exp", verifier, sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer, "sub": sub}), "", true},
+		{"no sub", verifier, sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer, "exp": exp}), "", true},
+		{"other issuer", verifier, sign(t, privateKey, "key", jwt.MapClaims{"iss": "https://example.com", "sub": sub, "exp": exp}), "", true},
+		{"other key", verifier, sign(t, otherKey, "key", jwt.MapClaims{"iss": issuer, "sub": sub, "exp": exp}), "", true},
+		{"unknown kid", verifier, sign(t, privateKey, "other", jwt.MapClaims{"iss": issuer, "sub": sub, "exp": exp}), "", true},
+		{"allowed audience", audienceVerifier, sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer, "sub": sub, "aud": "https://github.com/kaidotio", "exp": exp}), issuer + "#" + sub, false},
+		{"other audience", audienceVerifier, sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer, "sub": sub, "aud": "https://github.com/someone", "exp": exp}), "", true},
+		{"no audience", audienceVerifier, sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer, "sub": sub, "exp": exp}), "", true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		v := tt.verifier
+		token := tt.token
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := v.Verify(context.Background(), token)
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestVerifier_Issues(t *testing.T) {
+	verifier, privateKey, _ := newVerifier(t)
+
+	if !verifier.Issues(sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer})) {
+		t.Error("did not recognize a token of the issuer")
+	}
+	if verifier.Issues(sign(t, privateKey, "key", jwt.MapClaims{"iss": "https://kubernetes.default.svc.cluster.local"})) {
+		t.Error("recognized a token of another issuer")
+	}
+	if verifier.Issues("not-a-jwt") {
+		t.Error("recognized a token that is not a JWT")
+	}
+}
+
+func TestVerifier_Refresh(t *testing.T) {
+	verifier, privateKey, i := newVerifier(t)
+	exp := time.Now().Add(time.Hour).Unix()
+	known := sign(t, privateKey, "key", jwt.MapClaims{"iss": issuer, "sub": "a", "exp": exp})
+
+	// Concurrent verifications share one fetch.
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Go(func() {
+			if _, err := verifier.Verify(context.Background(), known); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if got := i.fetches.Load(); got != 1 {
+		t.Errorf("got %d fetches, want 1", got)
+	}
+
+	// Known keys are not fetched again.
+	if _, err := verifier.Verify(context.Background(), known); err != nil {
+		t.Error(err)
+	}
+	if got := i.fetches.Load(); got != 1 {
+		t.Errorf("got %d fetches, want 1", got)
+	}
+
+	// A rotated key is fetched once it signs a token.
+	rotated := sign(t, i.addKey(t, "rotated"), "rotated", jwt.MapClaims{"iss": issuer, "sub": "a", "exp": exp})
+	if _, err := verifier.Verify(context.Background(), rotated); err != nil {
+		t.Error(err)
+	}
+	if got := i.fetches.Load(); got != 2 {
+		t.Errorf("got %d fetches, want 2", got)
+	}
+}
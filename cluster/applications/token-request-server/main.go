@@ -16,12 +16,16 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"token-request-server/internal/auth"
 	"token-request-server/internal/myhttp"
+	"token-request-server/internal/oidc"
 
 	otelpyroscope "github.com/grafana/otel-profiling-go"
 	"github.com/grafana/pyroscope-go"
@@ -43,6 +47,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -101,6 +106,89 @@ type tokenRequestBody struct {
 	ExpirationSeconds *int64   `json:"expirationSeconds,omitempty"`
 }
 
+// PolicyRule lets any of Callers request tokens of any of ServiceAccounts for any of Audiences.
+type PolicyRule struct {
+	// Callers are globs of usernames verified by TokenReview, e.g. system:serviceaccount:<namespace>:*,
+	// or of <issuer>#<sub> of JWTs verified for --oidc-issuer.
+	Callers         []string `json:"callers"`
+	ServiceAccounts []string `json:"serviceAccounts"`
+	// Audiences are globs every requested audience must match. A request without audiences gets the audience
+	// of the API server, which is allowed when Audiences is empty or contains "*".
+	Audiences []string `json:"audiences"`
+	// MaxExpirationSeconds caps expirationSeconds. 0 leaves only the Kubernetes limit.
+	MaxExpirationSeconds int64 `json:"maxExpirationSeconds"`
+}
+
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	var policy Policy
+	if err := yaml.UnmarshalStrict(b, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+
+	for i, rule := range policy.Rules {
+		if len(rule.Callers) == 0 || len(rule.ServiceAccounts) == 0 {
+			return nil, fmt.Errorf("rules[%d]: callers and serviceAccounts must not be empty", i)
+		}
+		if rule.MaxExpirationSeconds != 0 && rule.MaxExpirationSeconds < tokenExpirationMin {
+			return nil, fmt.Errorf("rules[%d]: maxExpirationSeconds must be at least %d", i, tokenExpirationMin)
+		}
+	}
+
+	return &policy, nil
+}
+
+func (r *PolicyRule) allowsAudiences(audiences []string) bool {
+	if slices.Contains(r.Audiences, "*") {
+		return true
+	}
+	if len(audiences) == 0 {
+		return len(r.Audiences) == 0
+	}
+	for _, audience := range audiences {
+		if !auth.MatchAnyGlob(r.Audiences, audience) {
+			return false
+		}
+	}
+	return true
+}
+
+// Authorize returns the largest expirationSeconds caller may request for the service account and audiences,
+// or false if no rule allows the request at all.
+func (p *Policy) Authorize(caller string, serviceAccountName string, audiences []string) (int64, bool) {
+	maxExpirationSeconds := int64(-1)
+	for _, rule := range p.Rules {
+		if !auth.MatchAnyGlob(rule.Callers, caller) || !slices.Contains(rule.ServiceAccounts, serviceAccountName) || !rule.allowsAudiences(audiences) {
+			continue
+		}
+
+		limit := rule.MaxExpirationSeconds
+		if limit == 0 {
+			limit = tokenExpirationMax
+		}
+		maxExpirationSeconds = max(maxExpirationSeconds, limit)
+	}
+	return maxExpirationSeconds, maxExpirationSeconds >= 0
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 type auditLogEntry struct {
 	Time           string      `json:"time"`
 	Host           string      `json:"host"`
@@ -170,14 +258,34 @@ func main() {
 	var keepAlive bool
 	var maxConnections int
 	var serviceAccountName string
+	var policyFile string
+	var tokenReviewAudiences string
+	var tokenReviewCacheTTL time.Duration
+	var oidcIssuer string
+	var oidcJWKSURL string
+	var oidcAudiences string
 	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
 	flag.IntVar(&maxConnections, "max-connections", envOrDefaultValue("MAX_CONNECTIONS", 65532), "Maximum number of connections")
 	flag.StringVar(&serviceAccountName, "service-account-name", envOrDefaultValue("SERVICE_ACCOUNT_NAME", ""), "Service account name to create tokens for")
+	flag.StringVar(&policyFile, "policy-file", envOrDefaultValue("POLICY_FILE", ""), "Path to the policy of which callers may request tokens of which service accounts")
+	flag.StringVar(&tokenReviewAudiences, "token-review-audiences", envOrDefaultValue("TOKEN_REVIEW_AUDIENCES", ""), "Comma-separated audiences a caller token must have. Default is the audience of the API server.")
+	flag.DurationVar(&tokenReviewCacheTTL, "token-review-cache-ttl", envOrDefaultValue("TOKEN_REVIEW_CACHE_TTL", 10*time.Second), "How long a TokenReview result is cached")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", envOrDefaultValue("OIDC_ISSUER", ""), "Issuer of JWTs verified by the server itself instead of TokenReview, such as https://token.actions.githubusercontent.com")
+	flag.StringVar(&oidcJWKSURL, "oidc-jwks-url", envOrDefaultValue("OIDC_JWKS_URL", ""), "URL of the keys of --oidc-issuer")
+	flag.StringVar(&oidcAudiences, "oidc-audiences", envOrDefaultValue("OIDC_AUDIENCES", ""), "Comma-separated audiences of which a JWT of --oidc-issuer must have one. Default is any.")
 	flag.Parse()
 
+	if policyFile == "" {
+		log.Fatalf("policy file not specified")
+	}
+	policy, err := LoadPolicy(policyFile)
+	if err != nil {
+		log.Fatalf("failed to load policy: %+v", err)
+	}
+
 	ctx := context.Background()
 
 	runtime.SetMutexProfileFraction(1)
@@ -268,9 +376,23 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to find namespace: %+v", err)
 	}
-	delegatedServiceAccountName := "default"
+
+	tokenReviewer := &auth.TokenReviewer{
+		Clientset: clientset,
+		Audiences: splitList(tokenReviewAudiences),
+		CacheTTL:  tokenReviewCacheTTL,
+	}
+
+	var oidcVerifier *oidc.Verifier
+	if oidcIssuer != "" {
+		if oidcJWKSURL == "" {
+			log.Fatalf("--oidc-jwks-url not specified")
+		}
+		oidcVerifier = oidc.NewVerifier(oidcIssuer, oidcJWKSURL, splitList(oidcAudiences), &http.Client{Timeout: 10 * time.Second})
+	}
 
 	mux.HandleFuncWithMiddleware("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		delegatedServiceAccountName := "default"
 		if sa := r.URL.Query().Get("sa"); sa != "" {
 			delegatedServiceAccountName = sa
 		}
@@ -280,6 +402,32 @@ func main() {
 			return
 		}
 
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || bearer == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var caller string
+		if oidcVerifier != nil && oidcVerifier.Issues(bearer) {
+			caller, err = oidcVerifier.Verify(r.Context(), bearer)
+			if err != nil {
+				slog.Warn("failed to verify token", "error", err)
+			}
+		} else {
+			caller, err = tokenReviewer.Review(r.Context(), bearer)
+			if err != nil {
+				slog.Error("failed to review token", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		if caller == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
 		var requestBody tokenRequestBody
 		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil && err != io.EOF {
 			slog.Warn("failed to parse request body", "error", err)
@@ -287,7 +435,14 @@ func main() {
 			return
 		}
 
-		expirationSeconds := tokenExpirationDefault
+		maxExpirationSeconds, ok := policy.Authorize(caller, delegatedServiceAccountName, requestBody.Audiences)
+		if !ok {
+			slog.Warn("denied", "caller", caller, "serviceAccount", delegatedServiceAccountName, "audiences", requestBody.Audiences)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		expirationSeconds := min(tokenExpirationDefault, maxExpirationSeconds)
 		if requestBody.ExpirationSeconds != nil {
 			expirationSeconds = *requestBody.ExpirationSeconds
 			if expirationSeconds < tokenExpirationMin {
@@ -298,6 +453,10 @@ func main() {
 				http.Error(w, fmt.Sprintf("expirationSeconds must not exceed %d", tokenExpirationMax), http.StatusBadRequest)
 				return
 			}
+			if expirationSeconds > maxExpirationSeconds {
+				http.Error(w, fmt.Sprintf("expirationSeconds must not exceed %d for %s", maxExpirationSeconds, delegatedServiceAccountName), http.StatusForbidden)
+				return
+			}
 		}
 
 		tokenRequest := &authenticationv1.TokenRequest{
@@ -323,6 +482,8 @@ func main() {
 			return
 		}
 
+		slog.Info("issued token", "caller", caller, "serviceAccount", delegatedServiceAccountName, "audiences", requestBody.Audiences, "expirationSeconds", expirationSeconds)
+
 		response := struct {
 			Token               string `json:"token"`
 			ExpirationTimestamp string `json:"expirationTimestamp"`
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicy_Authorize(t *testing.T) {
+	policy := &Policy{
+		Rules: []PolicyRule{
+			{
+				Callers:              []string{"https://token.actions.githubusercontent.com#repo:kaidotio/*"},
+				ServiceAccounts:      []string{"default"},
+				MaxExpirationSeconds: 3600,
+			},
+			{
+				Callers:              []string{"system:serviceaccount:runner:*"},
+				ServiceAccounts:      []string{"default"},
+				Audiences:            []string{"https://*.example.com"},
+				MaxExpirationSeconds: 1800,
+			},
+			{
+				Callers:         []string{"system:serviceaccount:runner:admin"},
+				ServiceAccounts: []string{"default", "deployer"},
+				Audiences:       []string{"*"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name                     string
+		caller                   string
+		serviceAccountName       string
+		audiences                []string
+		wantMaxExpirationSeconds int64
+		wantOK                   bool
+	}{
+		{"GitHub Actions", "https://token.actions.githubusercontent.com#repo:kaidotio/hippocampus:ref:refs/heads/main", "default", nil, 3600, true},
+		{"GitHub Actions of another owner", "https://token.actions.githubusercontent.com#repo:someone/hippocampus:ref:refs/heads/main", "default", nil, -1, false},
+		{"GitHub Actions with an audience", "https://token.actions.githubusercontent.com#repo:kaidotio/hippocampus:ref:refs/heads/main", "default", []string{"https://api.example.com"}, -1, false},
+		{"audience matching a glob", "system:serviceaccount:runner:job", "default", []string{"https://api.example.com"}, 1800, true},
+		{"one audience not matching", "system:serviceaccount:runner:job", "default", []string{"https://api.example.com", "https://other.test"}, -1, false},
+		{"API server audience not listed", "system:serviceaccount:runner:job", "default", nil, -1, false},
+		{"other service account", "system:serviceaccount:runner:job", "deployer", []string{"https://api.example.com"}, -1, false},
+		{"largest limit of matching rules", "system:serviceaccount:runner:admin", "default", []string{"https://api.example.com"}, tokenExpirationMax, true},
+		{"any audience", "system:serviceaccount:runner:admin", "deployer", nil, tokenExpirationMax, true},
+		{"unknown caller", "system:serviceaccount:other:job", "default", nil, -1, false},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		caller := tt.caller
+		serviceAccountName := tt.serviceAccountName
+		audiences := tt.audiences
+		wantMaxExpirationSeconds := tt.wantMaxExpirationSeconds
+		wantOK := tt.wantOK
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := policy.Authorize(caller, serviceAccountName, audiences)
+			if got != wantMaxExpirationSeconds || ok != wantOK {
+				t.Errorf("got %d, %v, want %d, %v", got, ok, wantMaxExpirationSeconds, wantOK)
+			}
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{"valid", "rules:\n  - callers: [a]\n    serviceAccounts: [default]\n    maxExpirationSeconds: 600\n", false},
+		{"no callers", "rules:\n  - serviceAccounts: [default]\n", true},
+		{"no service accounts", "rules:\n  - callers: [a]\n", true},
+		{"too short expiration", "rules:\n  - callers: [a]\n    serviceAccounts: [default]\n    maxExpirationSeconds: 60\n", true},
+		{"unknown field", "rules:\n  - callers: [a]\n    serviceAccounts: [default]\n    caller: b\n", true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		policy := tt.policy
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "policy.yaml")
+			if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadPolicy(path); (err != nil) != wantErr {
+				t.Errorf("got error %v, want error %v", err, wantErr)
+			}
+		})
+	}
+}
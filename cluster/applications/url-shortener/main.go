@@ -3,24 +3,61 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path"
+	"regexp"
 	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+const (
+	prefix      = "/url_shortener"
+	statsPrefix = "/url_shortener_stats"
 )
 
-const prefix = "/url_shortener"
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// maxCodeAttempts bounds how many random codes are tried before giving up on collisions.
+const maxCodeAttempts = 5
+
+// maxReferrers bounds the referrers kept per link; the rest are counted under otherReferrer.
+const maxReferrers = 100
+
+const (
+	directReferrer = "(direct)"
+	otherReferrer  = "(other)"
+)
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// reservedCodes are paths served by url-shortener itself, which a link would shadow or be shadowed by.
+var reservedCodes = []string{"metrics", "healthz"}
+
+var errConflict = errors.New("key already exists")
 
 func envOrDefaultValue[T any](key string, defaultValue T) T {
 	value, exists := os.LookupEnv(key)
@@ -64,99 +101,475 @@ func envOrDefaultValue[T any](key string, defaultValue T) T {
 	return defaultValue
 }
 
+func generateCode(length int) (string, error) {
+	b := make([]byte, length)
+	base := big.NewInt(int64(len(base62Alphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, base)
+		if err != nil {
+			return "", err
+		}
+		b[i] = base62Alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// parseExpiresAfter accepts either a number of seconds or a Go duration string of at least a second, as http-kvs expires keys by the second.
+func parseExpiresAfter(value string) (time.Duration, error) {
+	var d time.Duration
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else {
+		d, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("expiry must be at least 1s: %s", value)
+	}
+	return d, nil
+}
+
+// expiresAfterSeconds formats d for X-Expires-After of http-kvs, rounding up so that a fraction of a second is not dropped.
+func expiresAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+type urlValidator struct {
+	schemes []string
+	hosts   []string
+}
+
+// validate accepts absolute URLs whose scheme is allowed and whose host is allowed, either exactly or through a leading "*." wildcard.
+func (v *urlValidator) validate(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("not an absolute URL: %s", rawURL)
+	}
+	if !slices.Contains(v.schemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("scheme is not allowed: %s", u.Scheme)
+	}
+	if len(v.hosts) == 0 {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range v.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return nil
+			}
+			continue
+		}
+		if host == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("host is not allowed: %s", u.Hostname())
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+type kvsClient struct {
+	baseURL string
+}
+
+// get returns the value of key along with the response header, which carries ETag and X-Expires-At.
+func (c *kvsClient) get(ctx context.Context, key string) ([]byte, http.Header, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil, nil
+	}
+	if response.StatusCode >= 400 {
+		return nil, nil, fmt.Errorf("unexpected status from http-kvs: %d", response.StatusCode)
+	}
+
+	b, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, response.Header, nil
+}
+
+// put writes value to key and returns errConflict when the precondition in header is not met.
+func (c *kvsClient) put(ctx context.Context, key string, value []byte, header http.Header) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+key, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		request.Header[k] = v
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode == http.StatusPreconditionFailed || response.StatusCode == http.StatusConflict {
+		return errConflict
+	}
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status from http-kvs: %d", response.StatusCode)
+	}
+	return nil
+}
+
+type Stats struct {
+	Clicks    int64            `json:"clicks"`
+	Referrers map[string]int64 `json:"referrers"`
+
+	// expiresAt is the expiry of the link, which the stats are stored with so that they go away together.
+	expiresAt time.Time
+}
+
+func (s *Stats) merge(other *Stats) {
+	s.Clicks += other.Clicks
+	if other.expiresAt.After(s.expiresAt) {
+		s.expiresAt = other.expiresAt
+	}
+	if s.Referrers == nil {
+		s.Referrers = make(map[string]int64)
+	}
+	for referrer, n := range other.Referrers {
+		if _, ok := s.Referrers[referrer]; !ok && len(s.Referrers) >= maxReferrers {
+			referrer = otherReferrer
+		}
+		s.Referrers[referrer] += n
+	}
+}
+
+// clickRecorder buffers clicks in memory and periodically merges them into http-kvs with compare-and-swap, so replicas never overwrite each other.
+type clickRecorder struct {
+	kvs         *kvsClient
+	clicksTotal metric.Int64Counter
+
+	mu      sync.Mutex
+	pending map[string]*Stats
+}
+
+func referrerHost(referer string) string {
+	if referer == "" {
+		return directReferrer
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return otherReferrer
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// record counts a click on code, whose link expires at expiresAt or never when it is zero.
+func (c *clickRecorder) record(ctx context.Context, code string, referer string, expiresAt time.Time) {
+	referrer := referrerHost(referer)
+
+	// Codes and referrers are chosen by clients, so they are kept in the stats only and never become labels
+	c.clicksTotal.Add(ctx, 1, metric.WithAttributes(
+		attribute.Key("referred").Bool(referrer != directReferrer),
+	))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats, ok := c.pending[code]
+	if !ok {
+		stats = &Stats{Referrers: make(map[string]int64)}
+		c.pending[code] = stats
+	}
+	stats.merge(&Stats{Clicks: 1, Referrers: map[string]int64{referrer: 1}, expiresAt: expiresAt})
+}
+
+func (c *clickRecorder) flush(ctx context.Context) {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]*Stats)
+	c.mu.Unlock()
+
+	for code, delta := range pending {
+		if err := c.mergeStats(ctx, code, delta); err != nil {
+			log.Printf("failed to flush stats of %s: %+v", code, err)
+			c.mu.Lock()
+			if stats, ok := c.pending[code]; ok {
+				delta.merge(stats)
+			}
+			c.pending[code] = delta
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *clickRecorder) mergeStats(ctx context.Context, code string, delta *Stats) error {
+	key := path.Join(statsPrefix, code)
+	for range maxCodeAttempts {
+		b, h, err := c.kvs.get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		var stats Stats
+		header := http.Header{}
+		if b == nil {
+			header.Set("If-None-Match", "*")
+		} else {
+			if err := json.Unmarshal(b, &stats); err != nil {
+				return err
+			}
+			header.Set("If-Match", h.Get("ETag"))
+		}
+		stats.merge(delta)
+
+		if !delta.expiresAt.IsZero() {
+			ttl := time.Until(delta.expiresAt)
+			if ttl <= 0 {
+				// The link is gone, and so are its stats
+				return nil
+			}
+			header.Set("X-Expires-After", expiresAfterSeconds(ttl))
+		}
+
+		v, err := json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		if err := c.kvs.put(ctx, key, v, header); err != nil {
+			if errors.Is(err, errConflict) {
+				continue
+			}
+			return err
+		}
+		return nil
+	}
+	return errConflict
+}
+
+func (c *clickRecorder) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.flush(ctx)
+		}
+	}
+}
+
 func main() {
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = http.DefaultTransport.(*http.Transport).MaxIdleConns
 
 	var address string
 	var httpKVSURL string
+	var codeLength int
+	var allowedSchemes string
+	var allowedHosts string
+	var statsFlushInterval time.Duration
 	var terminationGracePeriod time.Duration
 	var lameduck time.Duration
 	var keepAlive bool
 	flag.StringVar(&address, "address", envOrDefaultValue("ADDRESS", "0.0.0.0:8080"), "HTTP server address")
 	flag.StringVar(&httpKVSURL, "http-kvs-url", envOrDefaultValue("HTTP_KVS_URL", "https://http-kvs.minikube.127.0.0.1.nip.io"), "HTTP KVS URL")
+	flag.IntVar(&codeLength, "code-length", envOrDefaultValue("CODE_LENGTH", 7), "Length of generated base62 short codes")
+	flag.StringVar(&allowedSchemes, "allowed-schemes", envOrDefaultValue("ALLOWED_SCHEMES", "http,https"), "Comma-separated URL schemes that may be shortened")
+	flag.StringVar(&allowedHosts, "allowed-hosts", envOrDefaultValue("ALLOWED_HOSTS", ""), "Comma-separated hosts that may be shortened, with *.example.com matching subdomains; empty allows any host")
+	flag.DurationVar(&statsFlushInterval, "stats-flush-interval", envOrDefaultValue("STATS_FLUSH_INTERVAL", 10*time.Second), "Interval at which buffered click stats are written to http-kvs")
 
 	flag.DurationVar(&terminationGracePeriod, "termination-grace-period", envOrDefaultValue("TERMINATION_GRACE_PERIOD", 10*time.Second), "The duration the application needs to terminate gracefully")
 	flag.DurationVar(&lameduck, "lameduck", envOrDefaultValue("LAMEDUCK", 1*time.Second), "A period that explicitly asks clients to stop sending requests, although the backend task is listening on that port and can provide the service")
 	flag.BoolVar(&keepAlive, "http-keepalive", envOrDefaultValue("HTTP_KEEPALIVE", true), "Enable HTTP keep-alive")
 	flag.Parse()
 
+	exporter, err := otelprometheus.New()
+	if err != nil {
+		log.Fatalf("failed to create exporter: %+v", err)
+	}
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter)).Meter("url-shortener")
+	clicksTotal, err := meter.Int64Counter("url_shortener_clicks_total")
+	if err != nil {
+		log.Fatalf("failed to create counter: %+v", err)
+	}
+
+	kvs := &kvsClient{baseURL: httpKVSURL}
+	validator := &urlValidator{schemes: splitList(allowedSchemes), hosts: splitList(allowedHosts)}
+	recorder := &clickRecorder{kvs: kvs, clicksTotal: clicksTotal, pending: make(map[string]*Stats)}
+
+	recorderCtx, recorderCancel := context.WithCancel(context.Background())
+	recorderDone := make(chan struct{})
+	go func() {
+		defer close(recorderDone)
+		recorder.run(recorderCtx, statsFlushInterval)
+	}()
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, httpKVSURL+path.Join(prefix, r.RequestURI), nil)
-			if err != nil {
-				log.Printf("%+v", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
-			response, err := http.DefaultClient.Do(request)
-			if err != nil {
-				log.Printf("%+v", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
+	mux.HandleFunc("GET /{code}", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PathValue("code")
+
+		b, h, err := kvs.get(r.Context(), path.Join(prefix, code))
+		if err != nil {
+			log.Printf("%+v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if b == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		var expiresAt time.Time
+		if v := h.Get("X-Expires-At"); v != "" {
+			if expiresAt, err = http.ParseTime(v); err != nil {
+				log.Printf("invalid X-Expires-At of %s: %+v", code, err)
 			}
+		}
+		recorder.record(r.Context(), code, r.Referer(), expiresAt)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// Not 301, as browsers would cache it and stop counting clicks or honoring expiry
+		http.Redirect(w, r, string(b), http.StatusFound)
+	})
+
+	mux.HandleFunc("GET /{code}/stats", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PathValue("code")
 
-			defer func() {
-				_, _ = io.Copy(io.Discard, response.Body)
-				_ = response.Body.Close()
-			}()
-			b, err := io.ReadAll(response.Body)
+		b, _, err := kvs.get(r.Context(), path.Join(statsPrefix, code))
+		if err != nil {
+			log.Printf("%+v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		stats := Stats{Referrers: map[string]int64{}}
+		if b == nil {
+			link, _, err := kvs.get(r.Context(), path.Join(prefix, code))
 			if err != nil {
 				log.Printf("%+v", err)
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
 			}
-
-			if response.StatusCode >= 400 {
-				http.Error(w, http.StatusText(response.StatusCode), response.StatusCode)
+			if link == nil {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 				return
 			}
+		} else if err := json.Unmarshal(b, &stats); err != nil {
+			log.Printf("%+v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Printf("%+v", err)
+		}
+	})
 
-			url := string(b)
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			http.Redirect(w, r, url, http.StatusMovedPermanently)
-		case http.MethodPost:
-			url, err := io.ReadAll(r.Body)
+	mux.HandleFunc("POST /", func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%+v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		target := strings.TrimSpace(string(b))
+
+		if err := validator.validate(target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		header := http.Header{}
+		header.Set("Content-Type", "text/plain")
+		header.Set("If-None-Match", "*")
+		if v := r.URL.Query().Get("expires_after"); v != "" {
+			expiresAfter, err := parseExpiresAfter(v)
 			if err != nil {
-				log.Printf("%+v", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				http.Error(w, "invalid expires_after", http.StatusBadRequest)
 				return
 			}
+			header.Set("X-Expires-After", expiresAfterSeconds(expiresAfter))
+		}
 
-			shorten := fmt.Sprintf("%x", sha256.Sum256(url))
-
-			request, err := http.NewRequestWithContext(r.Context(), http.MethodPost, httpKVSURL+path.Join(prefix, shorten), bytes.NewReader(url))
-			if err != nil {
-				log.Printf("%+v", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		var shorten string
+		if alias := r.URL.Query().Get("alias"); alias != "" {
+			if !aliasPattern.MatchString(alias) || slices.Contains(reservedCodes, alias) {
+				http.Error(w, "invalid alias", http.StatusBadRequest)
 				return
 			}
-			request.Header.Set("Content-Type", "text/plain")
-			response, err := http.DefaultClient.Do(request)
-			if err != nil {
+			if err := kvs.put(r.Context(), path.Join(prefix, alias), []byte(target), header); err != nil {
+				if errors.Is(err, errConflict) {
+					http.Error(w, "alias already exists", http.StatusConflict)
+					return
+				}
 				log.Printf("%+v", err)
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
 			}
-			defer func() {
-				_, _ = io.Copy(io.Discard, response.Body)
-				_ = response.Body.Close()
-			}()
-
-			if response.StatusCode >= 400 {
-				http.Error(w, http.StatusText(response.StatusCode), response.StatusCode)
+			shorten = alias
+		} else {
+			for range maxCodeAttempts {
+				code, err := generateCode(codeLength)
+				if err != nil {
+					log.Printf("%+v", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				if slices.Contains(reservedCodes, code) {
+					continue
+				}
+				if err := kvs.put(r.Context(), path.Join(prefix, code), []byte(target), header); err != nil {
+					if errors.Is(err, errConflict) {
+						continue
+					}
+					log.Printf("%+v", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				shorten = code
+				break
+			}
+			if shorten == "" {
+				log.Printf("failed to find a free code after %d attempts", maxCodeAttempts)
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 				return
 			}
-
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			_, _ = w.Write([]byte(shorten))
-		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(shorten))
 	})
 
+	mux.Handle("GET /metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics: true,
+		}),
+	))
+
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
@@ -195,4 +608,8 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("failed to shutdown: %+v", err)
 	}
+
+	recorderCancel()
+	<-recorderDone
+	recorder.flush(ctx)
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseExpiresAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"seconds", "60", time.Minute, false},
+		{"duration", "1h30m", 90 * time.Minute, false},
+		{"one second", "1s", time.Second, false},
+		{"fraction over a second", "1500ms", 1500 * time.Millisecond, false},
+		{"under a second", "500ms", 0, true},
+		{"zero", "0", 0, true},
+		{"negative", "-1", 0, true},
+		{"invalid", "soon", 0, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		value := tt.value
+		want := tt.want
+		wantErr := tt.wantErr
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseExpiresAfter(value)
+			if (err != nil) != wantErr {
+				t.Fatalf("got error %v, want error %v", err, wantErr)
+			}
+			if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestExpiresAfterSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Millisecond, "1"},
+		{time.Hour, "3600"},
+	}
+
+	for _, tt := range tests {
+		if got := expiresAfterSeconds(tt.d); got != tt.want {
+			t.Errorf("expiresAfterSeconds(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestClickRecorder_MergeStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt time.Duration
+		wantWrite bool
+		want      string
+	}{
+		{"without expiry", 0, true, ""},
+		{"with expiry", 90 * time.Second, true, "90"},
+		{"under a second left", 500 * time.Millisecond, true, "1"},
+		{"expired", -time.Second, false, ""},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		expiresAt := tt.expiresAt
+		wantWrite := tt.wantWrite
+		want := tt.want
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var mu sync.Mutex
+			var writes []http.Header
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+					return
+				}
+				mu.Lock()
+				writes = append(writes, r.Header.Clone())
+				mu.Unlock()
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			c := &clickRecorder{kvs: &kvsClient{baseURL: server.URL}, pending: make(map[string]*Stats)}
+			delta := &Stats{Clicks: 1}
+			if expiresAt != 0 {
+				// Short of the whole seconds by a margin, so that the time the test takes does not change them
+				delta.expiresAt = time.Now().Add(expiresAt - 100*time.Millisecond)
+			}
+			if err := c.mergeStats(context.Background(), "code", delta); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !wantWrite {
+				if len(writes) != 0 {
+					t.Errorf("got %d writes, want none", len(writes))
+				}
+				return
+			}
+			if len(writes) != 1 {
+				t.Fatalf("got %d writes, want 1", len(writes))
+			}
+			if got := writes[0].Get("X-Expires-After"); got != want {
+				t.Errorf("got X-Expires-After %q, want %q", got, want)
+			}
+			if got := writes[0].Get("If-None-Match"); got != "*" {
+				t.Errorf("got If-None-Match %q, want *", got)
+			}
+		})
+	}
+}
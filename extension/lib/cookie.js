@@ -1,23 +1,78 @@
-const authURL = () => {
-  return `https://bakery.kaidotio.dev/callback?cookie_name=_oauth2_proxy&redirect_url=${encodeURIComponent(chrome.identity.getRedirectURL("extension"))}`;
+const bakeryURL = "https://bakery.kaidotio.dev";
+
+const base64URL = (bytes) => {
+  return btoa(String.fromCharCode(...new Uint8Array(bytes)))
+    .replace(/\+/g, "-")
+    .replace(/\//g, "_")
+    .replace(/=+$/, "");
+};
+
+const randomString = () => {
+  return base64URL(crypto.getRandomValues(new Uint8Array(32)));
+};
+
+// S256 code_challenge of a code_verifier, as in RFC 7636
+const codeChallenge = (verifier) => {
+  return crypto.subtle
+    .digest("SHA-256", new TextEncoder().encode(verifier))
+    .then(base64URL);
+};
+
+const authURL = (challenge, state) => {
+  const url = new URL(`${bakeryURL}/callback`);
+  url.searchParams.set("cookie_name", "_oauth2_proxy");
+  url.searchParams.set(
+    "redirect_url",
+    chrome.identity.getRedirectURL("extension"),
+  );
+  url.searchParams.set("code_challenge", challenge);
+  url.searchParams.set("code_challenge_method", "S256");
+  url.searchParams.set("state", state);
+  return url.toString();
+};
+
+// exchange redeems the one-time code bakery redirected with, by the verifier that never left the extension
+const exchange = (code, verifier) => {
+  return fetch(`${bakeryURL}/exchange`, {
+    method: "POST",
+    body: new URLSearchParams({ code, code_verifier: verifier }),
+  }).then((response) => {
+    if (!response.ok) {
+      throw new Error(`failed to exchange code: ${response.status}`);
+    }
+    return response.json();
+  });
 };
 
 export const cookieFromWebAuthFlow = (tabId) => {
-  return chrome.identity
-    .launchWebAuthFlow({
-      url: authURL(),
+  const verifier = randomString();
+  const state = randomString();
+  return codeChallenge(verifier)
+    .then((challenge) => {
+      return chrome.identity.launchWebAuthFlow({
+        url: authURL(challenge, state),
+      });
     })
     .then((responseURL) => {
       const url = new URL(responseURL);
-      const value = "_oauth2_proxy=" + url.searchParams.get("value");
-      const expires = url.searchParams.get("expires");
+      if (url.searchParams.get("state") !== state) {
+        throw new Error("invalid state");
+      }
+      return exchange(url.searchParams.get("code"), verifier);
+    })
+    .then((cookie) => {
+      const value = "_oauth2_proxy=" + cookie.value;
+      const expires = cookie.expires;
       return Promise.resolve({ value, expires });
     })
     .catch((error) => {
       if (error.toString().startsWith("Error: User interaction required.")) {
-        return chrome.tabs
-          .create({
-            url: authURL(),
+        // The tab only signs in, so the code it is redirected with is left to expire
+        return codeChallenge(randomString())
+          .then((challenge) => {
+            return chrome.tabs.create({
+              url: authURL(challenge, randomString()),
+            });
           })
           .then((tab) => {
             return new Promise((resolve) => {
@@ -27,6 +27,8 @@ impl Client {
         cookie.get("value").cloned().ok_or("value not found".into())
     }
 
+    /// challenge lets the browser hand a one-time code to a loopback listener, and exchanges the code for the
+    /// cookie value with a verifier that never leaves this process.
     pub async fn challenge(
         &self,
         cookie_name: &str,
@@ -34,6 +36,15 @@ impl Client {
         std::collections::HashMap<String, String>,
         Box<dyn std::error::Error + Send + Sync + 'static>,
     > {
+        let verifier = random_string();
+        let state = random_string();
+        let code_challenge = {
+            use base64::Engine;
+            use sha2::Digest;
+            base64::engine::general_purpose::URL_SAFE_NO_PAD
+                .encode(sha2::Sha256::digest(verifier.as_bytes()))
+        };
+
         let (tx, rx) = tokio::sync::oneshot::channel::<std::collections::HashMap<String, String>>();
 
         let tx = std::sync::Arc::new(tokio::sync::Mutex::new(Some(tx)));
@@ -51,7 +62,10 @@ impl Client {
                                     url::form_urlencoded::parse(query.as_bytes())
                                         .into_owned()
                                         .collect();
-                                if let Some(tx) = tx.lock().await.take() {
+                                // Other requests of the browser such as /favicon.ico carry no code
+                                if params.contains_key("code")
+                                    && let Some(tx) = tx.lock().await.take()
+                                {
                                     let _ = tx.send(params);
                                 }
                                 let response = hyper::Response::builder()
@@ -86,6 +100,9 @@ impl Client {
                 &format!("http://127.0.0.1:{}", local_addr.port()),
             );
             queries.append_pair("cookie_name", cookie_name);
+            queries.append_pair("code_challenge", &code_challenge);
+            queries.append_pair("code_challenge_method", "S256");
+            queries.append_pair("state", &state);
         }
         let uri: String = u.into();
 
@@ -93,7 +110,53 @@ impl Client {
             eprintln!("Please visit this URL to authorize this application: {uri}");
         }
 
-        let cookie = rx.await?;
+        let params = rx.await?;
+        if params.get("state") != Some(&state) {
+            return Err("invalid state".into());
+        }
+        let code = params.get("code").ok_or("code not found")?;
+        self.exchange(code, &verifier).await
+    }
+
+    /// exchange redeems a code at /exchange next to the callback URL.
+    pub async fn exchange(
+        &self,
+        code: &str,
+        verifier: &str,
+    ) -> Result<
+        std::collections::HashMap<String, String>,
+        Box<dyn std::error::Error + Send + Sync + 'static>,
+    > {
+        let u = url::Url::parse(&self.url)?.join("exchange")?;
+        let body = url::form_urlencoded::Serializer::new(String::new())
+            .append_pair("code", code)
+            .append_pair("code_verifier", verifier)
+            .finish();
+
+        let connector = hyper_rustls::HttpsConnectorBuilder::new()
+            .with_native_roots()
+            .https_or_http()
+            .enable_http1()
+            .build();
+        let client = hyper::Client::builder().build::<_, hyper::Body>(connector);
+        let request = hyper::Request::builder()
+            .method(hyper::Method::POST)
+            .uri(u.as_str())
+            .header("Content-Type", "application/x-www-form-urlencoded")
+            .body(hyper::Body::from(body))?;
+        let response = client.request(request).await?;
+        let status = response.status();
+        let b = hyper::body::to_bytes(response.into_body()).await?;
+        if !status.is_success() {
+            return Err(format!(
+                "failed to exchange code: {} {}",
+                status,
+                String::from_utf8_lossy(&b).trim()
+            )
+            .into());
+        }
+
+        let cookie = serde_json::from_slice(&b)?;
         Ok(cookie)
     }
 
@@ -140,3 +203,11 @@ impl Client {
         tmp.to_string_lossy().into_owned()
     }
 }
+
+fn random_string() -> String {
+    use base64::Engine;
+    use rand::RngCore;
+    let mut b = [0u8; 32];
+    rand::rng().fill_bytes(&mut b);
+    base64::engine::general_purpose::URL_SAFE_NO_PAD.encode(b)
+}